@@ -12,10 +12,13 @@ import (
 	"time"
 
 	sentryio "github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vpnhouse/tunnel/internal/authorizer"
 	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/firewall"
 	"github.com/vpnhouse/tunnel/internal/grpc"
 	"github.com/vpnhouse/tunnel/internal/httpapi"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
 	"github.com/vpnhouse/tunnel/internal/ipdiscover"
 	"github.com/vpnhouse/tunnel/internal/iprose"
 	"github.com/vpnhouse/tunnel/internal/manager"
@@ -23,6 +26,7 @@ import (
 	"github.com/vpnhouse/tunnel/internal/runtime"
 	"github.com/vpnhouse/tunnel/internal/settings"
 	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/tunnel/internal/wireguard"
 	"github.com/vpnhouse/common-lib-go/auth"
 	"github.com/vpnhouse/common-lib-go/control"
@@ -57,6 +61,8 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 			return err
 		}
 	}
+	// peer identifiers in the event log are left as is
+	types.SetLogRedaction(runtime.Settings.RedactLogs)
 
 	if len(runtime.Settings.Wireguard.ServerIPv4) == 0 {
 		// it's ok to fail here, ip checking host may not be available
@@ -68,8 +74,15 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 		}
 	}
 
-	// Initialize sqlite storage
-	dataStorage, err := storage.New(runtime.Settings.SQLitePath)
+	// Initialize sqlite storage, the in-memory one loses everything on restart
+	var dataStorage *storage.Storage
+	var err error
+	if runtime.Settings.InMemoryStorage {
+		zap.L().Warn("using the in-memory storage, the data is lost on restart")
+		dataStorage, err = storage.NewMemory()
+	} else {
+		dataStorage, err = storage.New(runtime.Settings.SQLitePath)
+	}
 	if err != nil {
 		return err
 	}
@@ -77,11 +90,58 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 
 	var eventLog eventlog.EventManager = eventlog.NewDummy()
 	if runtime.Features.WithEventLog() {
+		// the failed push is retried in background by every sink on its own,
+		// so others are not pushed twice, the peer operation never waits
+		var retry eventlog.RetryConfig
+		if runtime.Settings.EventRetry != nil {
+			retry = *runtime.Settings.EventRetry
+		}
+
+		sinks := []eventlog.EventManager{eventLog}
 		if runtime.Settings.EventLog != nil {
 			eventLog, err = eventlog.New(*runtime.Settings.EventLog)
 			if err != nil {
 				return err
 			}
+			if redact := runtime.Settings.EventLog.Redact; redact != nil {
+				eventLog, err = eventlog.NewRedactor(eventLog, *redact)
+				if err != nil {
+					return err
+				}
+			}
+			// the persistent log goes first to serve subscriptions,
+			// the database keeps the full copy of events for the audit
+			sinks = []eventlog.EventManager{
+				eventlog.NewRetrier(eventLog, retry),
+				eventlog.NewRetrier(eventlog.NewRecordSink(dataStorage), retry),
+			}
+		}
+
+		if runtime.Settings.Syslog != nil {
+			syslogSink, err := eventlog.NewSyslogSink(*runtime.Settings.Syslog)
+			if err != nil {
+				return err
+			}
+			if redact := runtime.Settings.Syslog.Redact; redact != nil {
+				syslogSink, err = eventlog.NewRedactor(syslogSink, *redact)
+				if err != nil {
+					return err
+				}
+			}
+			sinks = append(sinks, eventlog.NewRetrier(syslogSink, retry))
+		}
+
+		if len(sinks) > 1 {
+			eventLog = eventlog.NewMultiSink(sinks...)
+		}
+
+		if runtime.Settings.EventLog != nil || runtime.Settings.Syslog != nil {
+			// number events before the fan-out, so all sinks see the same sequence,
+			// retried events keep their numbers
+			eventLog, err = eventlog.NewSequencer(eventLog, dataStorage)
+			if err != nil {
+				return err
+			}
 			runtime.Services.RegisterService("eventLog", eventLog)
 		}
 	}
@@ -94,7 +154,7 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 
 	// Initialize wireguard controller
 	wgcfg := runtime.Settings.Wireguard
-	wireguardController, err := wireguard.New(wgcfg)
+	wireguardController, err := wireguard.New(wgcfg, runtime.Settings.GetIPPoolConfig().ExtraNetworks()...)
 	if err != nil {
 		return err
 	}
@@ -114,6 +174,17 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 	}
 	runtime.Services.RegisterService("ipv4am", ipv4am)
 
+	ipAllocator, err := ipalloc.New(ipv4am, wgcfg.Subnet.Unwrap(), netpol.Access.DefaultPolicy.Int(), runtime.Settings.GetIPPoolConfig())
+	if err != nil {
+		return err
+	}
+
+	portFilter, err := firewall.New(runtime.Settings.GetPolicyPorts(), runtime.Settings.GetEnforceTunnelDNS(),
+		runtime.Settings.GetWireguardDNS(), netpol.Access.DefaultPolicy.Int())
+	if err != nil {
+		return err
+	}
+
 	var geoClient *geoip.Instance
 	if runtime.Features.WithGeoip() {
 		if runtime.Settings.GeoDBPath == "" {
@@ -127,11 +198,12 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 	}
 
 	// Create new peer manager
-	sessionManager, err := manager.New(runtime, dataStorage, wireguardController, ipv4am, eventLog, geoClient)
+	sessionManager, err := manager.New(runtime, dataStorage, wireguardController, ipAllocator, portFilter, eventLog, geoClient)
 	if err != nil {
 		return err
 	}
 	runtime.Services.RegisterService("manager", sessionManager)
+	runtime.RegisterReloader(sessionManager)
 
 	var keyStore keystore.Keystore = keystore.DenyAllKeystore{}
 	if runtime.Features.WithFederation() {
@@ -171,7 +243,7 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 	}
 
 	// Prepare tunneling HTTP API
-	tunnelAPI := httpapi.NewTunnelHandlers(runtime, sessionManager, adminJWT, jwtAuthorizer, dataStorage, keyStore, ipv4am)
+	tunnelAPI := httpapi.NewTunnelHandlers(runtime, sessionManager, adminJWT, jwtAuthorizer, dataStorage, keyStore, ipAllocator, eventLog)
 
 	xHttpAddr := runtime.Settings.HTTP.ListenAddr
 	xhttpOpts := []xhttp.Option{xhttp.WithLogger()}
@@ -188,6 +260,13 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 		}, xhttpOpts...)
 	}
 
+	// options of the dedicated admin and federation API listeners,
+	// they share CORS and TLS with the main one, but not the metrics
+	listenerOpts := []xhttp.Option{xhttp.WithLogger()}
+	if runtime.Settings.HTTP.CORS {
+		listenerOpts = append([]xhttp.Option{xhttp.WithCORS()}, listenerOpts...)
+	}
+
 	// assume that config validation does not pass
 	// the SSL enabled without the domain name configuration
 	if runtime.Settings.SSL != nil {
@@ -220,6 +299,7 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 		runtime.HttpRouter = redirectOnly.Router()
 		xHttpAddr = runtime.Settings.SSL.ListenAddr
 		xhttpOpts = append([]xhttp.Option{xhttp.WithSSL(tlsCfg)}, xhttpOpts...)
+		listenerOpts = append([]xhttp.Option{xhttp.WithSSL(tlsCfg)}, listenerOpts...)
 	}
 
 	xHttpServer := xhttp.New(xhttpOpts...)
@@ -261,6 +341,32 @@ func initServices(runtime *runtime.TunnelRuntime) error {
 		runtime.HttpRouter = xHttpServer.Router()
 	}
 
+	if addr := runtime.Settings.AdminAPI.GetListenAddr(); len(addr) > 0 {
+		adminServer := xhttp.New(listenerOpts...)
+		tunnelAPI.RegisterAdminListenerHandlers(adminServer.Router())
+		if err := adminServer.Run(addr); err != nil {
+			return fmt.Errorf("failed to start the admin API listener on %s: %w", addr, err)
+		}
+		runtime.Services.RegisterService("adminHttpServer", adminServer)
+	}
+
+	if addr := runtime.Settings.GetFederationListenAddr(); len(addr) > 0 && runtime.Features.WithFederation() {
+		federationServer := xhttp.New(listenerOpts...)
+		tunnelAPI.RegisterFederationHandlers(federationServer.Router())
+		if err := federationServer.Run(addr); err != nil {
+			return fmt.Errorf("failed to start the federation API listener on %s: %w", addr, err)
+		}
+		runtime.Services.RegisterService("federationHttpServer", federationServer)
+	}
+
+	if socket := runtime.Settings.AdminAPI.Socket; socket != nil {
+		adminSocket, err := tunnelAPI.RunAdminSocket(*socket)
+		if err != nil {
+			return err
+		}
+		runtime.Services.RegisterService("adminSocketServer", adminSocket)
+	}
+
 	// note: during the test we DO NOT override the DNS settings for peers.
 	if runtime.Settings.DNSFilter != nil {
 		filter, err := xdns.NewFilteringServer(*runtime.Settings.DNSFilter)
@@ -285,6 +391,14 @@ func main() {
 	}
 
 	rand.Seed(time.Now().UnixNano())
+
+	// metrics survive soft restarts, so the labels can't be changed without the process restart
+	reg := prometheus.WrapRegistererWith(staticConf.HTTP.PrometheusLabels, prometheus.DefaultRegisterer)
+	manager.RegisterMetrics(reg)
+	eventlog.RegisterMetrics(reg)
+	httpapi.RegisterMetrics(reg)
+	storage.RegisterMetrics(reg)
+
 	r := runtime.New(staticConf, initServices)
 	control.Exec(r)
 }
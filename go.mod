@@ -8,6 +8,7 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/getsentry/sentry-go v0.12.0
 	github.com/go-chi/chi/v5 v5.0.7
+	github.com/google/nftables v0.0.0-20221002140148-535f5eb8da79
 	github.com/google/uuid v1.6.0
 	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0
 	github.com/jmoiron/sqlx v1.3.4
@@ -23,6 +24,7 @@ require (
 	github.com/vpnhouse/iprose-go v0.2.0
 	go.uber.org/multierr v1.10.0
 	go.uber.org/zap v1.25.0
+	golang.org/x/sys v0.13.0
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20211230205640-daad0b7ba671
 	google.golang.org/grpc v1.44.0
 	google.golang.org/protobuf v1.27.1
@@ -40,14 +42,12 @@ require (
 	github.com/go-acme/lego/v4 v4.6.0 // indirect
 	github.com/go-chi/cors v1.2.0 // indirect
 	github.com/google/gopacket v1.1.19 // indirect
-	github.com/google/nftables v0.0.0-20221002140148-535f5eb8da79 // indirect
 	github.com/miekg/dns v1.1.55 // indirect
 	github.com/muesli/cache2go v0.0.0-20221011235721-518229cd8021 // indirect
 	github.com/oschwald/maxminddb-golang v1.8.0 // indirect
 	github.com/slok/go-http-metrics v0.10.0 // indirect
 	go.etcd.io/etcd/client/v3 v3.5.2 // indirect
 	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
 )
 
 require (
@@ -30,12 +30,31 @@ const (
 type EventType int32
 
 const (
-	Unspecified      EventType = EventType(proto.EventType_Unspecified)
-	PeerAdd          EventType = EventType(proto.EventType_PeerAdd)
-	PeerRemove       EventType = EventType(proto.EventType_PeerRemove)
-	PeerUpdate       EventType = EventType(proto.EventType_PeerUpdate)
-	PeerTraffic      EventType = EventType(proto.EventType_PeerTraffic)
-	PeerFirstConnect EventType = EventType(proto.EventType_PeerFirstConnect)
+	Unspecified        EventType = EventType(proto.EventType_Unspecified)
+	PeerAdd            EventType = EventType(proto.EventType_PeerAdd)
+	PeerRemove         EventType = EventType(proto.EventType_PeerRemove)
+	PeerUpdate         EventType = EventType(proto.EventType_PeerUpdate)
+	PeerTraffic        EventType = EventType(proto.EventType_PeerTraffic)
+	PeerFirstConnect   EventType = EventType(proto.EventType_PeerFirstConnect)
+	PeerIdle           EventType = EventType(proto.EventType_PeerIdle)
+	PeerNeverConnected EventType = EventType(proto.EventType_PeerNeverConnected)
+	PeerConnected      EventType = EventType(proto.EventType_PeerConnected)
+	PeerDisconnected   EventType = EventType(proto.EventType_PeerDisconnected)
+
+	ServerMaintenance EventType = EventType(proto.EventType_ServerMaintenance)
+	ServerDNSUpdate   EventType = EventType(proto.EventType_ServerDNSUpdate)
+
+	ServerClockAnomaly  EventType = EventType(proto.EventType_ServerClockAnomaly)
+	ServerInterfaceDown EventType = EventType(proto.EventType_ServerInterfaceDown)
+	ServerPoolPressure  EventType = EventType(proto.EventType_ServerPoolPressure)
+
+	AuthKeysUpdated  EventType = EventType(proto.EventType_AuthKeysUpdated)
+	SettingsReloaded EventType = EventType(proto.EventType_SettingsReloaded)
+
+	ManagerStarting EventType = EventType(proto.EventType_ManagerStarting)
+	ManagerReady    EventType = EventType(proto.EventType_ManagerReady)
+	ManagerDraining EventType = EventType(proto.EventType_ManagerDraining)
+	ManagerStopped  EventType = EventType(proto.EventType_ManagerStopped)
 )
 
 type Event struct {
@@ -33,8 +33,8 @@ type eventManager struct {
 	stop chan struct{}
 	done chan struct{}
 
-	// buffered chan for incoming events
-	incoming chan []byte
+	// bounded queue for incoming events
+	incoming *eventQueue
 	// subscribers track callers (see the Subscribe() method)
 	subscribers map[string]*Subscription
 }
@@ -47,7 +47,7 @@ func New(cfg StorageConfig, fss ...afero.Fs) (*eventManager, error) {
 	}
 
 	m := &eventManager{
-		incoming:    make(chan []byte, 100),
+		incoming:    newEventQueue(maxQueuedEvents),
 		stop:        make(chan struct{}),
 		done:        make(chan struct{}),
 		subscribers: map[string]*Subscription{},
@@ -59,6 +59,9 @@ func New(cfg StorageConfig, fss ...afero.Fs) (*eventManager, error) {
 }
 
 // Push adds the event to the log.
+// It never blocks on the log writing: if the queue is full,
+// the lowest priority event gets dropped (see eventPriority).
+// Events accepted before the shutdown are all stored.
 func (em *eventManager) Push(eventType EventType, data interface{}) error {
 	if em.stopped.Load() {
 		return ErrServiceStopped
@@ -80,7 +83,15 @@ func (em *eventManager) Push(eventType EventType, data interface{}) error {
 		return err
 	}
 
-	em.incoming <- bs
+	dropped, ok, err := em.incoming.push(queuedEvent{eventType: eventType, data: bs})
+	if err != nil {
+		// lost the race with the shutdown
+		return err
+	}
+	if ok {
+		droppedEventsCounter.WithLabelValues(eventTypeLabel(dropped.eventType)).Inc()
+		zap.L().Debug("event queue is full, event dropped", zap.Int32("type", int32(dropped.eventType)))
+	}
 	return nil
 }
 
@@ -247,31 +258,28 @@ func (em *eventManager) run() {
 	defer close(em.done)
 	for {
 		select {
-		case event := <-em.incoming:
-			em.storeEvent(event)
+		case <-em.incoming.notify:
+			em.storeEvents(em.incoming.popAll())
 		case <-em.stop:
 			zap.L().Info("event manager is stopping")
 			// stop receiving new messages
 			em.stopped.Store(true)
 
-			// store remaining events before we go down.
-			for {
-				select {
-				case event := <-em.incoming:
-					em.storeEvent(event)
-				default:
-					em.close()
-					return
-				}
-			}
+			// store remaining events before we go down,
+			// pushes racing the stop are either drained here or rejected
+			em.storeEvents(em.incoming.close())
+			em.close()
+			return
 		}
 	}
 }
 
-// storeEvent writes the event in the underlying file
-func (em *eventManager) storeEvent(eventData []byte) {
-	if err := em.storage.Write(eventData); err != nil {
-		zap.L().Error("failed to store event", zap.Error(err))
+// storeEvents writes the events in the underlying file
+func (em *eventManager) storeEvents(events []queuedEvent) {
+	for _, event := range events {
+		if err := em.storage.Write(event.data); err != nil {
+			zap.L().Error("failed to store event", zap.Error(err))
+		}
 	}
 }
 
@@ -0,0 +1,134 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// maxSinkQueuedEvents limits the number of events waiting
+// to be pushed to a single sink of the multiSink.
+const maxSinkQueuedEvents = 1024
+
+type sinkEvent struct {
+	eventType EventType
+	data      interface{}
+}
+
+// sinkWorker delivers events to a single sink in the order they were pushed.
+type sinkWorker struct {
+	sink     EventManager
+	incoming chan sinkEvent
+	done     chan struct{}
+}
+
+func (w *sinkWorker) run() {
+	defer close(w.done)
+	for event := range w.incoming {
+		if err := w.sink.Push(event.eventType, event.data); err != nil {
+			zap.L().Error("failed to push event to the sink", zap.Error(err), zap.Int32("type", int32(event.eventType)))
+		}
+	}
+}
+
+// multiSink pushes events to all the underlying sinks,
+// each sink has its own worker, so the slow one never blocks others.
+type multiSink struct {
+	stopped atomic.Bool
+	// lock protects workers' channels from being closed during the push
+	lock    sync.RWMutex
+	workers []*sinkWorker
+}
+
+// NewMultiSink returns the EventManager that fans out events to all given sinks.
+// Subscriptions are served by the first sink, it's expected to be the
+// persistent one (see New).
+func NewMultiSink(sinks ...EventManager) EventManager {
+	m := &multiSink{
+		workers: make([]*sinkWorker, 0, len(sinks)),
+	}
+
+	for _, sink := range sinks {
+		w := &sinkWorker{
+			sink:     sink,
+			incoming: make(chan sinkEvent, maxSinkQueuedEvents),
+			done:     make(chan struct{}),
+		}
+		m.workers = append(m.workers, w)
+		go w.run()
+	}
+
+	return m
+}
+
+// Push enqueues the event to all sinks, the event is dropped
+// for the sink whose queue is full.
+func (m *multiSink) Push(eventType EventType, data interface{}) error {
+	if data == nil {
+		return ErrNilEvent
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.stopped.Load() {
+		return ErrServiceStopped
+	}
+
+	for _, w := range m.workers {
+		select {
+		case w.incoming <- sinkEvent{eventType: eventType, data: data}:
+		default:
+			droppedEventsCounter.WithLabelValues(eventTypeLabel(eventType)).Inc()
+			zap.L().Debug("sink queue is full, event dropped", zap.Int32("type", int32(eventType)))
+		}
+	}
+	return nil
+}
+
+func (m *multiSink) Subscribe(ctx context.Context, subscriberID string, opts ...SubscribeOption) (*Subscription, error) {
+	if len(m.workers) == 0 {
+		return nil, fmt.Errorf("no sinks to subscribe to: %w", ErrNotFound)
+	}
+	return m.workers[0].sink.Subscribe(ctx, subscriberID, opts...)
+}
+
+func (m *multiSink) Unsubscribe(ctx context.Context, subscriberID string) error {
+	if len(m.workers) == 0 {
+		return nil
+	}
+	return m.workers[0].sink.Unsubscribe(ctx, subscriberID)
+}
+
+func (m *multiSink) Running() bool {
+	return !m.stopped.Load()
+}
+
+// Shutdown delivers the remaining events and shuts all sinks down.
+func (m *multiSink) Shutdown() error {
+	m.lock.Lock()
+	if m.stopped.Load() {
+		m.lock.Unlock()
+		return fmt.Errorf("manager is not running")
+	}
+	m.stopped.Store(true)
+	for _, w := range m.workers {
+		close(w.incoming)
+	}
+	m.lock.Unlock()
+
+	var errs error
+	for _, w := range m.workers {
+		<-w.done
+		errs = multierr.Append(errs, w.sink.Shutdown())
+	}
+	return errs
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+type recordingSink struct {
+	dummyEventManager
+
+	lock   sync.Mutex
+	events []interface{}
+	block  chan struct{}
+}
+
+func (s *recordingSink) Push(_ EventType, data interface{}) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, data)
+	return nil
+}
+
+func TestMultiSinkFanOut(t *testing.T) {
+	slow := &recordingSink{block: make(chan struct{})}
+	fast := &recordingSink{}
+	m := NewMultiSink(slow, fast)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, m.Push(PeerAdd, i))
+	}
+
+	// the slow sink does not block the fast one
+	require.Eventually(t, func() bool {
+		fast.lock.Lock()
+		defer fast.lock.Unlock()
+		return len(fast.events) == 10
+	}, time.Second, 10*time.Millisecond)
+
+	close(slow.block)
+	require.NoError(t, m.Shutdown())
+
+	expected := []interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	assert.Equal(t, expected, slow.events)
+	assert.Equal(t, expected, fast.events)
+
+	assert.ErrorIs(t, m.Push(PeerAdd, 42), ErrServiceStopped)
+}
+
+func TestMultiSinkSubscribe(t *testing.T) {
+	m := NewMultiSink()
+	_, err := m.Subscribe(context.Background(), "foo")
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, m.Shutdown())
+}
+
+func TestMultiSinkRetriesSink(t *testing.T) {
+	failing := &failingSink{fails: 2}
+	healthy := &recordingSink{}
+	m := NewMultiSink(healthy, NewRetrier(failing, RetryConfig{Attempts: 3, Interval: 10 * time.Millisecond}))
+	s, err := NewSequencer(m, &memSequenceStore{})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Push(PeerAdd, &proto.PeerInfo{UserID: "alice"}))
+	// the failed sink gets the event once it's back,
+	// the healthy one is not pushed again
+	require.Eventually(t, func() bool { return failing.delivered() == 1 }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, s.Shutdown())
+	require.Len(t, healthy.events, 1)
+	assert.EqualValues(t, 1, healthy.events[0].(*proto.PeerInfo).Sequence)
+	assert.EqualValues(t, 1, failing.events[0].(*proto.PeerInfo).Sequence)
+}
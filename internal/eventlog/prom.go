@@ -0,0 +1,46 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+var droppedEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "eventlog",
+	Name:      "dropped_events_total",
+	Help:      "number of events dropped due to the full queue",
+}, []string{"type"})
+
+var retriedEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "eventlog",
+	Name:      "retried_events_total",
+	Help:      "number of events delivered by the retry after the failed push",
+}, []string{"type"})
+
+var undeliveredEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "eventlog",
+	Name:      "undelivered_events_total",
+	Help:      "number of events dropped after the failed push and retries",
+}, []string{"type"})
+
+// RegisterMetrics registers metrics of the event log,
+// must be called once on start.
+func RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(droppedEventsCounter, retriedEventsCounter, undeliveredEventsCounter)
+}
+
+func eventTypeLabel(eventType EventType) string {
+	if name, ok := proto.EventType_name[int32(eventType)]; ok {
+		return name
+	}
+	return strconv.Itoa(int(eventType))
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"sync"
+)
+
+// maxQueuedEvents limits the number of events waiting to be stored
+const maxQueuedEvents = 1024
+
+type queuedEvent struct {
+	eventType EventType
+	data      []byte
+}
+
+// maxEventPriority is the priority of events never dropped
+const maxEventPriority = 2
+
+// eventPriority defines which events to drop first
+// if the queue is full, the lower - the earlier.
+func eventPriority(eventType EventType) int {
+	switch eventType {
+	case PeerTraffic:
+		return 0
+	case PeerUpdate, PeerFirstConnect, PeerConnected, PeerDisconnected:
+		return 1
+	default:
+		return maxEventPriority
+	}
+}
+
+// eventQueue is the bounded FIFO queue of marshaled events
+// which never blocks the caller. Events of the highest priority
+// are never dropped, they are queued over the bound if nothing
+// less important is left to drop.
+type eventQueue struct {
+	lock   sync.Mutex
+	size   int
+	events []queuedEvent
+	// closed is set by the final drain, no events are accepted then
+	closed bool
+	// notify signals that the queue is not empty
+	notify chan struct{}
+}
+
+func newEventQueue(size int) *eventQueue {
+	return &eventQueue{
+		size:   size,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push adds the event to the queue. If the queue is full,
+// the oldest event having the lowest priority is dropped,
+// including the given one. Returns the dropped event, if any,
+// and ErrServiceStopped if the queue is closed.
+func (q *eventQueue) push(event queuedEvent) (queuedEvent, bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return queuedEvent{}, false, ErrServiceStopped
+	}
+
+	var dropped queuedEvent
+	hasDropped := false
+	if len(q.events) >= q.size {
+		victim := -1
+		for i, e := range q.events {
+			if eventPriority(e.eventType) < eventPriority(event.eventType) &&
+				(victim < 0 || eventPriority(e.eventType) < eventPriority(q.events[victim].eventType)) {
+				victim = i
+			}
+		}
+
+		switch {
+		case victim >= 0:
+			dropped, hasDropped = q.events[victim], true
+			q.events = append(q.events[:victim], q.events[victim+1:]...)
+		case eventPriority(event.eventType) < maxEventPriority:
+			// nothing less important in the queue
+			return event, true, nil
+		}
+	}
+
+	q.events = append(q.events, event)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return dropped, hasDropped, nil
+}
+
+// popAll returns all queued events in the order they were pushed.
+func (q *eventQueue) popAll() []queuedEvent {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	events := q.events
+	q.events = nil
+	return events
+}
+
+// close returns the events left in the queue,
+// the events pushed later are rejected.
+func (q *eventQueue) close() []queuedEvent {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	events := q.events
+	q.events = nil
+	return events
+}
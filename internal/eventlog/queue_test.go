@@ -0,0 +1,68 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventQueueDropsLowPriority(t *testing.T) {
+	q := newEventQueue(3)
+
+	_, dropped, _ := q.push(queuedEvent{eventType: PeerAdd, data: []byte("1")})
+	require.False(t, dropped)
+	_, dropped, _ = q.push(queuedEvent{eventType: PeerTraffic, data: []byte("2")})
+	require.False(t, dropped)
+	_, dropped, _ = q.push(queuedEvent{eventType: PeerUpdate, data: []byte("3")})
+	require.False(t, dropped)
+
+	// traffic event is dropped first
+	victim, dropped, _ := q.push(queuedEvent{eventType: PeerRemove, data: []byte("4")})
+	require.True(t, dropped)
+	assert.Equal(t, "2", string(victim.data))
+
+	// then the update one
+	victim, dropped, _ = q.push(queuedEvent{eventType: PeerRemove, data: []byte("5")})
+	require.True(t, dropped)
+	assert.Equal(t, "3", string(victim.data))
+
+	// the new low priority event is dropped by itself
+	victim, dropped, _ = q.push(queuedEvent{eventType: PeerTraffic, data: []byte("6")})
+	require.True(t, dropped)
+	assert.Equal(t, "6", string(victim.data))
+
+	// the peer lifecycle events are never dropped
+	_, dropped, _ = q.push(queuedEvent{eventType: PeerRemove, data: []byte("7")})
+	require.False(t, dropped)
+
+	// the order is preserved
+	events := q.popAll()
+	require.Len(t, events, 4)
+	assert.Equal(t, "1", string(events[0].data))
+	assert.Equal(t, "4", string(events[1].data))
+	assert.Equal(t, "5", string(events[2].data))
+	assert.Equal(t, "7", string(events[3].data))
+	assert.Empty(t, q.popAll())
+}
+
+func TestEventQueueClose(t *testing.T) {
+	q := newEventQueue(3)
+
+	_, _, err := q.push(queuedEvent{eventType: PeerAdd, data: []byte("1")})
+	require.NoError(t, err)
+
+	events := q.close()
+	require.Len(t, events, 1)
+	assert.Equal(t, "1", string(events[0].data))
+
+	// nothing is accepted after the final drain
+	_, dropped, err := q.push(queuedEvent{eventType: PeerAdd, data: []byte("2")})
+	require.ErrorIs(t, err, ErrServiceStopped)
+	assert.False(t, dropped)
+	assert.Empty(t, q.popAll())
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+// EventRecorder keeps events for the later lookup.
+type EventRecorder interface {
+	PutEvent(record types.EventRecord) error
+}
+
+// recordSink writes events to the EventRecorder, so they can be
+// searched by the event type, peer identifiers and time.
+// Traffic events are not recorded, they're too frequent
+// to be the part of the audit trail.
+type recordSink struct {
+	store   EventRecorder
+	stopped atomic.Bool
+}
+
+// NewRecordSink returns the EventManager recording events to the given store.
+// The store is written synchronously, so the sink is expected
+// to be used via NewMultiSink.
+func NewRecordSink(store EventRecorder) EventManager {
+	return &recordSink{store: store}
+}
+
+func (s *recordSink) Push(eventType EventType, data interface{}) error {
+	if data == nil {
+		return ErrNilEvent
+	}
+	if s.stopped.Load() {
+		return ErrServiceStopped
+	}
+	if eventType == PeerTraffic {
+		return nil
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	record := types.EventRecord{
+		Type:      int32(eventType),
+		Timestamp: time.Now(),
+		Data:      body,
+	}
+	if peer, ok := data.(*proto.PeerInfo); ok {
+		record.UserID = peer.UserID
+		record.InstallationID = peer.InstallationID
+		record.SessionID = peer.SessionID
+	}
+
+	return s.store.PutEvent(record)
+}
+
+func (s *recordSink) Subscribe(ctx context.Context, subscriberID string, opts ...SubscribeOption) (*Subscription, error) {
+	return nil, fmt.Errorf("record sink does not support subscriptions: %w", ErrNotFound)
+}
+
+func (s *recordSink) Unsubscribe(ctx context.Context, subscriberID string) error {
+	return nil
+}
+
+func (s *recordSink) Running() bool {
+	return !s.stopped.Load()
+}
+
+// Shutdown stops recording, the store is owned by the caller
+// and stays untouched.
+func (s *recordSink) Shutdown() error {
+	s.stopped.Store(true)
+	return nil
+}
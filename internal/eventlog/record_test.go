@@ -0,0 +1,69 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+func TestRecordSinkSearch(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Shutdown()
+
+	sink := NewRecordSink(db)
+	require.NoError(t, sink.Push(PeerAdd, &proto.PeerInfo{UserID: "alice", InstallationID: "a1"}))
+	require.NoError(t, sink.Push(PeerTraffic, &proto.PeerInfo{UserID: "alice", InstallationID: "a1"}))
+	require.NoError(t, sink.Push(PeerRemove, &proto.PeerInfo{UserID: "alice", InstallationID: "a1"}))
+	require.NoError(t, sink.Push(PeerRemove, &proto.PeerInfo{UserID: "bob", InstallationID: "b1"}))
+	require.NoError(t, sink.Push(ServerMaintenance, &proto.MaintenanceInfo{Enabled: true}))
+
+	// traffic events are not recorded
+	all, next, err := db.SearchEvents(types.EventFilter{}, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, all, 4)
+	assert.Zero(t, next)
+	assert.Equal(t, int32(ServerMaintenance), all[0].Type)
+
+	removed, _, err := db.SearchEvents(types.EventFilter{Types: []int32{int32(PeerRemove)}}, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, removed, 2)
+	assert.Equal(t, "bob", removed[0].UserID)
+	assert.Equal(t, "alice", removed[1].UserID)
+
+	alice, _, err := db.SearchEvents(types.EventFilter{UserID: "alice"}, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, alice, 2)
+	assert.Equal(t, int32(PeerRemove), alice[0].Type)
+	assert.Equal(t, int32(PeerAdd), alice[1].Type)
+
+	past, _, err := db.SearchEvents(types.EventFilter{Until: time.Now().Add(-time.Hour)}, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, past)
+
+	// walk through pages
+	var paged []types.EventRecord
+	cursor := int64(0)
+	for {
+		page, next, err := db.SearchEvents(types.EventFilter{}, cursor, 3)
+		require.NoError(t, err)
+		paged = append(paged, page...)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, all, paged)
+
+	require.NoError(t, sink.Shutdown())
+	assert.ErrorIs(t, sink.Push(PeerAdd, &proto.PeerInfo{}), ErrServiceStopped)
+}
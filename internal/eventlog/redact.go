@@ -0,0 +1,113 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/tunnel/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	RedactModeHash = "hash"
+	RedactModeDrop = "drop"
+
+	RedactFieldUserID         = "user_id"
+	RedactFieldInstallationID = "installation_id"
+	RedactFieldSessionID      = "session_id"
+	RedactFieldLabel          = "label"
+)
+
+// RedactConfig describes peer identifiers hidden from the sink.
+// Note that the peer public key is never a part of the event payload.
+type RedactConfig struct {
+	// Fields to redact, any of "user_id", "installation_id",
+	// "session_id" and "label"
+	Fields []string `yaml:"fields"`
+	// Mode is "hash" to replace values with their HMAC-SHA256
+	// or "drop" to clear them, default: "hash"
+	Mode string `yaml:"mode,omitempty"`
+	// Salt is the HMAC key, hashes can be matched
+	// across sinks sharing the same salt
+	Salt string `yaml:"salt,omitempty"`
+}
+
+func (c RedactConfig) validate() error {
+	switch c.Mode {
+	case "", RedactModeHash, RedactModeDrop:
+	default:
+		return xerror.EInvalidConfiguration("unknown redaction mode "+c.Mode, "redact.mode")
+	}
+
+	for _, f := range c.Fields {
+		switch f {
+		case RedactFieldUserID, RedactFieldInstallationID, RedactFieldSessionID, RedactFieldLabel:
+		default:
+			return xerror.EInvalidConfiguration("unknown redaction field "+f, "redact.fields")
+		}
+	}
+	return nil
+}
+
+// redactor hides peer identifiers of events before passing
+// them to the underlying manager, other events pass as is.
+type redactor struct {
+	EventManager
+
+	config RedactConfig
+}
+
+// NewRedactor returns the EventManager redacting peer events
+// pushed to the next one according to the config.
+func NewRedactor(next EventManager, config RedactConfig) (EventManager, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &redactor{
+		EventManager: next,
+		config:       config,
+	}, nil
+}
+
+func (r *redactor) Push(eventType EventType, data interface{}) error {
+	if data == nil {
+		return ErrNilEvent
+	}
+
+	peer, ok := data.(*proto.PeerInfo)
+	if !ok || len(r.config.Fields) == 0 {
+		return r.EventManager.Push(eventType, data)
+	}
+
+	// the same event is shared with other sinks, never modify it
+	redacted := protobuf.Clone(peer).(*proto.PeerInfo)
+	for _, f := range r.config.Fields {
+		switch f {
+		case RedactFieldUserID:
+			redacted.UserID = r.redact(redacted.UserID)
+		case RedactFieldInstallationID:
+			redacted.InstallationID = r.redact(redacted.InstallationID)
+		case RedactFieldSessionID:
+			redacted.SessionID = r.redact(redacted.SessionID)
+		case RedactFieldLabel:
+			redacted.Label = r.redact(redacted.Label)
+		}
+	}
+	return r.EventManager.Push(eventType, redacted)
+}
+
+func (r *redactor) redact(value string) string {
+	if value == "" || r.config.Mode == RedactModeDrop {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(r.config.Salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+func TestRedactor(t *testing.T) {
+	full := &recordingSink{}
+	hashed := &recordingSink{}
+	dropped := &recordingSink{}
+
+	hashing, err := NewRedactor(hashed, RedactConfig{Fields: []string{RedactFieldUserID, RedactFieldInstallationID}, Salt: "salt"})
+	require.NoError(t, err)
+	dropping, err := NewRedactor(dropped, RedactConfig{Fields: []string{RedactFieldUserID}, Mode: RedactModeDrop})
+	require.NoError(t, err)
+
+	peer := &proto.PeerInfo{UserID: "alice", InstallationID: "a1", SessionID: "s1", Sequence: 42}
+	for _, sink := range []EventManager{full, hashing, dropping} {
+		require.NoError(t, sink.Push(PeerAdd, peer))
+		require.NoError(t, sink.Push(ServerMaintenance, &proto.MaintenanceInfo{Enabled: true}))
+	}
+
+	// the original event is intact
+	assert.Equal(t, "alice", peer.UserID)
+	assert.Same(t, peer, full.events[0])
+
+	h := hashed.events[0].(*proto.PeerInfo)
+	assert.Len(t, h.UserID, 64)
+	assert.NotEqual(t, "alice", h.UserID)
+	assert.NotEqual(t, h.UserID, h.InstallationID)
+	assert.Equal(t, "s1", h.SessionID)
+	assert.EqualValues(t, 42, h.Sequence)
+
+	// hashes are stable
+	require.NoError(t, hashing.Push(PeerRemove, peer))
+	assert.Equal(t, h.UserID, hashed.events[2].(*proto.PeerInfo).UserID)
+
+	d := dropped.events[0].(*proto.PeerInfo)
+	assert.Empty(t, d.UserID)
+	assert.Equal(t, "a1", d.InstallationID)
+
+	// non-peer events pass as is
+	assert.IsType(t, &proto.MaintenanceInfo{}, dropped.events[1])
+
+	_, err = NewRedactor(full, RedactConfig{Fields: []string{"public_key"}})
+	assert.Error(t, err)
+	_, err = NewRedactor(full, RedactConfig{Mode: "mask"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryInterval = time.Second
+	defaultRetrySize     = 1024
+)
+
+type RetryConfig struct {
+	// Attempts is the number of retries before the event is dropped, default: 3
+	Attempts int `yaml:"attempts,omitempty"`
+	// Interval between retries, default: 1s
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Size limits the number of events waiting for the retry, default: 1024
+	Size int `yaml:"size,omitempty"`
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.Attempts <= 0 {
+		c.Attempts = defaultRetryAttempts
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultRetryInterval
+	}
+	if c.Size <= 0 {
+		c.Size = defaultRetrySize
+	}
+	return c
+}
+
+type retryEvent struct {
+	eventType EventType
+	data      interface{}
+	attempts  int
+}
+
+// retrier keeps events failed to be pushed to the underlying manager
+// and pushes them again in background, so the momentary failure
+// does not lose the event. Push never waits for retries.
+type retrier struct {
+	EventManager
+
+	config RetryConfig
+	// lock guards pending
+	lock     sync.Mutex
+	pending  []retryEvent
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewRetrier returns the EventManager retrying failed pushes
+// to the next one, the event is dropped once attempts exhaust
+// or if too many events are waiting for the retry.
+func NewRetrier(next EventManager, config RetryConfig) EventManager {
+	r := &retrier{
+		EventManager: next,
+		config:       config.withDefaults(),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *retrier) Push(eventType EventType, data interface{}) error {
+	if data == nil {
+		return ErrNilEvent
+	}
+
+	err := r.EventManager.Push(eventType, data)
+	if err == nil || errors.Is(err, ErrServiceStopped) {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.pending) >= r.config.Size {
+		undeliveredEventsCounter.WithLabelValues(eventTypeLabel(eventType)).Inc()
+		return err
+	}
+
+	zap.L().Warn("failed to push event, will retry", zap.Error(err), zap.Int32("type", int32(eventType)))
+	r.pending = append(r.pending, retryEvent{eventType: eventType, data: data})
+	return nil
+}
+
+func (r *retrier) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.retry(false)
+		}
+	}
+}
+
+// retry pushes pending events once, the ones still failing
+// are kept for the next attempt unless it's the last one.
+func (r *retrier) retry(last bool) {
+	r.lock.Lock()
+	events := r.pending
+	r.pending = nil
+	r.lock.Unlock()
+
+	failed := make([]retryEvent, 0, len(events))
+	for _, event := range events {
+		err := r.EventManager.Push(event.eventType, event.data)
+		if err == nil {
+			retriedEventsCounter.WithLabelValues(eventTypeLabel(event.eventType)).Inc()
+			continue
+		}
+
+		event.attempts++
+		if last || event.attempts >= r.config.Attempts {
+			undeliveredEventsCounter.WithLabelValues(eventTypeLabel(event.eventType)).Inc()
+			zap.L().Error("failed to push event, dropped", zap.Error(err),
+				zap.Int32("type", int32(event.eventType)), zap.Int("attempts", event.attempts))
+			continue
+		}
+		failed = append(failed, event)
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+
+	// keep the order, retried events go first
+	r.lock.Lock()
+	r.pending = append(failed, r.pending...)
+	r.lock.Unlock()
+}
+
+// Shutdown retries the pending events for the last time
+// and shuts the underlying manager down.
+func (r *retrier) Shutdown() error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+	r.retry(true)
+	return r.EventManager.Shutdown()
+}
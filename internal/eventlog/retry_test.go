@@ -0,0 +1,73 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+// failingSink fails the given number of pushes before delivering events
+type failingSink struct {
+	recordingSink
+
+	mu    sync.Mutex
+	fails int
+}
+
+func (s *failingSink) Push(eventType EventType, data interface{}) error {
+	s.mu.Lock()
+	if s.fails != 0 {
+		s.fails--
+		s.mu.Unlock()
+		return errors.New("sink is down")
+	}
+	s.mu.Unlock()
+	return s.recordingSink.Push(eventType, data)
+}
+
+func (s *failingSink) delivered() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.events)
+}
+
+func TestRetrierRetries(t *testing.T) {
+	sink := &failingSink{fails: 2}
+	r := NewRetrier(sink, RetryConfig{Attempts: 3, Interval: 10 * time.Millisecond})
+
+	// the failed push is not reported to the caller
+	require.NoError(t, r.Push(PeerAdd, &proto.PeerInfo{UserID: "alice"}))
+	require.Eventually(t, func() bool { return sink.delivered() == 1 }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, r.Shutdown())
+	assert.Equal(t, "alice", sink.events[0].(*proto.PeerInfo).UserID)
+}
+
+func TestRetrierDrops(t *testing.T) {
+	sink := &failingSink{fails: -1}
+	r := NewRetrier(sink, RetryConfig{Attempts: 2, Interval: 10 * time.Millisecond, Size: 1})
+
+	require.NoError(t, r.Push(PeerAdd, &proto.PeerInfo{}))
+	// the retry buffer is full
+	require.Error(t, r.Push(PeerRemove, &proto.PeerInfo{}))
+
+	// retries exhaust
+	rr := r.(*retrier)
+	require.Eventually(t, func() bool {
+		rr.lock.Lock()
+		defer rr.lock.Unlock()
+		return len(rr.pending) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, r.Shutdown())
+	assert.Zero(t, sink.delivered())
+}
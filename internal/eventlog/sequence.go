@@ -0,0 +1,92 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"sync"
+
+	"github.com/vpnhouse/tunnel/proto"
+	"go.uber.org/zap"
+)
+
+// sequenceReserveBlock is the number of sequence numbers reserved
+// in the store at once. If the process crashes, the unused rest
+// of the block is skipped, consumers see it as a gap.
+const sequenceReserveBlock = 1000
+
+// SequenceStore persists the event sequence across restarts.
+type SequenceStore interface {
+	GetEventSequence() (uint64, error)
+	SetEventSequence(seq uint64) error
+}
+
+// sequencer numbers events before passing them to the underlying manager.
+type sequencer struct {
+	EventManager
+
+	store SequenceStore
+	// lock guards the counters, it's held while pushing
+	// so the sinks receive events in the sequence order.
+	lock     sync.Mutex
+	last     uint64
+	reserved uint64
+}
+
+// NewSequencer returns the EventManager assigning the monotonic sequence
+// number to every pushed peer event, the number continues
+// from the one stored in the store.
+func NewSequencer(next EventManager, store SequenceStore) (EventManager, error) {
+	last, err := store.GetEventSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sequencer{
+		EventManager: next,
+		store:        store,
+		last:         last,
+		reserved:     last,
+	}, nil
+}
+
+func (s *sequencer) Push(eventType EventType, data interface{}) error {
+	if data == nil {
+		return ErrNilEvent
+	}
+
+	peer, ok := data.(*proto.PeerInfo)
+	if !ok {
+		return s.EventManager.Push(eventType, data)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seq := s.last + 1
+	if seq > s.reserved {
+		// never give out numbers that are not persisted,
+		// otherwise they can be reused after the restart.
+		if err := s.store.SetEventSequence(s.reserved + sequenceReserveBlock); err != nil {
+			return err
+		}
+		s.reserved += sequenceReserveBlock
+	}
+
+	s.last = seq
+	peer.Sequence = seq
+	return s.EventManager.Push(eventType, peer)
+}
+
+// Shutdown stores the exact last sequence, so the numbering
+// continues without gaps after the restart.
+func (s *sequencer) Shutdown() error {
+	s.lock.Lock()
+	if err := s.store.SetEventSequence(s.last); err != nil {
+		zap.L().Error("failed to store the event sequence", zap.Error(err), zap.Uint64("sequence", s.last))
+	}
+	s.lock.Unlock()
+
+	return s.EventManager.Shutdown()
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+type memSequenceStore struct {
+	seq    uint64
+	writes int
+}
+
+func (s *memSequenceStore) GetEventSequence() (uint64, error) {
+	return s.seq, nil
+}
+
+func (s *memSequenceStore) SetEventSequence(seq uint64) error {
+	s.seq = seq
+	s.writes++
+	return nil
+}
+
+func TestSequencer(t *testing.T) {
+	store := &memSequenceStore{}
+	sink := &recordingSink{}
+	s, err := NewSequencer(sink, store)
+	require.NoError(t, err)
+
+	const n = 2500
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Push(PeerAdd, &proto.PeerInfo{}))
+		}()
+	}
+	wg.Wait()
+
+	// numbers are reserved by blocks
+	assert.Equal(t, 3, store.writes)
+	assert.EqualValues(t, 3*sequenceReserveBlock, store.seq)
+
+	// sinks receive events in the sequence order
+	require.Len(t, sink.events, n)
+	for i, e := range sink.events {
+		assert.EqualValues(t, i+1, e.(*proto.PeerInfo).Sequence)
+	}
+
+	require.NoError(t, s.Shutdown())
+	assert.EqualValues(t, n, store.seq)
+
+	// the numbering continues after the restart
+	sink = &recordingSink{}
+	s, err = NewSequencer(sink, store)
+	require.NoError(t, err)
+	require.NoError(t, s.Push(PeerRemove, &proto.PeerInfo{}))
+	assert.EqualValues(t, n+1, sink.events[0].(*proto.PeerInfo).Sequence)
+}
@@ -53,6 +53,8 @@ type StorageConfig struct {
 	Period time.Duration `json:"period"`
 	// how many bytes we want to write to a single logfile
 	Size int64 `json:"size"`
+	// hide peer identifiers from the log subscribers, if set
+	Redact *RedactConfig `json:"redact,omitempty"`
 }
 
 // fsStorage implements logs storage on fs.
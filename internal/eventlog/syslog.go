@@ -0,0 +1,620 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vpnhouse/tunnel/proto"
+	"github.com/vpnhouse/common-lib-go/version"
+	"github.com/vpnhouse/common-lib-go/xerror"
+)
+
+const (
+	SyslogFormatKV  = "kv"
+	SyslogFormatCEF = "cef"
+
+	syslogAppName = "vpnhouse-tunnel"
+	// local0 facility, see RFC5424 6.2.1
+	syslogFacility     = 16
+	syslogDialTimeout  = 5 * time.Second
+	syslogWriteTimeout = 5 * time.Second
+)
+
+type SyslogConfig struct {
+	// Network is one of "udp", "tcp" or "tls"
+	Network string `yaml:"network"`
+	// Addr is the collector address, host:port
+	Addr string `yaml:"addr"`
+	// Format is "kv" for the key=value message or "cef" for the ArcSight CEF,
+	// default: "kv"
+	Format string `yaml:"format,omitempty"`
+	// Hostname to report in messages, the system hostname if empty
+	Hostname string `yaml:"hostname,omitempty"`
+	// TLSSkipVerify disables the collector certificate verification
+	TLSSkipVerify bool `yaml:"tls_skip_verify,omitempty"`
+	// Redact hides peer identifiers from the collector, if set
+	Redact *RedactConfig `yaml:"redact,omitempty"`
+}
+
+func (c SyslogConfig) validate() error {
+	switch c.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return xerror.EInvalidConfiguration("unknown syslog network "+c.Network, "syslog.network")
+	}
+
+	switch c.Format {
+	case "", SyslogFormatKV, SyslogFormatCEF:
+	default:
+		return xerror.EInvalidConfiguration("unknown syslog format "+c.Format, "syslog.format")
+	}
+
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return xerror.EInvalidConfiguration("invalid syslog collector address", "syslog.addr")
+	}
+	return nil
+}
+
+// syslogSink ships events to the syslog collector as RFC5424 messages.
+// Push blocks on the network, so the sink is expected to be used via NewMultiSink.
+type syslogSink struct {
+	config   SyslogConfig
+	hostname string
+
+	// lock guards the connection
+	lock    sync.Mutex
+	conn    net.Conn
+	stopped bool
+	// onDial is called on every new connection, if set
+	onDial func()
+}
+
+// NewSyslogSink returns the EventManager shipping events to the syslog collector.
+// The connection is established lazily and re-established on failures.
+func NewSyslogSink(config SyslogConfig) (EventManager, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	hostname := config.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	return &syslogSink{
+		config:   config,
+		hostname: hostname,
+	}, nil
+}
+
+func (s *syslogSink) Push(eventType EventType, data interface{}) error {
+	if data == nil {
+		return ErrNilEvent
+	}
+
+	var msg string
+	switch v := data.(type) {
+	case *proto.PeerInfo:
+		msg = formatSyslogMessage(time.Now(), s.hostname, s.config.Format, eventType, v)
+	case *proto.MaintenanceInfo:
+		msg = formatSyslogMaintenance(time.Now(), s.hostname, s.config.Format, v)
+	case *proto.DNSInfo:
+		msg = formatSyslogDNS(time.Now(), s.hostname, s.config.Format, v)
+	case *proto.ClockAnomalyInfo:
+		msg = formatSyslogClockAnomaly(time.Now(), s.hostname, s.config.Format, v)
+	case *proto.InterfaceInfo:
+		msg = formatSyslogInterfaceDown(time.Now(), s.hostname, s.config.Format, v)
+	case *proto.ManagerStateInfo:
+		msg = formatSyslogManagerState(time.Now(), s.hostname, s.config.Format, eventType, v)
+	case *proto.PoolPressureInfo:
+		msg = formatSyslogPoolPressure(time.Now(), s.hostname, s.config.Format, v)
+	case *proto.AuthKeysInfo:
+		msg = formatSyslogAuthKeys(time.Now(), s.hostname, s.config.Format, v)
+	case *proto.SettingsReloadInfo:
+		msg = formatSyslogSettingsReload(time.Now(), s.hostname, s.config.Format, v)
+	default:
+		return fmt.Errorf("unexpected event data type %T", data)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return ErrServiceStopped
+	}
+
+	// retry once with the fresh connection if the collector went away
+	err := s.write(msg)
+	if err != nil {
+		s.closeConn()
+		err = s.write(msg)
+	}
+	return err
+}
+
+func (s *syslogSink) write(msg string) error {
+	if s.conn != nil && s.config.Network != "udp" && !connAlive(s.conn) {
+		// writing to the connection closed by the collector
+		// may succeed, losing the message
+		s.closeConn()
+	}
+
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		if s.onDial != nil {
+			s.onDial()
+		}
+	}
+
+	if s.config.Network != "udp" {
+		// octet counting framing, RFC6587 3.4.1
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := s.conn.Write([]byte(msg))
+	return err
+}
+
+func (s *syslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	if s.config.Network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.config.Addr, &tls.Config{
+			InsecureSkipVerify: s.config.TLSSkipVerify,
+		})
+	}
+	return dialer.Dial(s.config.Network, s.config.Addr)
+}
+
+// connAlive checks that the stream connection is not closed by the peer.
+// The collector never writes, so the pending EOF or error means
+// the connection is gone.
+func connAlive(conn net.Conn) bool {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return true
+	}
+
+	alive := true
+	_ = raw.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		alive = n > 0 || errors.Is(err, syscall.EAGAIN)
+		// never wait for the data
+		return true
+	})
+	return alive
+}
+
+func (s *syslogSink) closeConn() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *syslogSink) Subscribe(ctx context.Context, subscriberID string, opts ...SubscribeOption) (*Subscription, error) {
+	return nil, fmt.Errorf("syslog sink does not store events: %w", ErrNotFound)
+}
+
+func (s *syslogSink) Unsubscribe(ctx context.Context, subscriberID string) error {
+	return nil
+}
+
+func (s *syslogSink) Running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.stopped
+}
+
+func (s *syslogSink) Shutdown() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopped = true
+	s.closeConn()
+	return nil
+}
+
+// syslogEvent describes the event in human terms.
+func syslogEvent(eventType EventType) (name string, severity int) {
+	switch eventType {
+	case PeerAdd:
+		return "peer added", 6
+	case PeerRemove:
+		return "peer removed", 5
+	case PeerUpdate:
+		return "peer updated", 6
+	case PeerTraffic:
+		return "peer traffic", 6
+	case PeerFirstConnect:
+		return "peer first connect", 6
+	case ServerMaintenance:
+		return "maintenance mode", 5
+	case ServerDNSUpdate:
+		return "dns servers updated", 5
+	case ServerClockAnomaly:
+		return "clock anomaly, expiration skipped", 4
+	case ServerInterfaceDown:
+		return "wireguard interface is gone", 3
+	case ManagerStarting:
+		return "manager starting", 6
+	case ManagerReady:
+		return "manager ready", 5
+	case ManagerDraining:
+		return "manager draining", 5
+	case ManagerStopped:
+		return "manager stopped", 5
+	case PeerIdle:
+		return "peer idle, disconnected", 6
+	case ServerPoolPressure:
+		return "address pool pressure", 4
+	case PeerNeverConnected:
+		return "never connected peer removed", 5
+	case AuthKeysUpdated:
+		return "authorizer keys updated", 5
+	case SettingsReloaded:
+		return "settings reloaded", 5
+	case PeerConnected:
+		return "peer online", 6
+	case PeerDisconnected:
+		return "peer offline", 6
+	default:
+		return "unknown event", 6
+	}
+}
+
+// formatSyslogMessage returns the RFC5424 message with the body
+// in the given format.
+func formatSyslogMessage(ts time.Time, hostname string, format string, eventType EventType, peer *proto.PeerInfo) string {
+	name, severity := syslogEvent(eventType)
+	msgID := proto.EventType(eventType).String()
+
+	var body string
+	if format == SyslogFormatCEF {
+		body = formatCEF(eventType, name, severity, peer)
+	} else {
+		body = formatKV(name, peer)
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+// formatSyslogMaintenance returns the RFC5424 message
+// for the maintenance mode transition.
+func formatSyslogMaintenance(ts time.Time, hostname string, format string, info *proto.MaintenanceInfo) string {
+	name, severity := syslogEvent(ServerMaintenance)
+	msgID := proto.EventType_ServerMaintenance.String()
+
+	state := "disabled"
+	if info.Enabled {
+		state = "enabled"
+	}
+
+	var body string
+	if format == SyslogFormatCEF {
+		extensions := []string{"act=" + state}
+		if info.CorrelationID != "" {
+			extensions = append(extensions, "cs5Label=correlationID", "cs5="+cefExtensionEscaper.Replace(info.CorrelationID))
+		}
+		body = formatCEFHeader(ServerMaintenance, name, severity) + strings.Join(extensions, " ")
+	} else {
+		fields := []string{
+			"reason=" + strconv.Quote(name+" "+state),
+			"enabled=" + strconv.FormatBool(info.Enabled),
+		}
+		if info.CorrelationID != "" {
+			fields = append(fields, "correlation_id="+strconv.Quote(info.CorrelationID))
+		}
+		body = strings.Join(fields, " ")
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+// formatSyslogDNS returns the RFC5424 message
+// for the change of DNS servers advertised to peers.
+func formatSyslogDNS(ts time.Time, hostname string, format string, info *proto.DNSInfo) string {
+	name, severity := syslogEvent(ServerDNSUpdate)
+	msgID := proto.EventType_ServerDNSUpdate.String()
+	servers := strings.Join(info.Servers, ",")
+
+	var body string
+	if format == SyslogFormatCEF {
+		extensions := []string{"cs6Label=dns", "cs6=" + cefExtensionEscaper.Replace(servers)}
+		if info.CorrelationID != "" {
+			extensions = append(extensions, "cs5Label=correlationID", "cs5="+cefExtensionEscaper.Replace(info.CorrelationID))
+		}
+		body = formatCEFHeader(ServerDNSUpdate, name, severity) + strings.Join(extensions, " ")
+	} else {
+		fields := []string{
+			"reason=" + strconv.Quote(name),
+			"dns=" + strconv.Quote(servers),
+		}
+		if info.CorrelationID != "" {
+			fields = append(fields, "correlation_id="+strconv.Quote(info.CorrelationID))
+		}
+		body = strings.Join(fields, " ")
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+// formatSyslogClockAnomaly returns the RFC5424 message
+// for the expiration skipped due to the likely clock jump.
+func formatSyslogClockAnomaly(ts time.Time, hostname string, format string, info *proto.ClockAnomalyInfo) string {
+	name, severity := syslogEvent(ServerClockAnomaly)
+	msgID := proto.EventType_ServerClockAnomaly.String()
+	expiring := strconv.FormatUint(info.Expiring, 10)
+	total := strconv.FormatUint(info.Total, 10)
+
+	var body string
+	if format == SyslogFormatCEF {
+		extensions := []string{
+			"cn2Label=expiring", "cn2=" + expiring,
+			"cn3Label=total", "cn3=" + total,
+		}
+		body = formatCEFHeader(ServerClockAnomaly, name, severity) + strings.Join(extensions, " ")
+	} else {
+		fields := []string{
+			"reason=" + strconv.Quote(name),
+			"expiring=" + expiring,
+			"total=" + total,
+		}
+		body = strings.Join(fields, " ")
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+// formatSyslogInterfaceDown returns the RFC5424 message
+// for the wireguard interface gone from the system.
+func formatSyslogInterfaceDown(ts time.Time, hostname string, format string, info *proto.InterfaceInfo) string {
+	name, severity := syslogEvent(ServerInterfaceDown)
+	msgID := proto.EventType_ServerInterfaceDown.String()
+
+	var body string
+	if format == SyslogFormatCEF {
+		body = formatCEFHeader(ServerInterfaceDown, name, severity) + "cs6Label=interface cs6=" + cefExtensionEscaper.Replace(info.Name)
+	} else {
+		body = "reason=" + strconv.Quote(name) + " interface=" + strconv.Quote(info.Name)
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+// formatSyslogPoolPressure returns the RFC5424 message
+// for the address pool utilization crossed the threshold.
+func formatSyslogPoolPressure(ts time.Time, hostname string, format string, info *proto.PoolPressureInfo) string {
+	name, severity := syslogEvent(ServerPoolPressure)
+	msgID := proto.EventType_ServerPoolPressure.String()
+	threshold := strconv.FormatUint(uint64(info.Threshold), 10)
+	used := strconv.FormatUint(info.Used, 10)
+	total := strconv.FormatUint(info.Total, 10)
+
+	var body string
+	if format == SyslogFormatCEF {
+		extensions := []string{
+			"cn1Label=threshold", "cn1=" + threshold,
+			"cn2Label=used", "cn2=" + used,
+			"cn3Label=total", "cn3=" + total,
+		}
+		body = formatCEFHeader(ServerPoolPressure, name, severity) + strings.Join(extensions, " ")
+	} else {
+		fields := []string{
+			"reason=" + strconv.Quote(name),
+			"threshold=" + threshold,
+			"used=" + used,
+			"total=" + total,
+		}
+		body = strings.Join(fields, " ")
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+// formatSyslogAuthKeys returns the RFC5424 message
+// for the authorizer keys set stored from the federation source.
+func formatSyslogAuthKeys(ts time.Time, hostname string, format string, info *proto.AuthKeysInfo) string {
+	name, severity := syslogEvent(AuthKeysUpdated)
+	msgID := proto.EventType_AuthKeysUpdated.String()
+	count := strconv.FormatUint(info.Count, 10)
+
+	var body string
+	if format == SyslogFormatCEF {
+		extensions := []string{
+			"cs1Label=source", "cs1=" + cefExtensionEscaper.Replace(info.Source),
+			"cn2Label=count", "cn2=" + count,
+			"cs2Label=fingerprint", "cs2=" + info.Fingerprint,
+		}
+		if info.Version > 0 {
+			extensions = append(extensions, "cn3Label=version", "cn3="+strconv.FormatInt(info.Version, 10))
+		}
+		if len(info.Added) > 0 {
+			extensions = append(extensions, "cs3Label=added", "cs3="+cefExtensionEscaper.Replace(info.Added))
+		}
+		if len(info.Revoked) > 0 {
+			extensions = append(extensions, "cs4Label=revoked", "cs4="+cefExtensionEscaper.Replace(info.Revoked))
+		}
+		body = formatCEFHeader(AuthKeysUpdated, name, severity) + strings.Join(extensions, " ")
+	} else {
+		fields := []string{
+			"reason=" + strconv.Quote(name),
+			"source=" + strconv.Quote(info.Source),
+			"count=" + count,
+			"fingerprint=" + info.Fingerprint,
+		}
+		if info.Version > 0 {
+			fields = append(fields, "version="+strconv.FormatInt(info.Version, 10))
+		}
+		if len(info.Added) > 0 {
+			fields = append(fields, "added="+strconv.Quote(info.Added))
+		}
+		if len(info.Revoked) > 0 {
+			fields = append(fields, "revoked="+strconv.Quote(info.Revoked))
+		}
+		body = strings.Join(fields, " ")
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+// formatSyslogSettingsReload returns the RFC5424 message
+// for the configuration reloaded without the restart.
+func formatSyslogSettingsReload(ts time.Time, hostname string, format string, info *proto.SettingsReloadInfo) string {
+	name, severity := syslogEvent(SettingsReloaded)
+	msgID := proto.EventType_SettingsReloaded.String()
+	applied := strings.Join(info.Applied, ",")
+	pending := strings.Join(info.Pending, ",")
+
+	var body string
+	if format == SyslogFormatCEF {
+		extensions := []string{
+			"cs1Label=applied", "cs1=" + cefExtensionEscaper.Replace(applied),
+			"cs2Label=pending", "cs2=" + cefExtensionEscaper.Replace(pending),
+		}
+		body = formatCEFHeader(SettingsReloaded, name, severity) + strings.Join(extensions, " ")
+	} else {
+		fields := []string{
+			"reason=" + strconv.Quote(name),
+			"applied=" + strconv.Quote(applied),
+			"pending=" + strconv.Quote(pending),
+		}
+		body = strings.Join(fields, " ")
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+// formatSyslogManagerState returns the RFC5424 message
+// for the transition of the peer manager state.
+func formatSyslogManagerState(ts time.Time, hostname string, format string, eventType EventType, info *proto.ManagerStateInfo) string {
+	name, severity := syslogEvent(eventType)
+	msgID := proto.EventType(eventType).String()
+	peers := strconv.FormatUint(info.Peers, 10)
+
+	var body string
+	if format == SyslogFormatCEF {
+		body = formatCEFHeader(eventType, name, severity) + "cn2Label=peers cn2=" + peers
+	} else {
+		body = "reason=" + strconv.Quote(name) + " peers=" + peers
+	}
+
+	return formatSyslogFrame(ts, hostname, severity, msgID, body)
+}
+
+func formatSyslogFrame(ts time.Time, hostname string, severity int, msgID string, body string) string {
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s - %s - %s",
+		syslogFacility*8+severity,
+		ts.UTC().Format(time.RFC3339),
+		hostname,
+		syslogAppName,
+		msgID,
+		body,
+	)
+}
+
+func formatKV(name string, peer *proto.PeerInfo) string {
+	fields := []string{
+		"sequence=" + strconv.FormatUint(peer.Sequence, 10),
+		"reason=" + strconv.Quote(name),
+		"user_id=" + strconv.Quote(peer.UserID),
+		"installation_id=" + strconv.Quote(peer.InstallationID),
+		"session_id=" + strconv.Quote(peer.SessionID),
+		"bytes_rx=" + strconv.FormatUint(peer.BytesRx, 10),
+		"bytes_tx=" + strconv.FormatUint(peer.BytesTx, 10),
+	}
+	if peer.Label != "" {
+		fields = append(fields, "label="+strconv.Quote(peer.Label))
+	}
+	if peer.BytesDeltaRx > 0 || peer.BytesDeltaTx > 0 {
+		fields = append(fields,
+			"bytes_delta_rx="+strconv.FormatUint(peer.BytesDeltaRx, 10),
+			"bytes_delta_tx="+strconv.FormatUint(peer.BytesDeltaTx, 10),
+		)
+	}
+	if peer.Country != "" {
+		fields = append(fields, "country="+strconv.Quote(peer.Country))
+	}
+	if peer.IdleReason != "" {
+		fields = append(fields, "idle_reason="+strconv.Quote(peer.IdleReason))
+	}
+	if peer.CorrelationID != "" {
+		fields = append(fields, "correlation_id="+strconv.Quote(peer.CorrelationID))
+	}
+	return strings.Join(fields, " ")
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func formatCEF(eventType EventType, name string, severity int, peer *proto.PeerInfo) string {
+	extensions := []string{
+		"cn1Label=sequence",
+		"cn1=" + strconv.FormatUint(peer.Sequence, 10),
+		"suser=" + cefExtensionEscaper.Replace(peer.UserID),
+		"cs1Label=installationID",
+		"cs1=" + cefExtensionEscaper.Replace(peer.InstallationID),
+		"cs2Label=sessionID",
+		"cs2=" + cefExtensionEscaper.Replace(peer.SessionID),
+		"in=" + strconv.FormatUint(peer.BytesRx, 10),
+		"out=" + strconv.FormatUint(peer.BytesTx, 10),
+	}
+	if peer.Label != "" {
+		extensions = append(extensions, "cs3Label=label", "cs3="+cefExtensionEscaper.Replace(peer.Label))
+	}
+	if peer.Country != "" {
+		extensions = append(extensions, "cs4Label=country", "cs4="+cefExtensionEscaper.Replace(peer.Country))
+	}
+	if peer.IdleReason != "" {
+		extensions = append(extensions, "reason="+cefExtensionEscaper.Replace(peer.IdleReason))
+	}
+	if peer.CorrelationID != "" {
+		extensions = append(extensions, "cs5Label=correlationID", "cs5="+cefExtensionEscaper.Replace(peer.CorrelationID))
+	}
+
+	return formatCEFHeader(eventType, name, severity) + strings.Join(extensions, " ")
+}
+
+// formatCEFHeader returns the CEF header followed by the extensions separator.
+func formatCEFHeader(eventType EventType, name string, severity int) string {
+	// CEF severity grows with the importance, unlike the syslog one
+	cefSeverity := 10 - severity
+
+	return fmt.Sprintf("CEF:0|VPNHouse|tunnel|%s|%d|%s|%d|",
+		cefHeaderEscaper.Replace(version.GetVersion()),
+		int32(eventType),
+		cefHeaderEscaper.Replace(name),
+		cefSeverity,
+	)
+}
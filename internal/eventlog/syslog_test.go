@@ -0,0 +1,241 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package eventlog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+func testSyslogPeer() *proto.PeerInfo {
+	return &proto.PeerInfo{
+		UserID:         "user|1",
+		InstallationID: "b0e6a0a4-2b3c-4bd6-8a5f-3c3c0f5f3c1a",
+		SessionID:      "0c3d1f96-3a42-4a4e-9f3e-5a5a3f2b4f2e",
+		BytesRx:        100,
+		BytesTx:        200,
+		Label:          "a=b",
+		Sequence:       42,
+	}
+}
+
+func TestFormatSyslogMessage(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	msg := formatSyslogMessage(ts, "node1", SyslogFormatKV, PeerRemove, testSyslogPeer())
+	assert.Equal(t, `<133>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - PeerRemove - `+
+		`sequence=42 reason="peer removed" user_id="user|1" installation_id="b0e6a0a4-2b3c-4bd6-8a5f-3c3c0f5f3c1a" `+
+		`session_id="0c3d1f96-3a42-4a4e-9f3e-5a5a3f2b4f2e" bytes_rx=100 bytes_tx=200 label="a=b"`, msg)
+
+	msg = formatSyslogMessage(ts, "", SyslogFormatCEF, PeerAdd, testSyslogPeer())
+	assert.True(t, strings.HasPrefix(msg, "<134>1 2023-03-01T10:00:00Z - vpnhouse-tunnel - PeerAdd - CEF:0|VPNHouse|tunnel|"), msg)
+	assert.Contains(t, msg, "|1|peer added|4|cn1Label=sequence cn1=42 suser=user|1 ")
+	assert.Contains(t, msg, "in=100 out=200")
+	assert.Contains(t, msg, `cs3=a\=b`)
+
+	peer := testSyslogPeer()
+	peer.IdleReason = "no_traffic"
+	msg = formatSyslogMessage(ts, "node1", SyslogFormatKV, PeerIdle, peer)
+	assert.True(t, strings.HasSuffix(msg, `label="a=b" idle_reason="no_traffic"`), msg)
+	assert.Contains(t, msg, `reason="peer idle, disconnected"`)
+
+	msg = formatSyslogMessage(ts, "node1", SyslogFormatCEF, PeerIdle, peer)
+	assert.Contains(t, msg, "|14|peer idle, disconnected|4|")
+	assert.Contains(t, msg, " reason=no_traffic")
+
+	msg = formatSyslogMessage(ts, "node1", SyslogFormatKV, PeerDisconnected, testSyslogPeer())
+	assert.True(t, strings.HasPrefix(msg, `<134>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - PeerDisconnected - `+
+		`sequence=42 reason="peer offline"`), msg)
+}
+
+func TestFormatSyslogMaintenance(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	info := &proto.MaintenanceInfo{Enabled: true, CorrelationID: "req-1"}
+
+	msg := formatSyslogMaintenance(ts, "node1", SyslogFormatKV, info)
+	assert.Equal(t, `<133>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - ServerMaintenance - `+
+		`reason="maintenance mode enabled" enabled=true correlation_id="req-1"`, msg)
+
+	msg = formatSyslogMaintenance(ts, "node1", SyslogFormatCEF, &proto.MaintenanceInfo{})
+	assert.True(t, strings.HasSuffix(msg, "|6|maintenance mode|5|act=disabled"), msg)
+}
+
+func TestFormatSyslogDNS(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	info := &proto.DNSInfo{Servers: []string{"1.1.1.1", "8.8.8.8"}}
+
+	msg := formatSyslogDNS(ts, "node1", SyslogFormatKV, info)
+	assert.Equal(t, `<133>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - ServerDNSUpdate - `+
+		`reason="dns servers updated" dns="1.1.1.1,8.8.8.8"`, msg)
+
+	msg = formatSyslogDNS(ts, "node1", SyslogFormatCEF, info)
+	assert.True(t, strings.HasSuffix(msg, "|7|dns servers updated|5|cs6Label=dns cs6=1.1.1.1,8.8.8.8"), msg)
+}
+
+func TestFormatSyslogClockAnomaly(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	info := &proto.ClockAnomalyInfo{Expiring: 900, Total: 1000}
+
+	msg := formatSyslogClockAnomaly(ts, "node1", SyslogFormatKV, info)
+	assert.Equal(t, `<132>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - ServerClockAnomaly - `+
+		`reason="clock anomaly, expiration skipped" expiring=900 total=1000`, msg)
+
+	msg = formatSyslogClockAnomaly(ts, "node1", SyslogFormatCEF, info)
+	assert.True(t, strings.HasSuffix(msg, "|8|clock anomaly, expiration skipped|6|cn2Label=expiring cn2=900 cn3Label=total cn3=1000"), msg)
+}
+
+func TestFormatSyslogInterfaceDown(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	info := &proto.InterfaceInfo{Name: "uwg0"}
+
+	msg := formatSyslogInterfaceDown(ts, "node1", SyslogFormatKV, info)
+	assert.Equal(t, `<131>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - ServerInterfaceDown - `+
+		`reason="wireguard interface is gone" interface="uwg0"`, msg)
+
+	msg = formatSyslogInterfaceDown(ts, "node1", SyslogFormatCEF, info)
+	assert.True(t, strings.HasSuffix(msg, "|9|wireguard interface is gone|7|cs6Label=interface cs6=uwg0"), msg)
+}
+
+func TestFormatSyslogPoolPressure(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	info := &proto.PoolPressureInfo{Threshold: 80, Used: 205, Total: 254}
+
+	msg := formatSyslogPoolPressure(ts, "node1", SyslogFormatKV, info)
+	assert.Equal(t, `<132>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - ServerPoolPressure - `+
+		`reason="address pool pressure" threshold=80 used=205 total=254`, msg)
+
+	msg = formatSyslogPoolPressure(ts, "node1", SyslogFormatCEF, info)
+	assert.True(t, strings.HasSuffix(msg, "|15|address pool pressure|6|cn1Label=threshold cn1=80 cn2Label=used cn2=205 cn3Label=total cn3=254"), msg)
+}
+
+func TestFormatSyslogAuthKeys(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	info := &proto.AuthKeysInfo{Source: "federation-1", Count: 3, Fingerprint: "ab12", Version: 7}
+
+	msg := formatSyslogAuthKeys(ts, "node1", SyslogFormatKV, info)
+	assert.Equal(t, `<133>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - AuthKeysUpdated - `+
+		`reason="authorizer keys updated" source="federation-1" count=3 fingerprint=ab12 version=7`, msg)
+
+	info.Version = 0
+	msg = formatSyslogAuthKeys(ts, "node1", SyslogFormatCEF, info)
+	assert.True(t, strings.HasSuffix(msg, "|17|authorizer keys updated|5|cs1Label=source cs1=federation-1 cn2Label=count cn2=3 cs2Label=fingerprint cs2=ab12"), msg)
+
+	info = &proto.AuthKeysInfo{Source: "federation-1", Count: 1, Fingerprint: "cd34", Revoked: "key-1"}
+	msg = formatSyslogAuthKeys(ts, "node1", SyslogFormatKV, info)
+	assert.True(t, strings.HasSuffix(msg, `count=1 fingerprint=cd34 revoked="key-1"`), msg)
+	msg = formatSyslogAuthKeys(ts, "node1", SyslogFormatCEF, &proto.AuthKeysInfo{Source: "federation-1", Count: 1, Added: "key-2"})
+	assert.True(t, strings.HasSuffix(msg, " cs3Label=added cs3=key-2"), msg)
+}
+
+func TestFormatSyslogSettingsReload(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	info := &proto.SettingsReloadInfo{Applied: []string{"lock_timeout", "peer_statistics"}, Pending: []string{"wireguard.subnet"}}
+
+	msg := formatSyslogSettingsReload(ts, "node1", SyslogFormatKV, info)
+	assert.Equal(t, `<133>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - SettingsReloaded - `+
+		`reason="settings reloaded" applied="lock_timeout,peer_statistics" pending="wireguard.subnet"`, msg)
+
+	msg = formatSyslogSettingsReload(ts, "node1", SyslogFormatCEF, &proto.SettingsReloadInfo{Applied: []string{"lock_timeout"}})
+	assert.True(t, strings.HasSuffix(msg, "|18|settings reloaded|5|cs1Label=applied cs1=lock_timeout cs2Label=pending cs2="), msg)
+}
+
+func TestFormatSyslogManagerState(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	info := &proto.ManagerStateInfo{Peers: 42}
+
+	msg := formatSyslogManagerState(ts, "node1", SyslogFormatKV, ManagerReady, info)
+	assert.Equal(t, `<133>1 2023-03-01T10:00:00Z node1 vpnhouse-tunnel - ManagerReady - `+
+		`reason="manager ready" peers=42`, msg)
+
+	msg = formatSyslogManagerState(ts, "node1", SyslogFormatCEF, ManagerStopped, &proto.ManagerStateInfo{})
+	assert.True(t, strings.HasSuffix(msg, "|13|manager stopped|5|cn2Label=peers cn2=0"), msg)
+}
+
+func TestSyslogSinkReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	messages := make(chan string, 10)
+	closed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			size, err := r.ReadString(' ')
+			if err == nil {
+				n, _ := strconv.Atoi(strings.TrimSpace(size))
+				buf := make([]byte, n)
+				if _, err := io.ReadFull(r, buf); err == nil {
+					messages <- string(buf)
+				}
+			}
+			// drop the connection after each message
+			_ = conn.Close()
+			closed <- struct{}{}
+		}
+	}()
+
+	sink, err := NewSyslogSink(SyslogConfig{Network: "tcp", Addr: ln.Addr().String(), Hostname: "node1"})
+	require.NoError(t, err)
+	dials := make(chan struct{}, 10)
+	sink.(*syslogSink).onDial = func() {
+		dials <- struct{}{}
+	}
+
+	require.NoError(t, sink.Push(PeerAdd, testSyslogPeer()))
+	waitSignal(t, dials)
+	assert.Contains(t, receiveMessage(t, messages), "PeerAdd")
+	waitSignal(t, closed)
+
+	// the sink notices the closed connection and dials again
+	require.NoError(t, sink.Push(PeerRemove, testSyslogPeer()))
+	waitSignal(t, dials)
+	assert.Contains(t, receiveMessage(t, messages), "PeerRemove")
+	require.NoError(t, sink.Shutdown())
+}
+
+func waitSignal(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the signal")
+	}
+}
+
+func receiveMessage(t *testing.T, messages <-chan string) string {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+		return ""
+	}
+}
+
+func TestSyslogConfigValidate(t *testing.T) {
+	_, err := NewSyslogSink(SyslogConfig{Network: "foo", Addr: "localhost:514"})
+	assert.Error(t, err)
+	_, err = NewSyslogSink(SyslogConfig{Network: "udp", Addr: "localhost"})
+	assert.Error(t, err)
+	_, err = NewSyslogSink(SyslogConfig{Network: "udp", Addr: "localhost:514", Format: "xml"})
+	assert.Error(t, err)
+	_, err = NewSyslogSink(SyslogConfig{Network: "tls", Addr: "localhost:6514", Format: SyslogFormatCEF})
+	assert.NoError(t, err)
+}
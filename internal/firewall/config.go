@@ -0,0 +1,218 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
+)
+
+// IANA protocol numbers
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+const dnsPort = 53
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Rule matches the outbound traffic of the peer by the destination port.
+type Rule struct {
+	// Protocol is "tcp", "udp" or "any" for both of them
+	Protocol string `yaml:"protocol"`
+	// Ports are single ports or ranges, e.g. "25" or "8000-8080"
+	Ports []string `yaml:"ports"`
+	// Action is "allow" or "deny"
+	Action string `yaml:"action"`
+}
+
+// Config maps the access policy name to the ordered list of rules
+// applied to peers with the policy, the first matching rule wins.
+// Keys are "internet_only" or "allow_all".
+type Config map[string][]Rule
+
+// Validate checks the rules are well-formed.
+func (c Config) Validate() error {
+	_, err := c.compile()
+	return err
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+type rule struct {
+	proto byte
+	ports []portRange
+	// dst limits the rule to the destination address, any if nil
+	dst    net.IP
+	accept bool
+}
+
+// compile parses rules of each policy.
+func (c Config) compile() (map[int][]rule, error) {
+	policies := make(map[int][]rule, len(c))
+	for name, rules := range c {
+		field := "policy_ports." + name
+		pol, ok := ipalloc.ParsePolicy(name)
+		if !ok {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("policy_ports: unknown policy %q", name), "policy_ports")
+		}
+
+		compiled := make([]rule, 0, len(rules))
+		for i, r := range rules {
+			v, err := r.compile()
+			if err != nil {
+				return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s[%d]: %v", field, i, err), field)
+			}
+			compiled = append(compiled, v...)
+		}
+		policies[pol] = compiled
+	}
+	return policies, nil
+}
+
+// DNSEnforcement maps the access policy name to whether the DNS traffic
+// of peers with the policy is restricted to the tunnel DNS servers,
+// queries to any other resolver are dropped.
+// Keys are "internet_only" or "allow_all".
+type DNSEnforcement map[string]bool
+
+// Validate checks the policy names.
+func (c DNSEnforcement) Validate() error {
+	_, err := c.compile()
+	return err
+}
+
+// compile returns the set of policies with the DNS restricted.
+func (c DNSEnforcement) compile() (map[int]bool, error) {
+	policies := make(map[int]bool, len(c))
+	for name, enforce := range c {
+		pol, ok := ipalloc.ParsePolicy(name)
+		if !ok {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("enforce_tunnel_dns: unknown policy %q", name), "enforce_tunnel_dns")
+		}
+		if enforce {
+			policies[pol] = true
+		}
+	}
+	return policies, nil
+}
+
+// Enabled reports whether any policy has the DNS restricted.
+func (c DNSEnforcement) Enabled() bool {
+	for _, enforce := range c {
+		if enforce {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsRules returns rules passing DNS queries to the given servers only.
+func dnsRules(servers []net.IP) []rule {
+	dns := []portRange{{from: dnsPort, to: dnsPort}}
+	rules := make([]rule, 0, 2*len(servers)+2)
+	for _, proto := range []byte{protoUDP, protoTCP} {
+		for _, server := range servers {
+			rules = append(rules, rule{proto: proto, ports: dns, dst: server, accept: true})
+		}
+		rules = append(rules, rule{proto: proto, ports: dns, accept: false})
+	}
+	return rules
+}
+
+// parseDNSServers returns IPv4 servers of the list, others are skipped.
+func parseDNSServers(servers []string) []net.IP {
+	parsed := make([]net.IP, 0, len(servers))
+	for _, s := range servers {
+		if ip := net.ParseIP(s).To4(); ip != nil {
+			parsed = append(parsed, ip)
+		}
+	}
+	return parsed
+}
+
+// compile returns the rule for each protocol matched.
+func (r Rule) compile() ([]rule, error) {
+	var protos []byte
+	switch r.Protocol {
+	case "tcp":
+		protos = []byte{protoTCP}
+	case "udp":
+		protos = []byte{protoUDP}
+	case "any":
+		protos = []byte{protoTCP, protoUDP}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", r.Protocol)
+	}
+
+	var v rule
+
+	switch r.Action {
+	case ActionAllow:
+		v.accept = true
+	case ActionDeny:
+		v.accept = false
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	if len(r.Ports) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	for _, s := range r.Ports {
+		ports, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		v.ports = append(v.ports, ports)
+	}
+
+	rules := make([]rule, 0, len(protos))
+	for _, proto := range protos {
+		v.proto = proto
+		rules = append(rules, v)
+	}
+	return rules, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+
+	first, err := parsePort(from)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	last, err := parsePort(to)
+	if err != nil || last < first {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return portRange{from: first, to: last}, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	v, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	if v == 0 {
+		return 0, fmt.Errorf("port must be positive")
+	}
+	return uint16(v), nil
+}
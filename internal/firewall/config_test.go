@@ -0,0 +1,189 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package firewall
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+)
+
+func TestConfigValidate(t *testing.T) {
+	deny := func(proto string, ports ...string) Config {
+		return Config{"internet_only": {{Protocol: proto, Ports: ports, Action: ActionDeny}}}
+	}
+
+	tests := []struct {
+		config Config
+		valid  bool
+	}{
+		{config: nil, valid: true},
+		{config: deny("tcp", "25"), valid: true},
+		{config: deny("udp", "8000-8080", "9000"), valid: true},
+		{config: deny("tcp", "1-65535"), valid: true},
+		{config: deny("any", "6881-6889"), valid: true},
+		{config: Config{"allow_all": {{Protocol: "tcp", Ports: []string{"25"}, Action: ActionAllow}}}, valid: true},
+		{config: deny("icmp", "25"), valid: false},
+		{config: deny("all", "25"), valid: false},
+		{config: deny("tcp"), valid: false},
+		{config: deny("tcp", "0"), valid: false},
+		{config: deny("tcp", "65536"), valid: false},
+		{config: deny("tcp", "8080-8000"), valid: false},
+		{config: deny("tcp", "smtp"), valid: false},
+		{config: Config{"internet_only": {{Protocol: "tcp", Ports: []string{"25"}, Action: "reject"}}}, valid: false},
+		{config: Config{"default": {{Protocol: "tcp", Ports: []string{"25"}, Action: ActionDeny}}}, valid: false},
+	}
+
+	for _, tt := range tests {
+		err := tt.config.Validate()
+		if tt.valid {
+			assert.NoError(t, err, "%v", tt.config)
+		} else {
+			assert.ErrorIs(t, err, xerror.EInvalidConfiguration("", ""), "%v", tt.config)
+		}
+	}
+}
+
+type fakeNetfilter struct {
+	// rules of each policy
+	rules map[int][]rule
+	// addrs maps the address to its policy
+	addrs map[string]int
+	// programmed counts setPolicyRules calls
+	programmed int
+}
+
+func newFakeNetfilter() *fakeNetfilter {
+	return &fakeNetfilter{rules: map[int][]rule{}, addrs: map[string]int{}}
+}
+
+func (f *fakeNetfilter) init() error {
+	return nil
+}
+
+func (f *fakeNetfilter) setPolicyRules(access int, rules []rule) error {
+	f.rules[access] = append([]rule(nil), rules...)
+	f.programmed++
+	return nil
+}
+
+func (f *fakeNetfilter) addAddr(access int, addr xnet.IP) error {
+	f.addrs[addr.String()] = access
+	return nil
+}
+
+func (f *fakeNetfilter) removeAddr(access int, addr xnet.IP) error {
+	delete(f.addrs, addr.String())
+	return nil
+}
+
+// applied returns the rules matching the traffic of the address.
+func (f *fakeNetfilter) applied(addr xnet.IP) []rule {
+	access, ok := f.addrs[addr.String()]
+	if !ok {
+		return nil
+	}
+	return f.rules[access]
+}
+
+func TestDNSEnforcementValidate(t *testing.T) {
+	assert.NoError(t, DNSEnforcement(nil).Validate())
+	assert.NoError(t, DNSEnforcement{"internet_only": true, "allow_all": false}.Validate())
+	assert.ErrorIs(t, DNSEnforcement{"default": true}.Validate(), xerror.EInvalidConfiguration("", ""))
+
+	assert.False(t, DNSEnforcement{"allow_all": false}.Enabled())
+	assert.True(t, DNSEnforcement{"allow_all": false, "internet_only": true}.Enabled())
+}
+
+func TestFilterApply(t *testing.T) {
+	nf := newFakeNetfilter()
+	f, err := newFilter(nf, Config{
+		"internet_only": {{Protocol: "tcp", Ports: []string{"25"}, Action: ActionDeny}},
+	}, nil, nil, ipam.AccessPolicyInternetOnly)
+	require.NoError(t, err)
+
+	addr := xnet.ParseIP("10.235.0.2")
+	// the default policy is resolved
+	require.NoError(t, f.Apply(addr, ipam.Policy{Access: ipam.AccessPolicyDefault}))
+	require.Len(t, nf.applied(addr), 1)
+
+	// rules are replaced, not appended
+	require.NoError(t, f.Apply(addr, ipam.Policy{Access: ipam.AccessPolicyInternetOnly}))
+	require.Len(t, nf.applied(addr), 1)
+
+	// no rules for the policy
+	require.NoError(t, f.Apply(addr, ipam.Policy{Access: ipam.AccessPolicyAllowAll}))
+	require.Empty(t, nf.addrs)
+
+	// the rules are programmed once per policy, not per peer
+	other := xnet.ParseIP("10.235.0.3")
+	require.NoError(t, f.Apply(other, ipam.Policy{Access: ipam.AccessPolicyInternetOnly}))
+	require.NoError(t, f.Apply(addr, ipam.Policy{Access: ipam.AccessPolicyInternetOnly}))
+	require.Equal(t, 1, nf.programmed)
+	require.Len(t, nf.rules[ipam.AccessPolicyInternetOnly], 1)
+
+	require.NoError(t, f.Remove(addr))
+	require.NoError(t, f.Remove(other))
+	require.Empty(t, nf.addrs)
+}
+
+func TestFilterAnyProtocol(t *testing.T) {
+	nf := newFakeNetfilter()
+	f, err := newFilter(nf, Config{
+		"internet_only": {
+			{Protocol: "tcp", Ports: []string{"6881"}, Action: ActionAllow},
+			{Protocol: "any", Ports: []string{"6881-6889", "6969"}, Action: ActionDeny},
+		},
+	}, nil, nil, ipam.AccessPolicyInternetOnly)
+	require.NoError(t, err)
+
+	addr := xnet.ParseIP("10.235.0.2")
+	require.NoError(t, f.Apply(addr, ipam.Policy{Access: ipam.AccessPolicyInternetOnly}))
+	// the order of rules is kept, "any" matches tcp then udp
+	ports := []portRange{{from: 6881, to: 6889}, {from: 6969, to: 6969}}
+	assert.Equal(t, []rule{
+		{proto: protoTCP, ports: []portRange{{from: 6881, to: 6881}}, accept: true},
+		{proto: protoTCP, ports: ports},
+		{proto: protoUDP, ports: ports},
+	}, nf.applied(addr))
+}
+
+func TestFilterDNSEnforcement(t *testing.T) {
+	nf := newFakeNetfilter()
+	f, err := newFilter(nf, Config{
+		"internet_only": {{Protocol: "tcp", Ports: []string{"25"}, Action: ActionDeny}},
+	}, DNSEnforcement{"internet_only": true, "allow_all": false}, []string{"10.235.0.1"}, ipam.AccessPolicyInternetOnly)
+	require.NoError(t, err)
+
+	addr := xnet.ParseIP("10.235.0.2")
+	require.NoError(t, f.Apply(addr, ipam.Policy{Access: ipam.AccessPolicyInternetOnly}))
+	rules := nf.applied(addr)
+	// accept and deny for udp and tcp, then the port rules
+	require.Len(t, rules, 5)
+	assert.Equal(t, rule{proto: protoUDP, ports: []portRange{{from: dnsPort, to: dnsPort}}, dst: xnet.ParseIP("10.235.0.1").IP.To4(), accept: true}, rules[0])
+	assert.Equal(t, rule{proto: protoUDP, ports: []portRange{{from: dnsPort, to: dnsPort}}}, rules[1])
+	assert.Equal(t, protoTCP, int(rules[2].proto))
+	assert.True(t, rules[2].accept)
+	assert.False(t, rules[3].accept)
+	assert.Nil(t, rules[3].dst)
+
+	other := xnet.ParseIP("10.235.0.3")
+	require.NoError(t, f.Apply(other, ipam.Policy{Access: ipam.AccessPolicyAllowAll}))
+	require.Empty(t, nf.applied(other))
+
+	// applied rules follow the servers
+	require.NoError(t, f.SetDNSServers([]string{"10.235.0.1", "10.235.0.53"}))
+	rules = nf.applied(addr)
+	require.Len(t, rules, 7)
+	assert.Equal(t, xnet.ParseIP("10.235.0.53").IP.To4(), rules[1].dst)
+	require.Empty(t, nf.applied(other))
+
+	require.NoError(t, f.Remove(addr))
+	require.Empty(t, nf.addrs)
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package firewall
+
+import (
+	"net"
+	"sync"
+
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/xnet"
+)
+
+// netFilter programs the rules of each access policy once,
+// the rules match the addresses of peers added to the policy.
+type netFilter interface {
+	init() error
+	setPolicyRules(access int, rules []rule) error
+	addAddr(access int, addr xnet.IP) error
+	removeAddr(access int, addr xnet.IP) error
+}
+
+// Filter applies the port rules of the peer's access policy
+// to the traffic originated from the peer's address.
+type Filter struct {
+	nf            netFilter
+	portRules     map[int][]rule
+	enforceDNS    map[int]bool
+	defaultPolicy int
+
+	// lock guards policies, dnsServers and applied
+	lock       sync.Mutex
+	policies   map[int][]rule
+	dnsServers []net.IP
+	// applied maps the address to the access policy of its rules
+	applied map[uint32]appliedRules
+}
+
+type appliedRules struct {
+	addr   xnet.IP
+	access int
+}
+
+// New returns the Filter for the given rules,
+// dns lists policies restricted to the dnsServers,
+// defaultPolicy is the access policy applied to peers without one.
+// Nothing is programmed if no rules are configured.
+func New(config Config, dns DNSEnforcement, dnsServers []string, defaultPolicy int) (*Filter, error) {
+	return newFilter(newNetfilter(), config, dns, dnsServers, defaultPolicy)
+}
+
+func newFilter(nf netFilter, config Config, dns DNSEnforcement, dnsServers []string, defaultPolicy int) (*Filter, error) {
+	portRules, err := config.compile()
+	if err != nil {
+		return nil, err
+	}
+	enforceDNS, err := dns.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Filter{
+		nf:            nf,
+		portRules:     portRules,
+		enforceDNS:    enforceDNS,
+		defaultPolicy: defaultPolicy,
+		dnsServers:    parseDNSServers(dnsServers),
+		applied:       make(map[uint32]appliedRules),
+	}
+	f.rebuild()
+	if len(f.policies) == 0 {
+		return f, nil
+	}
+
+	// drops rules left by the previous run
+	if err := f.nf.init(); err != nil {
+		return nil, err
+	}
+	for pol, rules := range f.policies {
+		if err := f.nf.setPolicyRules(pol, rules); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// rebuild merges the port rules with the DNS ones,
+// the latter go first to take precedence.
+func (f *Filter) rebuild() {
+	policies := make(map[int][]rule, len(f.portRules)+len(f.enforceDNS))
+	for pol := range f.enforceDNS {
+		policies[pol] = dnsRules(f.dnsServers)
+	}
+	for pol, rules := range f.portRules {
+		policies[pol] = append(policies[pol], rules...)
+	}
+	f.policies = policies
+}
+
+// Apply programs the rules of the policy for the address,
+// the rules previously applied to the address are replaced.
+func (f *Filter) Apply(addr xnet.IP, pol ipam.Policy) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.remove(addr); err != nil {
+		return err
+	}
+	return f.add(addr, f.access(pol))
+}
+
+func (f *Filter) add(addr xnet.IP, access int) error {
+	rules := f.policies[access]
+	if len(rules) == 0 {
+		return nil
+	}
+
+	if err := f.nf.addAddr(access, addr); err != nil {
+		return err
+	}
+	f.applied[addr.ToUint32()] = appliedRules{addr: addr, access: access}
+	return nil
+}
+
+// SetDNSServers replaces the DNS servers peers of the enforcing
+// policies are allowed to query, the applied rules are updated.
+func (f *Filter) SetDNSServers(servers []string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.dnsServers = parseDNSServers(servers)
+	f.rebuild()
+
+	// addresses stay in their policies, only the rules change
+	for pol := range f.enforceDNS {
+		if err := f.nf.setPolicyRules(pol, f.policies[pol]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove drops the rules applied to the address, if any.
+func (f *Filter) Remove(addr xnet.IP) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.remove(addr)
+}
+
+func (f *Filter) remove(addr xnet.IP) error {
+	applied, ok := f.applied[addr.ToUint32()]
+	if !ok {
+		return nil
+	}
+
+	if err := f.nf.removeAddr(applied.access, addr); err != nil {
+		return err
+	}
+	delete(f.applied, addr.ToUint32())
+	return nil
+}
+
+func (f *Filter) access(pol ipam.Policy) int {
+	if pol.Access == ipam.AccessPolicyDefault {
+		return f.defaultPolicy
+	}
+	return pol.Access
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package firewall
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+var polAccept = nftables.ChainPolicyAccept
+
+var nfPolicyPortsTable = &nftables.Table{
+	Name:   "vh_policyports",
+	Family: nftables.TableFamilyINet,
+}
+
+var nfPolicyPortsChain = &nftables.Chain{
+	Name:     "vh_filter",
+	Table:    nfPolicyPortsTable,
+	Hooknum:  nftables.ChainHookForward,
+	Priority: nftables.ChainPriorityFilter,
+	Type:     nftables.ChainTypeFilter,
+	Policy:   &polAccept,
+}
+
+// ruleIDPrefix distinguishes our rule IDs from the ones of ipam,
+// which uses the bare peer address and removes the rule
+// with the matching ID from any chain.
+var ruleIDPrefix = []byte{0xc0, 0xde, 0x02}
+
+type netfilterWrapper struct {
+	c *nftables.Conn
+	// sets holds the peer addresses of each access policy
+	sets map[int]*nftables.Set
+}
+
+func newNetfilter() netFilter {
+	return &netfilterWrapper{c: &nftables.Conn{}, sets: map[int]*nftables.Set{}}
+}
+
+func (nft *netfilterWrapper) init() error {
+	nft.c.AddTable(nfPolicyPortsTable)
+	nft.c.FlushTable(nfPolicyPortsTable)
+	nft.c.AddChain(nfPolicyPortsChain)
+	if err := nft.c.Flush(); err != nil {
+		return xerror.EInternalError("nft: failed to init policy ports table", err)
+	}
+	nft.sets = map[int]*nftables.Set{}
+	return nil
+}
+
+func ruleID(access int) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, ruleIDPrefix...), uint32(access))
+}
+
+// setPolicyRules replaces the rules of the access policy,
+// the rules match the source address by the set of the policy,
+// so the peers are added and removed without touching the rules.
+func (nft *netfilterWrapper) setPolicyRules(access int, rules []rule) error {
+	zap.L().Debug("set policy port rules", zap.Int("access", access), zap.Int("rules", len(rules)))
+
+	id := ruleID(access)
+	set, ok := nft.sets[access]
+	if ok {
+		existing, err := nft.c.GetRules(nfPolicyPortsTable, nfPolicyPortsChain)
+		if err != nil {
+			return xerror.EInternalError("nft: failed to list policy port rules", err)
+		}
+		for _, rule := range existing {
+			if !bytes.Equal(rule.UserData, id) {
+				continue
+			}
+			rule.Table.Family = nfPolicyPortsTable.Family
+			if err := nft.c.DelRule(rule); err != nil {
+				return xerror.EInternalError("nft: failed to delete policy port rule", err,
+					zap.Uint64("handle", rule.Handle))
+			}
+		}
+	} else {
+		set = &nftables.Set{
+			Table:   nfPolicyPortsTable,
+			Name:    fmt.Sprintf("policy_%d", access),
+			KeyType: nftables.TypeIPAddr,
+		}
+		if err := nft.c.AddSet(set, nil); err != nil {
+			return xerror.EInternalError("nft: failed to create policy address set", err, zap.Int("access", access))
+		}
+	}
+
+	for _, r := range rules {
+		verdict := expr.VerdictDrop
+		if r.accept {
+			verdict = expr.VerdictAccept
+		}
+
+		for _, ports := range r.ports {
+			exprs := []expr.Any{
+				// meta nfproto ipv4
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+				// offset 12 len 4 -> ipv4 src addr
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       12,
+					Len:          4,
+				},
+				&expr.Lookup{
+					SourceRegister: 1,
+					SetName:        set.Name,
+					SetID:          set.ID,
+				},
+			}
+			if r.dst != nil {
+				exprs = append(exprs,
+					// offset 16 len 4 -> ipv4 dst addr
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseNetworkHeader,
+						Offset:       16,
+						Len:          4,
+					},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: r.dst.To4()},
+				)
+			}
+			exprs = append(exprs,
+				// meta l4proto
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{r.proto}},
+				// offset 2 len 2 -> tcp/udp dst port
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseTransportHeader,
+					Offset:       2,
+					Len:          2,
+				},
+			)
+			if ports.from == ports.to {
+				exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: portBytes(ports.from)})
+			} else {
+				exprs = append(exprs, &expr.Range{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					FromData: portBytes(ports.from),
+					ToData:   portBytes(ports.to),
+				})
+			}
+			exprs = append(exprs, &expr.Counter{}, &expr.Verdict{Kind: verdict})
+
+			nft.c.AddRule(&nftables.Rule{
+				Table:    nfPolicyPortsTable,
+				Chain:    nfPolicyPortsChain,
+				UserData: id,
+				Exprs:    exprs,
+			})
+		}
+	}
+
+	if err := nft.c.Flush(); err != nil {
+		return xerror.EInternalError("nft: failed to set policy port rules", err, zap.Int("access", access))
+	}
+	nft.sets[access] = set
+	return nil
+}
+
+func (nft *netfilterWrapper) addAddr(access int, addr xnet.IP) error {
+	zap.L().Debug("add policy address", zap.String("ip", addr.String()), zap.Int("access", access))
+
+	set, ok := nft.sets[access]
+	if !ok {
+		return xerror.EInternalError("nft: no address set for the policy", nil, zap.Int("access", access))
+	}
+	if err := nft.c.SetAddElements(set, []nftables.SetElement{{Key: addr.IP.To4()}}); err != nil {
+		return xerror.EInternalError("nft: failed to add policy address", err)
+	}
+	if err := nft.c.Flush(); err != nil {
+		return xerror.EInternalError("nft: failed to add policy address", err)
+	}
+	return nil
+}
+
+func (nft *netfilterWrapper) removeAddr(access int, addr xnet.IP) error {
+	zap.L().Debug("remove policy address", zap.String("ip", addr.String()), zap.Int("access", access))
+
+	set, ok := nft.sets[access]
+	if !ok {
+		return nil
+	}
+	if err := nft.c.SetDeleteElements(set, []nftables.SetElement{{Key: addr.IP.To4()}}); err != nil {
+		return xerror.EInternalError("nft: failed to delete policy address", err)
+	}
+	if err := nft.c.Flush(); err != nil {
+		return xerror.EInternalError("nft: failed to delete policy address", err)
+	}
+	return nil
+}
+
+func portBytes(port uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, port)
+	return b
+}
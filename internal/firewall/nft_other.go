@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package firewall
+
+import (
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"go.uber.org/zap"
+)
+
+type noopNetfilter struct{}
+
+func newNetfilter() netFilter {
+	return noopNetfilter{}
+}
+
+func (noopNetfilter) init() error {
+	return nil
+}
+
+func (noopNetfilter) setPolicyRules(access int, rules []rule) error {
+	zap.L().Debug("set policy port rules", zap.Int("access", access), zap.Int("rules", len(rules)))
+	return nil
+}
+
+func (noopNetfilter) addAddr(access int, addr xnet.IP) error {
+	zap.L().Debug("add policy address", zap.String("ip", addr.String()), zap.Int("access", access))
+	return nil
+}
+
+func (noopNetfilter) removeAddr(access int, addr xnet.IP) error {
+	zap.L().Debug("remove policy address", zap.String("ip", addr.String()), zap.Int("access", access))
+	return nil
+}
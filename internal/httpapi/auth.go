@@ -19,6 +19,9 @@ import (
 func (tun *TunnelAPI) AdminDoAuth(w http.ResponseWriter, r *http.Request) {
 	xhttp.JSONResponse(w, func() (interface{}, error) {
 		authOK := false
+		// the identity is kept in the token and recorded
+		// in peers changed by the admin
+		who := ""
 
 		// Check if basic authentication is successful
 		if _, password, ok := r.BasicAuth(); ok {
@@ -27,6 +30,9 @@ func (tun *TunnelAPI) AdminDoAuth(w http.ResponseWriter, r *http.Request) {
 				return nil, err
 			}
 			authOK = true
+			// only the password is verified, the given username
+			// can't be trusted as the identity
+			who = defaultAdminIdentity
 		}
 
 		if !authOK {
@@ -34,11 +40,12 @@ func (tun *TunnelAPI) AdminDoAuth(w http.ResponseWriter, r *http.Request) {
 			tokenStr, haveBearer := xhttp.ExtractTokenFromRequest(r)
 			if haveBearer {
 				zap.L().Debug("found bearer authentication")
-				err := tun.adminCheckBearerAuth(tokenStr)
+				subject, err := tun.adminCheckBearerAuth(tokenStr)
 				if err != nil {
 					return nil, err
 				}
 				authOK = true
+				who = subject
 			}
 		}
 
@@ -50,6 +57,7 @@ func (tun *TunnelAPI) AdminDoAuth(w http.ResponseWriter, r *http.Request) {
 		issued := time.Now().Unix()
 		expires := issued + int64(tun.runtime.Settings.AdminAPI.TokenLifetime)
 		claims := jwt.StandardClaims{
+			Subject:   who,
 			IssuedAt:  issued,
 			ExpiresAt: expires,
 		}
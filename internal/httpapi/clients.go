@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -29,6 +30,18 @@ var (
 	unsafeUUIDSpace, _ = uuid.FromBytes([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
 )
 
+// clientConfiguration is the tunnelAPI.ClientConfiguration
+// extended with the fields the API specification does not describe.
+type clientConfiguration struct {
+	InfoWireguard *connectInfoWireguard `json:"info_wireguard,omitempty"`
+}
+
+type connectInfoWireguard struct {
+	tunnelAPI.ConnectInfoWireguard
+	// Endpoints are the ordered host:port candidates, see wireguard.Config.Endpoints
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
 // ClientConnect implements endpoint for POST /api/client/connect
 func (tun *TunnelAPI) ClientConnect(w http.ResponseWriter, r *http.Request) {
 	xhttp.JSONResponse(w, func() (interface{}, error) {
@@ -80,22 +93,25 @@ func (tun *TunnelAPI) ClientConnect(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Set peer
-		if err := tun.manager.ConnectPeer(&peer); err != nil {
+		profile, err := tun.manager.ConnectPeer(r.Context(), &peer, tun.runtime.Settings.GetConnectExtension())
+		if err != nil {
 			return nil, err
 		}
 
 		// Prepare connection response
-		wgSettings := tun.runtime.Settings.Wireguard
-		response := tunnelAPI.ClientConfiguration{
-			InfoWireguard: &tunnelAPI.ConnectInfoWireguard{
-				AllowedIps:      []string{"0.0.0.0/0"},
-				TunnelIpv4:      peer.Ipv4.String(),
-				Dns:             wgSettings.DNS,
-				Keepalive:       wgSettings.Keepalive,
-				ServerIpv4:      wgSettings.ServerIPv4,
-				ServerPort:      wgSettings.ListenPort,
-				ServerPublicKey: tun.runtime.Settings.Wireguard.GetPrivateKey().Public().Unwrap().String(),
-				PingInterval:    tun.runtime.Settings.GetPublicAPIConfig().PingInterval,
+		response := clientConfiguration{
+			InfoWireguard: &connectInfoWireguard{
+				ConnectInfoWireguard: tunnelAPI.ConnectInfoWireguard{
+					AllowedIps:      profile.AllowedIPs,
+					TunnelIpv4:      profile.Ipv4,
+					Dns:             profile.DNS,
+					Keepalive:       profile.Keepalive,
+					ServerIpv4:      profile.ServerIPv4,
+					ServerPort:      profile.ServerPort,
+					ServerPublicKey: profile.ServerPublicKey,
+					PingInterval:    tun.runtime.Settings.GetPublicAPIConfig().PingInterval,
+				},
+				Endpoints: profile.Endpoints,
 			},
 		}
 
@@ -158,35 +174,50 @@ func (tun *TunnelAPI) ClientConnectUnsafe(w http.ResponseWriter, r *http.Request
 		}
 
 		// Set peer
-		if err := tun.manager.ConnectPeer(&peer); err != nil {
+		profile, err := tun.manager.ConnectPeer(r.Context(), &peer, tun.runtime.Settings.GetConnectExtension())
+		if err != nil {
 			return nil, err
 		}
 
 		// Prepare connection response
-		settings := tun.runtime.Settings.Wireguard
 		ipv6Stub := net.ParseIP("0::0")
 		rand.Read(ipv6Stub)
 		ipv6Stub[0] = 0xfc
 		ipv6Stub[1] = 0
 
+		var hints string
+		if h, ok := tun.runtime.Settings.GetClientHints(peer.GetNetworkPolicy()); ok {
+			hints = h.Lines()
+		}
+
+		// wg-quick takes the single endpoint,
+		// the candidates are listed for clients able to fail over
+		var endpoints string
+		if len(profile.Endpoints) > 0 {
+			endpoints = fmt.Sprintf("# Endpoints = %s\n", strings.Join(profile.Endpoints, ", "))
+		}
+
 		tmpl := `[Interface]
 Address = %s/32, %s/128
 PrivateKey = %s
-
+%s
 [Peer]
 PublicKey = %s
 Endpoint = %s:%d
-AllowedIPs = 0.0.0.0/0, ::/0
+%sAllowedIPs = %s, ::/0
 PersistentKeepalive = %d
 `
 		response := fmt.Sprintf(tmpl,
-			peer.Ipv4.String(),
+			profile.Ipv4,
 			ipv6Stub.String(),
 			privateKey.String(),
-			tun.runtime.Settings.Wireguard.GetPrivateKey().Public().Unwrap().String(),
-			settings.ServerIPv4,
-			settings.ListenPort,
-			settings.Keepalive,
+			hints,
+			profile.ServerPublicKey,
+			profile.ServerIPv4,
+			profile.ServerPort,
+			endpoints,
+			strings.Join(profile.AllowedIPs, ", "),
+			profile.Keepalive,
 		)
 
 		return []byte(response), nil
@@ -207,7 +238,7 @@ func (tun *TunnelAPI) ClientDisconnect(w http.ResponseWriter, r *http.Request) {
 			return nil, err
 		}
 
-		if err := tun.manager.UnsetPeerByIdentifiers(identifiers); err != nil {
+		if err := tun.manager.UnsetPeerByIdentifiers(r.Context(), identifiers); err != nil {
 			return nil, err
 		}
 
@@ -223,7 +254,7 @@ func (tun *TunnelAPI) ClientPing(w http.ResponseWriter, r *http.Request) {
 			return nil, err
 		}
 
-		if err := tun.manager.UpdatePeerExpiration(identifiers, tun.getExpiration(nil)); err != nil {
+		if err := tun.manager.UpdatePeerExpiration(r.Context(), identifiers, tun.getExpiration(nil)); err != nil {
 			return nil, err
 		}
 
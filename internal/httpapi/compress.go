@@ -0,0 +1,188 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// compressionMiddleware compresses the response with gzip or deflate
+// as negotiated by the Accept-Encoding header. It must wrap other
+// middlewares, so responses without the body, like 304 of the
+// conditional requests, are passed as is.
+func (tun *TunnelAPI) compressionMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		minSize, enabled := tun.runtime.Settings.AdminAPI.GetCompressionMinSize()
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if len(encoding) == 0 || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: int(minSize)}
+		defer func() {
+			if err := cw.close(); err != nil {
+				zap.L().Debug("failed to write the compressed response", zap.Error(err))
+			}
+		}()
+		next.ServeHTTP(cw, r)
+	}
+}
+
+// negotiateEncoding returns the supported encoding preferred
+// by the Accept-Encoding header value, empty if none.
+func negotiateEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q > 0
+	}
+
+	for _, encoding := range []string{encodingGzip, encodingDeflate} {
+		if ok, listed := accepted[encoding]; listed {
+			if ok {
+				return encoding
+			}
+			continue
+		}
+		if accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressWriter buffers the response until it reaches the min size,
+// then the rest is compressed on the fly. Smaller responses are sent as is.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+	enc     compressor
+}
+
+// compressor is implemented by both gzip and flate writers.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.started || cw.status != 0 {
+		return
+	}
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.started {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) < cw.minSize {
+		return len(p), nil
+	}
+	if err := cw.start(true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start sends the headers and the buffered body,
+// compressed if asked and applicable to the response.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	header := cw.Header()
+	if compress && bodyAllowed(cw.status) && len(header.Get("Content-Encoding")) == 0 {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == encodingGzip {
+			cw.enc = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			// never fails with the valid level
+			cw.enc, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
+}
+
+// Flush sends the data written so far, the streamed response
+// is compressed regardless of the buffered size.
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		if err := cw.start(true); err != nil {
+			zap.L().Debug("failed to write the compressed response", zap.Error(err))
+			return
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Flush(); err != nil {
+			zap.L().Debug("failed to flush the compressed response", zap.Error(err))
+			return
+		}
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close completes the response, must be called once the handler returns.
+func (cw *compressWriter) close() error {
+	if !cw.started {
+		return cw.start(false)
+	}
+	if cw.enc != nil {
+		return cw.enc.Close()
+	}
+	return nil
+}
+
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
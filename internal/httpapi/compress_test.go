@@ -0,0 +1,134 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/settings"
+)
+
+func TestCompressionMiddleware(t *testing.T) {
+	tun := &TunnelAPI{
+		runtime: &runtime.TunnelRuntime{
+			Settings: &settings.Config{AdminAPI: &settings.AdminAPIConfig{}},
+		},
+	}
+
+	large := strings.Repeat(`{"id":1,"label":"peer"},`, 100)
+	flushed := make(chan int, 1)
+	var current *httptest.ResponseRecorder
+	handler := tun.compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			// written in chunks to cross the threshold in the middle
+			_, _ = w.Write([]byte(large[:100]))
+			_, _ = w.Write([]byte(large[100:]))
+		case "/small":
+			_, _ = w.Write([]byte(`{"id":1}`))
+		case "/not-modified":
+			w.WriteHeader(http.StatusNotModified)
+		case "/stream":
+			_, _ = w.Write([]byte(`{"id":1}`))
+			w.(http.Flusher).Flush()
+			flushed <- current.Body.Len()
+			_, _ = w.Write([]byte(`{"id":2}`))
+		}
+	})
+
+	serve := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if len(acceptEncoding) > 0 {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		current = rec
+		handler(rec, req)
+		return rec
+	}
+
+	rec := serve("/large", "gzip, deflate")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	rec = serve("/large", "gzip;q=0, deflate")
+	assert.Equal(t, "deflate", rec.Header().Get("Content-Encoding"))
+	body, err = io.ReadAll(flate.NewReader(rec.Body))
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	// below the threshold
+	rec = serve("/small", "gzip")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, `{"id":1}`, rec.Body.String())
+
+	// not supported by the client
+	rec = serve("/large", "")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, large, rec.Body.String())
+	rec = serve("/large", "br")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+
+	// the conditional request response has no body to compress
+	rec = serve("/not-modified", "gzip")
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Zero(t, rec.Body.Len())
+
+	// the flushed data is sent compressed before the handler returns
+	rec = serve("/stream", "gzip")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.True(t, rec.Flushed)
+	assert.NotZero(t, <-flushed)
+	gz, err = gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err = io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, `{"id":1}{"id":2}`, string(body))
+
+	tun.runtime.Settings.AdminAPI.Compression = &settings.AdminCompressionConfig{Disabled: true}
+	rec = serve("/large", "gzip")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Vary"))
+	assert.Equal(t, large, rec.Body.String())
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                     "",
+		"gzip":                 "gzip",
+		"deflate, gzip":        "gzip",
+		"deflate":              "deflate",
+		"GZIP;q=0.5":           "gzip",
+		"gzip;q=0":             "",
+		"gzip;q=0, *":          "deflate",
+		"*":                    "gzip",
+		"identity, br":         "",
+		"br, deflate;q=0.1":    "deflate",
+		"*;q=0, deflate;q=1.0": "deflate",
+	}
+	for header, expected := range tests {
+		assert.Equal(t, expected, negotiateEncoding(header), header)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/manager"
+	"github.com/vpnhouse/common-lib-go/xhttp"
+)
+
+type wireguardDiagnostics struct {
+	Interface    string `json:"interface"`
+	ListenPort   int    `json:"listen_port"`
+	FirewallMark int    `json:"fwmark"`
+}
+
+type diagnosticsResponse struct {
+	Wireguard wireguardDiagnostics `json:"wireguard"`
+}
+
+// AdminGetDiagnostics implements GET method on /api/tunnel/admin/diagnostics endpoint
+func (tun *TunnelAPI) AdminGetDiagnostics(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		fwmark, err := tun.manager.FirewallMark()
+		if err != nil {
+			return nil, err
+		}
+
+		wgSettings := tun.runtime.Settings.Wireguard
+		return diagnosticsResponse{
+			Wireguard: wireguardDiagnostics{
+				Interface:    wgSettings.Interface,
+				ListenPort:   wgSettings.ListenPort,
+				FirewallMark: fwmark,
+			},
+		}, nil
+	})
+}
+
+// AdminGetMetrics implements GET method on /api/tunnel/admin/metrics endpoint
+func (tun *TunnelAPI) AdminGetMetrics(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		return tun.manager.MetricsSnapshot(), nil
+	})
+}
+
+type processDiagnostics struct {
+	Goroutines int    `json:"goroutines"`
+	HeapBytes  uint64 `json:"heap_bytes"`
+}
+
+type managerDiagnosticsResponse struct {
+	*manager.ManagerDiagnostics
+	Process processDiagnostics `json:"process"`
+}
+
+// AdminGetManagerDiagnostics implements GET method on /api/tunnel/admin/debug/manager endpoint
+func (tun *TunnelAPI) AdminGetManagerDiagnostics(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		return managerDiagnosticsResponse{
+			ManagerDiagnostics: tun.manager.Diagnostics(),
+			Process: processDiagnostics{
+				Goroutines: runtime.NumGoroutine(),
+				HeapBytes:  mem.HeapAlloc,
+			},
+		}, nil
+	})
+}
+
+// statsResponse is the manager statistics collected by the refresh.
+type statsResponse struct {
+	PeersTotal             int       `json:"peers_total"`
+	PeersWithTraffic       int       `json:"peers_with_traffic"`
+	PeersActiveLastHour    int       `json:"peers_active_last_hour"`
+	PeersActiveLastDay     int       `json:"peers_active_last_day"`
+	Upstream               int64     `json:"upstream"`
+	UpstreamSpeed          int64     `json:"upstream_speed"`
+	Downstream             int64     `json:"downstream"`
+	DownstreamSpeed        int64     `json:"downstream_speed"`
+	UnattributedUpstream   int64     `json:"unattributed_upstream"`
+	UnattributedDownstream int64     `json:"unattributed_downstream"`
+	Collected              time.Time `json:"collected"`
+}
+
+// AdminRefreshStats implements POST method on /api/tunnel/admin/stats/refresh endpoint,
+// the stats are synced immediately instead of the next background tick.
+func (tun *TunnelAPI) AdminRefreshStats(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		if err := tun.manager.RefreshStats(); err != nil {
+			return nil, err
+		}
+
+		stats := tun.manager.GetCachedStatistics()
+		return statsResponse{
+			PeersTotal:             stats.PeersTotal,
+			PeersWithTraffic:       stats.PeersWithTraffic,
+			PeersActiveLastHour:    stats.PeersActiveLastHour,
+			PeersActiveLastDay:     stats.PeersActiveLastDay,
+			Upstream:               stats.Upstream,
+			UpstreamSpeed:          stats.UpstreamSpeed,
+			Downstream:             stats.Downstream,
+			DownstreamSpeed:        stats.DownstreamSpeed,
+			UnattributedUpstream:   stats.UnattributedUpstream,
+			UnattributedDownstream: stats.UnattributedDownstream,
+			Collected:              time.Unix(stats.Collected, 0),
+		}, nil
+	})
+}
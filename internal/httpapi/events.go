@@ -0,0 +1,114 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xhttp"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+const (
+	defaultEventsPageSize = 100
+	maxEventsPageSize     = 1000
+)
+
+type eventRecord struct {
+	types.EventRecord
+	TypeName string `json:"type_name"`
+}
+
+type eventsResponse struct {
+	Events []eventRecord `json:"events"`
+	// NextCursor is passed as the cursor to get the next page,
+	// omitted on the last page
+	NextCursor int64 `json:"next_cursor,omitempty"`
+}
+
+// AdminSearchEvents implements GET method on /api/tunnel/admin/events endpoint.
+// Events are filtered by the type, user_id, installation_id, session_id,
+// since and until (RFC3339) query parameters and returned newest first.
+func (tun *TunnelAPI) AdminSearchEvents(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		query := r.URL.Query()
+		filter, err := eventFilterFromQuery(query)
+		if err != nil {
+			return nil, err
+		}
+
+		var cursor int64
+		if v := query.Get("cursor"); len(v) > 0 {
+			cursor, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || cursor < 0 {
+				return nil, xerror.EInvalidArgument("invalid cursor", err)
+			}
+		}
+
+		limit := defaultEventsPageSize
+		if v := query.Get("limit"); len(v) > 0 {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit <= 0 || limit > maxEventsPageSize {
+				return nil, xerror.EInvalidArgument("limit must be in range 1.."+strconv.Itoa(maxEventsPageSize), err)
+			}
+		}
+
+		records, next, err := tun.storage.SearchEvents(filter, cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := eventsResponse{
+			Events:     make([]eventRecord, len(records)),
+			NextCursor: next,
+		}
+		for i, record := range records {
+			resp.Events[i] = eventRecord{
+				EventRecord: record,
+				TypeName:    proto.EventType(record.Type).String(),
+			}
+		}
+		return resp, nil
+	})
+}
+
+func eventFilterFromQuery(query url.Values) (types.EventFilter, error) {
+	filter := types.EventFilter{
+		UserID:         query.Get("user_id"),
+		InstallationID: query.Get("installation_id"),
+		SessionID:      query.Get("session_id"),
+	}
+
+	// the type is given either by its name or by its number
+	for _, v := range query["type"] {
+		if t, ok := proto.EventType_value[v]; ok {
+			filter.Types = append(filter.Types, t)
+			continue
+		}
+		t, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return filter, xerror.EInvalidArgument("unknown event type "+v, err)
+		}
+		filter.Types = append(filter.Types, int32(t))
+	}
+
+	var err error
+	if v := query.Get("since"); len(v) > 0 {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, xerror.EInvalidArgument("invalid since time", err)
+		}
+	}
+	if v := query.Get("until"); len(v) > 0 {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, xerror.EInvalidArgument("invalid until time", err)
+		}
+	}
+	return filter, nil
+}
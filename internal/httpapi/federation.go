@@ -6,47 +6,182 @@ package httpapi
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/vpnhouse/api/go/server/federation"
 	mgmtAPI "github.com/vpnhouse/api/go/server/tunnel_mgmt"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/manager"
 	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/proto"
 	"github.com/vpnhouse/common-lib-go/xerror"
 	"github.com/vpnhouse/common-lib-go/xhttp"
 	"go.uber.org/zap"
+	protobuf "google.golang.org/protobuf/proto"
 )
 
+const contentTypeProtobuf = "application/x-protobuf"
+
+// adminKeySource is the source of authorizer keys added via the admin API.
+const adminKeySource = "admin"
+
+// FederationPing reports the node statistics to the federation controller,
+// the reply is encoded as protobuf if the client asks for it, JSON otherwise.
 func (tun *TunnelAPI) FederationPing(w http.ResponseWriter, r *http.Request) {
 	zap.L().Debug("ping")
-	xhttp.JSONResponse(w, func() (interface{}, error) {
-		stats := tun.manager.GetCachedStatistics()
-		reply := mgmtAPI.PingResponse{
-			PeersTotal:       stats.PeersTotal,
-			PeersWithTraffic: stats.PeersWithTraffic,
-		}
-		if stats.LinkStat != nil {
-			reply.IfRxBytes = int(stats.LinkStat.RxBytes)
-			reply.IfRxPackets = int(stats.LinkStat.RxPackets)
-			reply.IfRxErrors = int(stats.LinkStat.RxErrors)
+	tun.federation.ping(r.Context().Value(contextKeyAuthkeyOwner).(string), time.Now())
+	writePingResponse(w, r, pingResponse(tun.manager.GetCachedStatistics()))
+}
+
+// pingResponse is the single source of the ping reply for both encodings.
+func pingResponse(stats *manager.CachedStatistics) mgmtAPI.PingResponse {
+	reply := mgmtAPI.PingResponse{
+		PeersTotal:       stats.PeersTotal,
+		PeersWithTraffic: stats.PeersWithTraffic,
+	}
+	if stats.LinkStat != nil {
+		reply.IfRxBytes = int(stats.LinkStat.RxBytes)
+		reply.IfRxPackets = int(stats.LinkStat.RxPackets)
+		reply.IfRxErrors = int(stats.LinkStat.RxErrors)
+
+		reply.IfTxBytes = int(stats.LinkStat.TxBytes)
+		reply.IfTxPackets = int(stats.LinkStat.TxPackets)
+		reply.IfTxErrors = int(stats.LinkStat.TxErrors)
+	}
+	return reply
+}
+
+func pingResponseProto(reply mgmtAPI.PingResponse) *proto.PingResponse {
+	return &proto.PingResponse{
+		PeersTotal:       int64(reply.PeersTotal),
+		PeersWithTraffic: int64(reply.PeersWithTraffic),
+		IfRxBytes:        int64(reply.IfRxBytes),
+		IfRxPackets:      int64(reply.IfRxPackets),
+		IfRxErrors:       int64(reply.IfRxErrors),
+		IfTxBytes:        int64(reply.IfTxBytes),
+		IfTxPackets:      int64(reply.IfTxPackets),
+		IfTxErrors:       int64(reply.IfTxErrors),
+	}
+}
+
+func writePingResponse(w http.ResponseWriter, r *http.Request, reply mgmtAPI.PingResponse) {
+	// the reply encoding depends on the Accept header, keep caches aware of it
+	w.Header().Add("Vary", "Accept")
+	if !acceptsProtobuf(r) {
+		xhttp.JSONResponse(w, func() (interface{}, error) {
+			return reply, nil
+		})
+		return
+	}
 
-			reply.IfTxBytes = int(stats.LinkStat.TxBytes)
-			reply.IfTxPackets = int(stats.LinkStat.TxPackets)
-			reply.IfTxErrors = int(stats.LinkStat.TxErrors)
+	bs, err := protobuf.Marshal(pingResponseProto(reply))
+	if err != nil {
+		xhttp.WriteJsonError(w, xerror.EInternalError("failed to marshal ping response", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeProtobuf)
+	if _, err := w.Write(bs); err != nil {
+		zap.L().Error("can't write response", zap.Error(err))
+	}
+}
+
+// acceptsProtobuf checks whether the client prefers the protobuf-encoded reply,
+// the Content-Type is used as a hint if the Accept header is not given.
+// Protobuf wins ties with JSON, media ranges with q=0 are refused.
+func acceptsProtobuf(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" || accept == "*/*" {
+		accept = r.Header.Get("Content-Type")
+	}
+
+	qProtobuf, qJSON := 0.0, 0.0
+	for _, v := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
 		}
-		return reply, nil
-	})
+		q := 1.0
+		if qv, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qv, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case contentTypeProtobuf:
+			qProtobuf = q
+		case "application/json":
+			qJSON = q
+		}
+	}
+	return qProtobuf > 0 && qProtobuf >= qJSON
+}
+
+type keyError struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
 }
 
+// dryRunKeysResponse describes the outcome of the key set push
+// without storing it.
+type dryRunKeysResponse struct {
+	// Stored is the number of keys that would be stored,
+	// keys sharing the same ID are stored once
+	Stored int `json:"stored"`
+	// Duplicates lists IDs given more than once, the last key wins
+	Duplicates []string   `json:"duplicates,omitempty"`
+	Errors     []keyError `json:"errors,omitempty"`
+}
+
+// FederationSetAuthorizerKeys stores the key set, with the dry_run=true
+// query parameter the set is only checked and nothing is stored.
+// With the version=N query parameter the set is stored only if N is greater
+// than the last version stored for the source, stale pushes get 409 Conflict.
 func (tun *TunnelAPI) FederationSetAuthorizerKeys(w http.ResponseWriter, r *http.Request) {
 	zap.L().Debug("set authorizer keys")
 	xhttp.JSONResponse(w, func() (interface{}, error) {
+		dryRun := false
+		if v := r.URL.Query().Get("dry_run"); len(v) > 0 {
+			var err error
+			if dryRun, err = strconv.ParseBool(v); err != nil {
+				return nil, xerror.EInvalidArgument("invalid dry_run value", err)
+			}
+		}
+
+		// the optional version of the key set, must grow with every push of the source
+		var version int64
+		if v := r.URL.Query().Get("version"); len(v) > 0 {
+			var err error
+			if version, err = strconv.ParseInt(v, 10, 64); err != nil || version <= 0 {
+				return nil, xerror.EInvalidArgument("invalid version value", err)
+			}
+		}
+
 		var records []federation.PublicKeyRecord
-		if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+		body := http.MaxBytesReader(w, r.Body, tun.runtime.Settings.GetFederationKeysMaxBodySize())
+		if err := json.NewDecoder(body).Decode(&records); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, xerror.EEntityTooLarge(fmt.Sprintf("key records exceed %d bytes", tooLarge.Limit), err)
+			}
 			return nil, xerror.EInvalidArgument("failed to unmarshal key records", err)
 		}
+		if maxKeys := tun.runtime.Settings.GetFederationKeysMaxKeys(); len(records) > maxKeys {
+			return nil, xerror.EEntityTooLarge(fmt.Sprintf("too many key records, at most %d allowed", maxKeys), nil,
+				zap.Int("count", len(records)))
+		}
 
 		source := r.Context().Value(contextKeyAuthkeyOwner).(string)
 		authorizerKeys := make([]types.AuthorizerKey, len(records))
+		reply := dryRunKeysResponse{}
+		seen := make(map[string]struct{}, len(records))
 		for i, rec := range records {
 			ak := types.AuthorizerKey{
 				ID:     rec.Id,
@@ -54,17 +189,183 @@ func (tun *TunnelAPI) FederationSetAuthorizerKeys(w http.ResponseWriter, r *http
 				Key:    rec.Key.Key,
 			}
 			if err := ak.Validate(); err != nil {
-				return nil, xerror.EInvalidArgument("failed to validate key record",
-					err, zap.String("id", rec.Id))
+				if !dryRun {
+					tun.federation.validationFailures(source, 1)
+					return nil, xerror.EInvalidArgument("failed to validate key record",
+						err, zap.String("id", rec.Id))
+				}
+				reply.Errors = append(reply.Errors, keyError{ID: rec.Id, Error: err.Error()})
 			}
 
+			if _, ok := seen[rec.Id]; ok {
+				reply.Duplicates = append(reply.Duplicates, rec.Id)
+			}
+			seen[rec.Id] = struct{}{}
 			authorizerKeys[i] = ak
 		}
 
-		if err := tun.storage.UpdateAuthorizerKeys(authorizerKeys); err != nil {
+		if dryRun {
+			if len(records) == 0 {
+				reply.Errors = append(reply.Errors, keyError{Error: "empty key list given"})
+			}
+			if len(reply.Errors) == 0 {
+				reply.Stored = len(seen)
+			}
+			return reply, nil
+		}
+
+		var err error
+		if version > 0 {
+			err = tun.storage.UpdateAuthorizerKeysVersion(source, version, authorizerKeys)
+		} else {
+			err = tun.storage.UpdateAuthorizerKeys(authorizerKeys)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		tun.federation.keyUpdate(source, now)
+		tun.pushAuthKeysEvent(&proto.AuthKeysInfo{
+			Source:      source,
+			Count:       uint64(len(seen)),
+			Fingerprint: types.AuthorizerKeysFingerprint(authorizerKeys),
+			Version:     version,
+			ServerTime:  proto.TimestampFromTime(now),
+		})
+		return nil, nil
+	})
+}
+
+// FederationAddAuthorizerKey implements handler for POST /api/tunnel/federation/authorizer-keys/{id},
+// the single key is added without touching others. The stored key
+// with the same ID is never replaced, adding the other one gets 409 Conflict.
+func (tun *TunnelAPI) FederationAddAuthorizerKey(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		source := r.Context().Value(contextKeyAuthkeyOwner).(string)
+		key, err := tun.decodeAuthorizerKey(w, r, source)
+		if err != nil {
 			return nil, err
 		}
+		if err := key.Validate(); err != nil {
+			tun.federation.validationFailures(source, 1)
+			return nil, xerror.EInvalidArgument("failed to validate key record", err, zap.String("id", key.ID))
+		}
+		if err := tun.addAuthorizerKey(key); err != nil {
+			return nil, err
+		}
+		tun.federation.keyUpdate(source, time.Now())
+		return nil, nil
+	})
+}
 
+// FederationRevokeAuthorizerKey implements handler for DELETE /api/tunnel/federation/authorizer-keys/{id},
+// the single key is revoked without touching others. The source may revoke
+// its own keys only, the missing key or the key of another source gets 404.
+func (tun *TunnelAPI) FederationRevokeAuthorizerKey(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		source := r.Context().Value(contextKeyAuthkeyOwner).(string)
+		if err := tun.revokeAuthorizerKey(chi.URLParam(r, "id"), source); err != nil {
+			return nil, err
+		}
+		tun.federation.keyUpdate(source, time.Now())
 		return nil, nil
 	})
 }
+
+// AdminAddAuthorizerKey implements handler for POST /api/tunnel/admin/authorizer-keys/{id},
+// the admin counterpart of FederationAddAuthorizerKey,
+// the key is stored on behalf of the admin source.
+func (tun *TunnelAPI) AdminAddAuthorizerKey(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		key, err := tun.decodeAuthorizerKey(w, r, adminKeySource)
+		if err != nil {
+			return nil, err
+		}
+		if err := key.Validate(); err != nil {
+			return nil, xerror.EInvalidArgument("failed to validate key record", err, zap.String("id", key.ID))
+		}
+		return nil, tun.addAuthorizerKey(key)
+	})
+}
+
+// AdminRevokeAuthorizerKey implements handler for DELETE /api/tunnel/admin/authorizer-keys/{id},
+// the admin may revoke the key of any source, the missing key gets 404.
+func (tun *TunnelAPI) AdminRevokeAuthorizerKey(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		return nil, tun.revokeAuthorizerKey(chi.URLParam(r, "id"), "")
+	})
+}
+
+// decodeAuthorizerKey reads the single key of the source
+// from the request body, the ID is taken from the path.
+func (tun *TunnelAPI) decodeAuthorizerKey(w http.ResponseWriter, r *http.Request, source string) (types.AuthorizerKey, error) {
+	var record federation.PublicKey
+	body := http.MaxBytesReader(w, r.Body, tun.runtime.Settings.GetFederationKeysMaxBodySize())
+	if err := json.NewDecoder(body).Decode(&record); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return types.AuthorizerKey{}, xerror.EEntityTooLarge(fmt.Sprintf("key record exceeds %d bytes", tooLarge.Limit), err)
+		}
+		return types.AuthorizerKey{}, xerror.EInvalidArgument("failed to unmarshal key record", err)
+	}
+
+	return types.AuthorizerKey{
+		ID:     chi.URLParam(r, "id"),
+		Source: source,
+		Key:    record.Key,
+	}, nil
+}
+
+// addAuthorizerKey stores the validated key and reports it.
+func (tun *TunnelAPI) addAuthorizerKey(key types.AuthorizerKey) error {
+	if err := tun.storage.AddAuthorizerKey(key); err != nil {
+		return err
+	}
+
+	tun.pushAuthKeysEvent(&proto.AuthKeysInfo{
+		Source:      key.Source,
+		Count:       1,
+		Fingerprint: types.AuthorizerKeysFingerprint([]types.AuthorizerKey{key}),
+		Added:       key.ID,
+		ServerTime:  proto.TimestampFromTime(time.Now()),
+	})
+	return nil
+}
+
+// revokeAuthorizerKey deletes the key and reports it,
+// the key of another source is not found unless the source is empty.
+func (tun *TunnelAPI) revokeAuthorizerKey(id string, source string) error {
+	key, err := tun.storage.GetAuthorizerKeyByID(id)
+	if err != nil {
+		return err
+	}
+	if len(source) > 0 && key.Source != source {
+		return xerror.EEntryNotFound("no such key", nil, zap.String("id", id), zap.String("source", source))
+	}
+	if err := tun.storage.RevokeAuthorizerKey(id); err != nil {
+		return err
+	}
+
+	tun.pushAuthKeysEvent(&proto.AuthKeysInfo{
+		Source:      key.Source,
+		Count:       1,
+		Fingerprint: types.AuthorizerKeysFingerprint([]types.AuthorizerKey{key}),
+		Revoked:     id,
+		ServerTime:  proto.TimestampFromTime(time.Now()),
+	})
+	return nil
+}
+
+// pushAuthKeysEvent reports the stored authorizer keys to the event log,
+// so a wave of auth failures can be correlated with the key push.
+func (tun *TunnelAPI) pushAuthKeysEvent(event *proto.AuthKeysInfo) {
+	if err := tun.eventLog.Push(eventlog.AuthKeysUpdated, event); err != nil {
+		// the keys are stored already, the event is best effort
+		zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_AuthKeysUpdated)))
+	}
+
+	zap.L().Info("authorizer keys updated", zap.String("source", event.Source), zap.Uint64("count", event.Count),
+		zap.String("fingerprint", event.Fingerprint), zap.Int64("version", event.Version),
+		zap.String("added", event.Added), zap.String("revoked", event.Revoked))
+}
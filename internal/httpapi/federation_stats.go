@@ -0,0 +1,134 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vpnhouse/common-lib-go/xhttp"
+)
+
+var federationPingsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "federation",
+	Name:      "pings_total",
+	Help:      "number of pings by the federation source",
+}, []string{"source"})
+
+var federationLastPingGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tunnel",
+	Subsystem: "federation",
+	Name:      "last_ping_timestamp_seconds",
+	Help:      "unix time of the last ping by the federation source",
+}, []string{"source"})
+
+var federationKeyUpdatesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "federation",
+	Name:      "key_updates_total",
+	Help:      "number of authorizer key sets stored from the federation source",
+}, []string{"source"})
+
+var federationInvalidKeysCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "federation",
+	Name:      "key_validation_failures_total",
+	Help:      "number of invalid authorizer key records pushed by the federation source",
+}, []string{"source"})
+
+// RegisterMetrics registers metrics of the HTTP API,
+// must be called once on start.
+func RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(federationPingsCounter, federationLastPingGauge, federationKeyUpdatesCounter, federationInvalidKeysCounter)
+}
+
+// federationSourceStats describes the activity of the single federation source.
+type federationSourceStats struct {
+	Source             string     `json:"source"`
+	Pings              int64      `json:"pings"`
+	LastPingAt         *time.Time `json:"last_ping_at,omitempty"`
+	KeyUpdates         int64      `json:"key_updates"`
+	LastKeyUpdateAt    *time.Time `json:"last_key_update_at,omitempty"`
+	ValidationFailures int64      `json:"validation_failures"`
+}
+
+// federationStats holds the per-source stats of the TunnelAPI instance,
+// unlike the prometheus metrics they are reset on soft restarts.
+// The zero value is ready to use.
+type federationStats struct {
+	mu      sync.Mutex
+	sources map[string]*federationSourceStats
+}
+
+func (s *federationStats) source(name string) *federationSourceStats {
+	if s.sources == nil {
+		s.sources = map[string]*federationSourceStats{}
+	}
+	v, ok := s.sources[name]
+	if !ok {
+		v = &federationSourceStats{Source: name}
+		s.sources[name] = v
+	}
+	return v
+}
+
+func (s *federationStats) ping(name string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := s.source(name)
+	v.Pings++
+	v.LastPingAt = &now
+	federationPingsCounter.WithLabelValues(name).Inc()
+	federationLastPingGauge.WithLabelValues(name).Set(float64(now.Unix()))
+}
+
+func (s *federationStats) keyUpdate(name string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := s.source(name)
+	v.KeyUpdates++
+	v.LastKeyUpdateAt = &now
+	federationKeyUpdatesCounter.WithLabelValues(name).Inc()
+}
+
+func (s *federationStats) validationFailures(name string, n int) {
+	if n == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.source(name).ValidationFailures += int64(n)
+	federationInvalidKeysCounter.WithLabelValues(name).Add(float64(n))
+}
+
+// list returns the copy of the stats ordered by the source name.
+func (s *federationStats) list() []federationSourceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]federationSourceStats, 0, len(s.sources))
+	for _, v := range s.sources {
+		list = append(list, *v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Source < list[j].Source
+	})
+	return list
+}
+
+// AdminGetFederationStats implements GET method on /api/tunnel/admin/federation/stats endpoint
+func (tun *TunnelAPI) AdminGetFederationStats(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		return tun.federation.list(), nil
+	})
+}
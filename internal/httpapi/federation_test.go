@@ -0,0 +1,465 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vpnhouse/api/go/server/federation"
+	mgmtAPI "github.com/vpnhouse/api/go/server/tunnel_mgmt"
+	"github.com/vpnhouse/common-lib-go/human"
+	"github.com/vpnhouse/common-lib-go/xcrypto"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/manager"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+func testPingResponse() mgmtAPI.PingResponse {
+	return pingResponse(&manager.CachedStatistics{
+		PeersTotal:       10,
+		PeersWithTraffic: 3,
+		LinkStat: &netlink.LinkStatistics{
+			RxBytes:   1000,
+			RxPackets: 100,
+			RxErrors:  1,
+			TxBytes:   2000,
+			TxPackets: 200,
+			TxErrors:  2,
+		},
+	})
+}
+
+func TestPingResponseJSON(t *testing.T) {
+	accepts := []string{
+		"",
+		"*/*",
+		"application/json",
+		"application/x-protobuf;q=0",
+		"application/x-protobuf;q=0.5, application/json",
+	}
+	for _, accept := range accepts {
+		r := httptest.NewRequest(http.MethodGet, "/api/federation/ping", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+
+		writePingResponse(w, r, testPingResponse())
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"), accept)
+		assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+		var reply mgmtAPI.PingResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reply))
+		assert.Equal(t, testPingResponse(), reply)
+	}
+}
+
+func TestPingResponseProtobuf(t *testing.T) {
+	headers := []http.Header{
+		{"Accept": []string{"application/x-protobuf"}},
+		{"Accept": []string{"application/json;q=0.5, application/x-protobuf"}},
+		{"Accept": []string{"application/json, application/x-protobuf"}},
+		{"Content-Type": []string{"application/x-protobuf"}},
+	}
+
+	for _, h := range headers {
+		r := httptest.NewRequest(http.MethodGet, "/api/federation/ping", nil)
+		r.Header = h
+		w := httptest.NewRecorder()
+
+		writePingResponse(w, r, testPingResponse())
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, contentTypeProtobuf, w.Header().Get("Content-Type"), h)
+		assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+		reply := &proto.PingResponse{}
+		require.NoError(t, protobuf.Unmarshal(w.Body.Bytes(), reply))
+		assert.EqualValues(t, 10, reply.PeersTotal)
+		assert.EqualValues(t, 3, reply.PeersWithTraffic)
+		assert.EqualValues(t, 1000, reply.IfRxBytes)
+		assert.EqualValues(t, 100, reply.IfRxPackets)
+		assert.EqualValues(t, 1, reply.IfRxErrors)
+		assert.EqualValues(t, 2000, reply.IfTxBytes)
+		assert.EqualValues(t, 200, reply.IfTxPackets)
+		assert.EqualValues(t, 2, reply.IfTxErrors)
+	}
+}
+
+func TestSetAuthorizerKeysDryRun(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Shutdown()
+	tun := &TunnelAPI{storage: db, runtime: &runtime.TunnelRuntime{}, eventLog: eventlog.NewDummy()}
+
+	private, err := xcrypto.GenerateKey()
+	require.NoError(t, err)
+	key := federation.PublicKey{Key: xcrypto.KeyToBase64(&private.PublicKey)}
+	id := uuid.New().String()
+
+	push := func(records []federation.PublicKeyRecord) dryRunKeysResponse {
+		body, err := json.Marshal(records)
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPut, "/api/federation/authorizer-keys?dry_run=true", bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyAuthkeyOwner, "controller"))
+		w := httptest.NewRecorder()
+
+		tun.FederationSetAuthorizerKeys(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var reply dryRunKeysResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reply))
+		return reply
+	}
+
+	reply := push([]federation.PublicKeyRecord{
+		{Id: id, Key: key},
+		{Id: uuid.New().String(), Key: key},
+		{Id: id, Key: key},
+	})
+	assert.Equal(t, 2, reply.Stored)
+	assert.Equal(t, []string{id}, reply.Duplicates)
+	assert.Empty(t, reply.Errors)
+
+	// all invalid records are reported, nothing would be stored
+	reply = push([]federation.PublicKeyRecord{
+		{Id: "not-a-uuid", Key: key},
+		{Id: id, Key: federation.PublicKey{Key: "garbage"}},
+	})
+	assert.Zero(t, reply.Stored)
+	require.Len(t, reply.Errors, 2)
+	assert.Equal(t, "not-a-uuid", reply.Errors[0].ID)
+	assert.Equal(t, id, reply.Errors[1].ID)
+
+	// nothing is stored by the dry run
+	keys, err := db.ListAuthorizerKeys()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestSetAuthorizerKeysVersion(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Shutdown()
+	tun := &TunnelAPI{storage: db, runtime: &runtime.TunnelRuntime{}, eventLog: eventlog.NewDummy()}
+	id := uuid.New().String()
+
+	push := func(source, version string) int {
+		private, err := xcrypto.GenerateKey()
+		require.NoError(t, err)
+		body, err := json.Marshal([]federation.PublicKeyRecord{
+			{Id: id, Key: federation.PublicKey{Key: xcrypto.KeyToBase64(&private.PublicKey)}},
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPut, "/api/federation/authorizer-keys?version="+version, bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyAuthkeyOwner, source))
+		w := httptest.NewRecorder()
+
+		tun.FederationSetAuthorizerKeys(w, r)
+		return w.Code
+	}
+	stored := func() string {
+		key, err := db.GetAuthorizerKeyByID(id)
+		require.NoError(t, err)
+		return key.Key
+	}
+	// in order
+	require.Equal(t, http.StatusOK, push("controller", "1"))
+	require.Equal(t, http.StatusOK, push("controller", "2"))
+	latest := stored()
+
+	// out of order and equal versions never revert the newer keys
+	assert.Equal(t, http.StatusConflict, push("controller", "1"))
+	assert.Equal(t, http.StatusConflict, push("controller", "2"))
+	assert.Equal(t, latest, stored())
+
+	// versions are tracked per source
+	assert.Equal(t, http.StatusOK, push("backup", "1"))
+	assert.Equal(t, http.StatusOK, push("controller", "3"))
+
+	assert.Equal(t, http.StatusBadRequest, push("controller", "0"))
+	assert.Equal(t, http.StatusBadRequest, push("controller", "latest"))
+}
+
+func TestSetAuthorizerKeysLimits(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Shutdown()
+	tun := &TunnelAPI{storage: db, eventLog: eventlog.NewDummy(), runtime: &runtime.TunnelRuntime{
+		Settings: &settings.Config{FederationKeys: &settings.FederationKeysConfig{
+			MaxBodySize: human.MustParseSize("4Kb"),
+			MaxKeys:     2,
+		}},
+	}}
+
+	private, err := xcrypto.GenerateKey()
+	require.NoError(t, err)
+	key := federation.PublicKey{Key: xcrypto.KeyToBase64(&private.PublicKey)}
+
+	push := func(body []byte) int {
+		r := httptest.NewRequest(http.MethodPut, "/api/federation/authorizer-keys", bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyAuthkeyOwner, "controller"))
+		w := httptest.NewRecorder()
+
+		tun.FederationSetAuthorizerKeys(w, r)
+		return w.Code
+	}
+	records := func(n int) []byte {
+		records := make([]federation.PublicKeyRecord, n)
+		for i := range records {
+			records[i] = federation.PublicKeyRecord{Id: uuid.New().String(), Key: key}
+		}
+		body, err := json.Marshal(records)
+		require.NoError(t, err)
+		return body
+	}
+
+	// the oversized body is never read whole
+	huge := append([]byte(`[{"id": "`), bytes.Repeat([]byte("x"), 1<<20)...)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, push(huge))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, push(records(3)))
+
+	keys, err := db.ListAuthorizerKeys()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	assert.Equal(t, http.StatusOK, push(records(2)))
+}
+
+func TestFederationSourceStats(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Shutdown()
+	tun := &TunnelAPI{storage: db, runtime: &runtime.TunnelRuntime{}, eventLog: eventlog.NewDummy()}
+
+	private, err := xcrypto.GenerateKey()
+	require.NoError(t, err)
+	key := federation.PublicKey{Key: xcrypto.KeyToBase64(&private.PublicKey)}
+
+	push := func(source string, query string, records []federation.PublicKeyRecord) int {
+		body, err := json.Marshal(records)
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPut, "/api/federation/authorizer-keys"+query, bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyAuthkeyOwner, source))
+		w := httptest.NewRecorder()
+
+		tun.FederationSetAuthorizerKeys(w, r)
+		return w.Code
+	}
+	stats := func(source string) federationSourceStats {
+		for _, v := range tun.federation.list() {
+			if v.Source == source {
+				return v
+			}
+		}
+		return federationSourceStats{}
+	}
+
+	valid := []federation.PublicKeyRecord{{Id: uuid.New().String(), Key: key}}
+	invalid := []federation.PublicKeyRecord{
+		{Id: "not-a-uuid", Key: key},
+		{Id: uuid.New().String(), Key: federation.PublicKey{Key: "garbage"}},
+	}
+	require.Equal(t, http.StatusOK, push("stats-good", "", valid))
+	require.Equal(t, http.StatusOK, push("stats-good", "?version=1", valid))
+	require.Equal(t, http.StatusOK, push("stats-bad", "?dry_run=true", invalid))
+	require.Equal(t, http.StatusBadRequest, push("stats-bad", "", invalid))
+
+	good := stats("stats-good")
+	assert.EqualValues(t, 2, good.KeyUpdates)
+	assert.NotNil(t, good.LastKeyUpdateAt)
+	assert.Zero(t, good.ValidationFailures)
+
+	bad := stats("stats-bad")
+	assert.Zero(t, bad.KeyUpdates)
+	assert.Nil(t, bad.LastKeyUpdateAt)
+	// the dry run is not counted, the real push fails on the first record
+	assert.EqualValues(t, 1, bad.ValidationFailures)
+
+	tun.federation.ping("stats-good", time.Unix(1700000000, 0))
+	good = stats("stats-good")
+	assert.EqualValues(t, 1, good.Pings)
+	assert.Equal(t, int64(1700000000), good.LastPingAt.Unix())
+}
+
+// recordingEventLog keeps the pushed events.
+type recordingEventLog struct {
+	eventlog.EventManager
+	types  []eventlog.EventType
+	events []interface{}
+}
+
+func (l *recordingEventLog) Push(eventType eventlog.EventType, data interface{}) error {
+	l.types = append(l.types, eventType)
+	l.events = append(l.events, data)
+	return nil
+}
+
+func TestSetAuthorizerKeysEvent(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Shutdown()
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	tun := &TunnelAPI{storage: db, runtime: &runtime.TunnelRuntime{}, eventLog: events}
+
+	push := func(query string, records []federation.PublicKeyRecord) {
+		body, err := json.Marshal(records)
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPut, "/api/federation/authorizer-keys"+query, bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyAuthkeyOwner, "controller"))
+		w := httptest.NewRecorder()
+
+		tun.FederationSetAuthorizerKeys(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	var records []federation.PublicKeyRecord
+	for i := 0; i < 2; i++ {
+		private, err := xcrypto.GenerateKey()
+		require.NoError(t, err)
+		records = append(records, federation.PublicKeyRecord{
+			Id:  uuid.New().String(),
+			Key: federation.PublicKey{Key: xcrypto.KeyToBase64(&private.PublicKey)},
+		})
+	}
+
+	// dry runs change nothing
+	push("?dry_run=true", records)
+	require.Empty(t, events.events)
+
+	push("", records)
+	push("?version=5", []federation.PublicKeyRecord{records[1], records[0]})
+	require.Equal(t, []eventlog.EventType{eventlog.AuthKeysUpdated, eventlog.AuthKeysUpdated}, events.types)
+
+	first := events.events[0].(*proto.AuthKeysInfo)
+	assert.Equal(t, "controller", first.Source)
+	assert.EqualValues(t, 2, first.Count)
+	assert.Len(t, first.Fingerprint, 64)
+	assert.Zero(t, first.Version)
+	assert.NotNil(t, first.ServerTime)
+
+	// the same set in another order
+	second := events.events[1].(*proto.AuthKeysInfo)
+	assert.Equal(t, first.Fingerprint, second.Fingerprint)
+	assert.EqualValues(t, 5, second.Version)
+}
+
+func TestAddRevokeAuthorizerKey(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Shutdown()
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	tun := &TunnelAPI{storage: db, runtime: &runtime.TunnelRuntime{}, eventLog: events}
+
+	// source is the federation source, empty for the admin
+	callAs := func(source string, method string, id string, body interface{}) int {
+		bs, err := json.Marshal(body)
+		require.NoError(t, err)
+		r := httptest.NewRequest(method, "/api/tunnel/federation/authorizer-keys/"+id, bytes.NewReader(bs))
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", id)
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+
+		switch {
+		case len(source) == 0 && method == http.MethodDelete:
+			tun.AdminRevokeAuthorizerKey(w, r)
+		case len(source) == 0:
+			tun.AdminAddAuthorizerKey(w, r)
+		case method == http.MethodDelete:
+			tun.FederationRevokeAuthorizerKey(w, r.WithContext(context.WithValue(r.Context(), contextKeyAuthkeyOwner, source)))
+		default:
+			tun.FederationAddAuthorizerKey(w, r.WithContext(context.WithValue(r.Context(), contextKeyAuthkeyOwner, source)))
+		}
+		return w.Code
+	}
+	call := func(method string, id string, body interface{}) int {
+		return callAs("controller", method, id, body)
+	}
+	newKey := func() federation.PublicKey {
+		private, err := xcrypto.GenerateKey()
+		require.NoError(t, err)
+		return federation.PublicKey{Key: xcrypto.KeyToBase64(&private.PublicKey)}
+	}
+	stored := func() []string {
+		keys, err := db.ListAuthorizerKeys()
+		require.NoError(t, err)
+		ids := make([]string, 0, len(keys))
+		for _, k := range keys {
+			ids = append(ids, k.ID)
+		}
+		return ids
+	}
+
+	first, second := uuid.New().String(), uuid.New().String()
+	key := newKey()
+	require.Equal(t, http.StatusOK, call(http.MethodPost, first, key))
+	require.Equal(t, http.StatusOK, call(http.MethodPost, second, newKey()))
+	assert.ElementsMatch(t, []string{first, second}, stored())
+
+	// retried add is fine, the other key never replaces the stored one
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, first, key))
+	assert.Equal(t, http.StatusConflict, call(http.MethodPost, first, newKey()))
+	// invalid keys are rejected
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "not-a-uuid", newKey()))
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, uuid.New().String(), federation.PublicKey{Key: "garbage"}))
+
+	// the revoke touches the single key
+	require.Equal(t, http.StatusOK, call(http.MethodDelete, first, nil))
+	assert.Equal(t, []string{second}, stored())
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, first, nil))
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, uuid.New().String(), nil))
+
+	// every change is reported, the retried add too
+	require.Len(t, events.events, 4)
+	added := events.events[0].(*proto.AuthKeysInfo)
+	assert.Equal(t, first, added.Added)
+	assert.EqualValues(t, 1, added.Count)
+	assert.Equal(t, "controller", added.Source)
+	revoked := events.events[3].(*proto.AuthKeysInfo)
+	assert.Equal(t, first, revoked.Revoked)
+	assert.Empty(t, revoked.Added)
+	assert.Equal(t, added.Fingerprint, revoked.Fingerprint)
+
+	// the source can't revoke the key of another one
+	assert.Equal(t, http.StatusNotFound, callAs("other", http.MethodDelete, second, nil))
+	assert.Equal(t, []string{second}, stored())
+
+	// the admin adds keys of its own and revokes any
+	third := uuid.New().String()
+	require.Equal(t, http.StatusOK, callAs("", http.MethodPost, third, newKey()))
+	assert.ElementsMatch(t, []string{second, third}, stored())
+	adminKey, err := db.GetAuthorizerKeyByID(third)
+	require.NoError(t, err)
+	assert.Equal(t, adminKeySource, adminKey.Source)
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, third, nil))
+	require.Equal(t, http.StatusOK, callAs("", http.MethodDelete, second, nil))
+	require.Equal(t, http.StatusOK, callAs("", http.MethodDelete, third, nil))
+	assert.Empty(t, stored())
+	assert.Equal(t, http.StatusNotFound, callAs("", http.MethodDelete, third, nil))
+	require.Len(t, events.events, 7)
+
+	// the oversized body
+	tun.runtime.Settings = &settings.Config{FederationKeys: &settings.FederationKeysConfig{MaxBodySize: human.MustParseSize("16b")}}
+	assert.Equal(t, http.StatusRequestEntityTooLarge, call(http.MethodPost, uuid.New().String(), newKey()))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, callAs("", http.MethodPost, uuid.New().String(), newKey()))
+}
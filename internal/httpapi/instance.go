@@ -5,6 +5,7 @@
 package httpapi
 
 import (
+	"context"
 	"io"
 	"net/http"
 
@@ -13,25 +14,39 @@ import (
 	adminAPI "github.com/vpnhouse/api/go/server/tunnel_admin"
 	mgmtAPI "github.com/vpnhouse/api/go/server/tunnel_mgmt"
 	"github.com/vpnhouse/tunnel/internal/authorizer"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
 	"github.com/vpnhouse/tunnel/internal/frontend"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
 	"github.com/vpnhouse/tunnel/internal/manager"
 	"github.com/vpnhouse/tunnel/internal/runtime"
 	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/common-lib-go/auth"
-	"github.com/vpnhouse/common-lib-go/ipam"
 	"github.com/vpnhouse/common-lib-go/keystore"
 	"github.com/vpnhouse/common-lib-go/xerror"
 	"go.uber.org/zap"
 )
 
+// peerSource is the part of the manager the peer lists
+// are streamed from, implemented by *manager.Manager.
+type peerSource interface {
+	GetPeer(ctx context.Context, id int64) (*types.PeerInfo, error)
+	WalkPeers(ctx context.Context, visit func([]*types.PeerInfo) error) error
+	SearchPeersByDisplayName(ctx context.Context, substr string) ([]*types.PeerInfo, error)
+	PeerSpeed(peer *types.PeerInfo) (int64, int64)
+}
+
 type TunnelAPI struct {
 	runtime    *runtime.TunnelRuntime
 	manager    *manager.Manager
+	peers      peerSource
 	adminJWT   *auth.JWTMaster
 	authorizer authorizer.JWTAuthorizer
 	storage    *storage.Storage
 	keystore   keystore.Keystore
-	ippool     *ipam.IPAM
+	ippool     *ipalloc.Allocator
+	eventLog   eventlog.EventManager
+	federation federationStats
 	running    bool
 }
 
@@ -42,16 +57,19 @@ func NewTunnelHandlers(
 	jwtAuthorizer authorizer.JWTAuthorizer,
 	storage *storage.Storage,
 	keystore keystore.Keystore,
-	ip4am *ipam.IPAM,
+	ip4am *ipalloc.Allocator,
+	eventLog eventlog.EventManager,
 ) *TunnelAPI {
 	instance := &TunnelAPI{
 		runtime:    runtime,
 		manager:    manager,
+		peers:      manager,
 		adminJWT:   adminJWT,
 		authorizer: authorizer.WithEntitlement(jwtAuthorizer, authorizer.Wireguard),
 		storage:    storage,
 		keystore:   keystore,
 		ippool:     ip4am,
+		eventLog:   eventLog,
 		running:    true,
 	}
 
@@ -59,32 +77,94 @@ func NewTunnelHandlers(
 }
 
 func (tun *TunnelAPI) RegisterHandlers(r chi.Router) {
+	// the admin API may be served on the socket or the listener of its own
+	adminAPIConfig := tun.runtime.Settings.AdminAPI
+	if !adminAPIConfig.AdminOnSocketOnly() && len(adminAPIConfig.GetListenAddr()) == 0 {
+		tun.RegisterAdminListenerHandlers(r)
+	}
+
+	if tun.runtime.Features.WithPublicAPI() {
+		tunnelAPI.HandlerWithOptions(tun, tunnelAPI.ChiServerOptions{
+			BaseRouter: r,
+			Middlewares: []tunnelAPI.MiddlewareFunc{
+				tun.correlationMiddleware,
+			},
+		})
+	}
+
+	if tun.runtime.Features.WithFederation() && len(tun.runtime.Settings.GetFederationListenAddr()) == 0 {
+		tun.RegisterFederationHandlers(r)
+	}
+}
+
+// RegisterAdminListenerHandlers registers the admin API
+// along with the frontend using it.
+func (tun *TunnelAPI) RegisterAdminListenerHandlers(r chi.Router) {
+	// the frontend is useless without the admin API
 	tun.addStaticHandler(r)
+	tun.RegisterAdminHandlers(r)
+}
 
-	// admin API
+// RegisterFederationHandlers registers the federation API handlers only.
+func (tun *TunnelAPI) RegisterFederationHandlers(r chi.Router) {
+	mgmtAPI.HandlerWithOptions(tun, mgmtAPI.ChiServerOptions{
+		BaseRouter: r,
+		Middlewares: []mgmtAPI.MiddlewareFunc{
+			tun.federationAuthMiddleware,
+			tun.correlationMiddleware,
+		},
+	})
+	// federation endpoints that are not the part of the API specification
+	r.Post("/api/tunnel/federation/authorizer-keys/{id}", tun.federationHandler(tun.FederationAddAuthorizerKey))
+	r.Delete("/api/tunnel/federation/authorizer-keys/{id}", tun.federationHandler(tun.FederationRevokeAuthorizerKey))
+}
+
+// RegisterAdminHandlers registers the admin API handlers only.
+func (tun *TunnelAPI) RegisterAdminHandlers(r chi.Router) {
 	adminAPI.HandlerWithOptions(tun, adminAPI.ChiServerOptions{
 		BaseRouter: r,
 		Middlewares: []adminAPI.MiddlewareFunc{
+			tun.adminTimeoutMiddleware,
 			tun.adminAuthMiddleware,
 			tun.initialSetupMiddleware,
 			tun.versionRestrictionsMiddleware,
+			tun.correlationMiddleware,
+			tun.compressionMiddleware,
 		},
 	})
-
-	if tun.runtime.Features.WithPublicAPI() {
-		tunnelAPI.HandlerWithOptions(tun, tunnelAPI.ChiServerOptions{
-			BaseRouter: r,
-		})
-	}
-
-	if tun.runtime.Features.WithFederation() {
-		mgmtAPI.HandlerWithOptions(tun, mgmtAPI.ChiServerOptions{
-			BaseRouter: r,
-			Middlewares: []mgmtAPI.MiddlewareFunc{
-				tun.federationAuthMiddleware,
-			},
-		})
-	}
+	// admin endpoints that are not the part of the API specification
+	r.Get("/api/tunnel/admin/diagnostics", tun.adminHandler(tun.AdminGetDiagnostics))
+	r.Get("/api/tunnel/admin/metrics", tun.adminHandler(tun.AdminGetMetrics))
+	r.Get("/api/tunnel/admin/debug/manager", tun.adminHandler(tun.AdminGetManagerDiagnostics))
+	r.Post("/api/tunnel/admin/stats/refresh", tun.adminHandler(tun.AdminRefreshStats))
+	r.Get("/api/tunnel/admin/settings/validate", tun.adminHandler(tun.AdminValidateSettings))
+	r.Post("/api/tunnel/admin/settings/reload", tun.adminHandler(tun.AdminReloadSettings))
+	r.Get("/api/tunnel/admin/config", tun.adminHandler(tun.AdminGetConfig))
+	r.Get("/api/tunnel/admin/maintenance", tun.adminHandler(tun.AdminGetMaintenance))
+	r.Put("/api/tunnel/admin/maintenance", tun.adminHandler(tun.AdminSetMaintenance))
+	r.Get("/api/tunnel/admin/background", tun.adminHandler(tun.AdminGetBackground))
+	r.Put("/api/tunnel/admin/background", tun.adminHandler(tun.AdminSetBackground))
+	r.Get("/api/tunnel/admin/dns", tun.adminHandler(tun.AdminGetDNS))
+	r.Put("/api/tunnel/admin/dns", tun.adminHandler(tun.AdminSetDNS))
+	r.Get("/api/tunnel/admin/traffic-thresholds", tun.adminHandler(tun.AdminGetTrafficThresholds))
+	r.Put("/api/tunnel/admin/traffic-thresholds", tun.adminHandler(tun.AdminSetTrafficThresholds))
+	r.Get("/api/tunnel/admin/traffic", tun.adminHandler(tun.AdminGetTraffic))
+	r.Get("/api/tunnel/admin/peers/desynced", tun.adminHandler(tun.AdminListDesyncedPeers))
+	r.Get("/api/tunnel/admin/peers/export", tun.adminHandler(tun.AdminExportPeers))
+	r.Post("/api/tunnel/admin/peers/validate", tun.adminHandler(tun.AdminValidatePeer))
+	r.Post("/api/tunnel/admin/peers/{id}/resync", tun.adminHandler(tun.AdminResyncPeer))
+	r.Post("/api/tunnel/admin/peers/{id}/rekey", tun.adminHandler(tun.AdminRekeyPeer))
+	r.Get("/api/tunnel/admin/peers/{id}/history", tun.adminHandler(tun.AdminGetPeerHistory))
+	r.Get("/api/tunnel/admin/peers/{id}/diagnostics", tun.adminHandler(tun.AdminGetPeerDiagnostics))
+	r.Get("/api/tunnel/admin/peers/by-ip/{ip}", tun.adminHandler(tun.AdminGetPeerByIP))
+	r.Get("/api/tunnel/admin/peers/expired", tun.adminHandler(tun.AdminListExpiredPeers))
+	r.Delete("/api/tunnel/admin/peers/expired", tun.adminHandler(tun.AdminWipeExpiredPeers))
+	r.Get("/api/tunnel/admin/peers/expired/preview", tun.adminHandler(tun.AdminPreviewExpirations))
+	r.Post("/api/tunnel/admin/peers/expirations", tun.adminHandler(tun.AdminExtendExpirations))
+	r.Get("/api/tunnel/admin/events", tun.adminHandler(tun.AdminSearchEvents))
+	r.Get("/api/tunnel/admin/federation/stats", tun.adminHandler(tun.AdminGetFederationStats))
+	r.Post("/api/tunnel/admin/authorizer-keys/{id}", tun.adminHandler(tun.AdminAddAuthorizerKey))
+	r.Delete("/api/tunnel/admin/authorizer-keys/{id}", tun.adminHandler(tun.AdminRevokeAuthorizerKey))
 }
 
 func (tun *TunnelAPI) addStaticHandler(r chi.Router) {
@@ -8,12 +8,14 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
 	commonAPI "github.com/vpnhouse/api/go/server/common"
 	tunnelAPI "github.com/vpnhouse/api/go/server/tunnel"
 	adminAPI "github.com/vpnhouse/api/go/server/tunnel_admin"
+	"github.com/vpnhouse/tunnel/internal/manager"
 	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/common-lib-go/auth"
 	"github.com/vpnhouse/common-lib-go/version"
@@ -27,6 +29,7 @@ import (
 const (
 	federationAuthHeader   = "X-VPNHOUSE-FEDERATION-KEY"
 	contextKeyAuthkeyOwner = "auth.owner"
+	defaultAdminIdentity   = "admin"
 )
 
 // skipNotFoundWriter is the `http.ResponseWriter`
@@ -53,14 +56,26 @@ func (w *skipNotFoundWriter) Write(p []byte) (int, error) {
 	return len(p), nil // Lie that we have successfully written it
 }
 
-func (tun *TunnelAPI) adminCheckBearerAuth(tokenStr string) error {
+// adminCheckBearerAuth validates the admin token
+// and returns the admin identity it was issued to.
+func (tun *TunnelAPI) adminCheckBearerAuth(tokenStr string) (string, error) {
 	var claims jwt.StandardClaims
 	err := tun.adminJWT.Parse(tokenStr, &claims)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return adminIdentity(claims.Subject), nil
+}
+
+// adminIdentity returns the admin identity recorded in peers
+// changed by the admin, tokens issued before the identity
+// was put into claims belong to the default admin.
+func adminIdentity(subject string) string {
+	if len(subject) == 0 {
+		return defaultAdminIdentity
+	}
+	return subject
 }
 
 // versionRestrictionsMiddleware limits an access to the admin API subsets depends on the build type.
@@ -97,6 +112,115 @@ var adminAuthBypassPaths = map[string]struct{}{
 	"/api/tunnel/admin/initial-setup": {},
 }
 
+// correlationHeaders are the request headers to take the correlation ID from,
+// in the order of preference.
+var correlationHeaders = []string{"X-Correlation-ID", "X-Request-ID"}
+
+// requestCorrelationID returns the correlation ID given by the caller,
+// falls back to the trace ID of the W3C traceparent header.
+func requestCorrelationID(r *http.Request) string {
+	for _, h := range correlationHeaders {
+		if id := r.Header.Get(h); len(id) > 0 {
+			return id
+		}
+	}
+
+	// version-traceid-parentid-flags
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1]
+	}
+	return ""
+}
+
+// correlationMiddleware passes the request correlation ID
+// to the peer operations via the request context.
+func (tun *TunnelAPI) correlationMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := requestCorrelationID(r)
+		if len(id) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set(correlationHeaders[0], id)
+		next.ServeHTTP(w, r.WithContext(manager.WithCorrelationID(r.Context(), id)))
+	}
+}
+
+// adminHandler wraps the handler with the same middlewares
+// as the generated admin API handlers have.
+func (tun *TunnelAPI) adminHandler(handler http.HandlerFunc) http.HandlerFunc {
+	for _, middleware := range []func(http.HandlerFunc) http.HandlerFunc{
+		tun.adminTimeoutMiddleware,
+		tun.adminAuthMiddleware,
+		tun.initialSetupMiddleware,
+		tun.versionRestrictionsMiddleware,
+		tun.correlationMiddleware,
+		tun.compressionMiddleware,
+	} {
+		handler = middleware(handler)
+	}
+	return handler
+}
+
+// federationHandler wraps the handler with the same middlewares
+// as the generated federation API handlers have.
+func (tun *TunnelAPI) federationHandler(handler http.HandlerFunc) http.HandlerFunc {
+	for _, middleware := range []func(http.HandlerFunc) http.HandlerFunc{
+		tun.federationAuthMiddleware,
+		tun.correlationMiddleware,
+	} {
+		handler = middleware(handler)
+	}
+	return handler
+}
+
+// adminListRequests are requests listing the whole collections,
+// they are limited by the list request timeout.
+var adminListRequests = map[string]struct{}{
+	"GET /api/tunnel/admin/peers":                 {},
+	"GET /api/tunnel/admin/peers/desynced":        {},
+	"GET /api/tunnel/admin/peers/expired":         {},
+	"DELETE /api/tunnel/admin/peers/expired":      {},
+	"GET /api/tunnel/admin/peers/expired/preview": {},
+	"GET /api/tunnel/admin/trusted":               {},
+}
+
+// isAdminStreamRequest reports whether the response is written progressively
+// and flushed on the way: the peers export and the CSV peer list are bounded
+// by the lock timeout of every batch, the reload flushes the reply before
+// the restart.
+func isAdminStreamRequest(r *http.Request) bool {
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/tunnel/admin/peers/export", "GET /api/tunnel/admin/reload":
+		return true
+	case "GET /api/tunnel/admin/peers":
+		return acceptsCSV(r)
+	}
+	return false
+}
+
+// adminTimeoutMiddleware limits the request handling time,
+// the request context is cancelled and 503 is responded if exceeded.
+// Stream requests are passed as is, the timeout handler buffers
+// the whole response and can't flush it.
+func (tun *TunnelAPI) adminTimeoutMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	_, body := xerror.ErrorToHttpResponse(xerror.EUnavailable("request timed out", nil))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAdminStreamRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := tun.runtime.Settings.AdminAPI.GetRequestTimeout()
+		if _, ok := adminListRequests[r.Method+" "+r.URL.Path]; ok {
+			timeout = tun.runtime.Settings.AdminAPI.GetListRequestTimeout()
+		}
+
+		http.TimeoutHandler(next, timeout, string(body)).ServeHTTP(w, r)
+	}
+}
+
 // adminAuthMiddleware checks if bearer authentication is succeed
 func (tun *TunnelAPI) adminAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -111,13 +235,13 @@ func (tun *TunnelAPI) adminAuthMiddleware(next http.HandlerFunc) http.HandlerFun
 			return
 		}
 
-		err := tun.adminCheckBearerAuth(tokenStr)
+		who, err := tun.adminCheckBearerAuth(tokenStr)
 		if err != nil {
 			xhttp.WriteJsonError(w, xerror.EUnauthorized("invalid auth token", nil))
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(manager.WithModifiedBy(r.Context(), who)))
 	}
 }
 
@@ -149,7 +273,7 @@ func (tun *TunnelAPI) exportPeer(peer *types.PeerInfo) (adminAPI.Peer, error) {
 	// Handle ipv4 address
 	ip := peer.Ipv4.String()
 
-	runtimePeerStat := tun.manager.GetRuntimePeerStat(peer)
+	upSpeed, downSpeed := tun.peers.PeerSpeed(peer)
 
 	oPeer := adminAPI.Peer{
 		Label:            peer.Label,
@@ -165,8 +289,8 @@ func (tun *TunnelAPI) exportPeer(peer *types.PeerInfo) (adminAPI.Peer, error) {
 		Activity:         peer.Activity.TimePtr(),
 		TrafficUp:        peer.Upstream,
 		TrafficDown:      peer.Downstream,
-		TrafficUpSpeed:   &runtimePeerStat.UpstreamSpeed,
-		TrafficDownSpeed: &runtimePeerStat.DownstreamSpeed,
+		TrafficUpSpeed:   &upSpeed,
+		TrafficDownSpeed: &downSpeed,
 	}
 
 	return oPeer, nil
@@ -191,6 +315,45 @@ func (tun *TunnelAPI) getPeerForSerialization(id int64) (adminAPI.PeerRecord, er
 	return record, nil
 }
 
+// peerRecord extends the API peer record with the display name,
+// the last admin changed the peer, the peer connections tracking,
+// device sync and link details.
+type peerRecord struct {
+	adminAPI.PeerRecord
+	DisplayName     *string    `json:"display_name,omitempty"`
+	ModifiedBy      *string    `json:"modified_by,omitempty"`
+	ConnectCount    int64      `json:"connect_count"`
+	LastConnectedAt *time.Time `json:"last_connected_at,omitempty"`
+	LastSyncError   *string    `json:"last_sync_error,omitempty"`
+	LastSyncedAt    *time.Time `json:"last_synced_at,omitempty"`
+	PointToPoint    bool       `json:"point_to_point,omitempty"`
+}
+
+func (tun *TunnelAPI) exportPeerRecord(peer *types.PeerInfo) (peerRecord, error) {
+	oPeer, err := tun.exportPeer(peer)
+	if err != nil {
+		return peerRecord{}, err
+	}
+
+	record := peerRecord{
+		PeerRecord: adminAPI.PeerRecord{
+			Id:   peer.ID,
+			Peer: oPeer,
+		},
+		DisplayName:     peer.DisplayName,
+		ModifiedBy:      peer.ModifiedBy,
+		LastConnectedAt: peer.LastConnectedAt.TimePtr(),
+		LastSyncError:   peer.LastSyncError,
+		LastSyncedAt:    peer.LastSyncedAt.TimePtr(),
+		PointToPoint:    peer.IsPointToPoint(),
+	}
+	if peer.ConnectCount != nil {
+		record.ConnectCount = *peer.ConnectCount
+	}
+
+	return record, nil
+}
+
 func importIdentifiers(oIdentifiers *commonAPI.ConnectionIdentifiers) (*types.PeerIdentifiers, error) {
 	if oIdentifiers == nil {
 		return &types.PeerIdentifiers{}, nil
@@ -268,7 +431,10 @@ func validateClientIdentifiers(identifiers *commonAPI.ConnectionIdentifiers) err
 	}
 
 	if identifiers.UserId == nil || identifiers.InstallationId == nil || identifiers.SessionId == nil {
-		return xerror.EInvalidArgument("not enough identification info", nil, zap.Any("identifiers", identifiers))
+		return xerror.EInvalidArgument("not enough identification info", nil,
+			types.LogString("user_id", identifiers.UserId),
+			types.LogString("installation_id", identifiers.InstallationId),
+			types.LogString("session_id", identifiers.SessionId))
 	}
 
 	return nil
@@ -0,0 +1,175 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tunnelAPI "github.com/vpnhouse/api/go/server/tunnel_admin"
+	"github.com/vpnhouse/tunnel/internal/manager"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/common-lib-go/auth"
+	"github.com/vpnhouse/common-lib-go/control"
+	"github.com/vpnhouse/common-lib-go/human"
+	"gopkg.in/hlandau/passlib.v1"
+)
+
+func TestAdminTimeoutMiddleware(t *testing.T) {
+	tun := &TunnelAPI{
+		runtime: &runtime.TunnelRuntime{
+			Settings: &settings.Config{
+				AdminAPI: &settings.AdminAPIConfig{
+					RequestTimeout:     human.MustParseInterval("50ms"),
+					ListRequestTimeout: human.MustParseInterval("1s"),
+				},
+			},
+		},
+	}
+
+	cancelled := make(chan struct{})
+	slow := tun.adminTimeoutMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(200 * time.Millisecond):
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	// single entry request hits the timeout
+	w := httptest.NewRecorder()
+	slow(w, httptest.NewRequest(http.MethodGet, "/api/tunnel/admin/peers/1", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request context is not cancelled")
+	}
+
+	// list request has the longer timeout
+	w = httptest.NewRecorder()
+	slow(w, httptest.NewRequest(http.MethodGet, "/api/tunnel/admin/peers", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// adminToken returns the admin API token issued by tun.
+func adminToken(t *testing.T, tun *TunnelAPI) string {
+	if tun.adminJWT == nil {
+		master, err := auth.NewJWTMaster(nil, nil)
+		require.NoError(t, err)
+		tun.adminJWT = master
+	}
+	token, err := tun.adminJWT.Token(&jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	require.NoError(t, err)
+	return *token
+}
+
+// adminRequest returns the admin API request authorized by the token of tun.
+func adminRequest(t *testing.T, tun *TunnelAPI, method string, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+adminToken(t, tun))
+	return r
+}
+
+func TestAdminReloadFlushes(t *testing.T) {
+	tun := &TunnelAPI{
+		runtime: &runtime.TunnelRuntime{
+			Settings: &settings.Config{
+				AdminAPI: &settings.AdminAPIConfig{
+					PasswordHash:   "hash",
+					RequestTimeout: human.MustParseInterval("1s"),
+				},
+			},
+			Events: control.NewEventManager(),
+		},
+	}
+
+	events := make(chan int, 1)
+	go func() {
+		events <- tun.runtime.Events.NextEvent().EventType
+	}()
+
+	w := httptest.NewRecorder()
+	tun.adminHandler(tun.AdminReloadService)(w, adminRequest(t, tun, http.MethodGet, "/api/tunnel/admin/reload"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	// the reply is flushed to the client before the restart
+	assert.True(t, w.Flushed)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, control.EventRestart, event)
+	case <-time.After(time.Second):
+		t.Fatal("restart event is not emitted")
+	}
+}
+
+func TestAdminDoAuthIdentity(t *testing.T) {
+	hash, err := passlib.Hash("password")
+	require.NoError(t, err)
+	tun := &TunnelAPI{
+		runtime: &runtime.TunnelRuntime{
+			Settings: &settings.Config{
+				AdminAPI: &settings.AdminAPIConfig{PasswordHash: hash, TokenLifetime: 60},
+			},
+		},
+	}
+	master, err := auth.NewJWTMaster(nil, nil)
+	require.NoError(t, err)
+	tun.adminJWT = master
+
+	// the username is not verified, so it's not the identity
+	r := httptest.NewRequest(http.MethodGet, "/api/tunnel/admin/auth", nil)
+	r.SetBasicAuth("someone-else", "password")
+	w := httptest.NewRecorder()
+	tun.AdminDoAuth(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp tunnelAPI.AdminAuthResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	var claims jwt.StandardClaims
+	require.NoError(t, tun.adminJWT.Parse(resp.AccessToken, &claims))
+	assert.Equal(t, defaultAdminIdentity, claims.Subject)
+}
+
+func TestCorrelationMiddleware(t *testing.T) {
+	tun := &TunnelAPI{}
+
+	var got string
+	handler := tun.correlationMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		got = manager.CorrelationID(r.Context())
+	})
+
+	cases := []struct {
+		headers map[string]string
+		id      string
+	}{
+		{headers: nil, id: ""},
+		{headers: map[string]string{"X-Request-ID": "req"}, id: "req"},
+		{headers: map[string]string{"X-Request-ID": "req", "X-Correlation-ID": "corr"}, id: "corr"},
+		{headers: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, id: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{headers: map[string]string{"traceparent": "garbage"}, id: ""},
+	}
+
+	for _, ca := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/api/client/connect", nil)
+		for k, v := range ca.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, ca.id, got, "headers %v", ca.headers)
+		assert.Equal(t, ca.id, w.Header().Get("X-Correlation-ID"))
+	}
+}
@@ -5,56 +5,274 @@
 package httpapi
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	tunnelAPI "github.com/vpnhouse/api/go/server/tunnel"
 	adminAPI "github.com/vpnhouse/api/go/server/tunnel_admin"
+	"github.com/vpnhouse/tunnel/internal/manager"
 	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/common-lib-go/xerror"
 	"github.com/vpnhouse/common-lib-go/xhttp"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"github.com/vpnhouse/common-lib-go/xtime"
+	"go.uber.org/zap"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // getPeerFromRequest parses peer information from request body.
 // WARNING! This function does not do any verification of imported data! Caller must do it itself!
 func getPeerFromRequest(r *http.Request, id int64) (types.PeerInfo, error) {
-	var peer adminAPI.Peer
-	if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return types.PeerInfo{}, xerror.EInvalidArgument("failed to read request body", err)
+	}
+
+	var oPeer adminAPI.Peer
+	var opts peerOptions
+	if err := json.Unmarshal(body, &oPeer); err != nil {
+		return types.PeerInfo{}, xerror.EInvalidArgument("invalid peer info", err)
+	}
+	if err := json.Unmarshal(body, &opts); err != nil {
 		return types.PeerInfo{}, xerror.EInvalidArgument("invalid peer info", err)
 	}
 
-	return importPeer(peer, id)
+	peer, err := importPeer(oPeer, id)
+	if err != nil {
+		return types.PeerInfo{}, err
+	}
+	peer.DisplayName = opts.DisplayName
+	return peer, nil
+}
+
+// peerOptions extends the API peer with the fields
+// the API specification does not describe.
+type peerOptions struct {
+	// DisplayName is the cosmetic name of the peer,
+	// the current one is kept on update if omitted.
+	DisplayName *string `json:"display_name,omitempty"`
 }
 
-// AdminListPeers implements GET method on /api/admin/peers endpoint
+// AdminListPeers implements GET method on /api/admin/peers endpoint,
+// the display_name query parameter lists peers whose display name contains it.
+// Peers are written as CSV if the client asks for it, see AdminListPeersCSV.
 func (tun *TunnelAPI) AdminListPeers(w http.ResponseWriter, r *http.Request) {
+	if acceptsCSV(r) {
+		tun.AdminListPeersCSV(w, r)
+		return
+	}
+
 	xhttp.JSONResponse(w, func() (interface{}, error) {
-		peers, err := tun.manager.ListPeers()
+		var peers []*types.PeerInfo
+		var err error
+		if name := r.URL.Query().Get("display_name"); len(name) > 0 {
+			peers, err = tun.manager.SearchPeersByDisplayName(r.Context(), name)
+		} else {
+			peers, err = tun.manager.ListPeers(r.Context())
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		foundPeers := make([]adminAPI.PeerRecord, len(peers))
+		foundPeers := make([]peerRecord, len(peers))
 		for i, peer := range peers {
-			oPeer, err := tun.exportPeer(peer)
+			record, err := tun.exportPeerRecord(peer)
 			if err != nil {
 				return nil, err
 			}
-			foundPeers[i].Id = peer.ID
-			foundPeers[i].Peer = oPeer
+			foundPeers[i] = record
 		}
 
 		return foundPeers, nil
 	})
 }
 
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeCSV    = "text/csv"
+)
+
+// streamWriter sets the headers of the stream on the first write,
+// so the error reply can be sent if nothing is written yet.
+type streamWriter struct {
+	http.ResponseWriter
+	contentType string
+	written     bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.writeHeader()
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *streamWriter) writeHeader() {
+	w.written = true
+	w.Header().Set("Content-Type", w.contentType)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (w *streamWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// AdminExportPeers implements GET method on /api/tunnel/admin/peers/export endpoint,
+// peers are streamed as newline-delimited JSON records of AdminListPeers,
+// the response is flushed after every batch.
+func (tun *TunnelAPI) AdminExportPeers(w http.ResponseWriter, r *http.Request) {
+	sw := &streamWriter{ResponseWriter: w, contentType: contentTypeNDJSON}
+	enc := json.NewEncoder(sw)
+	err := tun.peers.WalkPeers(r.Context(), func(peers []*types.PeerInfo) error {
+		for _, peer := range peers {
+			record, err := tun.exportPeerRecord(peer)
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(record); err != nil {
+				return xerror.EInternalError("failed to write peer", err, zap.Int64("id", peer.ID))
+			}
+		}
+		sw.Flush()
+		return nil
+	})
+	if err != nil {
+		if !sw.written {
+			xhttp.WriteJsonError(w, err)
+			return
+		}
+		// too late to reply with the error, the client gets the truncated stream
+		zap.L().Error("peers export interrupted", zap.Error(err))
+		return
+	}
+
+	if !sw.written {
+		// no peers at all
+		sw.writeHeader()
+	}
+}
+
+// peerCSVHeader names the columns of the CSV peer list.
+var peerCSVHeader = []string{
+	"user_id", "installation_id", "ip", "expires", "last_handshake",
+	"bytes_up", "bytes_down", "display_name",
+}
+
+// AdminListPeersCSV writes the peer list of AdminListPeers as CSV
+// with the header row, meant to be opened in spreadsheets.
+// All peers are streamed in batches the same as by AdminExportPeers.
+func (tun *TunnelAPI) AdminListPeersCSV(w http.ResponseWriter, r *http.Request) {
+	sw := &streamWriter{ResponseWriter: w, contentType: contentTypeCSV + "; charset=utf-8"}
+	cw := csv.NewWriter(sw)
+	// buffered, so it's sent along with the first batch
+	_ = cw.Write(peerCSVHeader)
+
+	write := func(peers []*types.PeerInfo) error {
+		for _, peer := range peers {
+			_ = cw.Write(peerCSVRecord(peer))
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return xerror.EInternalError("failed to write peers", err)
+		}
+		sw.Flush()
+		return nil
+	}
+
+	var err error
+	if name := r.URL.Query().Get("display_name"); len(name) > 0 {
+		var peers []*types.PeerInfo
+		peers, err = tun.peers.SearchPeersByDisplayName(r.Context(), name)
+		if err == nil {
+			err = write(peers)
+		}
+	} else {
+		err = tun.peers.WalkPeers(r.Context(), write)
+	}
+	if err != nil {
+		if !sw.written {
+			xhttp.WriteJsonError(w, err)
+			return
+		}
+		zap.L().Error("peers export interrupted", zap.Error(err))
+		return
+	}
+
+	// the header row of the empty list
+	cw.Flush()
+}
+
+func peerCSVRecord(peer *types.PeerInfo) []string {
+	record := make([]string, 0, len(peerCSVHeader))
+	record = append(record, csvText(peer.UserId))
+	if peer.InstallationId != nil {
+		record = append(record, peer.InstallationId.String())
+	} else {
+		record = append(record, "")
+	}
+	if peer.Ipv4 != nil {
+		record = append(record, peer.Ipv4.String())
+	} else {
+		record = append(record, "")
+	}
+	record = append(record, csvTime(peer.Expires), csvTime(peer.Activity))
+	record = append(record, csvInt(peer.Upstream), csvInt(peer.Downstream))
+	record = append(record, csvText(peer.DisplayName))
+	return record
+}
+
+// csvText returns the free-form text field, the one starting like
+// the formula gets the leading quote, so spreadsheets never evaluate it.
+func csvText(v *string) string {
+	if v == nil {
+		return ""
+	}
+	if len(*v) > 0 && strings.ContainsRune("=+-@\t\r", rune((*v)[0])) {
+		return "'" + *v
+	}
+	return *v
+}
+
+func csvTime(v *xtime.Time) string {
+	if v == nil || v.Time.IsZero() {
+		return ""
+	}
+	return v.Time.UTC().Format(time.RFC3339)
+}
+
+func csvInt(v *int64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+// acceptsCSV reports whether the client asks for the CSV reply.
+func acceptsCSV(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err == nil && mediaType == contentTypeCSV {
+			return true
+		}
+	}
+	return false
+}
+
 // AdminDeletePeer implements DELETE method on /api/admin/peers/{id} endpoint
 func (tun *TunnelAPI) AdminDeletePeer(w http.ResponseWriter, r *http.Request, id int64) {
 	xhttp.JSONResponse(w, func() (interface{}, error) {
-		if err := tun.manager.UnsetPeer(id); err != nil {
+		if err := tun.manager.UnsetPeer(r.Context(), id); err != nil {
 			return nil, err
 		}
 		return nil, nil
@@ -64,49 +282,130 @@ func (tun *TunnelAPI) AdminDeletePeer(w http.ResponseWriter, r *http.Request, id
 // AdminGetPeer implements GET method on /api/admin/peers/{id} endpoint
 func (tun *TunnelAPI) AdminGetPeer(w http.ResponseWriter, r *http.Request, id int64) {
 	xhttp.JSONResponse(w, func() (interface{}, error) {
-		peer, err := tun.manager.GetPeer(id)
+		peer, err := tun.peers.GetPeer(r.Context(), id)
 		if err != nil {
 			return nil, err
 		}
 
-		exported, err := tun.exportPeer(peer)
-		if err != nil {
-			return nil, err
-		}
+		return tun.exportPeerRecord(peer)
+	})
+}
 
-		info := adminAPI.PeerRecord{
-			Id:   id,
-			Peer: exported,
-		}
+// createPeerOptions extends the API peer
+// with the creation-only options.
+type createPeerOptions struct {
+	peerOptions
+	// PreferredIpv4 is assigned to the peer if it's free,
+	// any other address is allocated otherwise.
+	PreferredIpv4 *string `json:"preferred_ipv4,omitempty"`
+	// PointToPoint requests the /31 point-to-point link
+	// instead of the single address.
+	PointToPoint bool `json:"point_to_point,omitempty"`
+}
 
-		return info, nil
-	})
+// createdPeerRecord reports whether the preferred address was assigned
+// and whether the address is next to the user's other peers.
+type createdPeerRecord struct {
+	adminAPI.PeerRecord
+	PreferredIpv4Honored *bool `json:"preferred_ipv4_honored,omitempty"`
+	Clustered            *bool `json:"clustered,omitempty"`
 }
 
 // AdminCreatePeer implements POST method on /api/admin/peers endpoint
 func (tun *TunnelAPI) AdminCreatePeer(w http.ResponseWriter, r *http.Request) {
 	xhttp.JSONResponse(w, func() (interface{}, error) {
-		peer, err := getPeerFromRequest(r, 0)
+		peer, err := newPeerFromRequest(r)
 		if err != nil {
 			return nil, err
 		}
 
-		err = peer.Validate("ID", "Ipv4")
+		if err := tun.manager.SetPeer(r.Context(), &peer); err != nil {
+			return nil, err
+		}
+
+		record, err := tun.getPeerForSerialization(peer.ID)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := tun.manager.SetPeer(&peer); err != nil {
+		created := createdPeerRecord{PeerRecord: record, Clustered: peer.Clustered}
+		if peer.PreferredIpv4 != nil {
+			honored := peer.Ipv4.Equal(*peer.PreferredIpv4)
+			created.PreferredIpv4Honored = &honored
+		}
+		return created, nil
+	})
+}
+
+// newPeerFromRequest parses the peer to be created
+// along with the creation-only options.
+func newPeerFromRequest(r *http.Request) (types.PeerInfo, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return types.PeerInfo{}, xerror.EInvalidArgument("failed to read request body", err)
+	}
+
+	var oPeer adminAPI.Peer
+	var opts createPeerOptions
+	if err := json.Unmarshal(body, &oPeer); err != nil {
+		return types.PeerInfo{}, xerror.EInvalidArgument("invalid peer info", err)
+	}
+	if err := json.Unmarshal(body, &opts); err != nil {
+		return types.PeerInfo{}, xerror.EInvalidArgument("invalid peer info", err)
+	}
+
+	peer, err := importPeer(oPeer, 0)
+	if err != nil {
+		return types.PeerInfo{}, err
+	}
+	peer.DisplayName = opts.DisplayName
+
+	err = peer.Validate("ID", "Ipv4")
+	if err != nil {
+		return types.PeerInfo{}, err
+	}
+
+	if opts.PointToPoint {
+		if oPeer.Ipv4 != nil {
+			return types.PeerInfo{}, xerror.EInvalidField("point-to-point link address can not be given explicitly, use preferred_ipv4", "ipv4", nil)
+		}
+		peer.PointToPoint = &opts.PointToPoint
+	}
+
+	if opts.PreferredIpv4 != nil {
+		if oPeer.Ipv4 != nil {
+			return types.PeerInfo{}, xerror.EInvalidField("ipv4 and preferred_ipv4 are mutually exclusive", "preferred_ipv4", nil)
+		}
+		pref := xnet.ParseIP(*opts.PreferredIpv4)
+		if !pref.Isv4() {
+			return types.PeerInfo{}, xerror.EInvalidField("invalid preferred ipv4 format", "preferred_ipv4", nil)
+		}
+		peer.PreferredIpv4 = &pref
+	}
+
+	return peer, nil
+}
+
+// AdminValidatePeer implements POST method on /api/tunnel/admin/peers/validate endpoint,
+// the peer is checked the same way AdminCreatePeer does, but never created.
+func (tun *TunnelAPI) AdminValidatePeer(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		peer, err := newPeerFromRequest(r)
+		if err != nil {
 			return nil, err
 		}
 
-		return tun.getPeerForSerialization(peer.ID)
+		return nil, tun.manager.ValidatePeer(peer)
 	})
 }
 
 // AdminCreateSharedPeer implements POST method on /api/admin/peers/shared endpoint
 func (tun *TunnelAPI) AdminCreateSharedPeer(w http.ResponseWriter, r *http.Request) {
 	xhttp.JSONResponse(w, func() (interface{}, error) {
+		if tun.manager.Maintenance() {
+			return nil, xerror.EUnavailable("maintenance mode", nil)
+		}
+
 		peer, err := getPeerFromRequest(r, 0)
 		if err != nil {
 			return nil, err
@@ -137,6 +436,10 @@ func (tun *TunnelAPI) AdminCreateSharedPeer(w http.ResponseWriter, r *http.Reque
 
 func (tun *TunnelAPI) PublicPeerActivate(w http.ResponseWriter, r *http.Request, slug string) {
 	xhttp.JSONResponse(w, func() (interface{}, error) {
+		if tun.manager.Maintenance() {
+			return nil, xerror.EUnavailable("maintenance mode", nil)
+		}
+
 		var wgPeer tunnelAPI.PeerWireguard
 		if err := json.NewDecoder(r.Body).Decode(&wgPeer); err != nil {
 			return nil, xerror.EInvalidArgument("failed to decode given JSON body", err)
@@ -161,9 +464,10 @@ func (tun *TunnelAPI) PublicPeerActivate(w http.ResponseWriter, r *http.Request,
 			return nil, err
 		}
 
+		pol := (&types.PeerInfo{NetworkAccessPolicy: (*int)(fullPeer.Peer.NetAccessPolicy)}).GetNetworkPolicy()
 		return adminAPI.PeerActivationResponse{
 			Peer:             fullPeer,
-			WireguardOptions: wireguardConnectionInfo(tun.runtime.Settings.Wireguard),
+			WireguardOptions: wireguardConnectionInfo(tun.runtime.Settings, pol),
 		}, nil
 	})
 }
@@ -204,26 +508,236 @@ func (tun *TunnelAPI) AdminUpdatePeer(w http.ResponseWriter, r *http.Request, id
 			return nil, err
 		}
 
-		if err := tun.manager.UpdatePeer(&peer); err != nil {
+		if err := tun.manager.UpdatePeer(r.Context(), &peer); err != nil {
 			return nil, err
 		}
 
 		// fetch updated record and send it back
-		insertedPeer, err := tun.manager.GetPeer(id)
+		insertedPeer, err := tun.manager.GetPeer(r.Context(), id)
 		if err != nil {
 			return nil, err
 		}
 
-		exported, err := tun.exportPeer(insertedPeer)
+		return tun.exportPeerRecord(insertedPeer)
+	})
+}
+
+type desyncedPeersResponse struct {
+	MissingOnDevice []peerRecord `json:"missing_on_device"`
+	UnknownOnDevice []string     `json:"unknown_on_device"`
+}
+
+// AdminListDesyncedPeers implements GET method on /api/tunnel/admin/peers/desynced endpoint
+func (tun *TunnelAPI) AdminListDesyncedPeers(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		missing, unknown, err := tun.manager.ListDesyncedPeers()
+		if err != nil {
+			return nil, err
+		}
+
+		response := desyncedPeersResponse{
+			MissingOnDevice: make([]peerRecord, len(missing)),
+			UnknownOnDevice: unknown,
+		}
+		for i := range missing {
+			record, err := tun.exportPeerRecord(&missing[i])
+			if err != nil {
+				return nil, err
+			}
+			response.MissingOnDevice[i] = record
+		}
+
+		return response, nil
+	})
+}
+
+// AdminResyncPeer implements POST method on /api/tunnel/admin/peers/{id}/resync endpoint
+func (tun *TunnelAPI) AdminResyncPeer(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			return nil, xerror.EInvalidArgument("invalid peer id", err)
+		}
+
+		peer, err := tun.manager.ResyncPeer(r.Context(), id)
+		if err != nil {
+			return nil, err
+		}
+		return tun.exportPeerRecord(peer)
+	})
+}
+
+type rekeyPeerResponse struct {
+	Peer       peerRecord `json:"peer"`
+	PrivateKey string     `json:"private_key"`
+}
+
+// AdminRekeyPeer implements POST method on /api/tunnel/admin/peers/{id}/rekey endpoint
+func (tun *TunnelAPI) AdminRekeyPeer(w http.ResponseWriter, r *http.Request) {
+	// the private key is shown once, it must not be kept anywhere
+	w.Header().Set("Cache-Control", "no-store")
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			return nil, xerror.EInvalidArgument("invalid peer id", err)
+		}
+
+		privateKey, err := tun.manager.RekeyPeer(r.Context(), id)
+		if err != nil {
+			return nil, err
+		}
+		peer, err := tun.manager.GetPeer(r.Context(), id)
+		if err != nil {
+			return nil, err
+		}
+		record, err := tun.exportPeerRecord(peer)
+		if err != nil {
+			return nil, err
+		}
+		return rekeyPeerResponse{Peer: record, PrivateKey: privateKey}, nil
+	})
+}
+
+// AdminGetPeerHistory implements GET method on /api/tunnel/admin/peers/{id}/history endpoint
+func (tun *TunnelAPI) AdminGetPeerHistory(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			return nil, xerror.EInvalidArgument("invalid peer id", err)
+		}
+
+		return tun.manager.GetPeerHistory(id)
+	})
+}
+
+// AdminGetPeerDiagnostics implements GET method on /api/tunnel/admin/peers/{id}/diagnostics endpoint
+func (tun *TunnelAPI) AdminGetPeerDiagnostics(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			return nil, xerror.EInvalidArgument("invalid peer id", err)
+		}
+
+		return tun.manager.PeerDiagnostics(r.Context(), id)
+	})
+}
+
+// AdminGetPeerByIP implements GET method on /api/tunnel/admin/peers/by-ip/{ip} endpoint
+func (tun *TunnelAPI) AdminGetPeerByIP(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		ip := net.ParseIP(chi.URLParam(r, "ip"))
+		if ip == nil {
+			return nil, xerror.EInvalidArgument("invalid ip address", nil)
+		}
+
+		peer, err := tun.manager.GetPeerByIP(ip)
+		if err != nil {
+			return nil, err
+		}
+		return tun.exportPeerRecord(&peer)
+	})
+}
+
+type wipedPeersResponse struct {
+	Wiped int `json:"wiped"`
+}
+
+// AdminListExpiredPeers implements GET method on /api/tunnel/admin/peers/expired endpoint
+func (tun *TunnelAPI) AdminListExpiredPeers(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		peers, err := tun.manager.ListExpiredPeers()
 		if err != nil {
 			return nil, err
 		}
 
-		info := adminAPI.PeerRecord{
-			Id:   id,
-			Peer: exported,
+		records := make([]peerRecord, len(peers))
+		for i, peer := range peers {
+			record, err := tun.exportPeerRecord(peer)
+			if err != nil {
+				return nil, err
+			}
+			records[i] = record
+		}
+		return records, nil
+	})
+}
+
+// AdminPreviewExpirations implements GET method on /api/tunnel/admin/peers/expired/preview endpoint
+func (tun *TunnelAPI) AdminPreviewExpirations(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		peers, err := tun.manager.PreviewExpirations()
+		if err != nil {
+			return nil, err
 		}
 
-		return info, nil
+		records := make([]peerRecord, len(peers))
+		for i := range peers {
+			record, err := tun.exportPeerRecord(&peers[i])
+			if err != nil {
+				return nil, err
+			}
+			records[i] = record
+		}
+		return records, nil
+	})
+}
+
+// AdminWipeExpiredPeers implements DELETE method on /api/tunnel/admin/peers/expired endpoint
+func (tun *TunnelAPI) AdminWipeExpiredPeers(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		wiped, err := tun.manager.WipeExpiredPeers(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		return wipedPeersResponse{Wiped: wiped}, nil
+	})
+}
+
+type expirationRequest struct {
+	UserID         *string    `json:"user_id,omitempty"`
+	InstallationID *uuid.UUID `json:"installation_id,omitempty"`
+	SessionID      *uuid.UUID `json:"session_id,omitempty"`
+	// Expires is the new expiration, null means never
+	Expires *time.Time `json:"expires"`
+}
+
+type expirationResult struct {
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AdminExtendExpirations implements POST method on /api/tunnel/admin/peers/expirations endpoint
+func (tun *TunnelAPI) AdminExtendExpirations(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		var req []expirationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, xerror.EInvalidArgument("invalid expiration updates", err)
+		}
+
+		items := make([]manager.ExpirationUpdate, len(req))
+		for i, v := range req {
+			items[i] = manager.ExpirationUpdate{
+				Identifiers: &types.PeerIdentifiers{
+					UserId:         v.UserID,
+					InstallationId: v.InstallationID,
+					SessionId:      v.SessionID,
+				},
+				Expires: v.Expires,
+			}
+		}
+
+		errs, err := tun.manager.ExtendExpirations(r.Context(), items)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]expirationResult, len(errs))
+		for i, err := range errs {
+			results[i].Applied = err == nil
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		return results, nil
 	})
 }
@@ -0,0 +1,282 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"github.com/vpnhouse/common-lib-go/xtime"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// storagePeers serves peers right from the storage.
+type storagePeers struct {
+	peerSource
+	db *storage.Storage
+}
+
+func (s storagePeers) GetPeer(ctx context.Context, id int64) (*types.PeerInfo, error) {
+	return s.db.GetPeerContext(ctx, id)
+}
+
+func TestPeerNotFoundResponse(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Shutdown() })
+
+	tun := &TunnelAPI{
+		runtime: &runtime.TunnelRuntime{
+			Settings: &settings.Config{
+				AdminAPI: &settings.AdminAPIConfig{PasswordHash: "hash"},
+			},
+		},
+		peers: storagePeers{db: db},
+	}
+	r := chi.NewRouter()
+	tun.RegisterAdminHandlers(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/tunnel/admin/peers/42", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+adminToken(t, tun))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "peer not found", body["error"])
+	// no storage internals leak to the client
+	assert.NotContains(t, body, "details")
+}
+
+func TestPeerCSVRecord(t *testing.T) {
+	userID := "project/auth/user, with comma"
+	installationID := uuid.MustParse("6f0c9fa5-0d7c-4a1a-9b38-2e6c4f4b1c11")
+	ip := xnet.ParseIP("10.235.0.2")
+	expires := xtime.Time{Time: time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)}
+	up, down := int64(1024), int64(2048)
+	name := `Smith, John "JJ"` + "\nsecond line"
+	peer := &types.PeerInfo{
+		PeerIdentifiers: types.PeerIdentifiers{UserId: &userID, InstallationId: &installationID},
+		Ipv4:            &ip,
+		Expires:         &expires,
+		Upstream:        &up,
+		Downstream:      &down,
+		DisplayName:     &name,
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	require.NoError(t, cw.Write(peerCSVHeader))
+	require.NoError(t, cw.Write(peerCSVRecord(peer)))
+	require.NoError(t, cw.Write(peerCSVRecord(&types.PeerInfo{})))
+	cw.Flush()
+	require.NoError(t, cw.Error())
+
+	// fields with commas, quotes and line breaks are quoted
+	assert.Equal(t, "user_id,installation_id,ip,expires,last_handshake,bytes_up,bytes_down,display_name\n"+
+		`"project/auth/user, with comma",6f0c9fa5-0d7c-4a1a-9b38-2e6c4f4b1c11,10.235.0.2,2026-07-01T12:00:00Z,,1024,2048,"Smith, John ""JJ""`+"\nsecond line\"\n"+
+		",,,,,,,\n", buf.String())
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, name, records[1][7])
+
+	// formulas are never evaluated by spreadsheets
+	formula := "=HYPERLINK(\"http://example.com\")"
+	peer.DisplayName = &formula
+	assert.Equal(t, "'"+formula, peerCSVRecord(peer)[7])
+}
+
+func TestAcceptsCSV(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                 false,
+		"application/json":                 false,
+		"text/csv":                         true,
+		"text/csv; charset=utf-8":          true,
+		"application/json;q=0.5, text/csv": true,
+		"application/x-ndjson, text/plain": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/tunnel/admin/peers", nil)
+		r.Header.Set("Accept", accept)
+		assert.Equal(t, want, acceptsCSV(r), accept)
+	}
+}
+
+// batchPeers is the peer source yielding the next batch
+// only when the test lets it go on.
+type batchPeers struct {
+	batches [][]*types.PeerInfo
+	next    chan struct{}
+}
+
+func newBatchPeers(t *testing.T, batches int, size int) *batchPeers {
+	s := &batchPeers{next: make(chan struct{})}
+	for i := 0; i < batches; i++ {
+		var batch []*types.PeerInfo
+		for j := 0; j < size; j++ {
+			key, err := wgtypes.GeneratePrivateKey()
+			require.NoError(t, err)
+			pub := key.PublicKey().String()
+			ip := xnet.ParseIP(fmt.Sprintf("10.235.0.%d", 2+i*size+j))
+			batch = append(batch, &types.PeerInfo{
+				ID:            int64(1 + i*size + j),
+				Ipv4:          &ip,
+				WireguardInfo: types.WireguardInfo{WireguardPublicKey: &pub},
+			})
+		}
+		s.batches = append(s.batches, batch)
+	}
+	return s
+}
+
+func (s *batchPeers) WalkPeers(ctx context.Context, visit func([]*types.PeerInfo) error) error {
+	for i, batch := range s.batches {
+		if i > 0 {
+			select {
+			case <-s.next:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err := visit(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *batchPeers) GetPeer(_ context.Context, id int64) (*types.PeerInfo, error) {
+	for _, batch := range s.batches {
+		for _, peer := range batch {
+			if peer.ID == id {
+				return peer, nil
+			}
+		}
+	}
+	return nil, xerror.EEntryNotFound("peer not found", nil)
+}
+
+func (s *batchPeers) SearchPeersByDisplayName(context.Context, string) ([]*types.PeerInfo, error) {
+	return nil, nil
+}
+
+func (s *batchPeers) PeerSpeed(*types.PeerInfo) (int64, int64) {
+	return 0, 0
+}
+
+// getPeersStream requests the peers stream from the admin API router,
+// the batches after the first one are blocked until the test sends to source.next.
+func getPeersStream(t *testing.T, source *batchPeers, path string, accept string) *http.Response {
+	tun := &TunnelAPI{
+		runtime: &runtime.TunnelRuntime{
+			Settings: &settings.Config{
+				AdminAPI: &settings.AdminAPIConfig{PasswordHash: "hash"},
+			},
+		},
+		peers: source,
+	}
+	r := chi.NewRouter()
+	tun.RegisterAdminHandlers(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+adminToken(t, tun))
+	if len(accept) > 0 {
+		req.Header.Set("Accept", accept)
+	}
+	// the response held until the handler returns never comes
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return resp
+}
+
+func TestAdminExportPeersStream(t *testing.T) {
+	source := newBatchPeers(t, 3, 2)
+	resp := getPeersStream(t, source, "/api/tunnel/admin/peers/export", "")
+	assert.Equal(t, contentTypeNDJSON, resp.Header.Get("Content-Type"))
+
+	body := bufio.NewReader(resp.Body)
+	readID := func() int64 {
+		line, err := body.ReadBytes('\n')
+		require.NoError(t, err)
+		var record peerRecord
+		require.NoError(t, json.Unmarshal(line, &record))
+		return record.Id
+	}
+
+	var ids []int64
+	for batch := range source.batches {
+		if batch > 0 {
+			// the handler is still running
+			source.next <- struct{}{}
+		}
+		for range source.batches[batch] {
+			ids = append(ids, readID())
+		}
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5, 6}, ids)
+
+	rest, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+}
+
+func TestAdminListPeersCSVStream(t *testing.T) {
+	source := newBatchPeers(t, 2, 2)
+	resp := getPeersStream(t, source, "/api/tunnel/admin/peers", "text/csv")
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body := csv.NewReader(resp.Body)
+	header, err := body.Read()
+	require.NoError(t, err)
+	assert.Equal(t, peerCSVHeader, header)
+
+	var ips []string
+	for batch := range source.batches {
+		if batch > 0 {
+			// the handler is still running
+			source.next <- struct{}{}
+		}
+		for range source.batches[batch] {
+			record, err := body.Read()
+			require.NoError(t, err)
+			ips = append(ips, record[2])
+		}
+	}
+	assert.Equal(t, []string{"10.235.0.2", "10.235.0.3", "10.235.0.4", "10.235.0.5"}, ips)
+
+	_, err = body.Read()
+	assert.ErrorIs(t, err, io.EOF)
+}
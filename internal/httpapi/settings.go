@@ -109,6 +109,91 @@ func (tun *TunnelAPI) AdminUpdateSettings(w http.ResponseWriter, r *http.Request
 	})
 }
 
+type settingsReport struct {
+	// Valid is false if any issue is the error
+	Valid  bool                   `json:"valid"`
+	Issues []settings.ConfigIssue `json:"issues"`
+}
+
+// AdminValidateSettings implements handler for GET /api/tunnel/admin/settings/validate request
+func (tun *TunnelAPI) AdminValidateSettings(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		report := settingsReport{Valid: true, Issues: tun.runtime.ValidateSettings()}
+		for _, issue := range report.Issues {
+			if issue.Severity == settings.IssueError {
+				report.Valid = false
+			}
+		}
+		return report, nil
+	})
+}
+
+type settingsReload struct {
+	settings.ConfigChanges
+	RestartRequired bool `json:"restart_required"`
+}
+
+// AdminReloadSettings implements handler for POST /api/tunnel/admin/settings/reload request,
+// the config file is read again and applied without the restart where possible.
+func (tun *TunnelAPI) AdminReloadSettings(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		reloaded, err := tun.runtime.Settings.Reload()
+		if err != nil {
+			return nil, err
+		}
+
+		changes, err := tun.runtime.ReloadSettings(reloaded)
+		if err != nil {
+			return nil, err
+		}
+		return settingsReload{ConfigChanges: changes, RestartRequired: tun.runtime.Flags.RestartRequired}, nil
+	})
+}
+
+// effectiveConfig is the configuration the server is running with.
+type effectiveConfig struct {
+	Config  map[string]interface{} `json:"config"`
+	Runtime runtimeSettings        `json:"runtime"`
+	// FileChanges are settings of the config file differing
+	// from the running ones, none if the file can't be read
+	FileChanges *settings.ConfigChanges `json:"file_changes,omitempty"`
+}
+
+// runtimeSettings are changed via the admin API
+// without touching the config file.
+type runtimeSettings struct {
+	Maintenance       bool              `json:"maintenance"`
+	BackgroundPaused  bool              `json:"background_paused"`
+	TrafficThresholds trafficThresholds `json:"traffic_thresholds"`
+	RestartRequired   bool              `json:"restart_required"`
+}
+
+// AdminGetConfig implements handler for GET /api/tunnel/admin/config request,
+// secrets of the config are redacted.
+func (tun *TunnelAPI) AdminGetConfig(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		config, err := tun.runtime.Settings.Effective()
+		if err != nil {
+			return nil, err
+		}
+
+		effective := effectiveConfig{
+			Config: config,
+			Runtime: runtimeSettings{
+				Maintenance:       tun.manager.Maintenance(),
+				BackgroundPaused:  tun.manager.BackgroundPaused(),
+				TrafficThresholds: tun.trafficThresholds(),
+				RestartRequired:   tun.runtime.Flags.RestartRequired,
+			},
+		}
+		if file, err := tun.runtime.Settings.Reload(); err == nil {
+			changes := tun.runtime.Settings.Diff(file)
+			effective.FileChanges = &changes
+		}
+		return effective, nil
+	})
+}
+
 func settingsToOpenAPI(s *settings.Config) adminAPI.Settings {
 	public := s.Wireguard.GetPrivateKey().Public().Unwrap().String()
 	subnet := string(s.Wireguard.Subnet)
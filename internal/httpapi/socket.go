@@ -0,0 +1,92 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xhttp"
+	"go.uber.org/zap"
+)
+
+// AdminSocketServer serves the admin API on the unix domain socket.
+type AdminSocketServer struct {
+	path string
+	srv  *http.Server
+}
+
+// RunAdminSocket starts serving the admin API on the unix socket asynchronously.
+func (tun *TunnelAPI) RunAdminSocket(config settings.AdminSocketConfig) (*AdminSocketServer, error) {
+	mode, err := config.FileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	// remove the socket left by the previous run, if any
+	if fi, err := os.Lstat(config.Path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, xerror.EInternalError("admin socket path exists and it is not a socket", nil, zap.String("path", config.Path))
+		}
+		if err := os.Remove(config.Path); err != nil {
+			return nil, xerror.EInternalError("failed to remove the stale admin socket", err, zap.String("path", config.Path))
+		}
+	}
+
+	lis, err := net.Listen("unix", config.Path)
+	if err != nil {
+		return nil, xerror.EInternalError("failed to start admin socket listener", err, zap.String("path", config.Path))
+	}
+	if err := os.Chmod(config.Path, mode); err != nil {
+		_ = lis.Close()
+		return nil, xerror.EInternalError("failed to set admin socket permissions", err, zap.String("path", config.Path))
+	}
+
+	// xhttp.Server listens on TCP only, so borrow its router
+	// to have the same logging and JSON error responses.
+	router := xhttp.New(xhttp.WithLogger()).Router()
+	tun.RegisterAdminHandlers(router)
+
+	s := &AdminSocketServer{
+		path: config.Path,
+		srv: &http.Server{
+			Handler:     router,
+			ReadTimeout: 10 * time.Second,
+		},
+	}
+
+	zap.L().Info("starting admin API on the unix socket", zap.String("path", config.Path))
+	go func() {
+		if err := s.srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zap.L().Error("admin socket listener failed", zap.String("path", config.Path), zap.Error(err))
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *AdminSocketServer) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.srv.Shutdown(ctx)
+	s.srv = nil
+
+	// the listener unlinks the socket on close, make sure it does
+	if rmErr := os.Remove(s.path); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+		zap.L().Warn("failed to remove the admin socket", zap.String("path", s.path), zap.Error(rmErr))
+	}
+	return err
+}
+
+func (s *AdminSocketServer) Running() bool {
+	return s.srv != nil
+}
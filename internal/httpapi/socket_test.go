@@ -0,0 +1,77 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/settings"
+)
+
+func TestAdminSocket(t *testing.T) {
+	tun := &TunnelAPI{
+		runtime: &runtime.TunnelRuntime{
+			Settings: &settings.Config{
+				AdminAPI: &settings.AdminAPIConfig{PasswordHash: "hash"},
+			},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	// stale socket from the previous run
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	s, err := tun.RunAdminSocket(settings.AdminSocketConfig{Path: path, Mode: "0660"})
+	require.NoError(t, err)
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://unix/api/tunnel/admin/metrics")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	// the admin route is there, but requires the authentication
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = client.Get("http://unix/api/client/connect")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	// non-admin routes are not served via the socket
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	require.NoError(t, s.Shutdown())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestAdminSocketNotASocket(t *testing.T) {
+	tun := &TunnelAPI{}
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0600))
+
+	_, err := tun.RunAdminSocket(settings.AdminSocketConfig{Path: path})
+	assert.Error(t, err)
+}
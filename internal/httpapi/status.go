@@ -5,22 +5,67 @@
 package httpapi
 
 import (
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
 	adminAPI "github.com/vpnhouse/api/go/server/tunnel_admin"
+	"github.com/vpnhouse/tunnel/internal/settings"
 	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/ipam"
 	"github.com/vpnhouse/common-lib-go/xerror"
 	"github.com/vpnhouse/common-lib-go/xhttp"
 )
 
+// statusResponse extends the API status with the manager state.
+type statusResponse struct {
+	adminAPI.ServiceStatusResponse
+	// Running is false once the manager stopped accepting requests
+	Running     bool `json:"running"`
+	Maintenance bool `json:"maintenance"`
+	// DrainInProgress is set while the stopped manager
+	// finishes its background work
+	DrainInProgress bool `json:"drain_in_progress"`
+	// BackgroundPaused is set while the scheduled stats sync is paused
+	BackgroundPaused bool `json:"background_paused"`
+	// LastTick is the time of the last background iteration,
+	// omitted if it has not run yet
+	LastTick *time.Time `json:"last_tick,omitempty"`
+	// PeersOnDevice is the number of peers on the wireguard device,
+	// omitted once the manager is stopped
+	PeersOnDevice *int `json:"peers_on_device,omitempty"`
+	// MaxPeersPerInterface is the cap of PeersOnDevice,
+	// omitted if there is no limit
+	MaxPeersPerInterface *int `json:"max_peers_per_interface,omitempty"`
+}
+
 // AdminGetStatus returns current server status
 func (tun *TunnelAPI) AdminGetStatus(w http.ResponseWriter, r *http.Request) {
 	stats := tun.manager.GetCachedStatistics()
 	xhttp.JSONResponse(w, func() (interface{}, error) {
+		running := tun.manager.Running()
+		peersTotal := stats.PeersTotal
+		var peersOnDevice *int
+		if running {
+			// the cached number lags behind by the stats update interval
+			count, err := tun.manager.CountPeers()
+			if err != nil {
+				return nil, err
+			}
+			peersTotal = int(count)
+
+			onDevice, err := tun.manager.CountDevicePeers()
+			if err != nil {
+				return nil, err
+			}
+			peersOnDevice = &onDevice
+		}
+
 		flags := tun.runtime.Flags
 		status := adminAPI.ServiceStatusResponse{
 			RestartRequired:  flags.RestartRequired,
-			PeersTotal:       &stats.PeersTotal,
+			PeersTotal:       &peersTotal,
 			PeersConnected:   &stats.PeersWithTraffic,
 			PeersActive1h:    &stats.PeersActiveLastHour,
 			PeersActive1d:    &stats.PeersActiveLastDay,
@@ -29,7 +74,148 @@ func (tun *TunnelAPI) AdminGetStatus(w http.ResponseWriter, r *http.Request) {
 			TrafficUpSpeed:   &stats.UpstreamSpeed,
 			TrafficDownSpeed: &stats.DownstreamSpeed,
 		}
-		return status, nil
+		resp := statusResponse{
+			ServiceStatusResponse: status,
+			Running:               running,
+			Maintenance:           tun.manager.Maintenance(),
+			DrainInProgress:       tun.manager.Draining(),
+			BackgroundPaused:      tun.manager.BackgroundPaused(),
+			PeersOnDevice:         peersOnDevice,
+		}
+		if limit := tun.runtime.Settings.GetMaxPeersPerInterface(); limit > 0 {
+			resp.MaxPeersPerInterface = &limit
+		}
+		if tick := tun.manager.LastTick(); !tick.IsZero() {
+			resp.LastTick = &tick
+		}
+		return resp, nil
+	})
+}
+
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// AdminGetMaintenance implements GET method on /api/tunnel/admin/maintenance endpoint
+func (tun *TunnelAPI) AdminGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		return maintenanceState{Enabled: tun.manager.Maintenance()}, nil
+	})
+}
+
+// AdminSetMaintenance implements PUT method on /api/tunnel/admin/maintenance endpoint
+func (tun *TunnelAPI) AdminSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		var state maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			return nil, xerror.EInvalidArgument("invalid maintenance state", err)
+		}
+
+		if err := tun.manager.SetMaintenance(r.Context(), state.Enabled); err != nil {
+			return nil, err
+		}
+		return maintenanceState{Enabled: tun.manager.Maintenance()}, nil
+	})
+}
+
+type backgroundState struct {
+	Paused bool `json:"paused"`
+}
+
+// AdminGetBackground implements GET method on /api/tunnel/admin/background endpoint
+func (tun *TunnelAPI) AdminGetBackground(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		return backgroundState{Paused: tun.manager.BackgroundPaused()}, nil
+	})
+}
+
+// AdminSetBackground implements PUT method on /api/tunnel/admin/background endpoint.
+// The pause is not persisted, the stats sync is resumed after the restart.
+func (tun *TunnelAPI) AdminSetBackground(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		var state backgroundState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			return nil, xerror.EInvalidArgument("invalid background state", err)
+		}
+
+		var err error
+		if state.Paused {
+			err = tun.manager.PauseBackground(r.Context())
+		} else {
+			err = tun.manager.ResumeBackground(r.Context())
+		}
+		if err != nil {
+			return nil, err
+		}
+		return backgroundState{Paused: tun.manager.BackgroundPaused()}, nil
+	})
+}
+
+// trafficThresholds are the accumulated traffic changes in bytes
+// triggering the immediate send of traffic events, zero disables the threshold.
+type trafficThresholds struct {
+	MaxUpstreamTrafficChange   int64 `json:"max_upstream_traffic_change"`
+	MaxDownstreamTrafficChange int64 `json:"max_downstream_traffic_change"`
+}
+
+func (tun *TunnelAPI) trafficThresholds() trafficThresholds {
+	up, down := tun.manager.TrafficThresholds()
+	return trafficThresholds{
+		MaxUpstreamTrafficChange:   up,
+		MaxDownstreamTrafficChange: down,
+	}
+}
+
+// AdminGetTrafficThresholds implements GET method on /api/tunnel/admin/traffic-thresholds endpoint
+func (tun *TunnelAPI) AdminGetTrafficThresholds(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		return tun.trafficThresholds(), nil
+	})
+}
+
+// trafficTotals is the traffic of all peers in bytes within the time range.
+type trafficTotals struct {
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Upstream   int64     `json:"upstream"`
+	Downstream int64     `json:"downstream"`
+}
+
+// AdminGetTraffic implements GET method on /api/tunnel/admin/traffic endpoint,
+// the range is given by the required from and to (RFC3339) query parameters.
+func (tun *TunnelAPI) AdminGetTraffic(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		var err error
+		var totals trafficTotals
+		if totals.From, err = time.Parse(time.RFC3339, r.URL.Query().Get("from")); err != nil {
+			return nil, xerror.EInvalidArgument("invalid from time", err)
+		}
+		if totals.To, err = time.Parse(time.RFC3339, r.URL.Query().Get("to")); err != nil {
+			return nil, xerror.EInvalidArgument("invalid to time", err)
+		}
+
+		totals.Upstream, totals.Downstream, err = tun.manager.AggregateTraffic(totals.From, totals.To)
+		if err != nil {
+			return nil, err
+		}
+		return totals, nil
+	})
+}
+
+// AdminSetTrafficThresholds implements PUT method on /api/tunnel/admin/traffic-thresholds endpoint.
+// The thresholds are not persisted, the configured ones are used after the restart.
+func (tun *TunnelAPI) AdminSetTrafficThresholds(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		var thresholds trafficThresholds
+		if err := json.NewDecoder(r.Body).Decode(&thresholds); err != nil {
+			return nil, xerror.EInvalidArgument("invalid traffic thresholds", err)
+		}
+
+		err := tun.manager.SetTrafficThresholds(r.Context(), thresholds.MaxUpstreamTrafficChange, thresholds.MaxDownstreamTrafficChange)
+		if err != nil {
+			return nil, err
+		}
+		return tun.trafficThresholds(), nil
 	})
 }
 
@@ -40,16 +226,82 @@ func (tun *TunnelAPI) AdminConnectionInfoWireguard(w http.ResponseWriter, r *htt
 				"missing server public ipv4 option, please specify it in settings",
 				"wireguard_server_ipv4")
 		}
-		info := wireguardConnectionInfo(tun.runtime.Settings.Wireguard)
-		return info, nil
+		// the peer's policy decides the MTU hints and AllowedIPs, the default one if omitted
+		var pol ipam.Policy
+		if v := r.URL.Query().Get("peer_id"); len(v) > 0 {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, xerror.EInvalidArgument("invalid peer id", err)
+			}
+			peer, err := tun.manager.GetPeer(r.Context(), id)
+			if err != nil {
+				return nil, err
+			}
+			pol = peer.GetNetworkPolicy()
+		}
+
+		resp := wireguardOptions{WireguardOptions: wireguardConnectionInfo(tun.runtime.Settings, pol)}
+		if hints, ok := tun.runtime.Settings.GetClientHints(pol); ok {
+			resp.MTU = hints.MTU
+			resp.PostUp = hints.PostUp
+			resp.PostDown = hints.PostDown
+		}
+		resp.Endpoints = tun.runtime.Settings.Wireguard.Endpoints
+		resp.RoutingTable = tun.runtime.Settings.Wireguard.RoutingTable
+		if len(resp.RoutingTable) == 0 {
+			resp.RoutingTable = wireguard.RoutingTableAuto
+		}
+		return resp, nil
+	})
+}
+
+// wireguardOptions extends the connection info with the client
+// interface hints, they never affect the server side, the candidate
+// endpoints, and the routing table of the server interface subnets,
+// for the reference.
+type wireguardOptions struct {
+	adminAPI.WireguardOptions
+	MTU          int      `json:"mtu,omitempty"`
+	PostUp       string   `json:"post_up,omitempty"`
+	PostDown     string   `json:"post_down,omitempty"`
+	Endpoints    []string `json:"endpoints,omitempty"`
+	RoutingTable string   `json:"routing_table"`
+}
+
+type dnsServers struct {
+	Servers []string `json:"servers"`
+}
+
+// AdminGetDNS implements GET method on /api/tunnel/admin/dns endpoint
+func (tun *TunnelAPI) AdminGetDNS(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		return dnsServers{Servers: tun.runtime.Settings.GetWireguardDNS()}, nil
+	})
+}
+
+// AdminSetDNS implements PUT method on /api/tunnel/admin/dns endpoint.
+// Unlike the settings update it requires no restart,
+// new peer configurations get new servers immediately.
+func (tun *TunnelAPI) AdminSetDNS(w http.ResponseWriter, r *http.Request) {
+	xhttp.JSONResponse(w, func() (interface{}, error) {
+		var dns dnsServers
+		if err := json.NewDecoder(r.Body).Decode(&dns); err != nil {
+			return nil, xerror.EInvalidArgument("invalid dns servers", err)
+		}
+
+		if err := tun.manager.SetDNS(r.Context(), dns.Servers); err != nil {
+			return nil, err
+		}
+		return dnsServers{Servers: tun.runtime.Settings.GetWireguardDNS()}, nil
 	})
 }
 
-func wireguardConnectionInfo(c wireguard.Config) adminAPI.WireguardOptions {
+func wireguardConnectionInfo(s *settings.Config, pol ipam.Policy) adminAPI.WireguardOptions {
+	c := s.Wireguard
 	return adminAPI.WireguardOptions{
-		AllowedIps:      []string{"0.0.0.0/0"},
+		AllowedIps:      s.GetClientAllowedIPs(pol),
 		Subnet:          string(c.Subnet),
-		Dns:             c.DNS,
+		Dns:             s.GetWireguardDNS(),
 		Keepalive:       c.Keepalive,
 		ServerIpv4:      c.ServerIPv4,
 		ServerPort:      c.ClientPort(),
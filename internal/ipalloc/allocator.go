@@ -0,0 +1,998 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package ipalloc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/ippool"
+	"github.com/vpnhouse/common-lib-go/validator"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// policyNames maps the access policy names used in the configuration
+// to the ipam.AccessPolicy* values.
+var policyNames = map[string]int{
+	"internet_only": ipam.AccessPolicyInternetOnly,
+	"allow_all":     ipam.AccessPolicyAllowAll,
+}
+
+type Config struct {
+	// StartOffset is the host index inside the subnet the dynamic
+	// allocation starts from, e.g. 100 means 10.235.0.100 for 10.235.0.0/24.
+	// Lower addresses can only be assigned explicitly.
+	// Zero disables the offset: addresses are picked from the whole subnet.
+	StartOffset uint32 `yaml:"start_offset,omitempty"`
+	// PolicySubnets segments the pool by the network access policy:
+	// peers with the given policy get addresses from the given sub-range
+	// of the pool, others never get an address from it.
+	// Keys are "internet_only" or "allow_all".
+	PolicySubnets map[string]validator.Subnet `yaml:"policy_subnets,omitempty"`
+	// PointToPointSubnet is the sub-range of the pool reserved for
+	// RFC3021 /31 point-to-point links, each link takes both addresses
+	// of the aligned pair. Regular peers never get an address from it.
+	PointToPointSubnet validator.Subnet `yaml:"point_to_point_subnet,omitempty"`
+	// Deterministic derives the address of the peer from the hash
+	// of its public key, so identical peer sets get identical addresses
+	// on different nodes. If the derived address is taken, the next
+	// free one is picked, wrapping around the range, so a collision
+	// makes the result depend on the order peers are allocated in.
+	Deterministic bool `yaml:"deterministic,omitempty"`
+	// ExtraSubnets are the address blocks forming one logical pool
+	// with the wireguard subnet, e.g. if the address space is fragmented.
+	// Once the wireguard subnet is exhausted, peers get addresses
+	// from the blocks in the given order. The server takes the first
+	// usable address of every block. Only peers with the allow_all
+	// access get addresses from the blocks, as the isolation rules
+	// of internet_only peers cover the wireguard subnet only.
+	// Other options apply to the wireguard subnet only.
+	ExtraSubnets []validator.Subnet `yaml:"extra_subnets,omitempty"`
+	// ClusterRadius keeps peers of the same user in adjacent addresses,
+	// e.g. to make the firewall rules compact: the new peer gets the free
+	// address closest to the addresses of the user's other peers, at most
+	// the given number of addresses away. If there is none, the address is
+	// picked as usual. Zero disables the clustering.
+	// Can't be used with Deterministic.
+	ClusterRadius uint32 `yaml:"cluster_radius,omitempty"`
+	// Backend is where addresses are owned: "local" (default) keeps
+	// the pool in memory of the node, "external" claims every address
+	// in the external IPAM first, so nodes sharing the pool never
+	// assign the same address. Can't be used with ExtraSubnets.
+	Backend string `yaml:"backend,omitempty"`
+	// External is the IPAM used by the "external" backend.
+	External *ExternalConfig `yaml:"external,omitempty"`
+	// Quarantine is how long the released peer address is not given
+	// to another peer automatically, so sessions lingering on the old
+	// peer don't reach the new one. If nothing else is left, the longest
+	// quarantined address is reused. Explicit addresses are assigned
+	// regardless of it. Zero disables it.
+	Quarantine time.Duration `yaml:"quarantine,omitempty"`
+}
+
+// Validate checks that the configuration is applicable to the given subnet.
+func (c Config) Validate(subnet *xnet.IPNet) error {
+	policySubnets, err := c.policySubnets(subnet)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.linkSubnet(subnet, policySubnets); err != nil {
+		return err
+	}
+
+	if _, err := c.extraSubnets(subnet); err != nil {
+		return err
+	}
+
+	switch c.Backend {
+	case "", BackendLocal:
+	case BackendExternal:
+		if c.External == nil {
+			return xerror.EInvalidConfiguration("ip_pool.external is required for the external backend", "ip_pool.external")
+		}
+		if err := c.External.validate(); err != nil {
+			return err
+		}
+		if len(c.ExtraSubnets) > 0 {
+			return xerror.EInvalidConfiguration("ip_pool.extra_subnets can't be used with the external backend", "ip_pool.extra_subnets")
+		}
+	default:
+		return xerror.EInvalidConfiguration(fmt.Sprintf("ip_pool.backend: unknown backend %q", c.Backend), "ip_pool.backend")
+	}
+
+	if c.Quarantine < 0 {
+		return xerror.EInvalidConfiguration("ip_pool.quarantine must not be negative", "ip_pool.quarantine")
+	}
+
+	if c.ClusterRadius > 0 && c.Deterministic {
+		return xerror.EInvalidConfiguration("ip_pool.cluster_radius can't be used with ip_pool.deterministic", "ip_pool.cluster_radius")
+	}
+
+	if c.StartOffset == 0 {
+		return nil
+	}
+
+	netAddr, first, last := subnet.NetworkAddr(), subnet.FirstUsable(), subnet.LastUsable()
+	if c.StartOffset > last.ToUint32()-netAddr.ToUint32() || netAddr.ToUint32()+c.StartOffset < first.ToUint32() {
+		return xerror.EInvalidConfiguration(fmt.Sprintf("ip_pool.start_offset %d is out of the %s subnet", c.StartOffset, subnet.String()), "ip_pool.start_offset")
+	}
+	return nil
+}
+
+// policySubnets parses and validates the PolicySubnets option.
+func (c Config) policySubnets(subnet *xnet.IPNet) (map[int]*xnet.IPNet, error) {
+	subnets := make(map[int]*xnet.IPNet, len(c.PolicySubnets))
+	names := make(map[int]string, len(c.PolicySubnets))
+	for name, s := range c.PolicySubnets {
+		pol, ok := policyNames[name]
+		if !ok {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("ip_pool.policy_subnets: unknown policy %q", name), "ip_pool.policy_subnets")
+		}
+
+		_, sub, err := xnet.ParseCIDR(string(s))
+		if err != nil {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("ip_pool.policy_subnets.%s: invalid subnet", name), "ip_pool.policy_subnets."+name)
+		}
+		if !contains(subnet, sub.NetworkAddr()) || !contains(subnet, sub.BroadcastAddr()) {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("ip_pool.policy_subnets.%s: %s is out of the %s subnet", name, sub.String(), subnet.String()), "ip_pool.policy_subnets."+name)
+		}
+
+		for other, otherSub := range subnets {
+			if contains(otherSub, sub.NetworkAddr()) || contains(sub, otherSub.NetworkAddr()) {
+				return nil, xerror.EInvalidConfiguration(fmt.Sprintf("ip_pool.policy_subnets.%s overlaps with ip_pool.policy_subnets.%s", name, names[other]), "ip_pool.policy_subnets."+name)
+			}
+		}
+		subnets[pol] = sub
+		names[pol] = name
+	}
+	return subnets, nil
+}
+
+// linkSubnet parses and validates the PointToPointSubnet option,
+// returns nil if the point-to-point links are not configured.
+func (c Config) linkSubnet(subnet *xnet.IPNet, policySubnets map[int]*xnet.IPNet) (*xnet.IPNet, error) {
+	if len(c.PointToPointSubnet) == 0 {
+		return nil, nil
+	}
+
+	const field = "ip_pool.point_to_point_subnet"
+	_, sub, err := xnet.ParseCIDR(string(c.PointToPointSubnet))
+	if err != nil {
+		return nil, xerror.EInvalidConfiguration(field+": invalid subnet", field)
+	}
+	if ones, bits := sub.Mask().Size(); bits != 32 || ones > 31 {
+		return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s: %s is too small for a /31 link", field, sub.String()), field)
+	}
+	if !contains(subnet, sub.NetworkAddr()) || !contains(subnet, sub.BroadcastAddr()) {
+		return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s: %s is out of the %s subnet", field, sub.String(), subnet.String()), field)
+	}
+	// links have no network and broadcast addresses of their own,
+	// but the pool ones are never usable
+	if contains(sub, subnet.NetworkAddr()) || contains(sub, subnet.BroadcastAddr()) {
+		return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s: %s must not include the network or broadcast address of the %s subnet", field, sub.String(), subnet.String()), field)
+	}
+
+	for pol, polSub := range policySubnets {
+		if contains(polSub, sub.NetworkAddr()) || contains(sub, polSub.NetworkAddr()) {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s overlaps with ip_pool.policy_subnets.%s", field, policyName(pol)), field)
+		}
+	}
+	return sub, nil
+}
+
+// extraSubnets parses and validates the ExtraSubnets option.
+func (c Config) extraSubnets(subnet *xnet.IPNet) ([]*xnet.IPNet, error) {
+	const field = "ip_pool.extra_subnets"
+	blocks := make([]*xnet.IPNet, 0, len(c.ExtraSubnets))
+	for i, s := range c.ExtraSubnets {
+		ipa, sub, err := xnet.ParseCIDR(string(s))
+		if err != nil || !sub.IP().Isv4() {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s[%d]: invalid subnet", field, i), field)
+		}
+		if !sub.IP().Equal(*ipa) {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s[%d]: %s must be the network address, not the host one", field, i, s), field)
+		}
+		if ones, _ := sub.Mask().Size(); ones > 30 {
+			return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s[%d]: %s is too small, /30 or larger is required", field, i, s), field)
+		}
+
+		for _, other := range append([]*xnet.IPNet{subnet}, blocks...) {
+			if contains(other, sub.NetworkAddr()) || contains(sub, other.NetworkAddr()) {
+				return nil, xerror.EInvalidConfiguration(fmt.Sprintf("%s[%d]: %s overlaps with %s", field, i, s, other.String()), field)
+			}
+		}
+		blocks = append(blocks, sub)
+	}
+	return blocks, nil
+}
+
+// ExtraNetworks returns the parsed ExtraSubnets,
+// the configuration must be validated.
+func (c Config) ExtraNetworks() []*xnet.IPNet {
+	blocks := make([]*xnet.IPNet, 0, len(c.ExtraSubnets))
+	for _, s := range c.ExtraSubnets {
+		blocks = append(blocks, s.Unwrap())
+	}
+	return blocks
+}
+
+// ParsePolicy returns the ipam.AccessPolicy* value
+// by its name used in the configuration.
+func ParsePolicy(name string) (int, bool) {
+	pol, ok := policyNames[name]
+	return pol, ok
+}
+
+func policyName(pol int) string {
+	for name, v := range policyNames {
+		if v == pol {
+			return name
+		}
+	}
+	return strconv.Itoa(pol)
+}
+
+// Stats describes the pool utilization.
+type Stats struct {
+	// Used is a number of addresses assigned to peers
+	Used int
+	// Total is a number of usable addresses in the pool
+	Total int
+	// Links is a number of /31 point-to-point links,
+	// their addresses are counted in Used as well
+	Links int
+}
+
+// Utilization returns the ratio of used addresses, from 0 to 1.
+func (s Stats) Utilization() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Used) / float64(s.Total)
+}
+
+// addressPool is the subset of the *ipam.IPAM used by the Allocator.
+type addressPool interface {
+	Alloc(pol ipam.Policy) (xnet.IP, error)
+	Set(addr xnet.IP, pol ipam.Policy) error
+	Unset(addr xnet.IP) error
+	IsAvailable(addr xnet.IP) bool
+	Available() (xnet.IP, error)
+}
+
+// addressManager is the pool the Allocator claims addresses in.
+type addressManager interface {
+	addressPool
+	// AllocRange allocates an address of the range
+	// for the segmented pool.
+	AllocRange(pol ipam.Policy, r addressRange) (xnet.IP, error)
+	// Stats returns the utilization of the pool shared
+	// with other nodes, false if the node owns the pool.
+	Stats() (Stats, bool)
+	// Hold gives the address back to the pool shared with
+	// other nodes, the node keeps it claimed until Unset.
+	Hold(addr xnet.IP)
+}
+
+// addressRange is the range the dynamic allocation picks from,
+// addresses of the excluded subnets are skipped.
+type addressRange struct {
+	first   uint32
+	last    uint32
+	exclude []*xnet.IPNet
+}
+
+func (r addressRange) contains(addr xnet.IP) bool {
+	u := addr.ToUint32()
+	if u < r.first || u > r.last {
+		return false
+	}
+	for _, sub := range r.exclude {
+		if contains(sub, addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// localPool is the pool owned by the node.
+type localPool struct {
+	addressPool
+}
+
+func (p localPool) AllocRange(pol ipam.Policy, r addressRange) (xnet.IP, error) {
+	for u := r.first; u <= r.last; u++ {
+		addr := xnet.Uint32ToIP(u)
+		if !p.IsAvailable(addr) || !r.contains(addr) {
+			continue
+		}
+
+		err := p.Set(addr, pol)
+		if err == nil {
+			return addr, nil
+		}
+		if !errors.Is(err, ippool.ErrAddressInUse) {
+			return xnet.IP{}, err
+		}
+		// taken concurrently, try the next one
+	}
+
+	return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+}
+
+func (p localPool) Stats() (Stats, bool) {
+	return Stats{}, false
+}
+
+func (p localPool) Hold(xnet.IP) {}
+
+// Allocator picks peer addresses from the ipam.IPAM pool
+// according to the allocation configuration.
+type Allocator struct {
+	ipam          addressManager
+	subnet        *xnet.IPNet
+	config        Config
+	defaultPolicy int
+	policySubnets map[int]*xnet.IPNet
+	linkSubnet    *xnet.IPNet
+	// blocks are the ExtraSubnets pools, the ipam
+	// knows nothing about them, so no policy is applied
+	blocks []*block
+	// quarantine is nil if disabled
+	quarantine *quarantine
+	used       atomic.Int64
+	links      atomic.Int64
+}
+
+// block is the extra address block of the pool.
+type block struct {
+	subnet *xnet.IPNet
+	pool   *ippool.IPv4pool
+}
+
+// New returns the Allocator on top of the given IPAM,
+// defaultPolicy is the access policy applied to peers without one.
+func New(ip4am *ipam.IPAM, subnet *xnet.IPNet, defaultPolicy int, config Config) (*Allocator, error) {
+	var am addressManager = localPool{ip4am}
+	if config.Backend == BackendExternal && config.External != nil {
+		am = newExternal(ip4am, *config.External)
+	}
+	return newAllocator(am, subnet, defaultPolicy, config)
+}
+
+func newAllocator(ip4am addressManager, subnet *xnet.IPNet, defaultPolicy int, config Config) (*Allocator, error) {
+	if err := config.Validate(subnet); err != nil {
+		return nil, err
+	}
+
+	policySubnets, err := config.policySubnets(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	linkSubnet, err := config.linkSubnet(subnet, policySubnets)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := newBlocks(config, subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Allocator{
+		ipam:          ip4am,
+		subnet:        subnet,
+		config:        config,
+		defaultPolicy: defaultPolicy,
+		policySubnets: policySubnets,
+		linkSubnet:    linkSubnet,
+		blocks:        blocks,
+	}
+	if config.Quarantine > 0 {
+		a.quarantine = newQuarantine(config.Quarantine)
+	}
+	return a, nil
+}
+
+func newBlocks(config Config, subnet *xnet.IPNet) ([]*block, error) {
+	subnets, err := config.extraSubnets(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]*block, 0, len(subnets))
+	for _, sub := range subnets {
+		// the pool reserves the first usable address for the server
+		pool, err := ippool.NewIPv4FromSubnet(sub)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &block{subnet: sub, pool: pool})
+	}
+	return blocks, nil
+}
+
+// Alloc allocates an address for the peer with the given policy.
+// Addresses below the StartOffset are never picked,
+// as well as addresses of sub-pools of other policies.
+// Extra blocks are used once the wireguard subnet is exhausted,
+// quarantined addresses once nothing else is left.
+func (a *Allocator) Alloc(pol ipam.Policy) (xnet.IP, error) {
+	a.releaseExpired()
+
+	addr, err := a.alloc(pol)
+	if errors.Is(err, ippool.ErrNotEnoughSpace) {
+		return a.allocSpare(pol)
+	}
+	return addr, err
+}
+
+// allocSpare allocates an address of the extra blocks
+// or reuses the quarantined one.
+func (a *Allocator) allocSpare(pol ipam.Policy) (xnet.IP, error) {
+	addr, err := a.allocBlock(pol)
+	if errors.Is(err, ippool.ErrNotEnoughSpace) {
+		return a.reuseQuarantined(pol)
+	}
+	return addr, err
+}
+
+// alloc allocates an address of the wireguard subnet.
+func (a *Allocator) alloc(pol ipam.Policy) (xnet.IP, error) {
+	if !a.segmented() {
+		addr, err := a.ipam.Alloc(pol)
+		if err == nil {
+			a.used.Add(1)
+		}
+		return addr, err
+	}
+
+	addr, err := a.ipam.AllocRange(pol, a.allocRange(a.access(pol)))
+	if err == nil {
+		a.used.Add(1)
+	}
+	return addr, err
+}
+
+// allocBlock allocates an address of the first extra block
+// having one, if the peer is allowed to get it.
+func (a *Allocator) allocBlock(pol ipam.Policy) (xnet.IP, error) {
+	if a.access(pol) == ipam.AccessPolicyAllowAll {
+		for _, b := range a.blocks {
+			addr, err := b.pool.Alloc()
+			if err == nil {
+				a.used.Add(1)
+				return addr, nil
+			}
+			if !errors.Is(err, ippool.ErrNotEnoughSpace) {
+				return xnet.IP{}, err
+			}
+		}
+	}
+
+	return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+}
+
+// AllocKey allocates an address for the peer with the given policy
+// and public key. The address is derived from the key in the
+// deterministic mode, the key is ignored otherwise.
+// The extra blocks are not deterministic, see Alloc.
+func (a *Allocator) AllocKey(pol ipam.Policy, key string) (xnet.IP, error) {
+	if !a.config.Deterministic || len(key) == 0 {
+		return a.Alloc(pol)
+	}
+	a.releaseExpired()
+
+	access := a.access(pol)
+	first, last := a.dynamicRange(access)
+	size := uint64(last-first) + 1
+	offset := keyOffset(key, size)
+
+	// probe linearly from the derived address, wrapping around the range
+	for i := uint64(0); i < size; i++ {
+		addr := xnet.Uint32ToIP(first + uint32((offset+i)%size))
+		if !a.ipam.IsAvailable(addr) || !a.matches(addr, access) {
+			continue
+		}
+
+		err := a.ipam.Set(addr, pol)
+		if err == nil {
+			a.used.Add(1)
+			return addr, nil
+		}
+		if !errors.Is(err, ippool.ErrAddressInUse) {
+			return xnet.IP{}, err
+		}
+		// taken concurrently, try the next one
+	}
+
+	return a.allocSpare(pol)
+}
+
+// AllocNear allocates an address for the peer with the given policy
+// as close as possible to the given addresses, see ClusterRadius.
+// Reports whether the address is found within the radius,
+// otherwise it's allocated by Alloc.
+func (a *Allocator) AllocNear(pol ipam.Policy, near []xnet.IP) (xnet.IP, bool, error) {
+	if a.Clustering() && len(near) > 0 {
+		a.releaseExpired()
+		addr, err := a.allocNear(pol, near)
+		if err == nil {
+			return addr, true, nil
+		}
+		if !errors.Is(err, ippool.ErrNotEnoughSpace) {
+			return xnet.IP{}, false, err
+		}
+	}
+
+	addr, err := a.Alloc(pol)
+	return addr, false, err
+}
+
+// Clustering reports whether AllocNear looks for the nearby addresses.
+func (a *Allocator) Clustering() bool {
+	return a.config.ClusterRadius > 0
+}
+
+// allocNear probes addresses outward from the given ones,
+// the nearest one wins, the lower one on a tie.
+func (a *Allocator) allocNear(pol ipam.Policy, near []xnet.IP) (xnet.IP, error) {
+	access := a.access(pol)
+	for d := uint32(1); d <= a.config.ClusterRadius; d++ {
+		for _, hint := range near {
+			u := hint.ToUint32()
+			if u >= d {
+				if ok, err := a.claimNear(u-d, hint, pol, access); ok || err != nil {
+					return xnet.Uint32ToIP(u - d), err
+				}
+			}
+			if u+d > u {
+				if ok, err := a.claimNear(u+d, hint, pol, access); ok || err != nil {
+					return xnet.Uint32ToIP(u + d), err
+				}
+			}
+		}
+	}
+
+	return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+}
+
+// claimNear claims the address if it's free and belongs to the same
+// part of the pool as the hint does: the dynamic range of the policy
+// in the wireguard subnet or the extra block.
+func (a *Allocator) claimNear(u uint32, hint xnet.IP, pol ipam.Policy, access int) (bool, error) {
+	addr := xnet.Uint32ToIP(u)
+
+	var err error
+	if b := a.block(hint); b != nil {
+		if access != ipam.AccessPolicyAllowAll || !b.pool.IsAvailable(addr) {
+			return false, nil
+		}
+		err = b.pool.Set(addr)
+	} else {
+		first, last := a.dynamicRange(access)
+		if u < first || u > last || !a.ipam.IsAvailable(addr) || !a.matches(addr, access) {
+			return false, nil
+		}
+		err = a.ipam.Set(addr, pol)
+	}
+
+	if err == nil {
+		a.used.Add(1)
+		return true, nil
+	}
+	if errors.Is(err, ippool.ErrAddressInUse) {
+		// taken concurrently, try the next one
+		return false, nil
+	}
+	return false, err
+}
+
+// keyOffset derives the offset inside the range of the given size from the key.
+func keyOffset(key string, size uint64) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8]) % size
+}
+
+// Set claims the given address, any address of the subnet
+// can be claimed regardless of the StartOffset and the quarantine.
+// Addresses of the extra blocks are claimed in the owning block.
+func (a *Allocator) Set(addr xnet.IP, pol ipam.Policy) error {
+	if a.quarantine != nil && a.quarantine.remove(addr) {
+		// claimed again with the given policy
+		if err := a.release(addr); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if b := a.block(addr); b != nil {
+		err = b.pool.Set(addr)
+	} else {
+		err = a.ipam.Set(addr, pol)
+	}
+	if err != nil {
+		return err
+	}
+	a.used.Add(1)
+	return nil
+}
+
+// Unset releases the given address, the address is kept claimed
+// by the node while quarantined, see Config.Quarantine. The pool shared
+// with other nodes gets it back at once, so a restart leaks nothing.
+func (a *Allocator) Unset(addr xnet.IP) error {
+	if a.quarantine != nil && a.Contains(addr) && !a.poolAvailable(addr) {
+		if !a.quarantine.add(addr) {
+			return xerror.EEntryNotFound("ip address is not used", nil)
+		}
+		if a.block(addr) == nil {
+			a.ipam.Hold(addr)
+		}
+		a.used.Add(-1)
+		return nil
+	}
+
+	if err := a.release(addr); err != nil {
+		return err
+	}
+	a.used.Add(-1)
+	return nil
+}
+
+// release frees the address in the owning pool.
+func (a *Allocator) release(addr xnet.IP) error {
+	if b := a.block(addr); b != nil {
+		return b.pool.Unset(addr)
+	}
+	return a.ipam.Unset(addr)
+}
+
+// releaseExpired frees addresses quarantined for the whole window.
+func (a *Allocator) releaseExpired() {
+	if a.quarantine == nil {
+		return
+	}
+	for _, addr := range a.quarantine.expired() {
+		if err := a.release(addr); err != nil {
+			zap.L().Warn("failed to release the quarantined address", zap.Stringer("addr", addr), zap.Error(err))
+		}
+	}
+}
+
+// reuseQuarantined claims the longest quarantined address
+// the peer with the given policy may get. The address taken
+// by another node meanwhile is skipped.
+func (a *Allocator) reuseQuarantined(pol ipam.Policy) (xnet.IP, error) {
+	if a.quarantine == nil {
+		return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+	}
+
+	access := a.access(pol)
+	for {
+		addr, ok := a.quarantine.takeOldest(func(addr xnet.IP) bool { return a.reusable(addr, access) })
+		if !ok {
+			return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+		}
+		if err := a.release(addr); err != nil {
+			return xnet.IP{}, err
+		}
+
+		err := a.Set(addr, pol)
+		if err == nil {
+			zap.L().Debug("reused the quarantined address", zap.Stringer("addr", addr))
+			return addr, nil
+		}
+		if !errors.Is(err, ippool.ErrAddressInUse) {
+			return xnet.IP{}, err
+		}
+	}
+}
+
+// reusable reports whether the quarantined address
+// can be allocated for the given access policy.
+func (a *Allocator) reusable(addr xnet.IP, access int) bool {
+	if a.block(addr) != nil {
+		return access == ipam.AccessPolicyAllowAll
+	}
+	first, last := a.dynamicRange(access)
+	u := addr.ToUint32()
+	return u >= first && u <= last && a.matches(addr, access)
+}
+
+// block returns the extra block owning the address, nil if none.
+func (a *Allocator) block(addr xnet.IP) *block {
+	for _, b := range a.blocks {
+		if contains(b.subnet, addr) {
+			return b
+		}
+	}
+	return nil
+}
+
+// AllocLink allocates the /31 point-to-point link for the peer
+// with the given policy, returns the lower address of the link.
+func (a *Allocator) AllocLink(pol ipam.Policy) (xnet.IP, error) {
+	if a.linkSubnet == nil {
+		return xnet.IP{}, xerror.EInvalidArgument("point-to-point links are not configured", nil)
+	}
+
+	netAddr, bcastAddr := a.linkSubnet.NetworkAddr(), a.linkSubnet.BroadcastAddr()
+	first, last := netAddr.ToUint32(), bcastAddr.ToUint32()
+	for u := first; u < last; u += 2 {
+		addr, peer := xnet.Uint32ToIP(u), xnet.Uint32ToIP(u+1)
+		if !a.ipam.IsAvailable(addr) || !a.ipam.IsAvailable(peer) {
+			continue
+		}
+
+		err := a.setLink(addr, pol)
+		if err == nil {
+			return addr, nil
+		}
+		if !errors.Is(err, ippool.ErrAddressInUse) {
+			return xnet.IP{}, err
+		}
+		// taken concurrently, try the next one
+	}
+
+	return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+}
+
+// SetLink claims the /31 point-to-point link starting at the given address.
+func (a *Allocator) SetLink(addr xnet.IP, pol ipam.Policy) error {
+	if a.linkSubnet == nil || !contains(a.linkSubnet, addr) {
+		return ippool.ErrNotInRange
+	}
+	if addr.ToUint32()%2 != 0 {
+		// not aligned to the link boundary
+		return ippool.ErrInvalidAddress
+	}
+	return a.setLink(addr, pol)
+}
+
+func (a *Allocator) setLink(addr xnet.IP, pol ipam.Policy) error {
+	if err := a.ipam.Set(addr, pol); err != nil {
+		return err
+	}
+	if err := a.ipam.Set(xnet.Uint32ToIP(addr.ToUint32()+1), pol); err != nil {
+		_ = a.ipam.Unset(addr)
+		return err
+	}
+
+	a.used.Add(2)
+	a.links.Add(1)
+	return nil
+}
+
+// UnsetLink releases the /31 point-to-point link starting at the given address.
+func (a *Allocator) UnsetLink(addr xnet.IP) error {
+	err := multierr.Append(
+		a.ipam.Unset(addr),
+		a.ipam.Unset(xnet.Uint32ToIP(addr.ToUint32()+1)),
+	)
+	if err != nil {
+		return err
+	}
+
+	a.used.Add(-2)
+	a.links.Add(-1)
+	return nil
+}
+
+// MatchesLink reports whether the address starts
+// the /31 point-to-point link of the pool.
+func (a *Allocator) MatchesLink(addr xnet.IP) bool {
+	return a.linkSubnet != nil && contains(a.linkSubnet, addr) && addr.ToUint32()%2 == 0
+}
+
+// Stats returns the current pool utilization summed across
+// the wireguard subnet and the extra blocks, or the utilization
+// of the shared pool reported by the external IPAM.
+func (a *Allocator) Stats() Stats {
+	// the pool shared with other nodes
+	if stats, ok := a.ipam.Stats(); ok {
+		stats.Links = int(a.links.Load())
+		return stats
+	}
+
+	total := usable(a.subnet)
+	for _, b := range a.blocks {
+		total += usable(b.subnet)
+	}
+	return Stats{
+		Used:  int(a.used.Load()),
+		Total: total,
+		Links: int(a.links.Load()),
+	}
+}
+
+// IsAvailable reports whether the address can be claimed by Set,
+// quarantined addresses can.
+func (a *Allocator) IsAvailable(addr xnet.IP) bool {
+	if a.quarantine != nil && a.quarantine.contains(addr) {
+		return true
+	}
+	return a.poolAvailable(addr)
+}
+
+// poolAvailable reports whether the address is free in the owning pool.
+func (a *Allocator) poolAvailable(addr xnet.IP) bool {
+	if b := a.block(addr); b != nil {
+		return b.pool.IsAvailable(addr)
+	}
+	return a.ipam.IsAvailable(addr)
+}
+
+// Contains reports whether the address belongs to the pool subnet
+// or any of the extra blocks.
+func (a *Allocator) Contains(addr xnet.IP) bool {
+	return contains(a.subnet, addr) || a.block(addr) != nil
+}
+
+// CanAlloc reports whether Alloc would succeed
+// for the given policy, nothing is claimed.
+func (a *Allocator) CanAlloc(pol ipam.Policy) bool {
+	_, err := a.available(a.access(pol))
+	return err == nil
+}
+
+// CanAllocLink reports whether AllocLink would succeed, nothing is claimed.
+func (a *Allocator) CanAllocLink() bool {
+	if a.linkSubnet == nil {
+		return false
+	}
+
+	netAddr, bcastAddr := a.linkSubnet.NetworkAddr(), a.linkSubnet.BroadcastAddr()
+	first, last := netAddr.ToUint32(), bcastAddr.ToUint32()
+	for u := first; u < last; u += 2 {
+		if a.ipam.IsAvailable(xnet.Uint32ToIP(u)) && a.ipam.IsAvailable(xnet.Uint32ToIP(u+1)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether the address belongs to the sub-pool
+// of the given policy. Any address matches if the pool is not segmented.
+// Addresses of the extra blocks match the allow_all policy only.
+func (a *Allocator) Matches(addr xnet.IP, pol ipam.Policy) bool {
+	access := a.access(pol)
+	if a.block(addr) != nil {
+		return access == ipam.AccessPolicyAllowAll
+	}
+	return a.matches(addr, access)
+}
+
+// Available returns an address that would be picked by Alloc
+// for a peer with the default policy without claiming it.
+func (a *Allocator) Available() (xnet.IP, error) {
+	return a.available(a.defaultPolicy)
+}
+
+func (a *Allocator) available(access int) (xnet.IP, error) {
+	a.releaseExpired()
+
+	addr, err := a.availableSubnet(access)
+	if err == nil || !errors.Is(err, ippool.ErrNotEnoughSpace) {
+		return addr, err
+	}
+
+	if access == ipam.AccessPolicyAllowAll {
+		for _, b := range a.blocks {
+			if addr, err := b.pool.Available(); err == nil {
+				return addr, nil
+			}
+		}
+	}
+
+	if a.quarantine != nil {
+		if addr, ok := a.quarantine.oldest(func(addr xnet.IP) bool { return a.reusable(addr, access) }); ok {
+			return addr, nil
+		}
+	}
+	return xnet.IP{}, err
+}
+
+// availableSubnet returns an address of the wireguard subnet, see available.
+func (a *Allocator) availableSubnet(access int) (xnet.IP, error) {
+	if !a.segmented() {
+		return a.ipam.Available()
+	}
+
+	first, last := a.dynamicRange(access)
+	for u := first; u <= last; u++ {
+		addr := xnet.Uint32ToIP(u)
+		if a.ipam.IsAvailable(addr) && a.matches(addr, access) {
+			return addr, nil
+		}
+	}
+
+	return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+}
+
+// segmented reports whether some addresses of the pool
+// are not available for the regular allocation.
+func (a *Allocator) segmented() bool {
+	return a.config.StartOffset != 0 || len(a.policySubnets) > 0 || a.linkSubnet != nil
+}
+
+func (a *Allocator) access(pol ipam.Policy) int {
+	if pol.Access == ipam.AccessPolicyDefault {
+		return a.defaultPolicy
+	}
+	return pol.Access
+}
+
+func (a *Allocator) matches(addr xnet.IP, access int) bool {
+	if a.linkSubnet != nil && contains(a.linkSubnet, addr) {
+		return false
+	}
+
+	if sub, ok := a.policySubnets[access]; ok {
+		return contains(sub, addr)
+	}
+
+	for _, sub := range a.policySubnets {
+		if contains(sub, addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocRange returns the addresses Alloc picks from
+// for the given access policy.
+func (a *Allocator) allocRange(access int) addressRange {
+	first, last := a.dynamicRange(access)
+	r := addressRange{first: first, last: last}
+	if a.linkSubnet != nil {
+		r.exclude = append(r.exclude, a.linkSubnet)
+	}
+	if _, ok := a.policySubnets[access]; !ok {
+		for _, sub := range a.policySubnets {
+			r.exclude = append(r.exclude, sub)
+		}
+	}
+	return r
+}
+
+// dynamicRange returns the range of addresses used by Alloc
+// for the given access policy.
+func (a *Allocator) dynamicRange(access int) (uint32, uint32) {
+	netAddr, last := a.subnet.NetworkAddr(), a.subnet.LastUsable()
+	first, end := netAddr.ToUint32()+a.config.StartOffset, last.ToUint32()
+
+	if sub, ok := a.policySubnets[access]; ok {
+		subFirst, subLast := sub.NetworkAddr(), sub.BroadcastAddr()
+		if v := subFirst.ToUint32(); v > first {
+			first = v
+		}
+		if v := subLast.ToUint32(); v < end {
+			end = v
+		}
+	}
+	return first, end
+}
+
+// usable returns the number of usable addresses of the subnet.
+func usable(subnet *xnet.IPNet) int {
+	first, last := subnet.FirstUsable(), subnet.LastUsable()
+	return int(last.ToUint32()-first.ToUint32()) + 1
+}
+
+func contains(subnet *xnet.IPNet, addr xnet.IP) bool {
+	return subnet.IPNet.Contains(addr.IP)
+}
@@ -0,0 +1,379 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package ipalloc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/ippool"
+	"github.com/vpnhouse/common-lib-go/validator"
+	"github.com/vpnhouse/common-lib-go/xnet"
+)
+
+func TestConfigValidate(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.235.0.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		offset uint32
+		valid  bool
+	}{
+		{offset: 0, valid: true},
+		{offset: 1, valid: true},
+		{offset: 100, valid: true},
+		{offset: 254, valid: true},
+		{offset: 255, valid: false},
+		{offset: 1000, valid: false},
+	}
+
+	for _, tt := range tests {
+		err := Config{StartOffset: tt.offset}.Validate(subnet)
+		if tt.valid {
+			assert.NoError(t, err, "offset %d", tt.offset)
+		} else {
+			assert.Error(t, err, "offset %d", tt.offset)
+		}
+	}
+}
+
+func TestConfigValidatePolicySubnets(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.235.0.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		subnets map[string]validator.Subnet
+		valid   bool
+	}{
+		{subnets: nil, valid: true},
+		{subnets: map[string]validator.Subnet{"allow_all": "10.235.0.128/25"}, valid: true},
+		{subnets: map[string]validator.Subnet{"allow_all": "10.235.0.128/25", "internet_only": "10.235.0.0/25"}, valid: true},
+		{subnets: map[string]validator.Subnet{"allow_all": "10.235.0.0/24", "internet_only": "10.235.0.0/25"}, valid: false},
+		{subnets: map[string]validator.Subnet{"allow_all": "10.235.1.0/25"}, valid: false},
+		{subnets: map[string]validator.Subnet{"allow_all": "10.235.0.0/23"}, valid: false},
+		{subnets: map[string]validator.Subnet{"allow_all": "foo"}, valid: false},
+		{subnets: map[string]validator.Subnet{"default": "10.235.0.128/25"}, valid: false},
+	}
+
+	for _, tt := range tests {
+		err := Config{PolicySubnets: tt.subnets}.Validate(subnet)
+		if tt.valid {
+			assert.NoError(t, err, "subnets %v", tt.subnets)
+		} else {
+			assert.Error(t, err, "subnets %v", tt.subnets)
+		}
+	}
+}
+
+func TestAllocatorMatches(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.235.0.0/24")
+	require.NoError(t, err)
+
+	config := Config{PolicySubnets: map[string]validator.Subnet{"allow_all": "10.235.0.128/25"}}
+	policySubnets, err := config.policySubnets(subnet)
+	require.NoError(t, err)
+
+	a := &Allocator{
+		subnet:        subnet,
+		config:        config,
+		defaultPolicy: ipam.AccessPolicyInternetOnly,
+		policySubnets: policySubnets,
+	}
+
+	low, high := xnet.ParseIP("10.235.0.10"), xnet.ParseIP("10.235.0.200")
+	assert.True(t, a.Matches(low, ipam.Policy{}))
+	assert.False(t, a.Matches(high, ipam.Policy{}))
+	assert.True(t, a.Matches(low, ipam.Policy{Access: ipam.AccessPolicyInternetOnly}))
+	assert.False(t, a.Matches(low, ipam.Policy{Access: ipam.AccessPolicyAllowAll}))
+	assert.True(t, a.Matches(high, ipam.Policy{Access: ipam.AccessPolicyAllowAll}))
+
+	first, last := a.dynamicRange(ipam.AccessPolicyAllowAll)
+	firstIP, lastIP := xnet.Uint32ToIP(first), xnet.Uint32ToIP(last)
+	assert.Equal(t, "10.235.0.128", firstIP.String())
+	assert.Equal(t, "10.235.0.254", lastIP.String())
+}
+
+func TestConfigValidatePointToPoint(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.235.0.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		config Config
+		valid  bool
+	}{
+		{config: Config{PointToPointSubnet: "10.235.0.128/26"}, valid: true},
+		{config: Config{PointToPointSubnet: "10.235.0.16/31"}, valid: true},
+		{config: Config{PointToPointSubnet: "10.235.0.16/32"}, valid: false},
+		// includes the pool network or broadcast address
+		{config: Config{PointToPointSubnet: "10.235.0.0/26"}, valid: false},
+		{config: Config{PointToPointSubnet: "10.235.0.192/26"}, valid: false},
+		{config: Config{PointToPointSubnet: "10.235.1.0/26"}, valid: false},
+		{config: Config{PointToPointSubnet: "foo"}, valid: false},
+		{config: Config{
+			PointToPointSubnet: "10.235.0.128/26",
+			PolicySubnets:      map[string]validator.Subnet{"allow_all": "10.235.0.128/25"},
+		}, valid: false},
+	}
+
+	for _, tt := range tests {
+		err := tt.config.Validate(subnet)
+		if tt.valid {
+			assert.NoError(t, err, "subnet %s", tt.config.PointToPointSubnet)
+		} else {
+			assert.Error(t, err, "subnet %s", tt.config.PointToPointSubnet)
+		}
+	}
+}
+
+func TestAllocatorMatchesLink(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.235.0.0/24")
+	require.NoError(t, err)
+
+	config := Config{PointToPointSubnet: "10.235.0.128/26"}
+	linkSubnet, err := config.linkSubnet(subnet, nil)
+	require.NoError(t, err)
+
+	a := &Allocator{
+		subnet:        subnet,
+		config:        config,
+		defaultPolicy: ipam.AccessPolicyInternetOnly,
+		linkSubnet:    linkSubnet,
+	}
+
+	assert.True(t, a.MatchesLink(xnet.ParseIP("10.235.0.130")))
+	// not aligned
+	assert.False(t, a.MatchesLink(xnet.ParseIP("10.235.0.131")))
+	assert.False(t, a.MatchesLink(xnet.ParseIP("10.235.0.10")))
+
+	// regular peers never get an address of the links range
+	assert.True(t, a.Matches(xnet.ParseIP("10.235.0.10"), ipam.Policy{}))
+	assert.False(t, a.Matches(xnet.ParseIP("10.235.0.130"), ipam.Policy{}))
+}
+
+func TestAllocatorStartOffset(t *testing.T) {
+	// 10.8.0.4 - 10.8.0.6 are given out dynamically
+	a := newTestAllocator(t, Config{StartOffset: 4})
+
+	available, err := a.Available()
+	require.NoError(t, err)
+	assert.Equal(t, "10.8.0.4", available.String())
+
+	assert.Equal(t, "10.8.0.4", allocString(t, a))
+	assert.Equal(t, "10.8.0.5", allocString(t, a))
+	assert.Equal(t, "10.8.0.6", allocString(t, a))
+
+	// addresses below the offset are never picked
+	_, err = a.Alloc(ipam.Policy{})
+	assert.True(t, errors.Is(err, ippool.ErrNotEnoughSpace))
+	assert.False(t, a.CanAlloc(ipam.Policy{}))
+
+	// but can be assigned explicitly
+	explicit := xnet.ParseIP("10.8.0.2")
+	assert.True(t, a.IsAvailable(explicit))
+	require.NoError(t, a.Set(explicit, ipam.Policy{}))
+	assert.Equal(t, Stats{Used: 4, Total: 6}, a.Stats())
+
+	// the released address is reused
+	require.NoError(t, a.Unset(xnet.ParseIP("10.8.0.5")))
+	assert.Equal(t, "10.8.0.5", allocString(t, a))
+}
+
+func TestKeyOffset(t *testing.T) {
+	const size = 254
+	key := "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+
+	offset := keyOffset(key, size)
+	assert.Less(t, offset, uint64(size))
+	// the same key gets the same offset on every node
+	assert.Equal(t, offset, keyOffset(key, size))
+	assert.NotEqual(t, offset, keyOffset("HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=", size))
+}
+
+func TestAllocatorAllocKeyProbing(t *testing.T) {
+	const key = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+
+	// 10.8.0.2 - 10.8.0.6
+	a := newTestAllocator(t, Config{StartOffset: 2, Deterministic: true})
+	first, last := a.dynamicRange(a.access(ipam.Policy{}))
+	size := uint64(last-first) + 1
+	nth := func(i uint64) xnet.IP {
+		return xnet.Uint32ToIP(first + uint32((keyOffset(key, size)+i)%size))
+	}
+
+	// the derived address and the next one are taken
+	require.NoError(t, a.Set(nth(0), ipam.Policy{}))
+	require.NoError(t, a.Set(nth(1), ipam.Policy{}))
+
+	addr, err := a.AllocKey(ipam.Policy{}, key)
+	require.NoError(t, err)
+	assert.Equal(t, nth(2).String(), addr.String())
+
+	// probing wraps around the range
+	addr, err = a.AllocKey(ipam.Policy{}, key)
+	require.NoError(t, err)
+	assert.Equal(t, nth(3).String(), addr.String())
+	addr, err = a.AllocKey(ipam.Policy{}, key)
+	require.NoError(t, err)
+	assert.Equal(t, nth(4).String(), addr.String())
+
+	_, err = a.AllocKey(ipam.Policy{}, key)
+	assert.True(t, errors.Is(err, ippool.ErrNotEnoughSpace))
+
+	// the released derived address is picked again
+	require.NoError(t, a.Unset(nth(0)))
+	addr, err = a.AllocKey(ipam.Policy{}, key)
+	require.NoError(t, err)
+	assert.Equal(t, nth(0).String(), addr.String())
+}
+
+func TestConfigValidateExtraSubnets(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.8.0.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		subnets []validator.Subnet
+		valid   bool
+	}{
+		{subnets: nil, valid: true},
+		{subnets: []validator.Subnet{"10.20.5.0/24"}, valid: true},
+		{subnets: []validator.Subnet{"10.20.5.0/24", "10.30.0.0/30"}, valid: true},
+		// overlaps with the wireguard subnet
+		{subnets: []validator.Subnet{"10.8.0.128/25"}, valid: false},
+		{subnets: []validator.Subnet{"10.8.0.0/16"}, valid: false},
+		// overlaps with each other
+		{subnets: []validator.Subnet{"10.20.5.0/24", "10.20.5.128/25"}, valid: false},
+		{subnets: []validator.Subnet{"10.20.5.0/31"}, valid: false},
+		{subnets: []validator.Subnet{"10.20.5.1/24"}, valid: false},
+		{subnets: []validator.Subnet{"foo"}, valid: false},
+	}
+
+	for _, tt := range tests {
+		err := Config{ExtraSubnets: tt.subnets}.Validate(subnet)
+		if tt.valid {
+			assert.NoError(t, err, "subnets %v", tt.subnets)
+		} else {
+			assert.Error(t, err, "subnets %v", tt.subnets)
+		}
+	}
+}
+
+// poolIPAM is the ipam without the netfilter and traffic control.
+type poolIPAM struct {
+	*ippool.IPv4pool
+}
+
+func (p poolIPAM) Alloc(ipam.Policy) (xnet.IP, error) {
+	return p.IPv4pool.Alloc()
+}
+
+func (p poolIPAM) Set(addr xnet.IP, _ ipam.Policy) error {
+	return p.IPv4pool.Set(addr)
+}
+
+func TestAllocatorExtraSubnets(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.8.0.0/29")
+	require.NoError(t, err)
+	pool, err := ippool.NewIPv4FromSubnet(subnet)
+	require.NoError(t, err)
+
+	a, err := newAllocator(localPool{poolIPAM{pool}}, subnet, ipam.AccessPolicyAllowAll, Config{
+		ExtraSubnets: []validator.Subnet{"10.20.5.0/29", "10.30.0.0/30"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Total: 6 + 6 + 2}, a.Stats())
+
+	// the wireguard subnet first, the server takes 10.8.0.1
+	for i := 0; i < 5; i++ {
+		addr, err := a.Alloc(ipam.Policy{})
+		require.NoError(t, err)
+		assert.True(t, contains(subnet, addr), addr.String())
+	}
+	// internet_only peers never spill into the extra blocks
+	assert.False(t, a.CanAlloc(ipam.Policy{Access: ipam.AccessPolicyInternetOnly}))
+	_, err = a.Alloc(ipam.Policy{Access: ipam.AccessPolicyInternetOnly})
+	require.True(t, errors.Is(err, ippool.ErrNotEnoughSpace))
+
+	// spills into the first extra block, its server address is reserved
+	assert.True(t, a.CanAlloc(ipam.Policy{}))
+	for i := 0; i < 5; i++ {
+		addr, err := a.Alloc(ipam.Policy{})
+		require.NoError(t, err)
+		assert.True(t, contains(a.blocks[0].subnet, addr), addr.String())
+		assert.NotEqual(t, "10.20.5.1", addr.String())
+	}
+	// then into the second one
+	addr, err := a.AllocKey(ipam.Policy{}, "key")
+	require.NoError(t, err)
+	assert.Equal(t, "10.30.0.2", addr.String())
+	_, err = a.Alloc(ipam.Policy{})
+	require.True(t, errors.Is(err, ippool.ErrNotEnoughSpace))
+	assert.Equal(t, Stats{Used: 11, Total: 14}, a.Stats())
+
+	// the address is released to the owning block
+	released := xnet.ParseIP("10.20.5.4")
+	assert.False(t, a.IsAvailable(released))
+	require.NoError(t, a.Unset(released))
+	assert.True(t, a.IsAvailable(released))
+	require.NoError(t, a.Set(released, ipam.Policy{}))
+	assert.True(t, errors.Is(a.Set(released, ipam.Policy{}), ippool.ErrAddressInUse))
+
+	assert.True(t, a.Contains(released))
+	assert.True(t, a.Matches(released, ipam.Policy{}))
+	assert.False(t, a.Matches(released, ipam.Policy{Access: ipam.AccessPolicyInternetOnly}))
+
+	// matches none of the blocks
+	outside := xnet.ParseIP("10.40.0.2")
+	assert.False(t, a.Contains(outside))
+	assert.True(t, errors.Is(a.Set(outside, ipam.Policy{}), ippool.ErrNotInRange))
+}
+
+func TestAllocatorAllocNear(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.8.0.0/24")
+	require.NoError(t, err)
+	assert.Error(t, Config{ClusterRadius: 4, Deterministic: true}.Validate(subnet))
+
+	pool, err := ippool.NewIPv4FromSubnet(subnet)
+	require.NoError(t, err)
+	a, err := newAllocator(localPool{poolIPAM{pool}}, subnet, ipam.AccessPolicyAllowAll, Config{ClusterRadius: 2})
+	require.NoError(t, err)
+	require.True(t, a.Clustering())
+
+	// outward from the user's address, the lower one first
+	near := []xnet.IP{xnet.ParseIP("10.8.0.50")}
+	require.NoError(t, a.Set(near[0], ipam.Policy{}))
+	for _, expected := range []string{"10.8.0.49", "10.8.0.51", "10.8.0.48", "10.8.0.52"} {
+		addr, clustered, err := a.AllocNear(ipam.Policy{}, near)
+		require.NoError(t, err)
+		assert.True(t, clustered)
+		assert.Equal(t, expected, addr.String())
+	}
+
+	// the nearest of all the user's addresses wins
+	near = append(near, xnet.ParseIP("10.8.0.100"))
+	require.NoError(t, a.Set(near[1], ipam.Policy{}))
+	addr, clustered, err := a.AllocNear(ipam.Policy{}, near)
+	require.NoError(t, err)
+	assert.True(t, clustered)
+	assert.Equal(t, "10.8.0.99", addr.String())
+
+	// nothing free within the radius
+	addr, clustered, err = a.AllocNear(ipam.Policy{}, near[:1])
+	require.NoError(t, err)
+	assert.False(t, clustered)
+	assert.True(t, contains(subnet, addr), addr.String())
+	assert.Equal(t, Stats{Used: 8, Total: 254}, a.Stats())
+
+	// the clustering is disabled
+	pool, err = ippool.NewIPv4FromSubnet(subnet)
+	require.NoError(t, err)
+	a, err = newAllocator(localPool{poolIPAM{pool}}, subnet, ipam.AccessPolicyAllowAll, Config{})
+	require.NoError(t, err)
+	_, clustered, err = a.AllocNear(ipam.Policy{}, near)
+	require.NoError(t, err)
+	assert.False(t, clustered)
+}
@@ -0,0 +1,361 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package ipalloc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/ippool"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"go.uber.org/zap"
+)
+
+const (
+	// BackendLocal keeps the pool in memory of the node
+	BackendLocal = "local"
+	// BackendExternal requests addresses from the external IPAM
+	BackendExternal = "external"
+
+	defaultExternalTimeout  = 5 * time.Second
+	defaultExternalStatsTTL = 30 * time.Second
+)
+
+// ExternalConfig is the external IPAM owning addresses of the pool.
+type ExternalConfig struct {
+	// URL of the pool in the IPAM API, e.g. https://ipam.example.com/pools/vpn
+	URL string `yaml:"url"`
+	// Token is sent as the bearer token, optional
+	Token string `yaml:"token,omitempty"`
+	// Owner identifies the node to the IPAM, default: the hostname
+	Owner string `yaml:"owner,omitempty"`
+	// Timeout of the single request, default: 5s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// StatsTTL is how long the pool stats are cached, default: 30s
+	StatsTTL time.Duration `yaml:"stats_ttl,omitempty"`
+}
+
+func (c ExternalConfig) validate() error {
+	const field = "ip_pool.external.url"
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return xerror.EInvalidConfiguration(field+": the http(s) URL is required", field)
+	}
+	return nil
+}
+
+func (c ExternalConfig) withDefaults() ExternalConfig {
+	if len(c.Owner) == 0 {
+		c.Owner, _ = os.Hostname()
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultExternalTimeout
+	}
+	if c.StatsTTL <= 0 {
+		c.StatsTTL = defaultExternalStatsTTL
+	}
+	return c
+}
+
+// external is the address manager claiming addresses
+// in the external IPAM before they are set locally,
+// the local IPAM applies access policies of the claimed ones.
+// Addresses claimed by other nodes are only known to the external IPAM,
+// so IsAvailable reports the local state, and claiming such an address
+// fails with ippool.ErrAddressInUse.
+type external struct {
+	local  addressPool
+	config ExternalConfig
+	client *http.Client
+
+	// lock guards the fields below
+	lock sync.Mutex
+	// releases are addresses the IPAM failed to release,
+	// retried before the next request
+	releases map[string]xnet.IP
+	// held are addresses released to the IPAM
+	// while claimed locally, see Hold
+	held    map[string]struct{}
+	stats   Stats
+	statsAt time.Time
+}
+
+func newExternal(local addressPool, config ExternalConfig) *external {
+	config = config.withDefaults()
+	return &external{
+		local:    local,
+		config:   config,
+		client:   &http.Client{Timeout: config.Timeout},
+		releases: map[string]xnet.IP{},
+		held:     map[string]struct{}{},
+	}
+}
+
+type externalClaim struct {
+	Owner   string `json:"owner"`
+	Address string `json:"address,omitempty"`
+	// First, Last and Exclude limit the addresses
+	// of the segmented pool /allocate may return
+	First   string   `json:"first,omitempty"`
+	Last    string   `json:"last,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+type externalStats struct {
+	Used  int `json:"used"`
+	Total int `json:"total"`
+}
+
+func (e *external) Alloc(pol ipam.Policy) (xnet.IP, error) {
+	return e.allocate(pol, externalClaim{Owner: e.config.Owner}, nil)
+}
+
+// AllocRange sends the range to the IPAM, so the address is picked
+// by the single request instead of claiming addresses one by one.
+func (e *external) AllocRange(pol ipam.Policy, r addressRange) (xnet.IP, error) {
+	req := externalClaim{
+		Owner: e.config.Owner,
+		First: xnet.Uint32ToIP(r.first).String(),
+		Last:  xnet.Uint32ToIP(r.last).String(),
+	}
+	for _, sub := range r.exclude {
+		req.Exclude = append(req.Exclude, sub.String())
+	}
+	return e.allocate(pol, req, &r)
+}
+
+// allocate claims the address picked by the IPAM,
+// it must be in the range if one is given.
+func (e *external) allocate(pol ipam.Policy, req externalClaim, r *addressRange) (xnet.IP, error) {
+	e.flushReleases()
+
+	var claim externalClaim
+	status, err := e.do(http.MethodPost, "/allocate", req, &claim)
+	if err != nil {
+		return xnet.IP{}, err
+	}
+	if status == http.StatusConflict {
+		return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+	}
+	if status != http.StatusOK {
+		return xnet.IP{}, e.statusError("allocate", status)
+	}
+
+	addr := xnet.ParseIP(claim.Address)
+	if addr.IP == nil || !addr.Isv4() {
+		return xnet.IP{}, xerror.EInternalError("external IPAM returned the invalid address", nil, zap.String("address", claim.Address))
+	}
+	if r != nil && !r.contains(addr) {
+		e.release(addr)
+		return xnet.IP{}, xerror.EInternalError("external IPAM returned the address out of the range", nil,
+			zap.String("address", claim.Address), zap.String("first", req.First), zap.String("last", req.Last))
+	}
+	if err := e.local.Set(addr, pol); err != nil {
+		e.release(addr)
+		return xnet.IP{}, err
+	}
+	return addr, nil
+}
+
+func (e *external) Set(addr xnet.IP, pol ipam.Policy) error {
+	e.flushReleases()
+
+	// the address out of the subnet is never claimed
+	if !e.local.IsAvailable(addr) {
+		return e.local.Set(addr, pol)
+	}
+
+	status, err := e.do(http.MethodPut, "/addresses/"+addr.String(), externalClaim{Owner: e.config.Owner}, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict {
+		return ippool.ErrAddressInUse
+	}
+	if status != http.StatusOK && status != http.StatusCreated && status != http.StatusNoContent {
+		return e.statusError("claim", status)
+	}
+
+	if err := e.local.Set(addr, pol); err != nil {
+		e.release(addr)
+		return err
+	}
+	return nil
+}
+
+// Unset releases the address locally, the IPAM release
+// is retried later if it fails, so the local state is always updated.
+// The held address is released in the IPAM already.
+func (e *external) Unset(addr xnet.IP) error {
+	if err := e.local.Unset(addr); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	_, held := e.held[addr.String()]
+	delete(e.held, addr.String())
+	e.lock.Unlock()
+
+	if !held {
+		e.release(addr)
+	}
+	return nil
+}
+
+// Hold releases the address in the IPAM keeping it claimed locally,
+// so the quarantined address is not lost if the node stops.
+// Claiming it again fails if another node has taken it meanwhile.
+func (e *external) Hold(addr xnet.IP) {
+	e.lock.Lock()
+	e.held[addr.String()] = struct{}{}
+	e.lock.Unlock()
+
+	e.release(addr)
+}
+
+func (e *external) IsAvailable(addr xnet.IP) bool {
+	return e.local.IsAvailable(addr)
+}
+
+// Available returns the locally free address unless the IPAM
+// reports the pool is exhausted.
+func (e *external) Available() (xnet.IP, error) {
+	if s, ok := e.Stats(); ok && s.Used >= s.Total {
+		return xnet.IP{}, xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+	}
+	return e.local.Available()
+}
+
+// Stats returns the pool utilization reported by the IPAM,
+// cached for the StatsTTL. The last known stats are returned
+// if the IPAM fails, false if there are none.
+func (e *external) Stats() (Stats, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if !e.statsAt.IsZero() && time.Since(e.statsAt) < e.config.StatsTTL {
+		return e.stats, true
+	}
+
+	var stats externalStats
+	status, err := e.do(http.MethodGet, "/stats", nil, &stats)
+	if err == nil && status != http.StatusOK {
+		err = e.statusError("stats", status)
+	}
+	if err != nil {
+		zap.L().Warn("failed to get the external IPAM stats", zap.Error(err))
+		return e.stats, !e.statsAt.IsZero()
+	}
+
+	e.stats = Stats{Used: stats.Used, Total: stats.Total}
+	e.statsAt = time.Now()
+	return e.stats, true
+}
+
+// release releases the address in the IPAM,
+// it's queued for the retry on failure.
+func (e *external) release(addr xnet.IP) {
+	if err := e.releaseNow(addr); err != nil {
+		zap.L().Warn("failed to release the address in the external IPAM, will retry",
+			zap.Stringer("address", addr), zap.Error(err))
+		e.lock.Lock()
+		e.releases[addr.String()] = addr
+		e.lock.Unlock()
+	}
+}
+
+func (e *external) releaseNow(addr xnet.IP) error {
+	status, err := e.do(http.MethodDelete, "/addresses/"+addr.String(), externalClaim{Owner: e.config.Owner}, nil)
+	if err != nil {
+		return err
+	}
+	// not found means it's released already
+	if status != http.StatusOK && status != http.StatusNoContent && status != http.StatusNotFound {
+		return e.statusError("release", status)
+	}
+	return nil
+}
+
+// flushReleases retries the failed releases, the address
+// claimed again locally is not released unless it's held.
+func (e *external) flushReleases() {
+	e.lock.Lock()
+	pending := make([]xnet.IP, 0, len(e.releases))
+	for _, addr := range e.releases {
+		pending = append(pending, addr)
+	}
+	e.lock.Unlock()
+
+	for _, addr := range pending {
+		e.lock.Lock()
+		_, held := e.held[addr.String()]
+		e.lock.Unlock()
+
+		var err error
+		if held || e.local.IsAvailable(addr) {
+			err = e.releaseNow(addr)
+		}
+		if err != nil {
+			zap.L().Warn("failed to release the address in the external IPAM", zap.Stringer("address", addr), zap.Error(err))
+			continue
+		}
+
+		e.lock.Lock()
+		delete(e.releases, addr.String())
+		e.lock.Unlock()
+	}
+}
+
+// do sends the request to the IPAM, the response body
+// is decoded into the given value on success.
+// Returns the response status.
+func (e *external) do(method string, path string, body interface{}, v interface{}) (int, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return 0, xerror.EInternalError("failed to marshal the IPAM request", err)
+		}
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(e.config.URL, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, xerror.EInternalError("failed to create the IPAM request", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(e.config.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+e.config.Token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, xerror.EUnavailable("external IPAM is unavailable", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return 0, xerror.EUnavailable("external IPAM returned the invalid response", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (e *external) statusError(op string, status int) error {
+	return xerror.EUnavailable(fmt.Sprintf("external IPAM failed to %s the address", op),
+		errors.New(http.StatusText(status)), zap.Int("status", status))
+}
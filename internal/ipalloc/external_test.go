@@ -0,0 +1,309 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package ipalloc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/ippool"
+	"github.com/vpnhouse/common-lib-go/validator"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+)
+
+// fakeIPAM is the external IPAM shared by nodes.
+type fakeIPAM struct {
+	mu     sync.Mutex
+	free   []string
+	owners map[string]string
+	total  int
+	// failing makes every request fail
+	failing bool
+	// requests counts requests by the method
+	requests map[string]int
+}
+
+func newFakeIPAM(free ...string) *fakeIPAM {
+	return &fakeIPAM{free: free, owners: map[string]string{}, total: len(free), requests: map[string]int{}}
+}
+
+func (f *fakeIPAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failing {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.requests[r.Method]++
+
+	var claim externalClaim
+	if r.Method != http.MethodGet {
+		_ = json.NewDecoder(r.Body).Decode(&claim)
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/pools/vpn")
+	switch {
+	case r.Method == http.MethodGet && path == "/stats":
+		_ = json.NewEncoder(w).Encode(externalStats{Used: len(f.owners), Total: f.total})
+	case r.Method == http.MethodPost && path == "/allocate":
+		for i, addr := range f.free {
+			if _, ok := f.owners[addr]; ok || !claim.allows(addr) {
+				continue
+			}
+			f.free = append(f.free[:i:i], f.free[i+1:]...)
+			f.owners[addr] = claim.Owner
+			_ = json.NewEncoder(w).Encode(externalClaim{Owner: claim.Owner, Address: addr})
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+	case r.Method == http.MethodPut:
+		addr := strings.TrimPrefix(path, "/addresses/")
+		if owner, ok := f.owners[addr]; ok && owner != claim.Owner {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.owners[addr] = claim.Owner
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		addr := strings.TrimPrefix(path, "/addresses/")
+		if _, ok := f.owners[addr]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.owners, addr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// allows reports whether the address is in the range of the claim.
+func (c externalClaim) allows(addr string) bool {
+	ip, first, last := xnet.ParseIP(addr), xnet.ParseIP(c.First), xnet.ParseIP(c.Last)
+	if len(c.First) > 0 && ip.ToUint32() < first.ToUint32() {
+		return false
+	}
+	if len(c.Last) > 0 && ip.ToUint32() > last.ToUint32() {
+		return false
+	}
+	for _, s := range c.Exclude {
+		_, sub, _ := xnet.ParseCIDR(s)
+		if contains(sub, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeIPAM) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method]
+}
+
+func (f *fakeIPAM) owner(addr string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.owners[addr]
+}
+
+func (f *fakeIPAM) claim(addr string, owner string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.owners[addr] = owner
+}
+
+func (f *fakeIPAM) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func TestExternalAllocator(t *testing.T) {
+	fake := newFakeIPAM("10.8.0.2", "10.8.0.3", "10.8.0.4")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	_, subnet, err := xnet.ParseCIDR("10.8.0.0/29")
+	require.NoError(t, err)
+	pool, err := ippool.NewIPv4FromSubnet(subnet)
+	require.NoError(t, err)
+
+	config := Config{
+		Backend: BackendExternal,
+		External: &ExternalConfig{
+			URL:      server.URL + "/pools/vpn/",
+			Token:    "secret",
+			Owner:    "node1",
+			StatsTTL: time.Hour,
+		},
+	}
+	a, err := newAllocator(newExternal(poolIPAM{pool}, *config.External), subnet, ipam.AccessPolicyAllowAll, config)
+	require.NoError(t, err)
+
+	// the address comes from the IPAM
+	addr, err := a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.8.0.2", addr.String())
+	assert.Equal(t, "node1", fake.owner("10.8.0.2"))
+	assert.False(t, a.IsAvailable(addr))
+
+	// the address claimed by another node
+	fake.claim("10.8.0.5", "node2")
+	taken := xnet.ParseIP("10.8.0.5")
+	assert.True(t, errors.Is(a.Set(taken, ipam.Policy{}), ippool.ErrAddressInUse))
+	assert.True(t, a.IsAvailable(taken))
+
+	// restored addresses are claimed again
+	restored := xnet.ParseIP("10.8.0.6")
+	require.NoError(t, a.Set(restored, ipam.Policy{}))
+	assert.Equal(t, "node1", fake.owner("10.8.0.6"))
+
+	// the shared pool stats are cached
+	assert.Equal(t, Stats{Used: 3, Total: 3}, a.Stats())
+	fake.claim("10.8.0.7", "node2")
+	assert.Equal(t, Stats{Used: 3, Total: 3}, a.Stats())
+	assert.False(t, a.CanAlloc(ipam.Policy{}))
+
+	// the IPAM is unavailable: nothing is allocated,
+	// the release is retried later
+	fake.setFailing(true)
+	_, err = a.Alloc(ipam.Policy{})
+	assert.ErrorIs(t, err, xerror.EUnavailable("", nil))
+	require.NoError(t, a.Unset(restored))
+	assert.True(t, a.IsAvailable(restored))
+	assert.Equal(t, "node1", fake.owner("10.8.0.6"))
+
+	fake.setFailing(false)
+	addr, err = a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.8.0.3", addr.String())
+	assert.Empty(t, fake.owner("10.8.0.6"))
+
+	// the pool is exhausted in the IPAM
+	_, err = a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+	_, err = a.Alloc(ipam.Policy{})
+	assert.True(t, errors.Is(err, ippool.ErrNotEnoughSpace))
+}
+
+func TestExternalAllocatorRange(t *testing.T) {
+	fake := newFakeIPAM("10.8.0.2", "10.8.0.3", "10.8.0.4", "10.8.0.5", "10.8.0.6")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	_, subnet, err := xnet.ParseCIDR("10.8.0.0/29")
+	require.NoError(t, err)
+	pool, err := ippool.NewIPv4FromSubnet(subnet)
+	require.NoError(t, err)
+
+	config := Config{
+		Backend:     BackendExternal,
+		External:    &ExternalConfig{URL: server.URL + "/pools/vpn/", Token: "secret", Owner: "node1"},
+		StartOffset: 4,
+		PolicySubnets: map[string]validator.Subnet{
+			"internet_only": "10.8.0.6/31",
+		},
+	}
+	a, err := newAllocator(newExternal(poolIPAM{pool}, *config.External), subnet, ipam.AccessPolicyAllowAll, config)
+	require.NoError(t, err)
+
+	// the IPAM picks the address of the segment by the single request
+	addr, err := a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.8.0.4", addr.String())
+	addr, err = a.Alloc(ipam.Policy{Access: ipam.AccessPolicyInternetOnly})
+	require.NoError(t, err)
+	assert.Equal(t, "10.8.0.6", addr.String())
+	assert.Equal(t, 2, fake.count(http.MethodPost))
+	assert.Zero(t, fake.count(http.MethodPut))
+
+	// 10.8.0.5 is the last one of the allow_all segment
+	addr, err = a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.8.0.5", addr.String())
+	_, err = a.Alloc(ipam.Policy{})
+	assert.True(t, errors.Is(err, ippool.ErrNotEnoughSpace))
+	assert.Empty(t, fake.owner("10.8.0.2"))
+	assert.Empty(t, fake.owner("10.8.0.3"))
+}
+
+func TestExternalAllocatorQuarantine(t *testing.T) {
+	fake := newFakeIPAM("10.8.0.2", "10.8.0.3")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	_, subnet, err := xnet.ParseCIDR("10.8.0.0/29")
+	require.NoError(t, err)
+	pool, err := ippool.NewIPv4FromSubnet(subnet)
+	require.NoError(t, err)
+
+	config := Config{
+		Backend:    BackendExternal,
+		External:   &ExternalConfig{URL: server.URL + "/pools/vpn/", Token: "secret", Owner: "node1"},
+		Quarantine: time.Hour,
+	}
+	a, err := newAllocator(newExternal(poolIPAM{pool}, *config.External), subnet, ipam.AccessPolicyAllowAll, config)
+	require.NoError(t, err)
+
+	first, err := a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+	second, err := a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+
+	// the quarantined address is given back to the IPAM at once,
+	// the node still keeps it off the automatic allocation
+	require.NoError(t, a.Unset(first))
+	require.NoError(t, a.Unset(second))
+	assert.Empty(t, fake.owner(first.String()))
+	assert.Empty(t, fake.owner(second.String()))
+	assert.False(t, a.poolAvailable(first))
+
+	// another node has taken the oldest one, the next one is reused
+	fake.claim(first.String(), "node2")
+	addr, err := a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+	assert.Equal(t, second.String(), addr.String())
+	assert.Equal(t, "node1", fake.owner(second.String()))
+	assert.Equal(t, "node2", fake.owner(first.String()))
+	assert.True(t, a.poolAvailable(first))
+
+	// the reused address is released to the IPAM as usual
+	fake.setFailing(true)
+	require.NoError(t, a.Unset(second))
+	fake.setFailing(false)
+	require.NoError(t, a.Set(second, ipam.Policy{}))
+	assert.Equal(t, "node1", fake.owner(second.String()))
+}
+
+func TestConfigValidateBackend(t *testing.T) {
+	_, subnet, err := xnet.ParseCIDR("10.235.0.0/24")
+	require.NoError(t, err)
+
+	external := &ExternalConfig{URL: "https://ipam.example.com/pools/vpn"}
+	assert.NoError(t, Config{}.Validate(subnet))
+	assert.NoError(t, Config{Backend: BackendLocal}.Validate(subnet))
+	assert.NoError(t, Config{Backend: BackendExternal, External: external}.Validate(subnet))
+	assert.Error(t, Config{Backend: "consul"}.Validate(subnet))
+	assert.Error(t, Config{Backend: BackendExternal}.Validate(subnet))
+	assert.Error(t, Config{Backend: BackendExternal, External: &ExternalConfig{URL: "ipam:8080"}}.Validate(subnet))
+	assert.Error(t, Config{Backend: BackendExternal, External: external, ExtraSubnets: []validator.Subnet{"10.20.0.0/24"}}.Validate(subnet))
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package ipalloc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vpnhouse/common-lib-go/xnet"
+)
+
+const defaultQuarantine = 10 * time.Second
+
+// quarantine holds addresses released by the Allocator.Unset,
+// they stay claimed in the pool until the window elapses,
+// so the automatic allocation never picks them, see Config.Quarantine.
+type quarantine struct {
+	window time.Duration
+	now    func() time.Time
+
+	lock sync.Mutex
+	// freed holds the release time of quarantined addresses
+	freed map[uint32]time.Time
+}
+
+func newQuarantine(window time.Duration) *quarantine {
+	return &quarantine{
+		window: window,
+		now:    time.Now,
+		freed:  map[uint32]time.Time{},
+	}
+}
+
+// add quarantines the address, reports false if it's quarantined already.
+func (q *quarantine) add(addr xnet.IP) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	u := addr.ToUint32()
+	if _, ok := q.freed[u]; ok {
+		return false
+	}
+	q.freed[u] = q.now()
+	return true
+}
+
+// remove takes the address out of the quarantine,
+// reports whether it was quarantined.
+func (q *quarantine) remove(addr xnet.IP) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	u := addr.ToUint32()
+	if _, ok := q.freed[u]; !ok {
+		return false
+	}
+	delete(q.freed, u)
+	return true
+}
+
+func (q *quarantine) contains(addr xnet.IP) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	_, ok := q.freed[addr.ToUint32()]
+	return ok
+}
+
+// expired takes addresses quarantined for the whole window out.
+func (q *quarantine) expired() []xnet.IP {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var addrs []xnet.IP
+	deadline := q.now().Add(-q.window)
+	for u, freed := range q.freed {
+		if !freed.After(deadline) {
+			addrs = append(addrs, xnet.Uint32ToIP(u))
+			delete(q.freed, u)
+		}
+	}
+	return addrs
+}
+
+// oldest returns the longest quarantined address accepted by the filter.
+func (q *quarantine) oldest(accept func(addr xnet.IP) bool) (xnet.IP, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.find(accept)
+}
+
+// takeOldest is like oldest, but the address is taken out.
+func (q *quarantine) takeOldest(accept func(addr xnet.IP) bool) (xnet.IP, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	addr, ok := q.find(accept)
+	if ok {
+		delete(q.freed, addr.ToUint32())
+	}
+	return addr, ok
+}
+
+func (q *quarantine) find(accept func(addr xnet.IP) bool) (xnet.IP, bool) {
+	var (
+		oldest xnet.IP
+		at     time.Time
+		found  bool
+	)
+	for u, freed := range q.freed {
+		addr := xnet.Uint32ToIP(u)
+		// the lower address on a tie, to be deterministic
+		if found && (freed.After(at) || freed.Equal(at) && u > oldest.ToUint32()) {
+			continue
+		}
+		if accept(addr) {
+			oldest, at, found = addr, freed, true
+		}
+	}
+	return oldest, found
+}
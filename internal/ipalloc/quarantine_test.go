@@ -0,0 +1,117 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package ipalloc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/ippool"
+	"github.com/vpnhouse/common-lib-go/xnet"
+)
+
+func newTestAllocator(t *testing.T, config Config) *Allocator {
+	t.Helper()
+
+	// 10.8.0.2 - 10.8.0.6, the server takes 10.8.0.1,
+	// the pool picks addresses randomly unless segmented
+	_, subnet, err := xnet.ParseCIDR("10.8.0.0/29")
+	require.NoError(t, err)
+	pool, err := ippool.NewIPv4FromSubnet(subnet)
+	require.NoError(t, err)
+
+	a, err := newAllocator(localPool{poolIPAM{pool}}, subnet, ipam.AccessPolicyAllowAll, config)
+	require.NoError(t, err)
+	return a
+}
+
+func allocString(t *testing.T, a *Allocator) string {
+	t.Helper()
+
+	addr, err := a.Alloc(ipam.Policy{})
+	require.NoError(t, err)
+	return addr.String()
+}
+
+func TestAllocatorQuarantine(t *testing.T) {
+	// picked sequentially from the offset
+	a := newTestAllocator(t, Config{StartOffset: 2, Quarantine: 10 * time.Second})
+	now := time.Now()
+	a.quarantine.now = func() time.Time { return now }
+
+	assert.Equal(t, "10.8.0.2", allocString(t, a))
+	assert.Equal(t, "10.8.0.3", allocString(t, a))
+
+	// the released address is not given out within the window
+	released := xnet.ParseIP("10.8.0.2")
+	require.NoError(t, a.Unset(released))
+	assert.Equal(t, "10.8.0.4", allocString(t, a))
+	assert.Equal(t, Stats{Used: 2, Total: 6}, a.Stats())
+	assert.Error(t, a.Unset(released))
+
+	// but it's reused once the window elapses
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, "10.8.0.2", allocString(t, a))
+
+	// all free addresses are quarantined, the oldest one is reused
+	require.NoError(t, a.Unset(xnet.ParseIP("10.8.0.4")))
+	now = now.Add(time.Second)
+	require.NoError(t, a.Unset(xnet.ParseIP("10.8.0.3")))
+	assert.Equal(t, "10.8.0.5", allocString(t, a))
+	assert.Equal(t, "10.8.0.6", allocString(t, a))
+	assert.True(t, a.CanAlloc(ipam.Policy{}))
+	assert.Equal(t, "10.8.0.4", allocString(t, a))
+	assert.Equal(t, "10.8.0.3", allocString(t, a))
+	_, err := a.Alloc(ipam.Policy{})
+	assert.True(t, errors.Is(err, ippool.ErrNotEnoughSpace))
+	assert.False(t, a.CanAlloc(ipam.Policy{}))
+
+	// the quarantined address can be assigned explicitly
+	explicit := xnet.ParseIP("10.8.0.5")
+	require.NoError(t, a.Unset(explicit))
+	assert.True(t, a.IsAvailable(explicit))
+	require.NoError(t, a.Set(explicit, ipam.Policy{}))
+	assert.False(t, a.IsAvailable(explicit))
+	assert.True(t, errors.Is(a.Set(explicit, ipam.Policy{}), ippool.ErrAddressInUse))
+	assert.Equal(t, Stats{Used: 5, Total: 6}, a.Stats())
+}
+
+func TestAllocatorQuarantineRandom(t *testing.T) {
+	a := newTestAllocator(t, Config{Quarantine: time.Minute})
+
+	// one address is left
+	allocated := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		allocated[allocString(t, a)] = true
+	}
+	free, err := a.Available()
+	require.NoError(t, err)
+
+	for addr := range allocated {
+		require.NoError(t, a.Unset(xnet.ParseIP(addr)))
+		assert.Equal(t, free.String(), allocString(t, a))
+		// the released address is the only one left now
+		assert.Equal(t, addr, allocString(t, a))
+		break
+	}
+}
+
+func TestAllocatorQuarantineDisabled(t *testing.T) {
+	// disabled by default
+	a := newTestAllocator(t, Config{StartOffset: 2})
+	assert.Nil(t, a.quarantine)
+
+	assert.Equal(t, "10.8.0.2", allocString(t, a))
+	require.NoError(t, a.Unset(xnet.ParseIP("10.8.0.2")))
+	assert.Equal(t, "10.8.0.2", allocString(t, a))
+
+	_, subnet, err := xnet.ParseCIDR("10.8.0.0/29")
+	require.NoError(t, err)
+	assert.Error(t, Config{Quarantine: -time.Second}.Validate(subnet))
+}
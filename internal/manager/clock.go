@@ -0,0 +1,59 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/proto"
+	"go.uber.org/zap"
+)
+
+// expiryAnomalyMinPeers is the minimal number of peers expiring
+// within a tick to suspect the clock anomaly, so small nodes
+// do not trip the guard on ordinary expirations.
+const expiryAnomalyMinPeers = 10
+
+// expiryAnomaly reports whether expiring of the given number of peers
+// out of total within a single tick looks like the server clock jump.
+func expiryAnomaly(expiring int, total int, fraction float64) bool {
+	if expiring < expiryAnomalyMinPeers || total == 0 {
+		return false
+	}
+	return float64(expiring) > fraction*float64(total)
+}
+
+// checkClockAnomaly reports whether the expiration of peers must be
+// skipped for the tick. The warning is logged on every such tick,
+// the event is pushed once the anomaly is detected.
+func (manager *Manager) checkClockAnomaly(now time.Time, expiring int, total int) bool {
+	if !expiryAnomaly(expiring, total, manager.runtime.Settings.GetExpiryAnomalyFraction()) {
+		if manager.clockAnomaly.Swap(false) {
+			zap.L().Info("peer expiration is back to normal")
+		}
+		return false
+	}
+
+	zap.L().Warn("CLOCK ANOMALY: too many peers expired at once, expiration skipped; check the server clock and NTP",
+		zap.Int("expiring", expiring),
+		zap.Int("total", total),
+		zap.Time("server_time", now))
+
+	if manager.clockAnomaly.Swap(true) {
+		// already reported
+		return true
+	}
+
+	event := &proto.ClockAnomalyInfo{
+		Expiring:   uint64(expiring),
+		Total:      uint64(total),
+		ServerTime: proto.TimestampFromTime(now),
+	}
+	if err := manager.eventLog.Push(eventlog.ServerClockAnomaly, event); err != nil {
+		zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_ServerClockAnomaly)))
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/proto"
+	"go.uber.org/zap"
+)
+
+type correlationIDKey struct{}
+
+type modifiedByKey struct{}
+
+// WithCorrelationID returns the context carrying the given correlation ID,
+// peer operations performed with such context report it
+// in their logs and events.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if len(id) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by the context, if any.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// WithModifiedBy returns the context carrying the identity of the admin
+// on whose behalf peers are changed, it's recorded as the peer's
+// last modifier.
+func WithModifiedBy(ctx context.Context, who string) context.Context {
+	if len(who) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, modifiedByKey{}, who)
+}
+
+// ModifiedBy returns the admin identity carried by the context, if any.
+func ModifiedBy(ctx context.Context) string {
+	who, _ := ctx.Value(modifiedByKey{}).(string)
+	return who
+}
+
+// stampModifiedBy records the context's admin identity in the peer,
+// the peer is left intact if there is none.
+func stampModifiedBy(ctx context.Context, peer *types.PeerInfo) {
+	if who := ModifiedBy(ctx); len(who) > 0 {
+		peer.ModifiedBy = &who
+	}
+}
+
+// logger returns the logger annotated with the context's correlation ID.
+func logger(ctx context.Context) *zap.Logger {
+	if id := CorrelationID(ctx); len(id) > 0 {
+		return zap.L().With(zap.String("correlation_id", id))
+	}
+	return zap.L()
+}
+
+// peerEvent returns the event payload for the peer
+// annotated with the context's correlation ID.
+func peerEvent(ctx context.Context, peer *types.PeerInfo) *proto.PeerInfo {
+	p := peer.IntoProto()
+	p.CorrelationID = CorrelationID(ctx)
+	return p
+}
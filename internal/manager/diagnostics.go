@@ -0,0 +1,224 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// staleHandshakeAge is the age of the last handshake after which the
+// session can't be used anymore (wireguard's Reject-After-Time),
+// active peers renew it every two minutes.
+const staleHandshakeAge = 180 * time.Second
+
+// PeerDiagnostics describes the peer's state on the wireguard device.
+// The kernel does not expose handshake attempts or errors,
+// so the diagnosis is derived from the device presence
+// and the age of the last handshake.
+type PeerDiagnostics struct {
+	ID int64 `json:"id"`
+	// Programmed reports whether the peer is configured on the device
+	Programmed bool `json:"programmed"`
+	// InSync is false if the device configuration of the peer
+	// differs from the stored one
+	InSync  bool `json:"in_sync"`
+	Expired bool `json:"expired"`
+	// Idle reports whether the peer is removed from the device
+	// due to the lack of traffic until the next connect
+	Idle bool `json:"idle,omitempty"`
+	// LastHandshake is omitted if the peer has never completed the handshake
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	// HandshakeAgeSeconds is the age of the last handshake, if any
+	HandshakeAgeSeconds int64  `json:"handshake_age_seconds,omitempty"`
+	Endpoint            string `json:"endpoint,omitempty"`
+	ReceivedBytes       int64  `json:"rx_bytes"`
+	TransmittedBytes    int64  `json:"tx_bytes"`
+	// LastSyncError is the last error of programming the peer on the device
+	LastSyncError string `json:"last_sync_error,omitempty"`
+	// Diagnosis is the human readable summary of the above
+	Diagnosis string `json:"diagnosis"`
+}
+
+// PeerDiagnostics returns the state of the peer on the wireguard device.
+func (manager *Manager) PeerDiagnostics(ctx context.Context, id int64) (*PeerDiagnostics, error) {
+	if !manager.running.Load().(bool) {
+		return nil, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
+	}
+	defer manager.lock.Unlock()
+
+	peer, err := manager.storage.GetPeerContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if peer.WireguardPublicKey == nil {
+		return nil, xerror.EInvalidArgument("peer is not activated yet", nil)
+	}
+
+	wgPeers, err := manager.wireguard.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	_, suspended := manager.suspended[peer.ID]
+	_, idle := manager.idle[peer.ID]
+	wgPeer, programmed := wgPeers[*peer.WireguardPublicKey]
+	return peerDiagnostics(peer, wgPeer, programmed, suspended || peer.Expired(), idle, time.Now()), nil
+}
+
+// lockDiagnostics describes the contention on the manager's lock
+// by API requests, background jobs always wait and aren't counted.
+type lockDiagnostics struct {
+	Acquired  int64 `json:"acquired"`
+	Contended int64 `json:"contended"`
+	Timeouts  int64 `json:"timeouts"`
+	// Contention is the share of acquisitions that had to wait
+	Contention float64 `json:"contention"`
+	// Busy reports whether the lock was held at the moment,
+	// the peer counts guarded by the lock are omitted then
+	Busy bool `json:"busy"`
+}
+
+type peerCounts struct {
+	// Total and WithTraffic come from the last stats sync
+	Total       int  `json:"total"`
+	WithTraffic int  `json:"with_traffic"`
+	Suspended   *int `json:"suspended,omitempty"`
+	Idle        *int `json:"idle,omitempty"`
+}
+
+type poolCounts struct {
+	Used  int `json:"used"`
+	Total int `json:"total"`
+	Links int `json:"links"`
+}
+
+// ManagerDiagnostics is the internal state of the manager
+// for troubleshooting stalls and leaks.
+type ManagerDiagnostics struct {
+	Running          bool `json:"running"`
+	Draining         bool `json:"draining"`
+	Maintenance      bool `json:"maintenance"`
+	BackgroundPaused bool `json:"background_paused"`
+	// LastTick is omitted until the first background iteration
+	LastTick *time.Time `json:"last_tick,omitempty"`
+	// TickAgeSeconds is the age of the last background iteration, if any
+	TickAgeSeconds int64             `json:"tick_age_seconds,omitempty"`
+	TrafficSender  senderDiagnostics `json:"traffic_sender"`
+	Lock           lockDiagnostics   `json:"lock"`
+	Peers          peerCounts        `json:"peers"`
+	Pool           poolCounts        `json:"pool"`
+}
+
+// Diagnostics returns the internal state of the manager. It never waits
+// for the lock so the stalled manager can be inspected as well.
+func (manager *Manager) Diagnostics() *ManagerDiagnostics {
+	stats := manager.GetCachedStatistics()
+	pool := manager.ip4am.Stats()
+	d := &ManagerDiagnostics{
+		Running:          manager.Running(),
+		Draining:         manager.Draining(),
+		Maintenance:      manager.maintenance.Load(),
+		BackgroundPaused: manager.paused.Load(),
+		TrafficSender:    manager.peerTrafficSender.diagnostics(),
+		Lock: lockDiagnostics{
+			Acquired:  manager.lockStats.acquired.Load(),
+			Contended: manager.lockStats.contended.Load(),
+			Timeouts:  manager.lockStats.timeouts.Load(),
+		},
+		Peers: peerCounts{
+			Total:       stats.PeersTotal,
+			WithTraffic: stats.PeersWithTraffic,
+		},
+		Pool: poolCounts{
+			Used:  pool.Used,
+			Total: pool.Total,
+			Links: pool.Links,
+		},
+	}
+	if attempts := d.Lock.Acquired + d.Lock.Timeouts; attempts > 0 {
+		d.Lock.Contention = float64(d.Lock.Contended) / float64(attempts)
+	}
+	if tick := manager.LastTick(); !tick.IsZero() {
+		d.LastTick = &tick
+		d.TickAgeSeconds = int64(time.Since(tick).Seconds())
+	}
+
+	if !manager.lock.TryLock() {
+		d.Lock.Busy = true
+		return d
+	}
+	defer manager.lock.Unlock()
+
+	suspended, idle := len(manager.suspended), len(manager.idle)
+	d.Peers.Suspended = &suspended
+	d.Peers.Idle = &idle
+	return d
+}
+
+func peerDiagnostics(peer *types.PeerInfo, wgPeer wgtypes.Peer, programmed bool, expired bool, idle bool, now time.Time) *PeerDiagnostics {
+	diag := &PeerDiagnostics{
+		ID:         peer.ID,
+		Programmed: programmed,
+		Expired:    expired,
+		Idle:       idle,
+	}
+	if peer.LastSyncError != nil {
+		diag.LastSyncError = *peer.LastSyncError
+	}
+
+	if programmed {
+		expected := peerConfigLine(*peer.WireguardPublicKey, wireguard.AllowedIPs(peer), 0)
+		actual := peerConfigLine(*peer.WireguardPublicKey, wgPeer.AllowedIPs, 0)
+		diag.InSync = expected == actual
+		diag.ReceivedBytes = wgPeer.ReceiveBytes
+		diag.TransmittedBytes = wgPeer.TransmitBytes
+		if wgPeer.Endpoint != nil {
+			diag.Endpoint = wgPeer.Endpoint.String()
+		}
+		if !wgPeer.LastHandshakeTime.IsZero() {
+			handshake := wgPeer.LastHandshakeTime
+			diag.LastHandshake = &handshake
+			diag.HandshakeAgeSeconds = int64(now.Sub(handshake).Seconds())
+		}
+	}
+
+	diag.Diagnosis = diagnose(diag)
+	return diag
+}
+
+func diagnose(diag *PeerDiagnostics) string {
+	switch {
+	case diag.Expired:
+		return "peer is expired, prolong it to reconnect"
+	case diag.Idle:
+		return "peer is disconnected due to the lack of traffic, the client connect puts it back"
+	case !diag.Programmed && diag.LastSyncError != "":
+		return "peer is not programmed on the device: " + diag.LastSyncError + "; resync it once the cause is fixed"
+	case !diag.Programmed:
+		return "peer is not programmed on the device, resync it"
+	case !diag.InSync:
+		return "device configuration of the peer differs from the stored one, resync it"
+	case diag.LastHandshake == nil && diag.Endpoint == "":
+		return "no handshake, the client never reached the server: check the server endpoint and public key on the client and that the UDP port is reachable"
+	case diag.LastHandshake == nil:
+		// the endpoint is learned from the valid initiation, but the handshake
+		// is complete only once the client confirms it with the data packet
+		return "handshake initiated from " + diag.Endpoint + " was never confirmed: the responses likely don't reach the client"
+	case time.Duration(diag.HandshakeAgeSeconds)*time.Second > staleHandshakeAge:
+		return fmt.Sprintf("last handshake %s ago, the client is disconnected or idle", time.Duration(diag.HandshakeAgeSeconds)*time.Second)
+	default:
+		return "handshake is recent, the tunnel is up"
+	}
+}
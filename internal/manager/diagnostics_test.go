@@ -0,0 +1,105 @@
+package manager
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerDiagnostics(t *testing.T) {
+	m := newTestManager(t)
+	wg := m.wireguard.(*fakeWireguard)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+
+	diag, err := m.PeerDiagnostics(context.Background(), peer.ID)
+	require.NoError(t, err)
+	assert.True(t, diag.Programmed)
+	assert.True(t, diag.InSync)
+	assert.Nil(t, diag.LastHandshake)
+	assert.Contains(t, diag.Diagnosis, "never reached the server")
+
+	// the initiation came in but the client never confirmed the session
+	wg.mu.Lock()
+	wgPeer := wg.peers[*peer.WireguardPublicKey]
+	wgPeer.Endpoint = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}
+	wg.peers[*peer.WireguardPublicKey] = wgPeer
+	wg.mu.Unlock()
+
+	diag, err = m.PeerDiagnostics(context.Background(), peer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:51820", diag.Endpoint)
+	assert.Contains(t, diag.Diagnosis, "never confirmed")
+
+	wg.mu.Lock()
+	wgPeer.LastHandshakeTime = time.Now().Add(-10 * time.Minute)
+	wg.peers[*peer.WireguardPublicKey] = wgPeer
+	wg.mu.Unlock()
+
+	diag, err = m.PeerDiagnostics(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.NotNil(t, diag.LastHandshake)
+	assert.InDelta(t, 600, diag.HandshakeAgeSeconds, 5)
+	assert.Contains(t, diag.Diagnosis, "disconnected or idle")
+
+	wg.mu.Lock()
+	wgPeer.LastHandshakeTime = time.Now()
+	wg.peers[*peer.WireguardPublicKey] = wgPeer
+	wg.mu.Unlock()
+
+	diag, err = m.PeerDiagnostics(context.Background(), peer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "handshake is recent, the tunnel is up", diag.Diagnosis)
+
+	// the peer is lost by the device
+	require.NoError(t, wg.UnsetPeer(peer))
+	diag, err = m.PeerDiagnostics(context.Background(), peer.ID)
+	require.NoError(t, err)
+	assert.False(t, diag.Programmed)
+	assert.Contains(t, diag.Diagnosis, "resync")
+
+	_, err = m.PeerDiagnostics(context.Background(), peer.ID+1)
+	require.Error(t, err)
+}
+
+func TestManagerDiagnostics(t *testing.T) {
+	m := newTestManager(t)
+	require.Eventually(t, func() bool { return !m.LastTick().IsZero() }, 5*time.Second, 10*time.Millisecond)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+
+	var diag *ManagerDiagnostics
+	// the background job may hold the lock at the moment
+	require.Eventually(t, func() bool {
+		diag = m.Diagnostics()
+		return !diag.Lock.Busy
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, diag.Running)
+	assert.False(t, diag.Draining)
+	assert.NotNil(t, diag.LastTick)
+	assert.GreaterOrEqual(t, diag.Lock.Acquired, int64(1))
+	require.NotNil(t, diag.Peers.Suspended)
+	assert.Zero(t, *diag.Peers.Suspended)
+	require.NotNil(t, diag.Peers.Idle)
+	assert.Zero(t, *diag.Peers.Idle)
+	assert.Equal(t, 1, diag.Pool.Used)
+
+	// the held lock is reported, not waited for
+	m.lock.Lock()
+	assert.Error(t, m.lockWithTimeout(context.Background(), 10*time.Millisecond))
+	diag = m.Diagnostics()
+	m.lock.Unlock()
+
+	assert.True(t, diag.Lock.Busy)
+	assert.Nil(t, diag.Peers.Suspended)
+	assert.EqualValues(t, 1, diag.Lock.Timeouts)
+	assert.GreaterOrEqual(t, diag.Lock.Contended, int64(1))
+	assert.Greater(t, diag.Lock.Contention, 0.0)
+}
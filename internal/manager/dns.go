@@ -0,0 +1,38 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/proto"
+	"go.uber.org/zap"
+)
+
+// SetDNS changes DNS servers advertised to peers. WireGuard has no way
+// to push them to connected peers, so clients get new servers with
+// the next configuration they fetch, e.g. on reconnect.
+// Peers restricted to the tunnel DNS are switched to new servers at once.
+func (manager *Manager) SetDNS(ctx context.Context, servers []string) error {
+	if err := manager.runtime.Settings.SetWireguardDNS(servers); err != nil {
+		return err
+	}
+	if err := manager.ports.SetDNSServers(servers); err != nil {
+		return err
+	}
+
+	event := &proto.DNSInfo{
+		Servers:       servers,
+		CorrelationID: CorrelationID(ctx),
+	}
+	if err := manager.eventLog.Push(eventlog.ServerDNSUpdate, event); err != nil {
+		// do not return an error here because it's not related to the method itself.
+		logger(ctx).Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_ServerDNSUpdate)))
+	}
+
+	logger(ctx).Info("dns servers updated", zap.Strings("dns", servers))
+	return nil
+}
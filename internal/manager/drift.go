@@ -0,0 +1,282 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xtime"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DeviceConfigHash returns the hash of the peers configuration
+// as it is programmed on the wireguard device.
+func (manager *Manager) DeviceConfigHash() (string, error) {
+	if !manager.running.Load().(bool) {
+		return "", xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return "", err
+	}
+	defer manager.lock.Unlock()
+
+	wgPeers, err := manager.wireguard.GetPeers()
+	if err != nil {
+		return "", err
+	}
+
+	return deviceConfigHash(wgPeers), nil
+}
+
+// StorageConfigHash returns the hash of the peers configuration
+// as it expected to be programmed according to the storage.
+// It must be equal to the DeviceConfigHash unless the device drifted away.
+func (manager *Manager) StorageConfigHash() (string, error) {
+	if !manager.running.Load().(bool) {
+		return "", xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return "", err
+	}
+	defer manager.lock.Unlock()
+
+	peers, err := manager.peers()
+	if err != nil {
+		return "", err
+	}
+
+	return storageConfigHash(peers), nil
+}
+
+// ListDesyncedPeers returns peers present in the storage but absent
+// on the wireguard device, and public keys of peers configured on
+// the device but absent in the storage. Both are of the same snapshot.
+func (manager *Manager) ListDesyncedPeers() ([]types.PeerInfo, []string, error) {
+	if !manager.running.Load().(bool) {
+		return nil, nil, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, nil, err
+	}
+	defer manager.lock.Unlock()
+
+	peers, err := manager.peers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wgPeers, err := manager.wireguard.GetPeers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	missing, unknown := desyncedPeers(peers, wgPeers)
+	return missing, unknown, nil
+}
+
+// ResyncPeer programs the stored peer on the wireguard device again,
+// the peer's sync error is cleared on success.
+func (manager *Manager) ResyncPeer(ctx context.Context, id int64) (*types.PeerInfo, error) {
+	if !manager.running.Load().(bool) {
+		return nil, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
+	}
+	defer manager.lock.Unlock()
+
+	if err := manager.checkMaintenance(); err != nil {
+		return nil, err
+	}
+
+	peer, err := manager.storage.GetPeerContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if peer.WireguardPublicKey == nil {
+		return nil, xerror.EInvalidArgument("peer is not activated yet", nil)
+	}
+	if _, ok := manager.suspended[peer.ID]; ok || peer.Expired() {
+		return nil, xerror.EInvalidArgument("peer is expired", nil)
+	}
+
+	err = manager.wireguard.SetPeer(peer)
+	manager.recordPeerSync(ctx, peer, err)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := manager.idle[peer.ID]; ok {
+		// the idle peer is back on the device
+		delete(manager.idle, peer.ID)
+		manager.peerTrafficSender.Add(peer)
+	}
+
+	logger(ctx).Info("peer resynced", zap.Int64("id", peer.ID))
+	return peer, nil
+}
+
+// RekeyPeer replaces the keypair of the peer, everything else
+// including the address and the expiration is kept. The new private key
+// is returned to be passed to the client once, it's never stored.
+func (manager *Manager) RekeyPeer(ctx context.Context, id int64) (string, error) {
+	if !manager.running.Load().(bool) {
+		return "", xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return "", err
+	}
+	defer manager.lock.Unlock()
+
+	if err := manager.checkMaintenance(); err != nil {
+		return "", err
+	}
+
+	peer, err := manager.storage.GetPeerContext(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if peer.WireguardPublicKey == nil {
+		return "", xerror.EInvalidArgument("peer is not activated yet", nil)
+	}
+	if _, ok := manager.suspended[peer.ID]; ok || peer.Expired() {
+		return "", xerror.EInvalidArgument("peer is expired", nil)
+	}
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return "", xerror.EInternalError("can't generate private key", err)
+	}
+
+	// account the traffic of the old key before it leaves the device,
+	// the traffic updates are tracked by the key as well
+	manager.flushPeerTraffic(peer, nil)
+	manager.peerTrafficSender.Remove(peer)
+
+	publicKey := privateKey.PublicKey().String()
+	peer.WireguardPublicKey = &publicKey
+	if err := manager.updatePeer(ctx, peer); err != nil {
+		old, getErr := manager.storage.GetPeer(id)
+		if getErr == nil {
+			manager.peerTrafficSender.Add(old)
+		}
+		return "", err
+	}
+	manager.peerTrafficSender.Add(peer)
+	manager.syncPeerStats()
+
+	logger(ctx).Info("peer rekeyed", zap.Int64("id", peer.ID))
+	return privateKey.String(), nil
+}
+
+// recordPeerSync stores the result of programming the peer on the device.
+func (manager *Manager) recordPeerSync(ctx context.Context, peer *types.PeerInfo, syncErr error) {
+	now := xtime.Now()
+	peer.LastSyncedAt = &now
+	peer.LastSyncError = nil
+	if syncErr != nil {
+		reason := syncErr.Error()
+		peer.LastSyncError = &reason
+		logger(ctx).Error("failed to program the peer on the device", zap.Int64("id", peer.ID), zap.Error(syncErr))
+	}
+
+	// error is logged inside
+	_ = manager.storage.UpdatePeerSyncStatus(peer)
+}
+
+// countMissing returns the number of peers missing on the device
+// except the idle ones, they are taken off the device on purpose.
+func (manager *Manager) countMissing(missing []types.PeerInfo) int {
+	count := 0
+	for _, peer := range missing {
+		if _, ok := manager.idle[peer.ID]; !ok {
+			count++
+		}
+	}
+	return count
+}
+
+// desyncedPeers returns peers missing on the device
+// and keys of the device peers missing in the storage.
+func desyncedPeers(peers []*types.PeerInfo, wgPeers map[string]wgtypes.Peer) ([]types.PeerInfo, []string) {
+	known := make(map[string]struct{}, len(peers))
+	missing := make([]types.PeerInfo, 0)
+	for _, peer := range peers {
+		if peer.WireguardPublicKey == nil {
+			// not activated shared peers are not programmed on the device
+			continue
+		}
+		known[*peer.WireguardPublicKey] = struct{}{}
+		if peer.Expired() {
+			// expired peers are kept in the storage only if
+			// the automatic wiping is disabled, never on the device
+			continue
+		}
+		if _, ok := wgPeers[*peer.WireguardPublicKey]; !ok {
+			missing = append(missing, *peer)
+		}
+	}
+
+	unknown := make([]string, 0)
+	for key := range wgPeers {
+		if _, ok := known[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	return missing, unknown
+}
+
+func deviceConfigHash(wgPeers map[string]wgtypes.Peer) string {
+	lines := make([]string, 0, len(wgPeers))
+	for key, peer := range wgPeers {
+		lines = append(lines, peerConfigLine(key, peer.AllowedIPs, peer.PersistentKeepaliveInterval))
+	}
+	return configHash(lines)
+}
+
+func storageConfigHash(peers []*types.PeerInfo) string {
+	lines := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		if peer.WireguardPublicKey == nil || peer.Ipv4 == nil {
+			// not activated shared peers are not programmed on the device
+			continue
+		}
+		if peer.Expired() {
+			continue
+		}
+		// we never set the keepalive for peers on the server side
+		lines = append(lines, peerConfigLine(*peer.WireguardPublicKey, wireguard.AllowedIPs(peer), 0))
+	}
+	return configHash(lines)
+}
+
+// peerConfigLine is the canonical representation of the peer's device configuration.
+func peerConfigLine(publicKey string, allowedIPs []net.IPNet, keepalive time.Duration) string {
+	ips := make([]string, len(allowedIPs))
+	for i, ipn := range allowedIPs {
+		ips[i] = ipn.String()
+	}
+	sort.Strings(ips)
+
+	return publicKey + "|" + strings.Join(ips, ",") + "|" + strconv.Itoa(int(keepalive.Seconds()))
+}
+
+func configHash(lines []string) string {
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
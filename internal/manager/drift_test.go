@@ -0,0 +1,232 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDesyncedPeers(t *testing.T) {
+	onBoth, onStorage, onDevice := "both", "storage", "device"
+	peers := []*types.PeerInfo{
+		{ID: 1, WireguardInfo: types.WireguardInfo{WireguardPublicKey: &onBoth}},
+		{ID: 2, WireguardInfo: types.WireguardInfo{WireguardPublicKey: &onStorage}},
+		// not activated shared peer
+		{ID: 3},
+	}
+	wgPeers := map[string]wgtypes.Peer{
+		onBoth:   {},
+		onDevice: {},
+	}
+
+	missing, unknown := desyncedPeers(peers, wgPeers)
+	require.Len(t, missing, 1)
+	require.Equal(t, int64(2), missing[0].ID)
+	require.Equal(t, []string{onDevice}, unknown)
+}
+
+func TestListDesyncedPeers(t *testing.T) {
+	m := newTestManager(t)
+	wg := m.wireguard.(*fakeWireguard)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	stray := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	stray.Ipv4 = peer.Ipv4
+	require.NoError(t, wg.SetPeer(stray))
+	require.NoError(t, wg.UnsetPeer(peer))
+
+	missing, unknown, err := m.ListDesyncedPeers()
+	require.NoError(t, err)
+	require.Len(t, missing, 1)
+	require.Equal(t, peer.ID, missing[0].ID)
+	require.Equal(t, []string{*stray.WireguardPublicKey}, unknown)
+}
+
+func TestResyncPeer(t *testing.T) {
+	m := newTestManager(t)
+	wg := m.wireguard.(*fakeWireguard)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+
+	stored, err := m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored.LastSyncedAt)
+	assert.Nil(t, stored.LastSyncError)
+
+	// the device lost the peer and refuses to take it back
+	require.NoError(t, wg.UnsetPeer(peer))
+	wg.setErr = errors.New("device is busy")
+
+	_, err = m.ResyncPeer(context.Background(), peer.ID)
+	require.Error(t, err)
+
+	stored, err = m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored.LastSyncError)
+	assert.Equal(t, "device is busy", *stored.LastSyncError)
+
+	wg.setErr = nil
+	resynced, err := m.ResyncPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	assert.Nil(t, resynced.LastSyncError)
+
+	stored, err = m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	assert.Nil(t, stored.LastSyncError)
+
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	assert.Contains(t, wgPeers, *peer.WireguardPublicKey)
+}
+
+func TestRekeyPeer(t *testing.T) {
+	m := newTestManager(t)
+	wg := m.wireguard.(*fakeWireguard)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	oldKey := *peer.WireguardPublicKey
+
+	privateKey, err := m.RekeyPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	key, err := wgtypes.ParseKey(privateKey)
+	require.NoError(t, err)
+	newKey := key.PublicKey().String()
+	require.NotEqual(t, oldKey, newKey)
+
+	stored, err := m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, newKey, *stored.WireguardPublicKey)
+	assert.Equal(t, peer.Ipv4.String(), stored.Ipv4.String())
+	assert.Equal(t, peer.Expires.Time.Unix(), stored.Expires.Time.Unix())
+	assert.Equal(t, peer.Label, stored.Label)
+
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	assert.NotContains(t, wgPeers, oldKey)
+	assert.Contains(t, wgPeers, newKey)
+
+	_, err = m.RekeyPeer(context.Background(), peer.ID+1)
+	require.Error(t, err)
+}
+
+func TestProgramPeersConcurrently(t *testing.T) {
+	m := newTestManagerWithSettings(t, &settings.Config{RestoreConcurrency: 4})
+	wg := m.wireguard.(*fakeWireguard)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, m.SetPeer(context.Background(), newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))))
+	}
+	peers, err := m.peers()
+	require.NoError(t, err)
+
+	// the device lost everything
+	wg.mu.Lock()
+	wg.peers = map[string]wgtypes.Peer{}
+	wg.mu.Unlock()
+	m.lock.Lock()
+	m.programPeers(peers, 0)
+	m.lock.Unlock()
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	require.Len(t, wgPeers, 10)
+
+	// failures are recorded per peer
+	wg.mu.Lock()
+	wg.setErr = errors.New("device is gone")
+	wg.mu.Unlock()
+	m.lock.Lock()
+	m.programPeers(peers, 0)
+	m.lock.Unlock()
+
+	peers, err = m.peers()
+	require.NoError(t, err)
+	for _, peer := range peers {
+		require.NotNil(t, peer.LastSyncError)
+		require.Equal(t, "device is gone", *peer.LastSyncError)
+	}
+}
+
+func TestProgramPeersRate(t *testing.T) {
+	m := newTestManagerWithSettings(t, &settings.Config{RestoreConcurrency: 4, RestoreRate: 50})
+	wg := m.wireguard.(*fakeWireguard)
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, m.SetPeer(context.Background(), newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))))
+	}
+	peers, err := m.peers()
+	require.NoError(t, err)
+
+	wg.mu.Lock()
+	wg.peers = map[string]wgtypes.Peer{}
+	wg.mu.Unlock()
+
+	// the last of 6 peers is due at 100ms regardless of workers
+	started := time.Now()
+	m.lock.Lock()
+	m.programPeers(peers, m.runtime.Settings.GetRestoreRate())
+	m.lock.Unlock()
+	assert.GreaterOrEqual(t, time.Since(started), 100*time.Millisecond)
+
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	require.Len(t, wgPeers, 6)
+
+	// the watchdog holds the lock, so it is not paced
+	wg.mu.Lock()
+	wg.peers = map[string]wgtypes.Peer{}
+	wg.mu.Unlock()
+	started = time.Now()
+	m.lock.Lock()
+	m.reprogramPeers()
+	m.lock.Unlock()
+	assert.Less(t, time.Since(started), 100*time.Millisecond)
+
+	wgPeers, err = wg.GetPeers()
+	require.NoError(t, err)
+	require.Len(t, wgPeers, 6)
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	m := newTestManager(t)
+	wg := m.wireguard.(*fakeWireguard)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, m.SetPeer(context.Background(), newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))))
+	}
+	peers, err := m.peers()
+	require.NoError(t, err)
+
+	m.lock.Lock()
+	// one peer is lost, the idle one is off the device on purpose,
+	// the unknown one is added behind our back
+	wg.mu.Lock()
+	delete(wg.peers, *peers[0].WireguardPublicKey)
+	delete(wg.peers, *peers[1].WireguardPublicKey)
+	wg.peers["unknown"] = wgtypes.Peer{}
+	wg.mu.Unlock()
+	m.idle[peers[1].ID] = struct{}{}
+	m.syncPeerStats()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(desyncedPeersGauge.WithLabelValues("missing")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(desyncedPeersGauge.WithLabelValues("unknown")))
+	checked := testutil.ToFloat64(lastReconcileGauge)
+	assert.InDelta(t, float64(time.Now().Unix()), checked, 5)
+
+	delete(m.idle, peers[1].ID)
+	m.programPeers(peers, 0)
+	m.lock.Unlock()
+	assert.Equal(t, float64(3), testutil.ToFloat64(reconciledPeersGauge))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(lastReconcileGauge), checked)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/vpnhouse/tunnel/internal/runtime"
 	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/common-lib-go/human"
+	"github.com/vpnhouse/common-lib-go/xerror"
 	"github.com/vpnhouse/tunnel/proto"
 	"go.uber.org/zap"
 )
@@ -36,17 +37,22 @@ type peerTrafficUpdateEventSender struct {
 	stop               chan struct{}
 	done               chan struct{}
 	statsService       *runtimePeerStatsService
+	throttle           *eventThrottle
 
 	needSendChan chan struct{}
+	// intervalChan passes the new send interval to run
+	intervalChan chan time.Duration
 	lock         sync.Mutex
 	state        trafficState
 	// All peers (prev)
 	peerTraffic map[string]*PeerTraffic
 	// peers candidates for sending
 	updatedPeers map[string]*types.PeerInfo
+	// lastFlush is the time updates were sent last time
+	lastFlush time.Time
 }
 
-func NewPeerTrafficUpdateEventSender(runtime *runtime.TunnelRuntime, eventLog eventlog.EventManager, statsService *runtimePeerStatsService, peers []*types.PeerInfo) *peerTrafficUpdateEventSender {
+func NewPeerTrafficUpdateEventSender(runtime *runtime.TunnelRuntime, eventLog eventlog.EventManager, statsService *runtimePeerStatsService, throttle *eventThrottle, peers []*types.PeerInfo) *peerTrafficUpdateEventSender {
 	maxUpstreamBytes := int64(0)
 	maxDownstreamBytes := int64(0)
 	sendInterval := runtime.Settings.GetSentEventInterval().Value()
@@ -82,7 +88,9 @@ func NewPeerTrafficUpdateEventSender(runtime *runtime.TunnelRuntime, eventLog ev
 		peerTraffic:        peerTraffic,
 		updatedPeers:       make(map[string]*types.PeerInfo, len(peers)),
 		statsService:       statsService,
+		throttle:           throttle,
 		needSendChan:       make(chan struct{}, 1),
+		intervalChan:       make(chan time.Duration, 1),
 		stop:               make(chan struct{}),
 		done:               make(chan struct{}),
 	}
@@ -121,6 +129,42 @@ func (s *peerTrafficUpdateEventSender) Remove(peer *types.PeerInfo) {
 	if _, ok := s.peerTraffic[*peer.WireguardPublicKey]; ok {
 		delete(s.peerTraffic, *peer.WireguardPublicKey)
 	}
+	s.throttle.forget(peer.ID)
+}
+
+// SetThresholds changes the accumulated traffic change triggering
+// the immediate send, the new values are checked starting from
+// the next Send. Zero disables the threshold.
+func (s *peerTrafficUpdateEventSender) SetThresholds(up int64, down int64) error {
+	if up < 0 || down < 0 {
+		return xerror.EInvalidArgument("traffic change thresholds must not be negative", nil)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxUpstreamBytes = up
+	s.maxDownstreamBytes = down
+	return nil
+}
+
+// SetInterval changes the interval of the scheduled send,
+// the next send happens the new interval after the call.
+func (s *peerTrafficUpdateEventSender) SetInterval(interval time.Duration) {
+	for {
+		select {
+		case s.intervalChan <- interval:
+			return
+		case <-s.intervalChan:
+			// replaced by the latest one
+		}
+	}
+}
+
+// Thresholds returns the current upstream and downstream thresholds.
+func (s *peerTrafficUpdateEventSender) Thresholds() (int64, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.maxUpstreamBytes, s.maxDownstreamBytes
 }
 
 func (s *peerTrafficUpdateEventSender) Send(peers []*types.PeerInfo) {
@@ -168,24 +212,66 @@ func (s *peerTrafficUpdateEventSender) sendUpdates() {
 	if len(s.updatedPeers) == 0 {
 		return
 	}
-	for _, peer := range s.updatedPeers {
+	now := time.Now()
+	sent := 0
+	for key, peer := range s.updatedPeers {
+		if !s.throttle.allow(peer.ID, eventlog.PeerTraffic, now) {
+			// keep the peer until the next round, the sessions
+			// accumulate the traffic deltas meanwhile.
+			continue
+		}
+
 		for _, sess := range s.statsService.GetSessions(peer) {
 			err := s.eventLog.Push(eventlog.PeerTraffic, intoProto(peer, &sess))
 			if err != nil {
 				zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_PeerTraffic)))
 			}
 		}
+		delete(s.updatedPeers, key)
+		sent++
+	}
+	if sent > 0 {
+		s.lastFlush = now
 	}
 	zap.L().Info(
 		"send peer traffic updates",
-		zap.Int("peers", len(s.updatedPeers)),
+		zap.Int("peers", sent),
+		zap.Int("throttled", len(s.updatedPeers)),
 		zap.String("upstream", human.FormatSizeToHuman(uint64(s.state.UpstreamBytesChange))),
 		zap.String("downstream", human.FormatSizeToHuman(uint64(s.state.DownstreamBytesChange))),
 	)
-	s.updatedPeers = make(map[string]*types.PeerInfo, len(s.updatedPeers))
 	s.state.Reset()
 }
 
+// senderDiagnostics is the state of the traffic sender.
+type senderDiagnostics struct {
+	// Pending is the number of peers waiting to be sent
+	Pending int `json:"pending"`
+	// Tracked is the number of peers with known traffic
+	Tracked int `json:"tracked"`
+	// LastFlush is omitted if nothing has been sent yet
+	LastFlush        *time.Time `json:"last_flush,omitempty"`
+	UpstreamChange   int64      `json:"upstream_change"`
+	DownstreamChange int64      `json:"downstream_change"`
+}
+
+func (s *peerTrafficUpdateEventSender) diagnostics() senderDiagnostics {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := senderDiagnostics{
+		Pending:          len(s.updatedPeers),
+		Tracked:          len(s.peerTraffic),
+		UpstreamChange:   s.state.UpstreamBytesChange,
+		DownstreamChange: s.state.DownstreamBytesChange,
+	}
+	if !s.lastFlush.IsZero() {
+		lastFlush := s.lastFlush
+		d.LastFlush = &lastFlush
+	}
+	return d
+}
+
 func intoProto(peer *types.PeerInfo, sess *Session) *proto.PeerInfo {
 	p := peer.IntoProto()
 	p.BytesRx = uint64(sess.Upstream)
@@ -216,6 +302,10 @@ func (s *peerTrafficUpdateEventSender) run() {
 		case <-s.stop:
 			zap.L().Info("Shutting down sending peer traffic updates")
 			return
+		case interval := <-s.intervalChan:
+			sendPeerTicker.Reset(interval)
+			zap.L().Debug("Sending peer traffic updates interval changed", zap.Duration("interval", interval))
+			continue
 		case <-sendPeerTicker.C:
 		case <-s.needSendChan:
 		}
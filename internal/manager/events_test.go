@@ -0,0 +1,46 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/types"
+)
+
+func TestTrafficThresholds(t *testing.T) {
+	key := "key"
+	s := &peerTrafficUpdateEventSender{
+		peerTraffic:  map[string]*PeerTraffic{key: {}},
+		updatedPeers: map[string]*types.PeerInfo{},
+		needSendChan: make(chan struct{}, 1),
+	}
+
+	assert.Error(t, s.SetThresholds(-1, 0))
+	require.NoError(t, s.SetThresholds(100, 0))
+	up, down := s.Thresholds()
+	assert.EqualValues(t, 100, up)
+	assert.Zero(t, down)
+
+	send := func(upstream int64) bool {
+		downstream := int64(0)
+		s.Send([]*types.PeerInfo{{
+			WireguardInfo: types.WireguardInfo{WireguardPublicKey: &key},
+			Upstream:      &upstream,
+			Downstream:    &downstream,
+		}})
+		select {
+		case <-s.needSendChan:
+			return true
+		default:
+			return false
+		}
+	}
+
+	assert.False(t, send(50))
+	assert.True(t, send(150))
+
+	// the accumulated change is checked against the new threshold
+	require.NoError(t, s.SetThresholds(1000, 0))
+	assert.False(t, send(200))
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/xerror"
+)
+
+// trafficHistoryBuckets is the number of hourly samples kept per peer.
+const trafficHistoryBuckets = 24
+
+// trafficTotalsRetention is how long hourly totals of all peers are kept,
+// enough to report the traffic of any month of the last year.
+const trafficTotalsRetention = 400 * 24 * time.Hour
+
+// trafficRing holds the peer's hourly samples,
+// the bucket of the hour is picked by the hour number.
+type trafficRing [trafficHistoryBuckets]types.TrafficSample
+
+func hourBucket(hour time.Time) int {
+	return int(hour.Unix()/3600) % trafficHistoryBuckets
+}
+
+// trafficHistory keeps the recent hourly traffic of peers,
+// the memory is bounded by the fixed number of buckets per peer.
+type trafficHistory struct {
+	lock  sync.Mutex
+	peers map[int64]*trafficRing
+}
+
+func newTrafficHistory() *trafficHistory {
+	return &trafficHistory{
+		peers: make(map[int64]*trafficRing),
+	}
+}
+
+// add accounts the traffic to the sample of the current hour
+// and returns the updated sample.
+func (h *trafficHistory) add(peerID int64, now time.Time, upstream int64, downstream int64) types.TrafficSample {
+	hour := now.Truncate(time.Hour)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ring, ok := h.peers[peerID]
+	if !ok {
+		ring = &trafficRing{}
+		h.peers[peerID] = ring
+	}
+
+	sample := &ring[hourBucket(hour)]
+	if !sample.Hour.Equal(hour) {
+		// the bucket holds the sample of the day before
+		*sample = types.TrafficSample{Hour: hour}
+	}
+	sample.Upstream += upstream
+	sample.Downstream += downstream
+	return *sample
+}
+
+// restore puts samples loaded from the storage.
+func (h *trafficHistory) restore(peerID int64, samples []types.TrafficSample) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ring, ok := h.peers[peerID]
+	if !ok {
+		ring = &trafficRing{}
+		h.peers[peerID] = ring
+	}
+	for _, sample := range samples {
+		ring[hourBucket(sample.Hour)] = sample
+	}
+}
+
+// get returns samples of the last trafficHistoryBuckets hours
+// including the current one, oldest first. Hours without
+// the traffic are reported as zero samples.
+func (h *trafficHistory) get(peerID int64, now time.Time) []types.TrafficSample {
+	current := now.Truncate(time.Hour)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ring := h.peers[peerID]
+	samples := make([]types.TrafficSample, trafficHistoryBuckets)
+	for i := range samples {
+		hour := current.Add(-time.Duration(trafficHistoryBuckets-1-i) * time.Hour)
+		samples[i] = types.TrafficSample{Hour: hour}
+		if ring == nil {
+			continue
+		}
+		if sample := ring[hourBucket(hour)]; sample.Hour.Equal(hour) {
+			samples[i] = sample
+		}
+	}
+	return samples
+}
+
+// forget drops the history of the removed peer.
+func (h *trafficHistory) forget(peerID int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.peers, peerID)
+}
+
+// GetPeerHistory returns the peer's hourly traffic
+// of the last day, oldest first.
+func (manager *Manager) GetPeerHistory(id int64) ([]types.TrafficSample, error) {
+	if !manager.running.Load().(bool) {
+		return nil, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
+	}
+	defer manager.lock.Unlock()
+
+	// make sure the peer exists, it has no samples otherwise
+	if _, err := manager.storage.GetPeer(id); err != nil {
+		return nil, err
+	}
+	return manager.history.get(id, time.Now()), nil
+}
+
+// restoreHistory loads the recent traffic samples from the storage.
+func (manager *Manager) restoreHistory() {
+	since := time.Now().Truncate(time.Hour).Add(-(trafficHistoryBuckets - 1) * time.Hour)
+	samples, err := manager.storage.GetTrafficSamples(since)
+	if err != nil {
+		// err has already been logged inside
+		return
+	}
+
+	for peerID, peerSamples := range samples {
+		manager.history.restore(peerID, peerSamples)
+	}
+}
+
+// recordHistory accounts the traffic of peers since the previous tick,
+// prev holds peers' counters before the update.
+func (manager *Manager) recordHistory(now time.Time, peers []*types.PeerInfo, prev map[int64]PeerTraffic) {
+	var totalUpstream, totalDownstream int64
+	for _, peer := range peers {
+		old, ok := prev[peer.ID]
+		if !ok || peer.Upstream == nil || peer.Downstream == nil {
+			continue
+		}
+
+		upstream, downstream := *peer.Upstream-old.Upstream, *peer.Downstream-old.Downstream
+		if upstream <= 0 && downstream <= 0 {
+			continue
+		}
+
+		sample := manager.history.add(peer.ID, now, upstream, downstream)
+		// error is logged inside
+		_ = manager.storage.PutTrafficSample(peer.ID, sample)
+		totalUpstream += upstream
+		totalDownstream += downstream
+	}
+
+	if totalUpstream != 0 || totalDownstream != 0 {
+		// error is logged inside
+		_ = manager.storage.AddTrafficTotal(now.Truncate(time.Hour), totalUpstream, totalDownstream)
+	}
+}
+
+// AggregateTraffic returns the traffic of all peers within [from, to)
+// with the hourly precision: hours starting within the range are counted.
+// Totals are kept for trafficTotalsRetention, ranges without traffic give zeros.
+func (manager *Manager) AggregateTraffic(from time.Time, to time.Time) (int64, int64, error) {
+	if !manager.running.Load().(bool) {
+		return 0, 0, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if !to.After(from) {
+		return 0, 0, xerror.EInvalidArgument("the end of the range must be after the start", nil)
+	}
+
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return 0, 0, err
+	}
+	defer manager.lock.Unlock()
+
+	return manager.storage.SumTrafficTotals(from, to)
+}
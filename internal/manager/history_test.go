@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/types"
+)
+
+func TestTrafficHistory(t *testing.T) {
+	h := newTrafficHistory()
+	now := time.Date(2023, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	h.add(1, now, 10, 20)
+	h.add(1, now.Add(10*time.Minute), 1, 2)
+	h.add(1, now.Add(-2*time.Hour), 5, 5)
+	// the day old sample is overwritten by the current hour one
+	h.add(2, now.Add(-24*time.Hour), 100, 100)
+	h.add(2, now, 1, 1)
+
+	samples := h.get(1, now)
+	require.Len(t, samples, trafficHistoryBuckets)
+	assert.Equal(t, now.Truncate(time.Hour).Add(-23*time.Hour), samples[0].Hour)
+	last := samples[trafficHistoryBuckets-1]
+	assert.Equal(t, now.Truncate(time.Hour), last.Hour)
+	assert.EqualValues(t, 11, last.Upstream)
+	assert.EqualValues(t, 22, last.Downstream)
+	assert.EqualValues(t, 5, samples[trafficHistoryBuckets-3].Upstream)
+	assert.Zero(t, samples[trafficHistoryBuckets-2].Upstream)
+
+	samples = h.get(2, now)
+	assert.EqualValues(t, 1, samples[trafficHistoryBuckets-1].Upstream)
+	for _, sample := range samples[:trafficHistoryBuckets-1] {
+		assert.Zero(t, sample.Upstream)
+	}
+
+	// samples become stale as the time goes
+	samples = h.get(1, now.Add(24*time.Hour))
+	for _, sample := range samples {
+		assert.Zero(t, sample.Upstream)
+	}
+
+	h.forget(1)
+	assert.NotContains(t, h.peers, int64(1))
+}
+
+func TestPeerHistoryPersisted(t *testing.T) {
+	m := newTestManager(t)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+
+	upstream, downstream := int64(1000), int64(2000)
+	peer.Upstream, peer.Downstream = &upstream, &downstream
+	now := time.Now()
+	m.recordHistory(now, []*types.PeerInfo{peer}, map[int64]PeerTraffic{peer.ID: {}})
+
+	history, err := m.GetPeerHistory(peer.ID)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1000, history[trafficHistoryBuckets-1].Upstream)
+
+	// the restarted manager picks the samples up
+	m.history = newTrafficHistory()
+	m.restoreHistory()
+	history, err = m.GetPeerHistory(peer.ID)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2000, history[trafficHistoryBuckets-1].Downstream)
+
+	require.NoError(t, m.UnsetPeer(context.Background(), peer.ID))
+	samples, err := m.storage.GetTrafficSamples(now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+}
+
+func TestAggregateTraffic(t *testing.T) {
+	m := newTestManager(t)
+	// the startup sync must not wipe the samples recorded below
+	require.Eventually(t, func() bool { return !m.LastTick().IsZero() }, 5*time.Second, 10*time.Millisecond)
+
+	// within the retention of the traffic totals
+	from := time.Now().UTC().AddDate(0, -2, 0).Truncate(time.Hour)
+	to := from.AddDate(0, 1, 0)
+	traffic := func(up, down int64) []*types.PeerInfo {
+		return []*types.PeerInfo{{ID: 1, Upstream: &up, Downstream: &down}}
+	}
+
+	// samples of peers within the same hour are summed up
+	m.recordHistory(from.Add(time.Minute), traffic(10, 20), map[int64]PeerTraffic{1: {}})
+	m.recordHistory(from.Add(2*time.Minute), traffic(15, 30), map[int64]PeerTraffic{1: {Upstream: 10, Downstream: 20}})
+	m.recordHistory(from.Add(15*24*time.Hour), traffic(100, 200), map[int64]PeerTraffic{1: {}})
+	// the traffic at the end of the range is not counted
+	m.recordHistory(to, traffic(1000, 1000), map[int64]PeerTraffic{1: {}})
+	m.recordHistory(from.Add(-time.Minute), traffic(1000, 1000), map[int64]PeerTraffic{1: {}})
+
+	up, down, err := m.AggregateTraffic(from, to)
+	require.NoError(t, err)
+	assert.EqualValues(t, 115, up)
+	assert.EqualValues(t, 230, down)
+
+	// no samples in the range
+	up, down, err = m.AggregateTraffic(from.AddDate(-1, 0, 0), from.AddDate(0, -1, 0))
+	require.NoError(t, err)
+	assert.Zero(t, up)
+	assert.Zero(t, down)
+
+	_, _, err = m.AggregateTraffic(to, from)
+	require.Error(t, err)
+}
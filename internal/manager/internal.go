@@ -5,93 +5,346 @@
 package manager
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/settings"
 	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
 	"github.com/vpnhouse/common-lib-go/ippool"
 	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
 	"github.com/vpnhouse/common-lib-go/xtime"
 	"github.com/vpnhouse/tunnel/proto"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// lockStats estimates the lock contention: the share
+// of acquisitions that had to wait for another holder.
+type lockStats struct {
+	acquired  atomic.Int64
+	contended atomic.Int64
+	timeouts  atomic.Int64
+}
+
+// lockWithTimeout takes the manager's lock giving up after d
+// or once ctx is done, so API callers get the fast 503 instead
+// of hanging behind the long operation.
+func (manager *Manager) lockWithTimeout(ctx context.Context, d time.Duration) error {
+	if manager.lock.TryLock() {
+		manager.lockStats.acquired.Add(1)
+		return nil
+	}
+	manager.lockStats.contended.Add(1)
+
+	acquired, err := manager.lock.lockContext(ctx, d)
+	if err != nil {
+		return xerror.EUnavailable("request cancelled", err)
+	}
+	if !acquired {
+		lockTimeoutsCounter.Inc()
+		manager.lockStats.timeouts.Add(1)
+		zap.L().Warn("manager lock wait timed out", zap.Duration("timeout", d))
+		return xerror.EUnavailable("server busy", nil)
+	}
+	manager.lockStats.acquired.Add(1)
+	return nil
+}
+
 func (manager *Manager) peers() ([]*types.PeerInfo, error) {
 	return manager.storage.SearchPeers(nil)
 }
 
-// restore peers on startup
-func (manager *Manager) restorePeers() {
+// expiredPeers returns expired peers from the storage.
+func (manager *Manager) expiredPeers() ([]*types.PeerInfo, error) {
+	peers, err := manager.peers()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make([]*types.PeerInfo, 0)
+	for _, peer := range peers {
+		if peer.Expired() {
+			expired = append(expired, peer)
+		}
+	}
+	return expired, nil
+}
+
+// restore peers on startup, returns the number
+// of peers programmed on the device
+func (manager *Manager) restorePeers() int {
+	started := time.Now()
 	peers, err := manager.peers()
 	if err != nil {
 		// err has already been logged inside
-		return
+		return 0
 	}
 
+	program := make([]*types.PeerInfo, 0, len(peers))
 	for _, peer := range peers {
 		if peer.Expired() {
-			zap.L().Debug("wiping expired peer", zap.Any("peer", peer))
-			_ = manager.storage.DeletePeer(peer.ID)
+			if manager.runtime.Settings.GetAutoWipeExpired() {
+				zap.L().Debug("wiping expired peer", types.LogPeer("peer", peer))
+				_ = manager.storage.DeletePeer(peer.ID)
+				_ = manager.storage.DeleteTrafficSamples(peer.ID)
+				continue
+			}
+
+			// keep the address reserved until the peer is wiped by hand,
+			// but never program it on the device
+			_ = manager.setAddress(peer, *peer.Ipv4)
+			manager.suspended[peer.ID] = struct{}{}
+			allPeersGauge.Inc()
 			continue
 		}
 
-		if err := manager.ip4am.Set(*peer.Ipv4, peer.GetNetworkPolicy()); err != nil {
-			if !errors.Is(err, ippool.ErrNotInRange) {
+		if !manager.addressMatches(peer, *peer.Ipv4) {
+			// the policy's sub-pool has changed since the peer was created
+			if !manager.migratePeerAddress(peer) {
 				continue
 			}
-
-			newIP, err := manager.ip4am.Alloc(peer.GetNetworkPolicy())
-			if err != nil {
-				// TODO(nikonov): remove peer OR mark it as invalid
-				//  to allow further migration by hand.
+		} else if err := manager.setAddress(peer, *peer.Ipv4); err != nil {
+			if !errors.Is(err, ippool.ErrNotInRange) {
 				continue
 			}
-			peer.Ipv4 = &newIP
-			if _, err := manager.storage.UpdatePeer(peer); err != nil {
+
+			if !manager.migratePeerAddress(peer) {
 				continue
 			}
 		}
 
-		_ = manager.wireguard.SetPeer(peer)
+		program = append(program, peer)
 		allPeersGauge.Inc()
 		manager.peerTrafficSender.Add(peer)
 	}
+
+	manager.programPeers(program, manager.runtime.Settings.GetRestoreRate())
+	zap.L().Info("peers restored",
+		zap.Int("total", len(peers)),
+		zap.Int("programmed", len(program)),
+		zap.Duration("took", time.Since(started)))
+	return len(program)
 }
 
-func (manager *Manager) unsetPeer(peer *types.PeerInfo) error {
+// programPeers sets peers on the device using the bounded pool of workers,
+// paced by rate peers per second if it's positive, so the startup of the
+// node with many peers does not starve other services of the host.
+// The sync status is recorded for every peer, so the failed ones
+// are reported as desynced and may be resynced by hand.
+func (manager *Manager) programPeers(peers []*types.PeerInfo, rate int) {
+	workers := manager.runtime.Settings.GetRestoreConcurrency()
+	if workers > len(peers) {
+		workers = len(peers)
+	}
+
+	started := time.Now()
+	errs := make([]error, len(peers))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				errs[idx] = manager.wireguard.SetPeer(peers[idx])
+			}
+		}()
+	}
+	for idx := range peers {
+		if rate > 0 {
+			// the peer is due at idx/rate since the start, so the pace
+			// is kept regardless of how long each one takes
+			due := started.Add(time.Duration(idx) * time.Second / time.Duration(rate))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	// the storage is updated sequentially, sqlite serializes writes anyway
+	failed := make([]int64, 0)
+	for idx, peer := range peers {
+		manager.recordPeerSync(context.Background(), peer, errs[idx])
+		if errs[idx] != nil {
+			failed = append(failed, peer.ID)
+		}
+	}
+
+	if len(failed) > 0 {
+		zap.L().Error("failed to program peers on the device", zap.Int64s("ids", failed))
+	}
+	updatePrometheusReconciled(len(peers) - len(failed))
+	zap.L().Info("peers programmed on the device",
+		zap.Int("count", len(peers)),
+		zap.Int("failed", len(failed)),
+		zap.Int("workers", workers),
+		zap.Int("rate", rate),
+		zap.Duration("took", time.Since(started)))
+}
+
+// migratePeerAddress allocates a new address for the peer
+// from the sub-pool matching its network policy.
+func (manager *Manager) migratePeerAddress(peer *types.PeerInfo) bool {
+	oldIP := *peer.Ipv4
+	newIP, err := manager.allocAddress(peer)
+	if err != nil {
+		// TODO(nikonov): remove peer OR mark it as invalid
+		//  to allow further migration by hand.
+		zap.L().Error("failed to allocate a new address for the peer",
+			zap.Int64("id", peer.ID), zap.Stringer("ip", oldIP), zap.Error(err))
+		return false
+	}
+
+	peer.Ipv4 = &newIP
+	if _, err := manager.storage.UpdatePeer(peer); err != nil {
+		_ = manager.unsetAddress(peer, newIP)
+		return false
+	}
+
+	zap.L().Info("peer address migrated",
+		zap.Int64("id", peer.ID), zap.Stringer("from", oldIP), zap.Stringer("to", newIP))
+	return true
+}
+
+func (manager *Manager) unsetPeer(ctx context.Context, peer *types.PeerInfo) error {
+	return manager.removePeer(ctx, peer, eventlog.PeerRemove, nil)
+}
+
+// removePeer removes the peer from the storage, the device and
+// the pool, the removal is reported by the event of the given type.
+// The final traffic is taken from wgPeers, the device is queried
+// if nil: removals in a batch share a single device dump.
+func (manager *Manager) removePeer(ctx context.Context, peer *types.PeerInfo, eventType eventlog.EventType, wgPeers map[string]wgtypes.Peer) error {
+	upstreamDelta, downstreamDelta := manager.flushPeerTraffic(peer, wgPeers)
+
 	err := manager.storage.DeletePeer(peer.ID)
 	errs := multierr.Append(nil, err)
 
 	err = manager.wireguard.UnsetPeer(peer)
 	errs = multierr.Append(errs, err)
 
-	err = manager.ip4am.Unset(*peer.Ipv4)
+	err = manager.unsetAddress(peer, *peer.Ipv4)
 	errs = multierr.Append(errs, err)
 
 	allPeersGauge.Dec()
+	// the event carries the final totals and the traffic
+	// not reported by the traffic updates
+	event := peerEvent(ctx, peer)
+	event.BytesDeltaRx = uint64(upstreamDelta)
+	event.BytesDeltaTx = uint64(downstreamDelta)
+	if err := manager.eventLog.Push(eventType, event); err != nil {
+		// do not return an error here because it's not related to the method itself.
+		logger(ctx).Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(eventType)))
+	}
+
+	manager.peerTrafficSender.Remove(peer)
+	delete(manager.suspended, peer.ID)
+	delete(manager.idle, peer.ID)
+	manager.history.forget(peer.ID)
+	_ = manager.storage.DeleteTrafficSamples(peer.ID)
+
+	logger(ctx).Debug("peer removed", zap.Int64("id", peer.ID), zap.Error(errs))
+	return errs
+}
+
+// flushPeerTraffic accounts the traffic of the peer being removed
+// since the last stats update, so the final bytes are not lost.
+// Returns the accounted traffic, zero if the peer is already
+// gone from the device.
+func (manager *Manager) flushPeerTraffic(peer *types.PeerInfo, wgPeers map[string]wgtypes.Peer) (int64, int64) {
+	if peer.WireguardPublicKey == nil || peer.Upstream == nil || peer.Downstream == nil {
+		return 0, 0
+	}
+
+	if wgPeers == nil {
+		var err error
+		wgPeers, err = manager.wireguard.GetPeers()
+		if err != nil {
+			// err has already been logged inside
+			return 0, 0
+		}
+	}
+
+	wgPeer, ok := wgPeers[*peer.WireguardPublicKey]
+	if !ok {
+		return 0, 0
+	}
+	return manager.statsService.FlushPeerStats(time.Now(), peer, wgPeer)
+}
+
+// suspendPeer removes the expired peer from the device
+// keeping it in the storage for the manual review.
+func (manager *Manager) suspendPeer(peer *types.PeerInfo) error {
+	if _, ok := manager.suspended[peer.ID]; ok {
+		return nil
+	}
+
+	if _, ok := manager.idle[peer.ID]; ok {
+		// already off the device
+		delete(manager.idle, peer.ID)
+	} else if err := manager.wireguard.UnsetPeer(peer); err != nil {
+		return err
+	}
+	manager.suspended[peer.ID] = struct{}{}
+
 	if err := manager.eventLog.Push(eventlog.PeerRemove, peer.IntoProto()); err != nil {
 		// do not return an error here because it's not related to the method itself.
 		zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_PeerRemove)))
 	}
 
 	manager.peerTrafficSender.Remove(peer)
+	return nil
+}
 
-	return errs
+// disconnectIdlePeer removes the peer without traffic from the device,
+// the peer is kept in the storage and put back by the next connect.
+func (manager *Manager) disconnectIdlePeer(idle idlePeer) error {
+	peer := idle.Peer
+	if err := manager.wireguard.UnsetPeer(peer); err != nil {
+		return err
+	}
+	manager.idle[peer.ID] = struct{}{}
+	// the peer's counters start from zero once it's back on the device
+	manager.statsService.ForgetPeer(peer)
+
+	event := peer.IntoProto()
+	event.IdleReason = idle.reason()
+	if err := manager.eventLog.Push(eventlog.PeerIdle, event); err != nil {
+		// do not return an error here because it's not related to the method itself.
+		zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_PeerIdle)))
+	}
+
+	manager.peerTrafficSender.Remove(peer)
+	zap.L().Debug("idle peer disconnected", zap.Int64("id", peer.ID), zap.String("reason", event.IdleReason))
+	return nil
 }
 
 // setPeer changes the given PeerInfo,
 // fields: ID, IPv4
-func (manager *Manager) setPeer(peer *types.PeerInfo) error {
-	err := func() error {
-		if peer.Expired() {
-			return xerror.EInvalidArgument("peer already expired", nil)
-		}
+func (manager *Manager) setPeer(ctx context.Context, peer *types.PeerInfo) error {
+	// validate the peer before touching the pool or the storage
+	if err := validateNewPeer(peer); err != nil {
+		return err
+	}
+	if err := manager.checkPeerCapacity(ctx); err != nil {
+		return err
+	}
+	stampModifiedBy(ctx, peer)
 
+	err := func() error {
 		if peer.Ipv4 == nil || peer.Ipv4.IP == nil {
 			// Allocate IP, if necessary
-			ipv4, err := manager.ip4am.Alloc(peer.GetNetworkPolicy())
+			ipv4, err := manager.allocPeerAddress(ctx, peer)
 			if err != nil {
 				return err
 			}
@@ -99,12 +352,16 @@ func (manager *Manager) setPeer(peer *types.PeerInfo) error {
 			peer.Ipv4 = &ipv4
 		} else {
 			// Check if IP can be used
-			err := manager.ip4am.Set(*peer.Ipv4, peer.GetNetworkPolicy())
+			err := manager.setAddress(peer, *peer.Ipv4)
 			if err != nil {
 				return err
 			}
 		}
 
+		if err := manager.checkAllowedIPs(ctx, peer); err != nil {
+			return err
+		}
+
 		// Set counters to zeros to prevent any fails on update stats operation
 		if peer.Upstream == nil {
 			var zeroVal int64
@@ -126,6 +383,7 @@ func (manager *Manager) setPeer(peer *types.PeerInfo) error {
 		if err := manager.wireguard.SetPeer(peer); err != nil {
 			return err
 		}
+		manager.recordPeerSync(ctx, peer, nil)
 
 		return nil
 	}()
@@ -133,7 +391,7 @@ func (manager *Manager) setPeer(peer *types.PeerInfo) error {
 	// rollback an action on error
 	if err != nil {
 		if peer.Ipv4 != nil {
-			_ = manager.ip4am.Unset(*peer.Ipv4)
+			_ = manager.unsetAddress(peer, *peer.Ipv4)
 		}
 
 		if peer.ID > 0 {
@@ -144,37 +402,345 @@ func (manager *Manager) setPeer(peer *types.PeerInfo) error {
 	}
 
 	allPeersGauge.Inc()
-	if err := manager.eventLog.Push(eventlog.PeerAdd, peer.IntoProto()); err != nil {
+	if err := manager.eventLog.Push(eventlog.PeerAdd, peerEvent(ctx, peer)); err != nil {
 		// do not return an error here because it's not related to the method itself.
-		zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_PeerAdd)))
+		logger(ctx).Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_PeerAdd)))
 	}
 	manager.peerTrafficSender.Add(peer)
 
+	logger(ctx).Debug("peer added", zap.Int64("id", peer.ID), zap.Stringer("ipv4", peer.Ipv4))
 	return nil
 }
 
-// updatePeer changes given newPeer,
-// fields: ID, IPv4
-func (manager *Manager) updatePeer(newPeer *types.PeerInfo) error {
-	if newPeer.Expired() {
-		return manager.unsetPeer(newPeer)
+// validateNewPeer runs checks of the peer being created
+// which do not depend on the pool state.
+func validateNewPeer(peer *types.PeerInfo) error {
+	// the id and the address are assigned on the creation
+	if err := peer.Validate("ID", "Ipv4"); err != nil {
+		return err
+	}
+	if peer.Expired() {
+		return xerror.EInvalidArgument("peer already expired", nil)
+	}
+	return nil
+}
+
+// checkPeerCapacity rejects the new peer if the wireguard device
+// already holds the configured max number of peers.
+// The device is not dumped for that: activated peers are on it
+// unless suspended or idle.
+func (manager *Manager) checkPeerCapacity(ctx context.Context) error {
+	limit := manager.runtime.Settings.GetMaxPeersPerInterface()
+	if limit == 0 {
+		return nil
+	}
+
+	activated, err := manager.storage.CountActivatedPeers(ctx)
+	if err != nil {
+		return err
+	}
+	onDevice := int(activated) - len(manager.suspended) - len(manager.idle)
+	if onDevice >= limit {
+		return xerror.ENotEnoughSpace("peer limit of the interface is reached", nil, zap.Int("max_peers", limit))
 	}
+	return nil
+}
 
+// checkPeerAddress reports whether setPeer would get
+// the address for the peer, nothing is claimed.
+func (manager *Manager) checkPeerAddress(peer *types.PeerInfo) error {
+	if peer.Ipv4 != nil && peer.Ipv4.IP != nil {
+		if !manager.ip4am.Contains(*peer.Ipv4) {
+			return xerror.EInvalidField("ipv4 is out of the pool", "ipv4", nil)
+		}
+		if peer.IsPointToPoint() && !manager.ip4am.MatchesLink(*peer.Ipv4) {
+			return xerror.EInvalidField("ipv4 does not start the point-to-point link", "ipv4", nil)
+		}
+		if !manager.addressAvailable(peer, *peer.Ipv4) {
+			return xerror.EExists("ipv4 is already in use", nil)
+		}
+		return nil
+	}
+
+	if pref := peer.PreferredIpv4; pref != nil && pref.IP != nil {
+		if err := manager.checkPreferredAddress(peer, *pref); err != nil {
+			return err
+		}
+		if manager.addressAvailable(peer, *pref) {
+			return nil
+		}
+		// the taken preferred address falls back to any other one
+	}
+
+	if peer.IsPointToPoint() {
+		if !manager.ip4am.CanAllocLink() {
+			return xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+		}
+		return nil
+	}
+	if !manager.ip4am.CanAlloc(peer.GetNetworkPolicy()) {
+		return xerror.ENotEnoughSpace("ipv4pool", ippool.ErrNotEnoughSpace)
+	}
+	return nil
+}
+
+// checkPreferredAddress validates the preferred address
+// against the peer's access policy range.
+func (manager *Manager) checkPreferredAddress(peer *types.PeerInfo, pref xnet.IP) error {
+	if !manager.ip4am.Contains(pref) {
+		return xerror.EInvalidField("preferred ipv4 is out of the pool", "preferred_ipv4", nil)
+	}
+	if !manager.addressMatches(peer, pref) {
+		return xerror.EInvalidField("preferred ipv4 does not match the peer's access policy range", "preferred_ipv4", nil)
+	}
+	return nil
+}
+
+// allocPeerAddress allocates the address for the new peer,
+// the peer's preferred address is taken if it's free.
+func (manager *Manager) allocPeerAddress(ctx context.Context, peer *types.PeerInfo) (xnet.IP, error) {
+	if pref := peer.PreferredIpv4; pref != nil && pref.IP != nil {
+		if err := manager.checkPreferredAddress(peer, *pref); err != nil {
+			return xnet.IP{}, err
+		}
+
+		err := manager.setAddress(peer, *pref)
+		switch {
+		case err == nil:
+			return *pref, nil
+		case errors.Is(err, ippool.ErrAddressInUse):
+			logger(ctx).Debug("preferred ipv4 is in use, allocating another one", zap.Stringer("ipv4", pref))
+		case errors.Is(err, ippool.ErrNotInRange), errors.Is(err, ippool.ErrInvalidAddress):
+			return xnet.IP{}, xerror.EInvalidField("preferred ipv4 is out of the pool", "preferred_ipv4", err)
+		default:
+			return xnet.IP{}, err
+		}
+	}
+
+	return manager.allocAddress(peer)
+}
+
+// allocAddress allocates a new address for the peer,
+// the point-to-point peer gets the whole /31 link.
+func (manager *Manager) allocAddress(peer *types.PeerInfo) (xnet.IP, error) {
+	var addr xnet.IP
+	var err error
+	if peer.IsPointToPoint() {
+		addr, err = manager.ip4am.AllocLink(peer.GetNetworkPolicy())
+	} else if near := manager.userAddresses(peer); len(near) > 0 {
+		var clustered bool
+		addr, clustered, err = manager.ip4am.AllocNear(peer.GetNetworkPolicy(), near)
+		peer.Clustered = &clustered
+	} else {
+		var key string
+		if peer.WireguardPublicKey != nil {
+			key = *peer.WireguardPublicKey
+		}
+		addr, err = manager.ip4am.AllocKey(peer.GetNetworkPolicy(), key)
+	}
+	if err != nil {
+		return xnet.IP{}, err
+	}
+
+	if err := manager.applyPortRules(peer, addr); err != nil {
+		return xnet.IP{}, err
+	}
+	return addr, nil
+}
+
+// userAddresses returns addresses of other peers of the same user
+// to allocate the peer's address next to them, nil if the clustering
+// is disabled, see ipalloc.Config.ClusterRadius.
+func (manager *Manager) userAddresses(peer *types.PeerInfo) []xnet.IP {
+	if peer.UserId == nil || !manager.ip4am.Clustering() {
+		return nil
+	}
+
+	peers, err := manager.storage.SearchPeers(&types.PeerInfo{
+		PeerIdentifiers: types.PeerIdentifiers{UserId: peer.UserId},
+	})
+	if err != nil {
+		// the clustering is the best effort, allocate as usual
+		zap.L().Debug("failed to get peers of the user", zap.Error(err))
+		return nil
+	}
+
+	addrs := make([]xnet.IP, 0, len(peers))
+	for _, p := range peers {
+		if p.ID != peer.ID && p.Ipv4 != nil {
+			addrs = append(addrs, *p.Ipv4)
+		}
+	}
+	return addrs
+}
+
+// setAddress claims the given address for the peer.
+func (manager *Manager) setAddress(peer *types.PeerInfo, addr xnet.IP) error {
+	var err error
+	if peer.IsPointToPoint() {
+		err = manager.ip4am.SetLink(addr, peer.GetNetworkPolicy())
+	} else {
+		err = manager.ip4am.Set(addr, peer.GetNetworkPolicy())
+	}
+	if err != nil {
+		return err
+	}
+
+	return manager.applyPortRules(peer, addr)
+}
+
+// unsetAddress releases the peer's address.
+func (manager *Manager) unsetAddress(peer *types.PeerInfo, addr xnet.IP) error {
+	var err error
+	if peer.IsPointToPoint() {
+		err = manager.ip4am.UnsetLink(addr)
+	} else {
+		err = manager.ip4am.Unset(addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, a := range peerAddresses(peer, addr) {
+		err = multierr.Append(err, manager.ports.Remove(a))
+	}
+	return err
+}
+
+// applyPortRules applies the port rules of the peer's policy
+// to the just claimed address, the address is released on failure.
+func (manager *Manager) applyPortRules(peer *types.PeerInfo, addr xnet.IP) error {
+	var err error
+	for _, a := range peerAddresses(peer, addr) {
+		if err = manager.ports.Apply(a, peer.GetNetworkPolicy()); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	_ = manager.unsetAddress(peer, addr)
+	return err
+}
+
+// peerAddresses returns addresses the peer's traffic originates from,
+// the point-to-point peer owns both addresses of its link.
+func peerAddresses(peer *types.PeerInfo, addr xnet.IP) []xnet.IP {
+	if peer.IsPointToPoint() {
+		return []xnet.IP{addr, xnet.Uint32ToIP(addr.ToUint32() + 1)}
+	}
+	return []xnet.IP{addr}
+}
+
+// reapplyAddressPolicy claims the address of the old peer again
+// with the policy of the new peer, the address is kept.
+func (manager *Manager) reapplyAddressPolicy(oldPeer *types.PeerInfo, newPeer *types.PeerInfo) error {
+	if err := manager.unsetAddress(oldPeer, *oldPeer.Ipv4); err != nil {
+		return err
+	}
+
+	if err := manager.setAddress(newPeer, *oldPeer.Ipv4); err != nil {
+		// never leave the address unclaimed
+		_ = manager.setAddress(oldPeer, *oldPeer.Ipv4)
+		return err
+	}
+	return nil
+}
+
+// addressAvailable reports whether the address
+// can be claimed for the peer by setAddress.
+func (manager *Manager) addressAvailable(peer *types.PeerInfo, addr xnet.IP) bool {
+	if peer.IsPointToPoint() {
+		return manager.ip4am.MatchesLink(addr) &&
+			manager.ip4am.IsAvailable(addr) &&
+			manager.ip4am.IsAvailable(xnet.Uint32ToIP(addr.ToUint32()+1))
+	}
+	return manager.ip4am.IsAvailable(addr)
+}
+
+// addressMatches reports whether the address fits the peer,
+// see ipalloc.Allocator.Matches.
+func (manager *Manager) addressMatches(peer *types.PeerInfo, addr xnet.IP) bool {
+	if peer.IsPointToPoint() {
+		return manager.ip4am.MatchesLink(addr)
+	}
+	return manager.ip4am.Matches(addr, peer.GetNetworkPolicy())
+}
+
+// checkAllowedIPs rejects the peer whose AllowedIPs overlap the ones
+// of another peer, wireguard would route such packets ambiguously.
+// The pool keeps addresses unique, but it knows nothing about
+// the ranges of point-to-point links routed to a single peer.
+func (manager *Manager) checkAllowedIPs(ctx context.Context, peer *types.PeerInfo) error {
+	if !manager.runtime.Settings.GetCheckAllowedIPs() {
+		return nil
+	}
+
+	// AllowedIPs never exceed the /31 link, so only the peers
+	// of the same link may overlap
+	peers, err := manager.storage.SearchPeersInLink(ctx, *peer.Ipv4)
+	if err != nil {
+		return err
+	}
+
+	allowed := wireguard.AllowedIPs(peer)
+	for _, other := range peers {
+		if other.ID == peer.ID || other.Ipv4 == nil || other.Ipv4.IP == nil {
+			continue
+		}
+		for _, a := range allowed {
+			for _, b := range wireguard.AllowedIPs(other) {
+				if a.Contains(b.IP) || b.Contains(a.IP) {
+					return xerror.EExists("allowed ips overlap with another peer", nil,
+						zap.Int64("other_id", other.ID), zap.Stringer("allowed_ip", &a), zap.Stringer("other_allowed_ip", &b))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// updatePeer changes given newPeer,
+// fields: ID, IPv4
+func (manager *Manager) updatePeer(ctx context.Context, newPeer *types.PeerInfo) error {
 	// Find old peer to remove it from wireguard interface
 	oldPeer, err := manager.storage.GetPeer(newPeer.ID)
 	if err != nil {
 		return err
 	}
+	if newPeer.Expired() {
+		// the stored peer is the one programmed on the device,
+		// the key of the update does not matter
+		return manager.unsetPeer(ctx, oldPeer)
+	}
+
+	if err := newPeer.Validate("Ipv4"); err != nil {
+		return err
+	}
+	// the link can't be turned into the single address and vice versa
+	newPeer.PointToPoint = oldPeer.PointToPoint
+	if newPeer.DisplayName == nil {
+		// the display name is not the part of the API peer, keep it
+		newPeer.DisplayName = oldPeer.DisplayName
+	}
+	// updates on behalf of the client or the server itself
+	// keep the last admin
+	newPeer.ModifiedBy = oldPeer.ModifiedBy
+	stampModifiedBy(ctx, newPeer)
+	policyChanged := newPeer.GetNetworkPolicy() != oldPeer.GetNetworkPolicy()
+	// policyApplied is set if the new policy is applied to the old address
+	policyApplied := false
 
 	ipOK, dbOK, wgOK, err := func() (bool, bool, bool, error) {
 		var ipOK, dbOK, wgOK bool
 		// Prepare ipv4 address
 		if newPeer.Ipv4 == nil {
 			// IP is not set - allocate new one
-			ipv4, err := manager.ip4am.Alloc(newPeer.GetNetworkPolicy())
+			ipv4, err := manager.allocAddress(newPeer)
 			if err != nil {
 				// TODO: Differentiate log level by error type (i.e. no space is debug message, others are errors)
-				zap.L().Debug("can't allocate new IP for existing peer", zap.Error(err))
+				logger(ctx).Debug("can't allocate new IP for existing peer", zap.Error(err))
 
 				// Something went wrong - use old IP
 				newPeer.Ipv4 = oldPeer.Ipv4
@@ -184,14 +750,33 @@ func (manager *Manager) updatePeer(newPeer *types.PeerInfo) error {
 			}
 		} else if !newPeer.Ipv4.Equal(*oldPeer.Ipv4) {
 			// Try to set up new ip, if it differs from old one
-			if err := manager.ip4am.Set(*newPeer.Ipv4, newPeer.GetNetworkPolicy()); err != nil {
+			if err := manager.setAddress(newPeer, *newPeer.Ipv4); err != nil {
 				return ipOK, dbOK, wgOK, err
 			}
+		} else if policyChanged {
+			if manager.addressMatches(newPeer, *newPeer.Ipv4) {
+				// keep the address, but update the firewall and shaping rules
+				if err := manager.reapplyAddressPolicy(oldPeer, newPeer); err != nil {
+					return ipOK, dbOK, wgOK, err
+				}
+				policyApplied = true
+			} else {
+				// the address belongs to the sub-pool of the old policy
+				ipv4, err := manager.allocAddress(newPeer)
+				if err != nil {
+					return ipOK, dbOK, wgOK, err
+				}
+				newPeer.Ipv4 = &ipv4
+			}
 		}
 
 		// We finished IP updating
 		ipOK = true
 
+		if err := manager.checkAllowedIPs(ctx, newPeer); err != nil {
+			return ipOK, dbOK, wgOK, err
+		}
+
 		// Update database
 		now := xtime.Now()
 		newPeer.Updated = &now
@@ -204,18 +789,34 @@ func (manager *Manager) updatePeer(newPeer *types.PeerInfo) error {
 		dbOK = true
 
 		// Update wireguard peer
-		if *oldPeer.WireguardPublicKey != *newPeer.WireguardPublicKey {
+		if oldPeer.WireguardPublicKey != nil && (newPeer.WireguardPublicKey == nil || *oldPeer.WireguardPublicKey != *newPeer.WireguardPublicKey) {
 			// Key changed - we need remove old peer and set new
 			if err := manager.wireguard.UnsetPeer(oldPeer); err != nil {
 				return ipOK, dbOK, wgOK, err
 			}
 		}
+		if newPeer.WireguardPublicKey == nil {
+			// the inactive shared peer gets on the device once activated
+			return ipOK, dbOK, wgOK, nil
+		}
 
 		if err := manager.wireguard.SetPeer(newPeer); err != nil {
-			zap.L().Error("failed to set new peer, trying to revert old", zap.Error(err))
+			logger(ctx).Error("failed to set new peer, trying to revert old", zap.Error(err))
+			manager.recordPeerSync(ctx, newPeer, err)
 			err = manager.wireguard.SetPeer(oldPeer)
 			return ipOK, dbOK, wgOK, err
 		}
+		manager.recordPeerSync(ctx, newPeer, nil)
+		if _, ok := manager.suspended[newPeer.ID]; ok {
+			// the suspended peer is back on the device
+			delete(manager.suspended, newPeer.ID)
+			manager.peerTrafficSender.Add(newPeer)
+		}
+		if _, ok := manager.idle[newPeer.ID]; ok {
+			// the idle peer has connected again
+			delete(manager.idle, newPeer.ID)
+			manager.peerTrafficSender.Add(newPeer)
+		}
 
 		wgOK = true
 		return ipOK, dbOK, wgOK, err
@@ -230,7 +831,12 @@ func (manager *Manager) updatePeer(newPeer *types.PeerInfo) error {
 
 		if ipOK && !newPeer.Ipv4.Equal(*oldPeer.Ipv4) {
 			// Try to cleanup new IP
-			_ = manager.ip4am.Unset(*newPeer.Ipv4)
+			_ = manager.unsetAddress(newPeer, *newPeer.Ipv4)
+		}
+
+		if policyApplied {
+			// Try to restore the old policy rules
+			_ = manager.reapplyAddressPolicy(newPeer, oldPeer)
 		}
 
 		if wgOK {
@@ -242,17 +848,57 @@ func (manager *Manager) updatePeer(newPeer *types.PeerInfo) error {
 		return err
 	}
 
+	if !newPeer.Ipv4.Equal(*oldPeer.Ipv4) {
+		// the peer has moved, release the old address
+		if err := manager.unsetAddress(oldPeer, *oldPeer.Ipv4); err != nil {
+			logger(ctx).Error("failed to release the old peer address",
+				zap.Int64("id", newPeer.ID), zap.Stringer("ipv4", oldPeer.Ipv4), zap.Error(err))
+		}
+	}
+
 	// TODO(nikonov): report an actual traffic on update
-	if err := manager.eventLog.Push(eventlog.PeerUpdate, newPeer.IntoProto()); err != nil {
+	if err := manager.eventLog.Push(eventlog.PeerUpdate, peerEvent(ctx, newPeer)); err != nil {
 		// do not return an error here because it's not related to the method itself.
-		zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_PeerUpdate)))
+		logger(ctx).Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_PeerUpdate)))
 	}
 
+	logger(ctx).Debug("peer updated", zap.Int64("id", newPeer.ID), zap.Stringer("ipv4", newPeer.Ipv4))
+	return nil
+}
+
+// applyExpiration brings the device in line with the new expiration
+// of the peer already stored: expired peers are removed the same way
+// updatePeer does, the suspended ones are programmed back.
+func (manager *Manager) applyExpiration(ctx context.Context, peer *types.PeerInfo) error {
+	if peer.Expired() {
+		return manager.unsetPeer(ctx, peer)
+	}
+
+	if _, ok := manager.suspended[peer.ID]; ok {
+		err := manager.wireguard.SetPeer(peer)
+		manager.recordPeerSync(ctx, peer, err)
+		if err != nil {
+			return err
+		}
+
+		// the suspended peer is back on the device
+		delete(manager.suspended, peer.ID)
+		manager.peerTrafficSender.Add(peer)
+	}
+
+	if err := manager.eventLog.Push(eventlog.PeerUpdate, peerEvent(ctx, peer)); err != nil {
+		// do not return an error here because it's not related to the method itself.
+		logger(ctx).Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_PeerUpdate)))
+	}
+
+	logger(ctx).Debug("peer expiration updated", zap.Int64("id", peer.ID))
 	return nil
 }
 
 func (manager *Manager) findPeerByIdentifiers(identifiers *types.PeerIdentifiers) (*types.PeerInfo, error) {
-	if identifiers == nil {
+	// the empty query matches every peer
+	if identifiers == nil ||
+		identifiers.UserId == nil && identifiers.InstallationId == nil && identifiers.SessionId == nil {
 		return nil, xerror.EInvalidArgument("no identifiers", nil)
 	}
 
@@ -270,7 +916,8 @@ func (manager *Manager) findPeerByIdentifiers(identifiers *types.PeerIdentifiers
 	}
 
 	if len(peers) > 1 {
-		return nil, xerror.EInvalidArgument("not enough identifiers to update peer", nil)
+		// identifiers are valid but ambiguous, respond with 409
+		return nil, xerror.EExists("ambiguous peer match, supply more identifiers", nil)
 	}
 
 	return peers[0], nil
@@ -284,18 +931,46 @@ func (manager *Manager) syncPeerStats() {
 		updatePrometheusFromLinkStats(linkStats)
 	}
 
-	// ignore error because it logged by the common.Error wrapper.
+	// error is logged by the common.Error wrapper.
 	// it is safe to call reportTrafficByPeer with nil map.
-	wireguardPeers, _ := manager.wireguard.GetPeers()
+	wireguardPeers, wgErr := manager.wireguard.GetPeers()
 
 	peers, err := manager.peers()
 	if err != nil {
 		return
 	}
 
+	if wgErr == nil {
+		updatePrometheusConfigHash(deviceConfigHash(wireguardPeers), storageConfigHash(peers))
+		missing, unknown := desyncedPeers(peers, wireguardPeers)
+		updatePrometheusDesynced(manager.countMissing(missing), len(unknown))
+	}
+
 	now := time.Now()
+	prevTraffic := make(map[int64]PeerTraffic, len(peers))
+	for _, peer := range peers {
+		if peer.Upstream != nil && peer.Downstream != nil {
+			prevTraffic[peer.ID] = PeerTraffic{Upstream: *peer.Upstream, Downstream: *peer.Downstream}
+		}
+	}
+
+	// idle peers are off the device until they connect again,
+	// so they have no traffic to account, but still expire
+	onDevice := peers
+	var idleExpired []*types.PeerInfo
+	if len(manager.idle) > 0 {
+		onDevice = make([]*types.PeerInfo, 0, len(peers))
+		for _, peer := range peers {
+			if _, ok := manager.idle[peer.ID]; !ok {
+				onDevice = append(onDevice, peer)
+			} else if peer.Expires != nil && peer.Expires.Time.Before(now) {
+				idleExpired = append(idleExpired, peer)
+			}
+		}
+	}
+
 	// Update peer stats according to current metrics in wireguard peers
-	results := manager.statsService.UpdatePeersStats(now, peers, wireguardPeers)
+	results := manager.statsService.UpdatePeersStats(now, onDevice, wireguardPeers)
 
 	// Save stats of the updated peers
 	for _, peer := range results.UpdatedPeers {
@@ -307,8 +982,17 @@ func (manager *Manager) syncPeerStats() {
 		}
 	}
 
+	manager.recordHistory(now, results.TrafficUpdatedPeers, prevTraffic)
+	_ = manager.storage.DeleteTrafficSamplesBefore(now.Truncate(time.Hour).Add(-(trafficHistoryBuckets - 1) * time.Hour))
+	_ = manager.storage.DeleteTrafficTotalsBefore(now.Truncate(time.Hour).Add(-trafficTotalsRetention))
+
 	// Send notifications about peers with first connection
 	for _, peer := range results.FirstConnectedPeers {
+		if !manager.eventThrottle.allow(peer.ID, eventlog.PeerFirstConnect, now) {
+			// the peer is flapping, the connection is counted anyway
+			continue
+		}
+
 		// Send event containing updated peer
 		err := manager.eventLog.Push(eventlog.PeerFirstConnect, peer.IntoProto())
 		if err != nil {
@@ -316,17 +1000,54 @@ func (manager *Manager) syncPeerStats() {
 		}
 	}
 
+	manager.trackPresence(now, peers)
+
 	// Notify with the peers with traffic updates
 	manager.peerTrafficSender.Send(results.TrafficUpdatedPeers)
 
-	// Delete expired peers
-	for _, peer := range results.ExpiredPeers {
-		err = manager.unsetPeer(peer)
+	// Mass expiration most likely means the clock jump,
+	// keep peers intact until the clock is fixed
+	expired := append(results.ExpiredPeers, idleExpired...)
+	if manager.checkClockAnomaly(now, len(expired), results.NumPeers+len(peers)-len(onDevice)) {
+		expired = nil
+	}
+
+	// Delete expired peers, or just remove them from the device
+	// if they are subject to the manual wipe
+	// keep the storage intact in the maintenance mode
+	autoWipe := manager.runtime.Settings.GetAutoWipeExpired() && !manager.maintenance.Load()
+	if wgErr != nil {
+		// the traffic is unknown, don't query the device per peer
+		wireguardPeers = map[string]wgtypes.Peer{}
+	}
+	for _, peer := range expired {
+		if !autoWipe {
+			if err := manager.suspendPeer(peer); err != nil {
+				zap.L().Error("failed to suspend expired peer", zap.Error(err))
+			}
+			continue
+		}
+
+		err = manager.removePeer(context.Background(), peer, eventlog.PeerRemove, wireguardPeers)
 		if err != nil {
 			zap.L().Error("failed to unset expired peer", zap.Error(err))
 		}
 	}
 
+	for _, idle := range results.IdlePeers {
+		if err := manager.disconnectIdlePeer(idle); err != nil {
+			zap.L().Error("failed to disconnect idle peer", zap.Int64("id", idle.Peer.ID), zap.Error(err))
+		}
+	}
+
+	manager.checkPoolPressure(now)
+
+	if linkStats == nil {
+		// the interface is gone, keep the link counters
+		// as is until it's back, see checkInterface.
+		return
+	}
+
 	oldStats := manager.GetCachedStatistics()
 
 	diffUpstream := linkStats.RxBytes
@@ -336,21 +1057,36 @@ func (manager *Manager) syncPeerStats() {
 		diffDownstream -= oldStats.LinkStat.TxBytes
 	}
 
+	var unattributedUpstream, unattributedDownstream int64
+	if oldStats.LinkStat != nil {
+		// no baseline on the first tick
+		unattributedUpstream, unattributedDownstream = unattributedTraffic(
+			int64(diffUpstream), int64(diffDownstream), results.TrafficUpdatedPeers, prevTraffic)
+		unattributedBytesGauge.WithLabelValues("upstream").Set(float64(unattributedUpstream))
+		unattributedBytesGauge.WithLabelValues("downstream").Set(float64(unattributedDownstream))
+	}
+
 	newStats := &CachedStatistics{
-		PeersTotal:          results.NumPeers,
-		PeersWithTraffic:    results.NumPeersWithHadshakes,
-		PeersActiveLastHour: results.NumPeersActiveLastHour,
-		PeersActiveLastDay:  results.NumPeersActiveLastDay,
-		LinkStat:            linkStats,
-		Upstream:            oldStats.Upstream + int64(diffUpstream),
-		Downstream:          oldStats.Downstream + int64(diffDownstream),
-		Collected:           time.Now().Unix(),
+		PeersTotal:             results.NumPeers,
+		PeersWithTraffic:       results.NumPeersWithHadshakes,
+		PeersActiveLastHour:    results.NumPeersActiveLastHour,
+		PeersActiveLastDay:     results.NumPeersActiveLastDay,
+		LinkStat:               linkStats,
+		Upstream:               oldStats.Upstream + int64(diffUpstream),
+		Downstream:             oldStats.Downstream + int64(diffDownstream),
+		UnattributedUpstream:   unattributedUpstream,
+		UnattributedDownstream: unattributedDownstream,
+		Collected:              time.Now().Unix(),
 	}
 
 	speed := newStats.CalcSpeed(oldStats)
 	if speed != nil {
 		newStats.UpstreamSpeed = manager.upstreamSpeedAvg.Push(speed.Upstream)
 		newStats.DownstreamSpeed = manager.downstreamSpeedAvg.Push(speed.Downstream)
+	} else {
+		// e.g. the manual refresh within the second of the tick
+		newStats.UpstreamSpeed = oldStats.UpstreamSpeed
+		newStats.DownstreamSpeed = oldStats.DownstreamSpeed
 	}
 
 	zap.L().Debug("STATS",
@@ -361,7 +1097,9 @@ func (manager *Manager) syncPeerStats() {
 		zap.Int("rx_bytes", int(linkStats.RxBytes)),
 		zap.Int("rx_packets", int(linkStats.RxPackets)),
 		zap.Int("tx_bytes", int(linkStats.TxBytes)),
-		zap.Int("tx_packets", int(linkStats.TxPackets)))
+		zap.Int("tx_packets", int(linkStats.TxPackets)),
+		zap.Int64("unattributed_rx_bytes", unattributedUpstream),
+		zap.Int64("unattributed_tx_bytes", unattributedDownstream))
 
 	peersWithHandshakesGauge.Set(float64(results.NumPeersWithHadshakes))
 	manager.storage.SetUpstreamMetric(newStats.Upstream)
@@ -370,18 +1108,66 @@ func (manager *Manager) syncPeerStats() {
 	manager.statistic.Store(newStats)
 }
 
-func (manager *Manager) background() {
-	syncPeerTicker := time.NewTicker(manager.runtime.Settings.GetUpdateStatisticsInterval().Value())
-	zap.L().Debug("Start update peer stats", zap.Stringer("interval", manager.runtime.Settings.GetUpdateStatisticsInterval()))
+// unattributedTraffic returns the link traffic since the previous tick
+// not accounted to any peer: handshakes, keepalives, or the per-peer
+// accounting errors if the value is large. prev holds peers' counters
+// before the update.
+func unattributedTraffic(linkUpstream int64, linkDownstream int64, peers []*types.PeerInfo, prev map[int64]PeerTraffic) (int64, int64) {
+	for _, peer := range peers {
+		old, ok := prev[peer.ID]
+		if !ok || peer.Upstream == nil || peer.Downstream == nil {
+			continue
+		}
+		linkUpstream -= *peer.Upstream - old.Upstream
+		linkDownstream -= *peer.Downstream - old.Downstream
+	}
+	return linkUpstream, linkDownstream
+}
+
+// backgroundIntervals are the periods of the background jobs.
+type backgroundIntervals struct {
+	stats          time.Duration
+	checkInterface time.Duration
+	stalePeers     time.Duration
+}
+
+func newBackgroundIntervals(s *settings.Config) backgroundIntervals {
+	return backgroundIntervals{
+		stats:          s.GetUpdateStatisticsInterval().Value(),
+		checkInterface: s.GetInterfaceCheckInterval().Value(),
+		stalePeers:     s.GetStalePeersInterval().Value(),
+	}
+}
+
+// setBackgroundIntervals passes new intervals to the background,
+// the pending ones are replaced.
+func (manager *Manager) setBackgroundIntervals(intervals backgroundIntervals) {
+	for {
+		select {
+		case manager.resetTickers <- intervals:
+			return
+		case <-manager.resetTickers:
+		}
+	}
+}
+
+func (manager *Manager) background(intervals backgroundIntervals) {
+	syncPeerTicker := time.NewTicker(intervals.stats)
+	zap.L().Debug("Start update peer stats", zap.Duration("interval", intervals.stats))
+	checkInterfaceTicker := time.NewTicker(intervals.checkInterface)
+	stalePeersTicker := time.NewTicker(intervals.stalePeers)
 
 	defer func() {
 		syncPeerTicker.Stop()
+		checkInterfaceTicker.Stop()
+		stalePeersTicker.Stop()
 		close(manager.done)
 	}()
 
 	manager.lock.Lock()
-	manager.syncPeerStats()
+	manager.refreshStats()
 	manager.lock.Unlock()
+	manager.lastTick.Store(time.Now().Unix())
 
 	for {
 		select {
@@ -389,9 +1175,26 @@ func (manager *Manager) background() {
 			zap.L().Info("Shutting down manager background process")
 			return
 		case <-syncPeerTicker.C:
+			if manager.paused.Load() {
+				continue
+			}
+			manager.lock.Lock()
+			manager.refreshStats()
+			manager.lock.Unlock()
+			manager.lastTick.Store(time.Now().Unix())
+		case now := <-checkInterfaceTicker.C:
+			manager.lock.Lock()
+			manager.checkInterface(now)
+			manager.lock.Unlock()
+		case now := <-stalePeersTicker.C:
 			manager.lock.Lock()
-			manager.syncPeerStats()
+			manager.removeStalePeers(now)
 			manager.lock.Unlock()
+		case intervals := <-manager.resetTickers:
+			syncPeerTicker.Reset(intervals.stats)
+			checkInterfaceTicker.Reset(intervals.checkInterface)
+			stalePeersTicker.Reset(intervals.stalePeers)
+			zap.L().Debug("Background intervals changed", zap.Duration("stats", intervals.stats))
 		}
 	}
 }
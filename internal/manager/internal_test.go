@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/xnet"
+)
+
+func TestRestorePeersMigratesAddress(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Shutdown() })
+
+	inPool := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	inPoolIP := xnet.IP{IP: net.IPv4(10, 0, 0, 100).To4()}
+	inPool.Ipv4 = &inPoolIP
+	inPoolID, err := db.CreatePeer(*inPool)
+	require.NoError(t, err)
+
+	// the peer got its address before the pool was segmented
+	wrongPool := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	wrongPoolIP := xnet.IP{IP: net.IPv4(10, 0, 0, 200).To4()}
+	wrongPool.Ipv4 = &wrongPoolIP
+	wrongPoolID, err := db.CreatePeer(*wrongPool)
+	require.NoError(t, err)
+
+	ip4am := newFakeIPAM()
+	ip4am.matches = func(addr xnet.IP, _ ipam.Policy) bool {
+		return addr.IP.To4()[3] < 128
+	}
+	wg := newFakeWireguard()
+
+	m, err := newManager(&runtime.TunnelRuntime{}, db, wg, ip4am, newFakePortFilter(), eventlog.NewDummy(), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = m.Shutdown() })
+
+	peer, err := db.GetPeer(inPoolID)
+	require.NoError(t, err)
+	assert.Equal(t, inPoolIP.String(), peer.Ipv4.String())
+
+	peer, err = db.GetPeer(wrongPoolID)
+	require.NoError(t, err)
+	assert.NotEqual(t, wrongPoolIP.String(), peer.Ipv4.String())
+	assert.True(t, ip4am.Matches(*peer.Ipv4, peer.GetNetworkPolicy()))
+
+	peers, err := wg.GetPeers()
+	require.NoError(t, err)
+	require.Contains(t, peers, *wrongPool.WireguardPublicKey)
+	assert.Equal(t, peer.Ipv4.IP.To4(), peers[*wrongPool.WireguardPublicKey].AllowedIPs[0].IP.To4())
+}
+
+func TestUnattributedTraffic(t *testing.T) {
+	up1, down1 := int64(1100), int64(2200)
+	up2, down2 := int64(500), int64(500)
+	peers := []*types.PeerInfo{
+		{ID: 1, Upstream: &up1, Downstream: &down1},
+		{ID: 2, Upstream: &up2, Downstream: &down2},
+		// appeared since the previous tick, nothing to compare with
+		{ID: 3, Upstream: &up2, Downstream: &down2},
+	}
+	prev := map[int64]PeerTraffic{
+		1: {Upstream: 1000, Downstream: 2000},
+		2: {Upstream: 400, Downstream: 500},
+	}
+
+	up, down := unattributedTraffic(250, 300, peers, prev)
+	assert.EqualValues(t, 50, up)
+	assert.EqualValues(t, 100, down)
+}
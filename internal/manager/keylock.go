@@ -0,0 +1,58 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"sync"
+)
+
+// keyLock serializes callers sharing the same key,
+// callers with different keys proceed in parallel.
+// Entries are dropped once nobody holds or waits for them.
+type keyLock struct {
+	mu    sync.Mutex
+	locks map[string]*keyLockEntry
+}
+
+type keyLockEntry struct {
+	mu sync.Mutex
+	// refs is the number of holders and waiters, guarded by keyLock.mu
+	refs int
+}
+
+func newKeyLock() *keyLock {
+	return &keyLock{locks: make(map[string]*keyLockEntry)}
+}
+
+// Lock locks the key, returns the function unlocking it.
+func (l *keyLock) Lock(key string) func() {
+	l.mu.Lock()
+	entry, ok := l.locks[key]
+	if !ok {
+		entry = &keyLockEntry{}
+		l.locks[key] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.mu.Lock()
+	return func() {
+		entry.mu.Unlock()
+
+		l.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// size returns the number of keys held or waited for.
+func (l *keyLock) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.locks)
+}
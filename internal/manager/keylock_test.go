@@ -0,0 +1,54 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyLock(t *testing.T) {
+	l := newKeyLock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inside := map[string]int{}
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		key := "a"
+		if i%2 == 0 {
+			key = "b"
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := l.Lock(key)
+			defer unlock()
+
+			mu.Lock()
+			inside[key]++
+			if inside[key] != 1 {
+				errs <- fmt.Errorf("key %s is held %d times", key, inside[key])
+			}
+			mu.Unlock()
+
+			mu.Lock()
+			inside[key]--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	// nothing is left once all keys are released
+	require.Zero(t, l.size())
+}
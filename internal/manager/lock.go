@@ -0,0 +1,60 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// managerLock is the mutex the waiter can give up on,
+// backed by the 1-slot semaphore. The zero value is unlocked.
+type managerLock struct {
+	once sync.Once
+	sem  chan struct{}
+}
+
+func (l *managerLock) slot() chan struct{} {
+	l.once.Do(func() { l.sem = make(chan struct{}, 1) })
+	return l.sem
+}
+
+func (l *managerLock) Lock() {
+	l.slot() <- struct{}{}
+}
+
+func (l *managerLock) TryLock() bool {
+	select {
+	case l.slot() <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// lockContext waits for the lock for d at most,
+// returns the context error if ctx is done first.
+func (l *managerLock) lockContext(ctx context.Context, d time.Duration) (bool, error) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case l.slot() <- struct{}{}:
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (l *managerLock) Unlock() {
+	select {
+	case <-l.slot():
+	default:
+		panic("manager: unlock of unlocked lock")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/tunnel/proto"
+	"go.uber.org/zap"
+)
+
+// SetMaintenance switches the read-only maintenance mode.
+// Peers stay on the device and can be queried, but any
+// peer mutation is rejected until the mode is switched off.
+func (manager *Manager) SetMaintenance(ctx context.Context, enabled bool) error {
+	if !manager.running.Load().(bool) {
+		return xerror.EUnavailable("server is shutting down", nil)
+	}
+	// wait for the mutations in progress
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
+	defer manager.lock.Unlock()
+
+	if manager.maintenance.Load() == enabled {
+		return nil
+	}
+	manager.maintenance.Store(enabled)
+
+	event := &proto.MaintenanceInfo{
+		Enabled:       enabled,
+		CorrelationID: CorrelationID(ctx),
+	}
+	if err := manager.eventLog.Push(eventlog.ServerMaintenance, event); err != nil {
+		// do not return an error here because it's not related to the method itself.
+		logger(ctx).Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_ServerMaintenance)))
+	}
+
+	logger(ctx).Info("maintenance mode switched", zap.Bool("enabled", enabled))
+	return nil
+}
+
+// Maintenance reports whether the maintenance mode is on.
+func (manager *Manager) Maintenance() bool {
+	return manager.maintenance.Load()
+}
+
+// checkMaintenance rejects the mutation in the maintenance mode,
+// must be called with the lock held.
+func (manager *Manager) checkMaintenance() error {
+	if manager.maintenance.Load() {
+		return xerror.EUnavailable("maintenance mode", nil)
+	}
+	return nil
+}
+
+// PauseBackground stops the scheduled peer stats sync
+// until ResumeBackground, e.g. for the duration of a heavy migration.
+// The sync in progress completes before the call returns.
+func (manager *Manager) PauseBackground(ctx context.Context) error {
+	return manager.setBackgroundPaused(ctx, true)
+}
+
+// ResumeBackground restarts the scheduled peer stats sync
+// stopped by PauseBackground, starting from the next tick.
+func (manager *Manager) ResumeBackground(ctx context.Context) error {
+	return manager.setBackgroundPaused(ctx, false)
+}
+
+// BackgroundPaused reports whether the scheduled peer stats sync is paused.
+func (manager *Manager) BackgroundPaused() bool {
+	return manager.paused.Load()
+}
+
+func (manager *Manager) setBackgroundPaused(ctx context.Context, paused bool) error {
+	if !manager.running.Load().(bool) {
+		return xerror.EUnavailable("server is shutting down", nil)
+	}
+	// wait for the sync in progress
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
+	defer manager.lock.Unlock()
+
+	if manager.paused.Swap(paused) != paused {
+		logger(ctx).Info("background stats sync switched", zap.Bool("paused", paused))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/common-lib-go/human"
+	"github.com/vpnhouse/common-lib-go/xerror"
+)
+
+func TestMaintenance(t *testing.T) {
+	m := newTestManager(t)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.lock.Unlock()
+
+	ctx := context.Background()
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(ctx, peer))
+
+	require.NoError(t, m.SetMaintenance(WithCorrelationID(ctx, "req-1"), true))
+	// repeated switch is not a transition
+	require.NoError(t, m.SetMaintenance(ctx, true))
+	assert.True(t, m.Maintenance())
+
+	assertUnavailable := func(err error) {
+		t.Helper()
+		require.Error(t, err)
+		code, _ := xerror.ErrorToHttpResponse(err)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+	}
+	assertUnavailable(m.SetPeer(ctx, newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))))
+	assertUnavailable(m.UpdatePeer(ctx, peer))
+	_, err := m.ConnectPeer(ctx, peer, 0)
+	assertUnavailable(err)
+	assertUnavailable(m.UnsetPeer(ctx, peer.ID))
+	_, err = m.WipeExpiredPeers(ctx)
+	assertUnavailable(err)
+
+	// reads keep working
+	stored, err := m.GetPeer(ctx, peer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, peer.ID, stored.ID)
+	peers, err := m.ListPeers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, peers, 1)
+
+	require.NoError(t, m.SetMaintenance(ctx, false))
+	require.NoError(t, m.UnsetPeer(ctx, peer.ID))
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	require.Len(t, events.maintenance, 2)
+	assert.True(t, events.maintenance[0].Enabled)
+	assert.Equal(t, "req-1", events.maintenance[0].CorrelationID)
+	assert.False(t, events.maintenance[1].Enabled)
+}
+
+func TestPauseBackground(t *testing.T) {
+	m := newTestManagerWithSettings(t, &settings.Config{
+		PeerStatistics: &settings.PeerStatisticConfig{
+			UpdateStatisticsInterval:       human.MustParseInterval("10ms"),
+			TrafficChangeSendEventInterval: human.MustParseInterval(settings.DefaultTrafficChangeSendEventInterval),
+		},
+	})
+	synced := func() time.Time {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return m.statsSynced
+	}
+
+	// the initial sync is done regardless of the schedule
+	require.Eventually(t, func() bool {
+		return !m.LastTick().IsZero()
+	}, time.Second, 10*time.Millisecond)
+
+	ctx := context.Background()
+	require.NoError(t, m.PauseBackground(ctx))
+	assert.True(t, m.BackgroundPaused())
+
+	// no sync within several ticks
+	paused := synced()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, paused, synced())
+
+	// the manual refresh keeps working
+	require.NoError(t, m.RefreshStats())
+	assert.True(t, synced().After(paused))
+
+	require.NoError(t, m.ResumeBackground(ctx))
+	assert.False(t, m.BackgroundPaused())
+	resumed := synced()
+	require.Eventually(t, func() bool {
+		return synced().After(resumed)
+	}, time.Second, 10*time.Millisecond)
+
+	// the cleanup shutdown must not hang while paused
+	require.NoError(t, m.PauseBackground(ctx))
+}
@@ -5,22 +5,66 @@
 package manager
 
 import (
-	"sync"
+	"context"
 	"sync/atomic"
 	"time"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/firewall"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
 	"github.com/vpnhouse/tunnel/internal/runtime"
 	"github.com/vpnhouse/tunnel/internal/storage"
 	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/tunnel/proto"
 	"github.com/vpnhouse/common-lib-go/geoip"
 	"github.com/vpnhouse/common-lib-go/ipam"
 	"github.com/vpnhouse/common-lib-go/statutils"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
 	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// wireguardDevice is the subset of the *wireguard.Wireguard
+// used by the manager, it allows to test the manager
+// without the real wireguard interface.
+type wireguardDevice interface {
+	SetPeer(info *types.PeerInfo) error
+	UnsetPeer(info *types.PeerInfo) error
+	GetPeers() (map[string]wgtypes.Peer, error)
+	GetLinkStatistic() (*netlink.LinkStatistics, error)
+	GetFirewallMark() (int, error)
+	Recreate() error
+}
+
+// ipAllocator is the subset of the *ipalloc.Allocator used by the manager.
+type ipAllocator interface {
+	AllocKey(pol ipam.Policy, key string) (xnet.IP, error)
+	AllocNear(pol ipam.Policy, near []xnet.IP) (xnet.IP, bool, error)
+	Clustering() bool
+	Set(addr xnet.IP, pol ipam.Policy) error
+	Matches(addr xnet.IP, pol ipam.Policy) bool
+	Unset(addr xnet.IP) error
+	AllocLink(pol ipam.Policy) (xnet.IP, error)
+	SetLink(addr xnet.IP, pol ipam.Policy) error
+	MatchesLink(addr xnet.IP) bool
+	UnsetLink(addr xnet.IP) error
+	IsAvailable(addr xnet.IP) bool
+	Contains(addr xnet.IP) bool
+	CanAlloc(pol ipam.Policy) bool
+	CanAllocLink() bool
+	Stats() ipalloc.Stats
+}
+
+// portFilter is the subset of the *firewall.Filter used by the manager.
+type portFilter interface {
+	Apply(addr xnet.IP, pol ipam.Policy) error
+	Remove(addr xnet.IP) error
+	SetDNSServers(servers []string) error
+}
+
 type CachedStatistics struct {
 	// PeersTotal is a number of peers
 	// being authorized to connect to this node
@@ -44,6 +88,10 @@ type CachedStatistics struct {
 	Downstream int64
 	// Downstream speed totally (bytes per second)
 	DownstreamSpeed int64
+	// Link traffic since the previous collection
+	// not accounted to any peer (bytes)
+	UnattributedUpstream   int64
+	UnattributedDownstream int64
 
 	// The time in seconds then statistics was collected
 	Collected int64
@@ -77,46 +125,100 @@ func (s *CachedStatistics) CalcSpeed(prevStats *CachedStatistics) *speedValue {
 
 type Manager struct {
 	runtime           *runtime.TunnelRuntime
-	lock              sync.RWMutex
+	lock              managerLock
 	storage           *storage.Storage
-	wireguard         *wireguard.Wireguard
-	ip4am             *ipam.IPAM
+	wireguard         wireguardDevice
+	ip4am             ipAllocator
+	ports             portFilter
 	eventLog          eventlog.EventManager
 	statsService      *runtimePeerStatsService
 	peerTrafficSender *peerTrafficUpdateEventSender
+	eventThrottle     *eventThrottle
 	running           atomic.Value
 	stop              chan struct{}
 	done              chan struct{}
+	// resetTickers passes new intervals to the background
+	resetTickers chan backgroundIntervals
 
 	upstreamSpeedAvg   *statutils.AvgValue
 	downstreamSpeedAvg *statutils.AvgValue
 
 	statistic atomic.Value // *CachedStatistics
+	// lastTick is the unix time of the last background iteration
+	lastTick atomic.Int64
+	// statsSynced is the time of the last stats sync,
+	// scheduled or manual, guarded by the lock
+	statsSynced time.Time
+	// suspended holds IDs of expired peers removed from the device
+	// but kept in the storage, guarded by the lock
+	suspended map[int64]struct{}
+	// idle holds IDs of peers removed from the device due to
+	// the lack of traffic until they connect again, guarded by the lock
+	idle map[int64]struct{}
+	// poolPressure holds the pool utilization thresholds
+	// already crossed, see checkPoolPressure, guarded by the lock
+	poolPressure map[int]struct{}
+	// presence holds the last reported online state of peers,
+	// nil until the first sync, see trackPresence, guarded by the lock
+	presence map[int64]presenceState
+	// maintenance rejects peer mutations, see SetMaintenance
+	maintenance atomic.Bool
+	// paused skips the scheduled stats sync, see PauseBackground
+	paused atomic.Bool
+	// history holds the recent hourly traffic of peers
+	history *trafficHistory
+	// clockAnomaly is set while the expiration is skipped
+	// due to the likely clock jump, see checkClockAnomaly
+	clockAnomaly atomic.Bool
+	// interfaceDown is set while the wireguard
+	// interface is gone, see checkInterface
+	interfaceDown atomic.Bool
+	// userConnects serializes ConnectPeer calls of the same user
+	userConnects *keyLock
+	// lockStats counts the lock acquisitions by lockWithTimeout
+	lockStats lockStats
 }
 
-func New(runtime *runtime.TunnelRuntime, storage *storage.Storage, wireguard *wireguard.Wireguard, ip4am *ipam.IPAM, eventLog eventlog.EventManager, geoClient *geoip.Instance) (*Manager, error) {
+func New(runtime *runtime.TunnelRuntime, storage *storage.Storage, wireguard *wireguard.Wireguard, ip4am *ipalloc.Allocator, ports *firewall.Filter, eventLog eventlog.EventManager, geoClient *geoip.Instance) (*Manager, error) {
+	return newManager(runtime, storage, wireguard, ip4am, ports, eventLog, geoClient)
+}
+
+func newManager(runtime *runtime.TunnelRuntime, storage *storage.Storage, wireguard wireguardDevice, ip4am ipAllocator, ports portFilter, eventLog eventlog.EventManager, geoClient *geoip.Instance) (*Manager, error) {
 	statsService := &runtimePeerStatsService{
 		ResetInterval: runtime.Settings.GetSentEventInterval().Value(),
+		IdleTimeout:   runtime.Settings.GetPeerIdleTimeout(),
 		Geo:           geoClient,
 	}
-	peerTrafficSender := NewPeerTrafficUpdateEventSender(runtime, eventLog, statsService, nil)
+	eventThrottle := newEventThrottle(runtime.Settings.GetPeerEventMinInterval().Value())
+	peerTrafficSender := NewPeerTrafficUpdateEventSender(runtime, eventLog, statsService, eventThrottle, nil)
 
 	manager := &Manager{
 		runtime:            runtime,
 		storage:            storage,
 		wireguard:          wireguard,
 		ip4am:              ip4am,
+		ports:              ports,
 		eventLog:           eventLog,
 		peerTrafficSender:  peerTrafficSender,
+		eventThrottle:      eventThrottle,
 		stop:               make(chan struct{}),
 		done:               make(chan struct{}),
+		resetTickers:       make(chan backgroundIntervals, 1),
 		upstreamSpeedAvg:   statutils.NewAvgValue(10),
 		downstreamSpeedAvg: statutils.NewAvgValue(10),
 		statsService:       statsService,
+		suspended:          make(map[int64]struct{}),
+		idle:               make(map[int64]struct{}),
+		poolPressure:       make(map[int]struct{}),
+		history:            newTrafficHistory(),
+		userConnects:       newKeyLock(),
 	}
 
-	manager.restorePeers()
+	manager.pushState(eventlog.ManagerStarting, 0)
+	restored := manager.restorePeers()
+	manager.restoreHistory()
 	manager.running.Store(true)
+	manager.pushState(eventlog.ManagerReady, restored)
 	manager.statistic.Store(&CachedStatistics{
 		Upstream:   storage.GetUpstreamMetric(),
 		Downstream: storage.GetDownstreamMetric(),
@@ -124,7 +226,7 @@ func New(runtime *runtime.TunnelRuntime, storage *storage.Storage, wireguard *wi
 	})
 
 	// Run background goroutine
-	go manager.background()
+	go manager.background(newBackgroundIntervals(runtime.Settings))
 
 	return manager, nil
 }
@@ -132,6 +234,7 @@ func New(runtime *runtime.TunnelRuntime, storage *storage.Storage, wireguard *wi
 func (manager *Manager) Shutdown() error {
 	zap.L().Debug("Marking manager as not accepting any requests anymore")
 	manager.running.Store(false)
+	manager.pushState(eventlog.ManagerDraining, 0)
 
 	// Shutdown background goroutine
 	zap.L().Debug("Sending stop signal to manager background goroutine")
@@ -142,10 +245,23 @@ func (manager *Manager) Shutdown() error {
 
 	// Stop sending all events
 	manager.peerTrafficSender.Stop()
+	manager.pushState(eventlog.ManagerStopped, 0)
 
 	return nil
 }
 
+// pushState reports the transition of the manager state,
+// so the orchestration knows when the node accepts peers.
+func (manager *Manager) pushState(eventType eventlog.EventType, peers int) {
+	event := &proto.ManagerStateInfo{
+		Peers:      uint64(peers),
+		ServerTime: proto.TimestampFromTime(time.Now()),
+	}
+	if err := manager.eventLog.Push(eventType, event); err != nil {
+		zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(eventType)))
+	}
+}
+
 func (manager *Manager) Running() bool {
 	return manager.running.Load().(bool)
 }
@@ -154,6 +270,114 @@ func (manager *Manager) GetCachedStatistics() *CachedStatistics {
 	return manager.statistic.Load().(*CachedStatistics)
 }
 
+// RefreshStats syncs the peer stats out of the background schedule,
+// e.g. to verify a change without waiting for the next tick.
+// Refreshes queued behind the one in progress reuse its result.
+func (manager *Manager) RefreshStats() error {
+	if !manager.running.Load().(bool) {
+		return xerror.EUnavailable("server is shutting down", nil)
+	}
+
+	requested := time.Now()
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
+	defer manager.lock.Unlock()
+
+	if manager.statsSynced.After(requested) {
+		// synced while waiting for the lock
+		return nil
+	}
+	manager.refreshStats()
+	return nil
+}
+
+// refreshStats syncs the peer stats, the lock must be held.
+func (manager *Manager) refreshStats() {
+	manager.syncPeerStats()
+	manager.statsSynced = time.Now()
+}
+
 func (manager *Manager) GetRuntimePeerStat(peer *types.PeerInfo) *runtimePeerStat {
 	return manager.statsService.GetRuntimePeerStat(peer)
 }
+
+// PeerSpeed returns the upstream and downstream speed of the peer,
+// zero until the peer stats are synced.
+func (manager *Manager) PeerSpeed(peer *types.PeerInfo) (int64, int64) {
+	if peer.WireguardPublicKey == nil {
+		return 0, 0
+	}
+	return manager.statsService.GetSpeed(peer)
+}
+
+// SetTrafficThresholds changes the traffic change thresholds
+// of the traffic events sender at runtime, until the restart.
+func (manager *Manager) SetTrafficThresholds(ctx context.Context, up int64, down int64) error {
+	if err := manager.peerTrafficSender.SetThresholds(up, down); err != nil {
+		return err
+	}
+
+	logger(ctx).Info("traffic change thresholds changed", zap.Int64("upstream", up), zap.Int64("downstream", down))
+	return nil
+}
+
+// TrafficThresholds returns the upstream and downstream
+// traffic change thresholds of the traffic events sender.
+func (manager *Manager) TrafficThresholds() (int64, int64) {
+	return manager.peerTrafficSender.Thresholds()
+}
+
+// MetricsSnapshot returns the live manager numbers
+// collected by the last background iteration.
+func (manager *Manager) MetricsSnapshot() types.ManagerMetrics {
+	stats := manager.GetCachedStatistics()
+	pool := manager.ip4am.Stats()
+
+	metrics := types.ManagerMetrics{
+		PeersTotal:          stats.PeersTotal,
+		PeersWithHandshakes: stats.PeersWithTraffic,
+		PeersActiveLastHour: stats.PeersActiveLastHour,
+		PeersActiveLastDay:  stats.PeersActiveLastDay,
+		Upstream:            stats.Upstream,
+		Downstream:          stats.Downstream,
+		PoolUsed:            pool.Used,
+		PoolTotal:           pool.Total,
+		PoolUtilization:     pool.Utilization(),
+		PoolLinks:           pool.Links,
+
+		UnattributedUpstream:   stats.UnattributedUpstream,
+		UnattributedDownstream: stats.UnattributedDownstream,
+	}
+	metrics.LastTick = manager.LastTick()
+	return metrics
+}
+
+// LastTick returns the time of the last background iteration,
+// zero if it has not run yet.
+func (manager *Manager) LastTick() time.Time {
+	if tick := manager.lastTick.Load(); tick > 0 {
+		return time.Unix(tick, 0)
+	}
+	return time.Time{}
+}
+
+// Draining reports whether the manager has stopped accepting
+// requests, but the background routine is still finishing.
+func (manager *Manager) Draining() bool {
+	if manager.Running() {
+		return false
+	}
+
+	select {
+	case <-manager.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// FirewallMark returns the fwmark currently set on the wireguard device.
+func (manager *Manager) FirewallMark() (int, error) {
+	return manager.wireguard.GetFirewallMark()
+}
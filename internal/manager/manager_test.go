@@ -0,0 +1,493 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/human"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/ippool"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"github.com/vpnhouse/common-lib-go/xtime"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type fakeWireguard struct {
+	mu    sync.Mutex
+	peers map[string]wgtypes.Peer
+	// setErr is returned by SetPeer if set
+	setErr error
+	// gone emulates the interface removed from the system
+	gone bool
+	// recreated counts Recreate calls
+	recreated int
+	// dumps counts GetPeers calls
+	dumps int
+}
+
+func newFakeWireguard() *fakeWireguard {
+	return &fakeWireguard{peers: map[string]wgtypes.Peer{}}
+}
+
+func (wg *fakeWireguard) SetPeer(info *types.PeerInfo) error {
+	key, err := wgtypes.ParseKey(*info.WireguardPublicKey)
+	if err != nil {
+		return err
+	}
+
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	if wg.setErr != nil {
+		return wg.setErr
+	}
+	wg.peers[*info.WireguardPublicKey] = wgtypes.Peer{
+		PublicKey:  key,
+		AllowedIPs: wireguard.AllowedIPs(info),
+	}
+	return nil
+}
+
+func (wg *fakeWireguard) UnsetPeer(info *types.PeerInfo) error {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	delete(wg.peers, *info.WireguardPublicKey)
+	return nil
+}
+
+func (wg *fakeWireguard) GetPeers() (map[string]wgtypes.Peer, error) {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	wg.dumps++
+	peers := make(map[string]wgtypes.Peer, len(wg.peers))
+	for k, v := range wg.peers {
+		peers[k] = v
+	}
+	return peers, nil
+}
+
+func (wg *fakeWireguard) GetFirewallMark() (int, error) {
+	return 0, nil
+}
+
+func (wg *fakeWireguard) GetLinkStatistic() (*netlink.LinkStatistics, error) {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	if wg.gone {
+		return nil, errors.New("link not found")
+	}
+	return &netlink.LinkStatistics{}, nil
+}
+
+func (wg *fakeWireguard) Recreate() error {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	wg.gone = false
+	wg.peers = map[string]wgtypes.Peer{}
+	wg.recreated++
+	return nil
+}
+
+// remove emulates the interface removed from the system with all its peers.
+func (wg *fakeWireguard) remove() {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	wg.gone = true
+	wg.peers = map[string]wgtypes.Peer{}
+}
+
+// fakeIPAM allocates addresses from the 10.0.0.0/24 network
+type fakeIPAM struct {
+	mu    sync.Mutex
+	used  map[string]bool
+	links int
+	// access holds the access policy the address was claimed with
+	access map[string]int
+	// matches emulates the pool segmentation, any address matches if nil
+	matches func(addr xnet.IP, pol ipam.Policy) bool
+	// clusterRadius emulates the clustering of the user's peers
+	clusterRadius int
+}
+
+func newFakeIPAM() *fakeIPAM {
+	return &fakeIPAM{used: map[string]bool{}, access: map[string]int{}}
+}
+
+func (m *fakeIPAM) Alloc(pol ipam.Policy) (xnet.IP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 2; i < 255; i++ {
+		addr := xnet.IP{IP: net.IPv4(10, 0, 0, byte(i)).To4()}
+		if !m.used[addr.String()] && (m.matches == nil || m.matches(addr, pol)) {
+			m.used[addr.String()] = true
+			m.access[addr.String()] = pol.Access
+			return addr, nil
+		}
+	}
+	return xnet.IP{}, ippool.ErrNotEnoughSpace
+}
+
+func (m *fakeIPAM) AllocKey(pol ipam.Policy, _ string) (xnet.IP, error) {
+	return m.Alloc(pol)
+}
+
+func (m *fakeIPAM) AllocNear(pol ipam.Policy, near []xnet.IP) (xnet.IP, bool, error) {
+	m.mu.Lock()
+	for d := 1; d <= m.clusterRadius; d++ {
+		for _, hint := range near {
+			addr := xnet.Uint32ToIP(hint.ToUint32() + uint32(d))
+			if m.Contains(addr) && !m.used[addr.String()] {
+				m.used[addr.String()] = true
+				m.access[addr.String()] = pol.Access
+				m.mu.Unlock()
+				return addr, true, nil
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	addr, err := m.Alloc(pol)
+	return addr, false, err
+}
+
+func (m *fakeIPAM) Clustering() bool {
+	return m.clusterRadius > 0
+}
+
+func (m *fakeIPAM) Set(addr xnet.IP, pol ipam.Policy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used[addr.String()] {
+		return ippool.ErrAddressInUse
+	}
+	m.used[addr.String()] = true
+	m.access[addr.String()] = pol.Access
+	return nil
+}
+
+func (m *fakeIPAM) Matches(addr xnet.IP, pol ipam.Policy) bool {
+	if m.matches == nil {
+		return true
+	}
+	return m.matches(addr, pol)
+}
+
+func (m *fakeIPAM) Unset(addr xnet.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.used, addr.String())
+	delete(m.access, addr.String())
+	return nil
+}
+
+// links are allocated from the 10.0.0.0/24 network too,
+// the lower address of the link is always even
+func (m *fakeIPAM) AllocLink(_ ipam.Policy) (xnet.IP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 2; i < 254; i += 2 {
+		addr := xnet.IP{IP: net.IPv4(10, 0, 0, byte(i)).To4()}
+		peer := xnet.IP{IP: net.IPv4(10, 0, 0, byte(i+1)).To4()}
+		if !m.used[addr.String()] && !m.used[peer.String()] {
+			m.used[addr.String()] = true
+			m.used[peer.String()] = true
+			m.links++
+			return addr, nil
+		}
+	}
+	return xnet.IP{}, ippool.ErrNotEnoughSpace
+}
+
+func (m *fakeIPAM) SetLink(addr xnet.IP, _ ipam.Policy) error {
+	if !m.MatchesLink(addr) {
+		return ippool.ErrInvalidAddress
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peer := xnet.Uint32ToIP(addr.ToUint32() + 1)
+	if m.used[addr.String()] || m.used[peer.String()] {
+		return ippool.ErrAddressInUse
+	}
+	m.used[addr.String()] = true
+	m.used[peer.String()] = true
+	m.links++
+	return nil
+}
+
+func (m *fakeIPAM) MatchesLink(addr xnet.IP) bool {
+	return addr.ToUint32()%2 == 0
+}
+
+func (m *fakeIPAM) UnsetLink(addr xnet.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.used, addr.String())
+	delete(m.used, xnet.Uint32ToIP(addr.ToUint32()+1).String())
+	m.links--
+	return nil
+}
+
+func (m *fakeIPAM) IsAvailable(addr xnet.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Contains(addr) && !m.used[addr.String()]
+}
+
+func (m *fakeIPAM) Contains(addr xnet.IP) bool {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	return subnet.Contains(addr.IP)
+}
+
+func (m *fakeIPAM) CanAlloc(_ ipam.Policy) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 2; i < 255; i++ {
+		if !m.used[net.IPv4(10, 0, 0, byte(i)).String()] {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *fakeIPAM) CanAllocLink() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 2; i < 254; i += 2 {
+		if !m.used[net.IPv4(10, 0, 0, byte(i)).String()] && !m.used[net.IPv4(10, 0, 0, byte(i+1)).String()] {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *fakeIPAM) Stats() ipalloc.Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ipalloc.Stats{Used: len(m.used), Total: 253, Links: m.links}
+}
+
+// fakePortFilter records the access policy port rules are applied with
+type fakePortFilter struct {
+	mu         sync.Mutex
+	applied    map[string]int
+	dnsServers []string
+}
+
+func newFakePortFilter() *fakePortFilter {
+	return &fakePortFilter{applied: map[string]int{}}
+}
+
+func (f *fakePortFilter) Apply(addr xnet.IP, pol ipam.Policy) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied[addr.String()] = pol.Access
+	return nil
+}
+
+func (f *fakePortFilter) Remove(addr xnet.IP) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.applied, addr.String())
+	return nil
+}
+
+func (f *fakePortFilter) SetDNSServers(servers []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dnsServers = servers
+	return nil
+}
+
+func newTestManager(t *testing.T) *Manager {
+	return newTestManagerWithSettings(t, nil)
+}
+
+func newTestManagerWithSettings(t *testing.T, s *settings.Config) *Manager {
+	t.Helper()
+
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+
+	m, err := newManager(&runtime.TunnelRuntime{Settings: s}, db, newFakeWireguard(), newFakeIPAM(), newFakePortFilter(), eventlog.NewDummy(), nil)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = m.Shutdown()
+		_ = db.Shutdown()
+	})
+	return m
+}
+
+func newTestPeer(t *testing.T, userID string, installationID uuid.UUID, expires time.Time) *types.PeerInfo {
+	t.Helper()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	pubKey := key.PublicKey().String()
+
+	return &types.PeerInfo{
+		WireguardInfo: types.WireguardInfo{
+			WireguardPublicKey: &pubKey,
+		},
+		PeerIdentifiers: types.PeerIdentifiers{
+			UserId:         &userID,
+			InstallationId: &installationID,
+		},
+		Expires: &xtime.Time{Time: expires},
+	}
+}
+
+// connectPeer connects the peer failing the test on error.
+func connectPeer(t *testing.T, ctx context.Context, m *Manager, peer *types.PeerInfo, extendBy time.Duration) types.ConnectionProfile {
+	t.Helper()
+
+	profile, err := m.ConnectPeer(ctx, peer, extendBy)
+	require.NoError(t, err)
+	return profile
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	m := newTestManager(t)
+
+	for i := 0; i < 3; i++ {
+		connectPeer(t, context.Background(), m, newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour)), 0)
+	}
+
+	m.statistic.Store(&CachedStatistics{
+		PeersTotal:       3,
+		PeersWithTraffic: 2,
+		Upstream:         100,
+		Downstream:       200,
+	})
+
+	metrics := m.MetricsSnapshot()
+	assert.Equal(t, 3, metrics.PeersTotal)
+	assert.Equal(t, 2, metrics.PeersWithHandshakes)
+	assert.EqualValues(t, 100, metrics.Upstream)
+	assert.EqualValues(t, 200, metrics.Downstream)
+	assert.Equal(t, 3, metrics.PoolUsed)
+	assert.Equal(t, 253, metrics.PoolTotal)
+	assert.InDelta(t, 3.0/253, metrics.PoolUtilization, 1e-9)
+}
+
+func TestRefreshStats(t *testing.T) {
+	m := newTestManager(t)
+
+	for i := 0; i < 3; i++ {
+		connectPeer(t, context.Background(), m, newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour)), 0)
+	}
+
+	// the refresh within the same second keeps the speed
+	m.statistic.Store(&CachedStatistics{UpstreamSpeed: 42, Collected: time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, m.RefreshStats())
+	stats := m.GetCachedStatistics()
+	assert.Equal(t, 3, stats.PeersTotal)
+	assert.EqualValues(t, 42, stats.UpstreamSpeed)
+
+	// the refresh queued behind the completed one is skipped
+	m.statistic.Store(&CachedStatistics{})
+	m.lock.Lock()
+	m.statsSynced = time.Now().Add(time.Hour)
+	m.lock.Unlock()
+	require.NoError(t, m.RefreshStats())
+	assert.Zero(t, m.GetCachedStatistics().PeersTotal)
+}
+
+func TestLockTimeout(t *testing.T) {
+	m := newTestManagerWithSettings(t, &settings.Config{LockTimeout: human.MustParseInterval("200ms")})
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+
+	// the slow operation holds the lock
+	m.lock.Lock()
+	started := time.Now()
+	_, err := m.GetPeer(context.Background(), peer.ID)
+	require.Error(t, err)
+	code, _ := xerror.ErrorToHttpResponse(err)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Less(t, time.Since(started), time.Second)
+
+	// released within the timeout
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.lock.Unlock()
+	}()
+	_, err = m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+
+	// the timed out requests leave nothing waiting for the lock
+	m.lock.Lock()
+	for i := 0; i < 3; i++ {
+		_, err = m.GetPeer(context.Background(), peer.ID)
+		require.Error(t, err)
+	}
+	m.lock.Unlock()
+	require.True(t, m.lock.TryLock())
+	m.lock.Unlock()
+
+	// the request gone gives up waiting at once
+	m.lock.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started = time.Now()
+	_, err = m.GetPeer(ctx, peer.ID)
+	require.Error(t, err)
+	code, _ = xerror.ErrorToHttpResponse(err)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Less(t, time.Since(started), 100*time.Millisecond)
+	m.lock.Unlock()
+}
+
+func TestDraining(t *testing.T) {
+	m := newTestManager(t)
+	require.Eventually(t, func() bool {
+		return !m.LastTick().IsZero()
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, m.Draining())
+
+	// stopped accepting requests, the background routine is still alive
+	m.running.Store(false)
+	assert.True(t, m.Draining())
+	m.running.Store(true)
+}
+
+func TestStateEvents(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Shutdown() })
+
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m, err := newManager(&runtime.TunnelRuntime{}, db, newFakeWireguard(), newFakeIPAM(), newFakePortFilter(), events, nil)
+	require.NoError(t, err)
+
+	events.mu.Lock()
+	require.Equal(t, []eventlog.EventType{eventlog.ManagerStarting, eventlog.ManagerReady}, events.states)
+	events.mu.Unlock()
+
+	require.NoError(t, m.Shutdown())
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	require.Equal(t, []eventlog.EventType{
+		eventlog.ManagerStarting,
+		eventlog.ManagerReady,
+		eventlog.ManagerDraining,
+		eventlog.ManagerStopped,
+	}, events.states)
+}
@@ -5,24 +5,123 @@
 package manager
 
 import (
-	"database/sql"
+	"context"
 	"errors"
+	"net"
 	"time"
 
+	"github.com/vpnhouse/tunnel/internal/eventlog"
 	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
 	"github.com/vpnhouse/common-lib-go/xtime"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func (manager *Manager) SetPeer(info *types.PeerInfo) error {
+func (manager *Manager) SetPeer(ctx context.Context, info *types.PeerInfo) error {
 	if !manager.running.Load().(bool) {
 		return xerror.EUnavailable("server is shutting down", nil)
 	}
-	manager.lock.Lock()
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
 	defer manager.lock.Unlock()
 
+	if err := manager.checkMaintenance(); err != nil {
+		return err
+	}
+
 	// note: manager.setPeer changes given struct
-	err := manager.setPeer(info)
+	err := manager.setPeer(ctx, info)
+	if err != nil {
+		return err
+	}
+	manager.syncPeerStats()
+	return nil
+}
+
+// EnsurePeer creates the peer unless the one with the same user and
+// installation identifiers exists, the check and the creation are atomic.
+// The existing peer is left as is, unlike ConnectPeer it's never updated.
+// On return info holds the effective peer, created reports which one it is.
+func (manager *Manager) EnsurePeer(ctx context.Context, info *types.PeerInfo) (bool, error) {
+	if info.UserId == nil || info.InstallationId == nil {
+		return false, xerror.EInvalidArgument("user and installation identifiers are required", nil)
+	}
+	if !manager.running.Load().(bool) {
+		return false, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return false, err
+	}
+	defer manager.lock.Unlock()
+
+	shadow := types.PeerInfo{
+		PeerIdentifiers: types.PeerIdentifiers{
+			UserId:         info.UserId,
+			InstallationId: info.InstallationId,
+		},
+	}
+	existing, err := manager.storage.SearchPeers(&shadow)
+	if err != nil {
+		return false, err
+	}
+	switch len(existing) {
+	case 0:
+	case 1:
+		*info = *existing[0]
+		return false, nil
+	default:
+		return false, xerror.EInternalError("too many peers for identifiers", nil)
+	}
+
+	if err := manager.checkMaintenance(); err != nil {
+		return false, err
+	}
+	// note: manager.setPeer changes given struct
+	if err := manager.setPeer(ctx, info); err != nil {
+		return false, err
+	}
+	manager.syncPeerStats()
+	return true, nil
+}
+
+// ValidatePeer runs checks of SetPeer against the peer without creating it,
+// neither the pool nor the storage are changed. The first failed check is returned.
+func (manager *Manager) ValidatePeer(info types.PeerInfo) error {
+	if !manager.running.Load().(bool) {
+		return xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
+	defer manager.lock.Unlock()
+
+	if err := manager.checkMaintenance(); err != nil {
+		return err
+	}
+	if err := validateNewPeer(&info); err != nil {
+		return err
+	}
+	return manager.checkPeerAddress(&info)
+}
+
+func (manager *Manager) UpdatePeer(ctx context.Context, info *types.PeerInfo) error {
+	if !manager.running.Load().(bool) {
+		return xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
+	defer manager.lock.Unlock()
+
+	if err := manager.checkMaintenance(); err != nil {
+		return err
+	}
+
+	err := manager.updatePeer(ctx, info)
 	if err != nil {
 		return err
 	}
@@ -30,46 +129,95 @@ func (manager *Manager) SetPeer(info *types.PeerInfo) error {
 	return nil
 }
 
-func (manager *Manager) UpdatePeer(info *types.PeerInfo) error {
+// PatchPeer changes only the fields set in the patch. The patch is merged
+// onto the stored peer under the lock, so concurrent changes of other
+// fields are not lost.
+func (manager *Manager) PatchPeer(ctx context.Context, id int64, patch types.PeerPatch) error {
 	if !manager.running.Load().(bool) {
 		return xerror.EUnavailable("server is shutting down", nil)
 	}
-	manager.lock.Lock()
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
 	defer manager.lock.Unlock()
-	err := manager.updatePeer(info)
+
+	if err := manager.checkMaintenance(); err != nil {
+		return err
+	}
+
+	peer, err := manager.storage.GetPeerContext(ctx, id)
 	if err != nil {
 		return err
 	}
+
+	patch.Apply(peer)
+	if err := manager.updatePeer(ctx, peer); err != nil {
+		return err
+	}
 	manager.syncPeerStats()
 	return nil
 }
 
-func (manager *Manager) GetPeer(id int64) (*types.PeerInfo, error) {
+func (manager *Manager) GetPeer(ctx context.Context, id int64) (*types.PeerInfo, error) {
 	if !manager.running.Load().(bool) {
 		return nil, xerror.EUnavailable("server is shutting down", nil)
 	}
-	manager.lock.Lock()
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
+	}
+	defer manager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		// the caller gave up while waiting for the lock
+		return nil, xerror.EUnavailable("request cancelled", err)
+	}
+	return manager.storage.GetPeerContext(ctx, id)
+}
+
+// GetPeerByIP returns the peer the address is allocated to.
+func (manager *Manager) GetPeerByIP(ip net.IP) (types.PeerInfo, error) {
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return types.PeerInfo{}, xerror.EInvalidArgument("invalid ipv4 address", nil)
+	}
+
+	if !manager.running.Load().(bool) {
+		return types.PeerInfo{}, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return types.PeerInfo{}, err
+	}
 	defer manager.lock.Unlock()
 
-	return manager.storage.GetPeer(id)
+	peer, err := manager.storage.GetPeerByIPv4(xnet.IP{IP: ipv4})
+	if err != nil {
+		return types.PeerInfo{}, err
+	}
+	return *peer, nil
 }
 
-func (manager *Manager) UnsetPeer(id int64) error {
+func (manager *Manager) UnsetPeer(ctx context.Context, id int64) error {
 	if !manager.running.Load().(bool) {
 		return xerror.EUnavailable("server is shutting down", nil)
 	}
-	manager.lock.Lock()
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
 	defer manager.lock.Unlock()
 
+	if err := manager.checkMaintenance(); err != nil {
+		return err
+	}
+
 	info, err := manager.storage.GetPeer(id)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, xerror.EEntryNotFound("", nil)) {
 			return nil
 		}
 		return err
 	}
 
-	err = manager.unsetPeer(info)
+	err = manager.unsetPeer(ctx, info)
 	if err != nil {
 		return err
 	}
@@ -77,19 +225,25 @@ func (manager *Manager) UnsetPeer(id int64) error {
 	return nil
 }
 
-func (manager *Manager) UnsetPeerByIdentifiers(identifiers *types.PeerIdentifiers) error {
+func (manager *Manager) UnsetPeerByIdentifiers(ctx context.Context, identifiers *types.PeerIdentifiers) error {
 	if !manager.running.Load().(bool) {
 		return xerror.EUnavailable("server is shutting down", nil)
 	}
-	manager.lock.Lock()
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
 	defer manager.lock.Unlock()
 
+	if err := manager.checkMaintenance(); err != nil {
+		return err
+	}
+
 	info, err := manager.findPeerByIdentifiers(identifiers)
 	if err != nil {
 		return err
 	}
 
-	err = manager.unsetPeer(info)
+	err = manager.unsetPeer(ctx, info)
 	if err != nil {
 		return err
 	}
@@ -97,23 +251,223 @@ func (manager *Manager) UnsetPeerByIdentifiers(identifiers *types.PeerIdentifier
 	return nil
 }
 
-func (manager *Manager) ListPeers() ([]*types.PeerInfo, error) {
+func (manager *Manager) ListPeers(ctx context.Context) ([]*types.PeerInfo, error) {
 	if !manager.running.Load().(bool) {
 		return nil, xerror.EUnavailable("server is shutting down", nil)
 	}
-	manager.lock.Lock()
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
+	}
 	defer manager.lock.Unlock()
 
-	return manager.storage.SearchPeers(nil)
+	if err := ctx.Err(); err != nil {
+		// the caller gave up while waiting for the lock
+		return nil, xerror.EUnavailable("request cancelled", err)
+	}
+	return manager.storage.SearchPeersContext(ctx, nil)
 }
 
-func (manager *Manager) ConnectPeer(info *types.PeerInfo) error {
+// SearchPeersByDisplayName returns peers whose display name
+// contains the given substring.
+func (manager *Manager) SearchPeersByDisplayName(ctx context.Context, substr string) ([]*types.PeerInfo, error) {
 	if !manager.running.Load().(bool) {
-		return xerror.EUnavailable("server is shutting down", nil)
+		return nil, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
 	}
-	manager.lock.Lock()
 	defer manager.lock.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		// the caller gave up while waiting for the lock
+		return nil, xerror.EUnavailable("request cancelled", err)
+	}
+	return manager.storage.SearchPeersByDisplayName(ctx, substr)
+}
+
+// streamBatchSize is the number of peers fetched
+// from the storage at once by WalkPeers
+const streamBatchSize = 500
+
+// WalkPeers calls visit with all peers in batches ordered by ID.
+// The lock is held while fetching the batch only, so peers changed
+// during the walk may be visited either way.
+func (manager *Manager) WalkPeers(ctx context.Context, visit func([]*types.PeerInfo) error) error {
+	var afterID int64
+	for {
+		peers, lastID, err := manager.nextPeersBatch(ctx, afterID)
+		if err != nil {
+			return err
+		}
+		if lastID == afterID {
+			return nil
+		}
+		afterID = lastID
+
+		if err := visit(peers); err != nil {
+			return err
+		}
+	}
+}
+
+func (manager *Manager) nextPeersBatch(ctx context.Context, afterID int64) ([]*types.PeerInfo, int64, error) {
+	if !manager.running.Load().(bool) {
+		return nil, afterID, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, afterID, err
+	}
+	defer manager.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		// the caller gave up, e.g. the client has gone
+		return nil, afterID, xerror.EUnavailable("request cancelled", err)
+	}
+	return manager.storage.ListPeersAfter(ctx, afterID, streamBatchSize)
+}
+
+// CountPeers returns the number of stored peers
+// without loading them from the storage.
+func (manager *Manager) CountPeers() (int64, error) {
+	if !manager.running.Load().(bool) {
+		return 0, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return 0, err
+	}
+	defer manager.lock.Unlock()
+
+	return manager.storage.CountPeers(nil)
+}
+
+// CountDevicePeers returns the number of peers on the wireguard device,
+// see settings.Config.MaxPeersPerInterface.
+func (manager *Manager) CountDevicePeers() (int, error) {
+	if !manager.running.Load().(bool) {
+		return 0, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return 0, err
+	}
+	defer manager.lock.Unlock()
+
+	wgPeers, err := manager.wireguard.GetPeers()
+	if err != nil {
+		return 0, err
+	}
+	return len(wgPeers), nil
+}
+
+// ListExpiredPeers returns expired peers kept in the storage
+// because the automatic wiping is disabled.
+func (manager *Manager) ListExpiredPeers() ([]*types.PeerInfo, error) {
+	if !manager.running.Load().(bool) {
+		return nil, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
+	}
+	defer manager.lock.Unlock()
+
+	return manager.expiredPeers()
+}
+
+// PreviewExpirations returns peers the next statistics update would
+// remove from the device, nothing is changed. The list is empty if
+// the expiration would be skipped due to the clock anomaly.
+func (manager *Manager) PreviewExpirations() ([]types.PeerInfo, error) {
+	if !manager.running.Load().(bool) {
+		return nil, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(context.Background(), manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
+	}
+	defer manager.lock.Unlock()
+
+	peers, err := manager.peers()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make([]types.PeerInfo, 0)
+	for _, peer := range peers {
+		if peer.Expired() {
+			expired = append(expired, *peer)
+		}
+	}
+
+	if expiryAnomaly(len(expired), len(peers), manager.runtime.Settings.GetExpiryAnomalyFraction()) {
+		return []types.PeerInfo{}, nil
+	}
+	return expired, nil
+}
+
+// WipeExpiredPeers deletes all expired peers,
+// returns the number of deleted peers.
+func (manager *Manager) WipeExpiredPeers(ctx context.Context) (int, error) {
+	if !manager.running.Load().(bool) {
+		return 0, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return 0, err
+	}
+	defer manager.lock.Unlock()
+
+	if err := manager.checkMaintenance(); err != nil {
+		return 0, err
+	}
+
+	peers, err := manager.expiredPeers()
+	if err != nil {
+		return 0, err
+	}
+
+	wgPeers, err := manager.wireguard.GetPeers()
+	if err != nil {
+		// the traffic is unknown, don't query the device per peer
+		wgPeers = map[string]wgtypes.Peer{}
+	}
+
+	var errs error
+	wiped := 0
+	for _, peer := range peers {
+		if err := manager.removePeer(ctx, peer, eventlog.PeerRemove, wgPeers); err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		wiped++
+	}
+
+	manager.syncPeerStats()
+	return wiped, errs
+}
+
+// ConnectPeer creates a new peer or updates the existing one
+// found by the user and installation identifiers,
+// both cases are counted as the peer connection.
+// On reconnect, the non-zero extendBy moves the peer expiration
+// to at least now+extendBy, and the stored lease never gets shorter.
+// Passing zero extendBy takes the given expiration as is.
+// Returns the connection profile of the connected peer.
+func (manager *Manager) ConnectPeer(ctx context.Context, info *types.PeerInfo, extendBy time.Duration) (types.ConnectionProfile, error) {
+	if !manager.running.Load().(bool) {
+		return types.ConnectionProfile{}, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if info.UserId != nil && manager.runtime.Settings.GetConnectGuard() {
+		// the search-then-act below must be atomic per user, the guard
+		// is taken before the manager's lock, never while holding it
+		unlock := manager.userConnects.Lock(*info.UserId)
+		defer unlock()
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return types.ConnectionProfile{}, err
+	}
+	defer manager.lock.Unlock()
+
+	if err := manager.checkMaintenance(); err != nil {
+		return types.ConnectionProfile{}, err
+	}
+
 	oldPeerShadow := types.PeerInfo{
 		PeerIdentifiers: types.PeerIdentifiers{
 			UserId:         info.UserId,
@@ -123,34 +477,79 @@ func (manager *Manager) ConnectPeer(info *types.PeerInfo) error {
 
 	oldPeers, err := manager.storage.SearchPeers(&oldPeerShadow)
 	if err != nil {
-		return err
+		return types.ConnectionProfile{}, err
 	}
 
 	if len(oldPeers) == 0 {
-		err = manager.setPeer(info)
+		countPeerConnection(info, time.Now())
+		err = manager.setPeer(ctx, info)
 		if err != nil {
-			return err
+			return types.ConnectionProfile{}, err
 		}
 		manager.syncPeerStats()
-		return nil
+		return manager.connectionProfile(info), nil
 	}
 
 	if len(oldPeers) > 1 {
-		return xerror.EInternalError("too many peers for identifiers", nil)
+		// partial identifiers match different peers legitimately,
+		// only the full match is the duplicate
+		duplicates := info.UserId != nil && info.InstallationId != nil
+		if !duplicates || !manager.runtime.Settings.GetHealDuplicatePeers() {
+			return types.ConnectionProfile{}, xerror.EInternalError("too many peers for identifiers", nil)
+		}
+		oldPeers, err = manager.healDuplicatePeers(ctx, oldPeers)
+		if err != nil {
+			return types.ConnectionProfile{}, err
+		}
 	}
 
 	info.ID = oldPeers[0].ID
 	info.Ipv4 = oldPeers[0].Ipv4
+	if extendBy > 0 {
+		info.Expires = extendExpiration(laterExpiration(info.Expires, oldPeers[0].Expires), time.Now().Add(extendBy))
+	}
 
-	err = manager.updatePeer(info)
+	err = manager.updatePeer(ctx, info)
 	if err != nil {
-		return err
+		return types.ConnectionProfile{}, err
+	}
+
+	info.ConnectCount = oldPeers[0].ConnectCount
+	countPeerConnection(info, time.Now())
+	err = manager.storage.UpdatePeerConnections(info)
+	if err != nil {
+		return types.ConnectionProfile{}, err
 	}
 	manager.syncPeerStats()
-	return nil
+	return manager.connectionProfile(info), nil
+}
+
+// connectionProfile composes the client connection
+// profile of the peer from its allocation and the settings.
+func (manager *Manager) connectionProfile(peer *types.PeerInfo) types.ConnectionProfile {
+	s := manager.runtime.Settings
+	pol := peer.GetNetworkPolicy()
+	profile := types.ConnectionProfile{
+		AllowedIPs: s.GetClientAllowedIPs(pol),
+	}
+	if peer.Ipv4 != nil {
+		profile.Ipv4 = peer.Ipv4.String()
+	}
+	if hints, ok := s.GetClientHints(pol); ok {
+		profile.MTU = hints.MTU
+	}
+	if s != nil {
+		profile.ServerPublicKey = s.Wireguard.GetPrivateKey().Public().Unwrap().String()
+		profile.ServerIPv4 = s.Wireguard.ServerIPv4
+		profile.ServerPort = s.Wireguard.ClientPort()
+		profile.Endpoints = append([]string(nil), s.Wireguard.Endpoints...)
+		profile.DNS = s.GetWireguardDNS()
+		profile.Keepalive = s.Wireguard.Keepalive
+	}
+	return profile
 }
 
-func (manager *Manager) UpdatePeerExpiration(identifiers *types.PeerIdentifiers, expires *time.Time) error {
+func (manager *Manager) UpdatePeerExpiration(ctx context.Context, identifiers *types.PeerIdentifiers, expires *time.Time) error {
 	if identifiers == nil {
 		return xerror.EInvalidArgument("no identifiers", nil)
 	}
@@ -158,31 +557,142 @@ func (manager *Manager) UpdatePeerExpiration(identifiers *types.PeerIdentifiers,
 	if !manager.running.Load().(bool) {
 		return xerror.EUnavailable("server is shutting down", nil)
 	}
-	manager.lock.Lock()
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return err
+	}
 	defer manager.lock.Unlock()
 
-	peerQuery := types.PeerInfo{
-		PeerIdentifiers: *identifiers,
+	if err := manager.checkMaintenance(); err != nil {
+		return err
 	}
 
-	peers, err := manager.storage.SearchPeers(&peerQuery)
+	peer, err := manager.findPeerByIdentifiers(identifiers)
 	if err != nil {
 		return err
 	}
 
+	peer.Expires = xtime.FromTimePtr(expires)
+	err = manager.updatePeer(ctx, peer)
+	if err != nil {
+		return err
+	}
+	manager.syncPeerStats()
+	return nil
+}
+
+// ExpirationUpdate is the new expiration of the peer found by the identifiers,
+// nil Expires means that the peer never expires.
+type ExpirationUpdate struct {
+	Identifiers *types.PeerIdentifiers
+	Expires     *time.Time
+}
+
+// ExtendExpirations applies new expirations to many peers at once,
+// the storage is updated in a single transaction.
+// Unknown and ambiguous identifiers are skipped, the returned slice
+// holds the error of every item, nil for the applied ones.
+func (manager *Manager) ExtendExpirations(ctx context.Context, items []ExpirationUpdate) ([]error, error) {
+	if !manager.running.Load().(bool) {
+		return nil, xerror.EUnavailable("server is shutting down", nil)
+	}
+	if err := manager.lockWithTimeout(ctx, manager.runtime.Settings.GetLockTimeout()); err != nil {
+		return nil, err
+	}
+	defer manager.lock.Unlock()
+
+	if err := manager.checkMaintenance(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(items))
+	peers := make([]*types.PeerInfo, 0, len(items))
+	// positions of peers in items
+	positions := make([]int, 0, len(items))
+	for i, item := range items {
+		if item.Identifiers == nil {
+			errs[i] = xerror.EInvalidArgument("no identifiers", nil)
+			continue
+		}
+
+		peer, err := manager.findPeerByIdentifiers(item.Identifiers)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		peer.Expires = xtime.FromTimePtr(item.Expires)
+		peers = append(peers, peer)
+		positions = append(positions, i)
+	}
+
 	if len(peers) == 0 {
-		return xerror.EEntryNotFound("peer not found", nil)
+		return errs, nil
 	}
 
-	if len(peers) > 1 {
-		return xerror.EInvalidArgument("not enough identifiers to update peer", nil)
+	if err := manager.storage.UpdatePeersExpiration(peers); err != nil {
+		return nil, err
 	}
 
-	peers[0].Expires = xtime.FromTimePtr(expires)
-	err = manager.updatePeer(peers[0])
-	if err != nil {
-		return err
+	for i, peer := range peers {
+		errs[positions[i]] = manager.applyExpiration(ctx, peer)
 	}
 	manager.syncPeerStats()
-	return nil
+	return errs, nil
+}
+
+// laterExpiration returns the later of the given and the stored
+// expiration, the stored one is kept if none is given.
+// Nil never expires, so it's the latest.
+func laterExpiration(given *xtime.Time, stored *xtime.Time) *xtime.Time {
+	if given == nil || stored == nil || stored.Time.After(given.Time) {
+		return stored
+	}
+	return given
+}
+
+// extendExpiration returns the latest of the given expiration and the atLeast time.
+// nil expiration means that the peer never expires, so it stays unchanged.
+func extendExpiration(expires *xtime.Time, atLeast time.Time) *xtime.Time {
+	if expires == nil || !expires.Time.Before(atLeast) {
+		return expires
+	}
+	return &xtime.Time{Time: atLeast}
+}
+
+// healDuplicatePeers keeps the newest of peers sharing the same identifiers
+// and removes the rest. Such duplicates are left by partial failures.
+func (manager *Manager) healDuplicatePeers(ctx context.Context, peers []*types.PeerInfo) ([]*types.PeerInfo, error) {
+	newest := 0
+	for i, peer := range peers {
+		if peerNewer(peer, peers[newest]) {
+			newest = i
+		}
+	}
+
+	removed := make([]int64, 0, len(peers)-1)
+	for i, peer := range peers {
+		if i == newest {
+			continue
+		}
+		if err := manager.unsetPeer(ctx, peer); err != nil {
+			return nil, err
+		}
+		removed = append(removed, peer.ID)
+	}
+
+	logger(ctx).Warn("duplicate peers for identifiers removed",
+		zap.Int64("kept", peers[newest].ID),
+		zap.Int64s("removed", removed),
+		types.LogString("user_id", peers[newest].UserId),
+		types.LogUUID("install_id", peers[newest].InstallationId))
+	return peers[newest : newest+1], nil
+}
+
+// peerNewer reports whether the peer a was created after the peer b,
+// the higher ID wins if creation times are unknown or equal.
+func peerNewer(a, b *types.PeerInfo) bool {
+	if a.Created != nil && b.Created != nil && !a.Created.Time.Equal(b.Created.Time) {
+		return a.Created.Time.After(b.Created.Time)
+	}
+	return a.ID > b.ID
 }
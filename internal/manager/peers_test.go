@@ -0,0 +1,1302 @@
+package manager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"github.com/vpnhouse/common-lib-go/xtime"
+	"github.com/vpnhouse/tunnel/proto"
+)
+
+func TestConnectPeerCreate(t *testing.T) {
+	m := newTestManager(t)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	peer := newTestPeer(t, "user", uuid.New(), expires)
+	connectPeer(t, context.Background(), m, peer, 24*time.Hour)
+	require.NotZero(t, peer.ID)
+	require.NotNil(t, peer.Ipv4)
+
+	stored, err := m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	// extension is applied to reconnects only
+	require.True(t, stored.Expires.Time.Equal(expires))
+}
+
+func TestConnectPeerProfile(t *testing.T) {
+	s := &settings.Config{Wireguard: wireguard.DefaultConfig()}
+	s.Wireguard.ServerIPv4 = "203.0.113.1"
+	s.Wireguard.NATedPort = 3333
+	s.Wireguard.Endpoints = []string{"203.0.113.1:3333", "vpn2.example.com:3333"}
+	m := newTestManagerWithSettings(t, s)
+
+	installationID := uuid.New()
+	peer := newTestPeer(t, "user", installationID, time.Now().Add(time.Hour))
+	profile := connectPeer(t, context.Background(), m, peer, 0)
+	require.Equal(t, types.ConnectionProfile{
+		Ipv4:            peer.Ipv4.String(),
+		ServerPublicKey: s.Wireguard.GetPrivateKey().Public().Unwrap().String(),
+		ServerIPv4:      "203.0.113.1",
+		ServerPort:      3333,
+		Endpoints:       []string{"203.0.113.1:3333", "vpn2.example.com:3333"},
+		DNS:             []string{"8.8.8.8", "8.8.4.4"},
+		AllowedIPs:      []string{wireguard.DefaultClientAllowedIPs},
+		Keepalive:       60,
+	}, profile)
+
+	// the reconnect gets the same address
+	again := connectPeer(t, context.Background(), m, newTestPeer(t, "user", installationID, time.Now().Add(time.Hour)), 0)
+	require.Equal(t, profile, again)
+}
+
+func TestConnectPeerReconnectExtend(t *testing.T) {
+	m := newTestManager(t)
+
+	installationID := uuid.New()
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	peer := newTestPeer(t, "user", installationID, expires)
+	connectPeer(t, context.Background(), m, peer, 0)
+
+	// zero extension keeps the given expiration
+	again := newTestPeer(t, "user", installationID, expires)
+	connectPeer(t, context.Background(), m, again, 0)
+	require.Equal(t, peer.ID, again.ID)
+	require.True(t, again.Ipv4.Equal(*peer.Ipv4))
+	stored, err := m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.True(t, stored.Expires.Time.Equal(expires))
+
+	// the lease is extended up to now+extendBy
+	before := time.Now()
+	again = newTestPeer(t, "user", installationID, expires)
+	connectPeer(t, context.Background(), m, again, 24*time.Hour)
+	require.Equal(t, peer.ID, again.ID)
+	stored, err = m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.False(t, stored.Expires.Time.Before(before.Add(24*time.Hour).Truncate(time.Second)))
+
+	// the lease is never shortened
+	longExpires := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	again = newTestPeer(t, "user", installationID, longExpires)
+	connectPeer(t, context.Background(), m, again, time.Hour)
+	stored, err = m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.True(t, stored.Expires.Time.Equal(longExpires))
+
+	// neither by the shorter expiration given on the reconnect
+	again = newTestPeer(t, "user", installationID, expires)
+	connectPeer(t, context.Background(), m, again, time.Hour)
+	stored, err = m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.True(t, stored.Expires.Time.Equal(longExpires))
+}
+
+func TestConnectPeerConcurrent(t *testing.T) {
+	m := newTestManager(t)
+
+	installationID := uuid.New()
+	expires := time.Now().Add(time.Hour)
+	peers := make([]*types.PeerInfo, 10)
+	for i := range peers {
+		peers[i] = newTestPeer(t, "user", installationID, expires)
+	}
+
+	errs := make(chan error, len(peers))
+	for _, peer := range peers {
+		go func(peer *types.PeerInfo) {
+			_, err := m.ConnectPeer(context.Background(), peer, time.Hour)
+			errs <- err
+		}(peer)
+	}
+	for range peers {
+		require.NoError(t, <-errs)
+	}
+
+	// connects of the same installation share the single peer
+	count, err := m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+	require.Zero(t, m.userConnects.size())
+}
+
+func TestConnectPeerGuard(t *testing.T) {
+	connect := func(m *Manager, user string) <-chan error {
+		peer := newTestPeer(t, user, uuid.New(), time.Now().Add(time.Hour))
+		done := make(chan error, 1)
+		go func() {
+			_, err := m.ConnectPeer(context.Background(), peer, time.Hour)
+			done <- err
+		}()
+		return done
+	}
+
+	m := newTestManager(t)
+	// the connect of the user is in flight
+	unlock := m.userConnects.Lock("user")
+
+	// connects of other users are not blocked
+	require.NoError(t, <-connect(m, "other"))
+
+	// the connect of the same user waits for the one in flight
+	done := connect(m, "user")
+	select {
+	case err := <-done:
+		t.Fatalf("connect of the same user is not serialized, err: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	require.NoError(t, <-done)
+
+	// the guard may be disabled
+	disabled := false
+	m = newTestManagerWithSettings(t, &settings.Config{ConnectGuard: &disabled})
+	unlock = m.userConnects.Lock("user")
+	defer unlock()
+	require.NoError(t, <-connect(m, "user"))
+}
+
+func TestEnsurePeer(t *testing.T) {
+	m := newTestManager(t)
+
+	installationID := uuid.New()
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	peer := newTestPeer(t, "user", installationID, expires)
+	created, err := m.EnsurePeer(context.Background(), peer)
+	require.NoError(t, err)
+	require.True(t, created)
+	require.NotZero(t, peer.ID)
+	require.NotNil(t, peer.Ipv4)
+
+	// the existing peer is returned untouched
+	again := newTestPeer(t, "user", installationID, expires.Add(time.Hour))
+	created, err = m.EnsurePeer(context.Background(), again)
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, peer.ID, again.ID)
+	require.True(t, again.Ipv4.Equal(*peer.Ipv4))
+	require.Equal(t, *peer.WireguardPublicKey, *again.WireguardPublicKey)
+	require.True(t, again.Expires.Time.Equal(expires))
+
+	_, err = m.EnsurePeer(context.Background(), &types.PeerInfo{})
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestEnsurePeerConcurrent(t *testing.T) {
+	m := newTestManager(t)
+
+	installationID := uuid.New()
+	expires := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	peers := make([]*types.PeerInfo, 10)
+	created := make([]bool, len(peers))
+	errs := make([]error, len(peers))
+	for i := range peers {
+		peers[i] = newTestPeer(t, "user", installationID, expires)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			created[i], errs[i] = m.EnsurePeer(context.Background(), peers[i])
+		}(i)
+	}
+	wg.Wait()
+
+	creations := 0
+	for i, err := range errs {
+		require.NoError(t, err)
+		require.Equal(t, peers[0].ID, peers[i].ID)
+		if created[i] {
+			creations++
+		}
+	}
+	require.Equal(t, 1, creations)
+	count, err := m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+}
+
+func TestGetPeerNotFound(t *testing.T) {
+	m := newTestManager(t)
+
+	_, err := m.GetPeer(context.Background(), 42)
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusNotFound, code)
+
+	// removing the missing peer is not an error
+	require.NoError(t, m.UnsetPeer(context.Background(), 42))
+}
+
+func TestGetPeerByIP(t *testing.T) {
+	m := newTestManager(t)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	p2p := true
+	link := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	link.PointToPoint = &p2p
+	require.NoError(t, m.SetPeer(context.Background(), link))
+
+	found, err := m.GetPeerByIP(peer.Ipv4.IP)
+	require.NoError(t, err)
+	require.Equal(t, peer.ID, found.ID)
+
+	// both addresses of the link belong to the link peer
+	found, err = m.GetPeerByIP(link.Ipv4.IP)
+	require.NoError(t, err)
+	require.Equal(t, link.ID, found.ID)
+	found, err = m.GetPeerByIP(xnet.Uint32ToIP(link.Ipv4.ToUint32() + 1).IP)
+	require.NoError(t, err)
+	require.Equal(t, link.ID, found.ID)
+
+	_, err = m.GetPeerByIP(net.IPv4(10, 0, 0, 200))
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusNotFound, code)
+
+	_, err = m.GetPeerByIP(net.ParseIP("fd00::1"))
+	code, _ = xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestUpdatePeerExpiration(t *testing.T) {
+	m := newTestManager(t)
+
+	expires := time.Now().Add(time.Hour)
+	userID := "user"
+
+	// no matches
+	err := m.UpdatePeerExpiration(context.Background(), &types.PeerIdentifiers{UserId: &userID}, &expires)
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusNotFound, code)
+
+	connectPeer(t, context.Background(), m, newTestPeer(t, userID, uuid.New(), expires), 0)
+	connectPeer(t, context.Background(), m, newTestPeer(t, userID, uuid.New(), expires), 0)
+
+	// multiple matches
+	err = m.UpdatePeerExpiration(context.Background(), &types.PeerIdentifiers{UserId: &userID}, &expires)
+	code, _ = xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusConflict, code)
+
+	// no identifiers
+	err = m.UpdatePeerExpiration(context.Background(), nil, &expires)
+	code, _ = xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// empty identifiers must not match every peer
+	err = m.UpdatePeerExpiration(context.Background(), &types.PeerIdentifiers{}, &expires)
+	code, _ = xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusBadRequest, code)
+	err = m.UnsetPeerByIdentifiers(context.Background(), &types.PeerIdentifiers{})
+	code, _ = xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestExtendExpirations(t *testing.T) {
+	autoWipe := false
+	m := newTestManagerWithSettings(t, &settings.Config{AutoWipeExpired: &autoWipe})
+	wg := m.wireguard.(*fakeWireguard)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	userID, otherID, sharedID, unknownID := "user", "other", "shared", "unknown"
+	peer := newTestPeer(t, userID, uuid.New(), expires)
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	other := newTestPeer(t, otherID, uuid.New(), expires)
+	require.NoError(t, m.SetPeer(context.Background(), other))
+	require.NoError(t, m.SetPeer(context.Background(), newTestPeer(t, sharedID, uuid.New(), expires)))
+	require.NoError(t, m.SetPeer(context.Background(), newTestPeer(t, sharedID, uuid.New(), expires)))
+
+	// suspend the other peer
+	other.Expires = &xtime.Time{Time: time.Now().Add(-time.Minute)}
+	_, err := m.storage.UpdatePeer(other)
+	require.NoError(t, err)
+	m.lock.Lock()
+	m.syncPeerStats()
+	m.lock.Unlock()
+
+	extended := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	errs, err := m.ExtendExpirations(context.Background(), []ExpirationUpdate{
+		{Identifiers: &types.PeerIdentifiers{UserId: &userID}, Expires: &extended},
+		{Identifiers: &types.PeerIdentifiers{UserId: &unknownID}, Expires: &extended},
+		{Identifiers: &types.PeerIdentifiers{UserId: &sharedID}, Expires: &extended},
+		{Identifiers: nil, Expires: &extended},
+		{Identifiers: &types.PeerIdentifiers{UserId: &otherID}, Expires: &extended},
+	})
+	require.NoError(t, err)
+	require.Len(t, errs, 5)
+	require.NoError(t, errs[0])
+	code, _ := xerror.ErrorToHttpResponse(errs[1])
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = xerror.ErrorToHttpResponse(errs[2])
+	require.Equal(t, http.StatusConflict, code)
+	code, _ = xerror.ErrorToHttpResponse(errs[3])
+	require.Equal(t, http.StatusBadRequest, code)
+	require.NoError(t, errs[4])
+
+	for _, id := range []int64{peer.ID, other.ID} {
+		stored, err := m.GetPeer(context.Background(), id)
+		require.NoError(t, err)
+		require.True(t, stored.Expires.Time.Equal(extended))
+	}
+
+	// the suspended peer is back on the device
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	require.Contains(t, wgPeers, *other.WireguardPublicKey)
+	require.NotContains(t, m.suspended, other.ID)
+}
+
+func TestWalkPeers(t *testing.T) {
+	m := newTestManager(t)
+
+	var visited []string
+	visit := func(peers []*types.PeerInfo) error {
+		for _, peer := range peers {
+			visited = append(visited, strconv.FormatInt(peer.ID, 10))
+		}
+		return nil
+	}
+	require.NoError(t, m.WalkPeers(context.Background(), visit))
+	require.Empty(t, visited)
+
+	ids := make([]string, 3)
+	for i := range ids {
+		peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+		require.NoError(t, m.SetPeer(context.Background(), peer))
+		ids[i] = strconv.FormatInt(peer.ID, 10)
+	}
+
+	require.NoError(t, m.WalkPeers(context.Background(), visit))
+	require.Equal(t, strings.Join(ids, "\n"), strings.Join(visited, "\n"))
+
+	// the visit error stops the walk
+	stop := errors.New("stop")
+	require.ErrorIs(t, m.WalkPeers(context.Background(), func([]*types.PeerInfo) error { return stop }), stop)
+
+	// pages continue after the last ID read
+	page, lastID, err := m.storage.ListPeersAfter(context.Background(), 0, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	page, lastID, err = m.storage.ListPeersAfter(context.Background(), lastID, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	_, next, err := m.storage.ListPeersAfter(context.Background(), lastID, 2)
+	require.NoError(t, err)
+	require.Equal(t, lastID, next)
+}
+
+func TestPatchPeer(t *testing.T) {
+	m := newTestManager(t)
+	ctx := context.Background()
+
+	label := "laptop"
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	peer.Label = &label
+	require.NoError(t, m.SetPeer(ctx, peer))
+
+	// the label changed concurrently is kept by the expiration patch
+	stored, err := m.GetPeer(ctx, peer.ID)
+	require.NoError(t, err)
+	newLabel := "phone"
+	stored.Label = &newLabel
+	require.NoError(t, m.UpdatePeer(ctx, stored))
+
+	expires := xtime.Time{Time: time.Now().Add(2 * time.Hour).Truncate(time.Second)}
+	require.NoError(t, m.PatchPeer(ctx, peer.ID, types.PeerPatch{Expires: &expires}))
+
+	stored, err = m.GetPeer(ctx, peer.ID)
+	require.NoError(t, err)
+	require.Equal(t, newLabel, *stored.Label)
+	require.True(t, expires.Time.Equal(stored.Expires.Time))
+	require.Equal(t, *peer.WireguardPublicKey, *stored.WireguardPublicKey)
+	require.True(t, peer.Ipv4.Equal(*stored.Ipv4))
+
+	// the empty patch changes nothing
+	require.NoError(t, m.PatchPeer(ctx, peer.ID, types.PeerPatch{}))
+	patched, err := m.GetPeer(ctx, peer.ID)
+	require.NoError(t, err)
+	require.Equal(t, newLabel, *patched.Label)
+	require.True(t, expires.Time.Equal(patched.Expires.Time))
+
+	err = m.PatchPeer(ctx, peer.ID+1, types.PeerPatch{Label: &label})
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestUpdatePeerDisplayName(t *testing.T) {
+	m := newTestManager(t)
+	ctx := context.Background()
+
+	name := "Alice's laptop"
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	peer.DisplayName = &name
+	require.NoError(t, m.SetPeer(ctx, peer))
+
+	// the update without the display name keeps it
+	label := "laptop"
+	update := newTestPeer(t, "user", *peer.InstallationId, time.Now().Add(time.Hour))
+	update.ID = peer.ID
+	update.WireguardPublicKey = peer.WireguardPublicKey
+	update.Label = &label
+	require.NoError(t, m.UpdatePeer(ctx, update))
+
+	stored, err := m.GetPeer(ctx, peer.ID)
+	require.NoError(t, err)
+	require.Equal(t, label, *stored.Label)
+	require.Equal(t, name, *stored.DisplayName)
+
+	newName := "Alice's phone"
+	require.NoError(t, m.PatchPeer(ctx, peer.ID, types.PeerPatch{DisplayName: &newName}))
+	found, err := m.SearchPeersByDisplayName(ctx, "phone")
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.Equal(t, peer.ID, found[0].ID)
+
+	tooLong := strings.Repeat("x", types.MaxDisplayNameLength+1)
+	err = m.PatchPeer(ctx, peer.ID, types.PeerPatch{DisplayName: &tooLong})
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestSetPeerValidatesKey(t *testing.T) {
+	m := newTestManager(t)
+	ip4am := m.ip4am.(*fakeIPAM)
+
+	for _, key := range []string{
+		"",
+		"not a base64 key",
+		// valid base64, but 16 bytes only
+		"AAAAAAAAAAAAAAAAAAAAAA==",
+	} {
+		peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+		peer.WireguardPublicKey = &key
+		err := m.SetPeer(context.Background(), peer)
+		code, _ := xerror.ErrorToHttpResponse(err)
+		require.Equal(t, http.StatusBadRequest, code, key)
+		require.Empty(t, ip4am.used, "no address must be allocated")
+	}
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	require.Len(t, ip4am.used, 1)
+
+	// the expired peer is removed regardless of its key
+	broken := "not a base64 key"
+	expired := newTestPeer(t, "user", uuid.New(), time.Now().Add(-time.Hour))
+	expired.ID = peer.ID
+	expired.WireguardPublicKey = &broken
+	require.NoError(t, m.UpdatePeer(context.Background(), expired))
+	_, err := m.GetPeer(context.Background(), peer.ID)
+	require.Error(t, err)
+}
+
+func TestUpdateSharedPeer(t *testing.T) {
+	m := newTestManager(t)
+
+	// the shared peer has no key until activated
+	sharingKey := uuid.New().String()
+	sharingExpires := time.Now().Add(time.Hour).Unix()
+	shared := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	shared.WireguardPublicKey = nil
+	shared.SharingKey = &sharingKey
+	shared.SharingKeyExpiration = &sharingExpires
+	ipa, err := m.ip4am.AllocKey(shared.GetNetworkPolicy(), "")
+	require.NoError(t, err)
+	shared.Ipv4 = &ipa
+	id, err := m.storage.CreatePeer(*shared)
+	require.NoError(t, err)
+
+	label := "renamed"
+	shared.ID = id
+	shared.Label = &label
+	require.NoError(t, m.UpdatePeer(context.Background(), shared))
+	stored, err := m.GetPeer(context.Background(), id)
+	require.NoError(t, err)
+	require.Equal(t, label, *stored.Label)
+	require.Nil(t, stored.WireguardPublicKey)
+
+	wgPeers, err := m.wireguard.GetPeers()
+	require.NoError(t, err)
+	require.Empty(t, wgPeers)
+}
+
+func TestSetPeerPreferredAddress(t *testing.T) {
+	m := newTestManager(t)
+	ip4am := m.ip4am.(*fakeIPAM)
+
+	preferred := xnet.ParseIP("10.0.0.100")
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	peer.PreferredIpv4 = &preferred
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	require.True(t, peer.Ipv4.Equal(preferred))
+
+	// the address is taken, fallback to any other one
+	other := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	other.PreferredIpv4 = &preferred
+	require.NoError(t, m.SetPeer(context.Background(), other))
+	require.False(t, other.Ipv4.Equal(preferred))
+
+	// the address is out of the policy range
+	ip4am.matches = func(addr xnet.IP, _ ipam.Policy) bool {
+		return !addr.Equal(xnet.ParseIP("10.0.0.200"))
+	}
+	outOfRange := xnet.ParseIP("10.0.0.200")
+	third := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	third.PreferredIpv4 = &outOfRange
+	err := m.SetPeer(context.Background(), third)
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Len(t, ip4am.used, 2)
+}
+
+func TestSetPeerClustered(t *testing.T) {
+	m := newTestManager(t)
+	ip4am := m.ip4am.(*fakeIPAM)
+	ip4am.clusterRadius = 4
+
+	addr := xnet.ParseIP("10.0.0.100")
+	first := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	first.Ipv4 = &addr
+	require.NoError(t, m.SetPeer(context.Background(), first))
+
+	// the user's next peer is put next to the first one
+	second := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), second))
+	require.NotNil(t, second.Clustered)
+	require.True(t, *second.Clustered)
+	require.Equal(t, "10.0.0.101", second.Ipv4.String())
+
+	// no peers of the user to cluster with
+	other := newTestPeer(t, "other", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), other))
+	require.Nil(t, other.Clustered)
+	require.Equal(t, "10.0.0.2", other.Ipv4.String())
+
+	// nothing free nearby, any address is allocated
+	ip4am.mu.Lock()
+	ip4am.clusterRadius = 1
+	ip4am.used["10.0.0.102"] = true
+	ip4am.mu.Unlock()
+	third := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), third))
+	require.NotNil(t, third.Clustered)
+	require.False(t, *third.Clustered)
+	require.Equal(t, "10.0.0.3", third.Ipv4.String())
+}
+
+func TestValidatePeer(t *testing.T) {
+	m := newTestManager(t)
+	ip4am := m.ip4am.(*fakeIPAM)
+
+	code := func(peer *types.PeerInfo) int {
+		code, _ := xerror.ErrorToHttpResponse(m.ValidatePeer(*peer))
+		return code
+	}
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.ValidatePeer(*peer))
+	require.Empty(t, ip4am.used, "validation must not claim addresses")
+
+	invalidKey := "not a key"
+	badKey := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	badKey.WireguardPublicKey = &invalidKey
+	require.Equal(t, http.StatusBadRequest, code(badKey))
+
+	expired := newTestPeer(t, "user", uuid.New(), time.Now().Add(-time.Hour))
+	require.Equal(t, http.StatusBadRequest, code(expired))
+
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	taken := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	taken.Ipv4 = peer.Ipv4
+	require.Equal(t, http.StatusConflict, code(taken))
+
+	outOfPool := xnet.ParseIP("192.168.0.1")
+	taken.Ipv4 = &outOfPool
+	require.Equal(t, http.StatusBadRequest, code(taken))
+
+	// the taken preferred address is not an error
+	preferred := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	preferred.PreferredIpv4 = peer.Ipv4
+	require.NoError(t, m.ValidatePeer(*preferred))
+
+	// exhausted pool
+	ip4am.mu.Lock()
+	for i := 2; i < 255; i++ {
+		ip4am.used[xnet.IP{IP: net.IPv4(10, 0, 0, byte(i)).To4()}.String()] = true
+	}
+	ip4am.mu.Unlock()
+	require.Error(t, m.ValidatePeer(*newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))))
+	require.Len(t, ip4am.used, 253)
+}
+
+func TestSuspendExpiredPeers(t *testing.T) {
+	autoWipe := false
+	m := newTestManagerWithSettings(t, &settings.Config{AutoWipeExpired: &autoWipe})
+	wg := m.wireguard.(*fakeWireguard)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+
+	peer.Expires = &xtime.Time{Time: time.Now().Add(-time.Minute)}
+	_, err := m.storage.UpdatePeer(peer)
+	require.NoError(t, err)
+
+	m.lock.Lock()
+	m.syncPeerStats()
+	m.lock.Unlock()
+
+	// removed from the device but kept in the storage
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	require.NotContains(t, wgPeers, *peer.WireguardPublicKey)
+
+	expired, err := m.ListExpiredPeers()
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	require.Equal(t, peer.ID, expired[0].ID)
+
+	wiped, err := m.WipeExpiredPeers(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, wiped)
+
+	_, err = m.GetPeer(context.Background(), peer.ID)
+	require.Error(t, err)
+}
+
+func TestPreviewExpirations(t *testing.T) {
+	m := newTestManager(t)
+	// the startup sync must not sweep the peers seeded below
+	require.Eventually(t, func() bool { return !m.LastTick().IsZero() }, 5*time.Second, 10*time.Millisecond)
+
+	peers := make([]*types.PeerInfo, 12)
+	for i := range peers {
+		peers[i] = newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+		require.NoError(t, m.SetPeer(context.Background(), peers[i]))
+	}
+
+	expire := func(peers []*types.PeerInfo) {
+		for _, peer := range peers {
+			peer.Expires = &xtime.Time{Time: time.Now().Add(-time.Minute)}
+			_, err := m.storage.UpdatePeer(peer)
+			require.NoError(t, err)
+		}
+	}
+	sweep := func() {
+		m.lock.Lock()
+		m.syncPeerStats()
+		m.lock.Unlock()
+	}
+
+	expire(peers[:2])
+	preview, err := m.PreviewExpirations()
+	require.NoError(t, err)
+	require.Len(t, preview, 2)
+	previewIDs := []int64{preview[0].ID, preview[1].ID}
+
+	// nothing is removed by the preview
+	count, err := m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 12, count)
+
+	// the sweep removes exactly the previewed peers
+	sweep()
+	for _, id := range previewIDs {
+		_, err := m.GetPeer(context.Background(), id)
+		require.Error(t, err)
+	}
+	count, err = m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, count)
+
+	// the mass expiration is skipped by the sweep and the preview alike
+	expire(peers[2:])
+	preview, err = m.PreviewExpirations()
+	require.NoError(t, err)
+	require.Empty(t, preview)
+	sweep()
+	count, err = m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, count)
+}
+
+func TestExpiryClockAnomaly(t *testing.T) {
+	m := newTestManager(t)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.lock.Unlock()
+	// the startup sync must not sweep the peers seeded below
+	require.Eventually(t, func() bool { return !m.LastTick().IsZero() }, 5*time.Second, 10*time.Millisecond)
+
+	peers := make([]*types.PeerInfo, 12)
+	for i := range peers {
+		peers[i] = newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+		require.NoError(t, m.SetPeer(context.Background(), peers[i]))
+	}
+
+	// the clock jumped: most of peers are expired at once
+	for _, peer := range peers[:11] {
+		peer.Expires = &xtime.Time{Time: time.Now().Add(-time.Minute)}
+		_, err := m.storage.UpdatePeer(peer)
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		m.lock.Lock()
+		m.syncPeerStats()
+		m.lock.Unlock()
+	}
+
+	count, err := m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 12, count)
+
+	events.mu.Lock()
+	require.Len(t, events.clockAnomaly, 1)
+	require.EqualValues(t, 11, events.clockAnomaly[0].Expiring)
+	require.EqualValues(t, 12, events.clockAnomaly[0].Total)
+	events.mu.Unlock()
+
+	// the clock is fixed, the ordinary expiration goes on
+	for _, peer := range peers[1:11] {
+		peer.Expires = &xtime.Time{Time: time.Now().Add(time.Hour)}
+		_, err := m.storage.UpdatePeer(peer)
+		require.NoError(t, err)
+	}
+
+	m.lock.Lock()
+	m.syncPeerStats()
+	m.lock.Unlock()
+
+	count, err = m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 11, count)
+	require.False(t, m.clockAnomaly.Load())
+}
+
+func TestHealDuplicatePeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sqlite3")
+	db, err := storage.New(path)
+	require.NoError(t, err)
+	s := &settings.Config{}
+	ip4am := newFakeIPAM()
+	wg := newFakeWireguard()
+	m, err := newManager(&runtime.TunnelRuntime{Settings: s}, db, wg, ip4am, newFakePortFilter(), eventlog.NewDummy(), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = m.Shutdown()
+		_ = db.Shutdown()
+	})
+
+	// the unique index prevents duplicates, drop it
+	// to emulate the state left by the partial failure
+	raw, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = raw.Exec(`DROP INDEX peers_identifiers`)
+	require.NoError(t, err)
+	require.NoError(t, raw.Close())
+
+	installationID := uuid.New()
+	older := newTestPeer(t, "user", installationID, time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), older))
+	newer := newTestPeer(t, "user", installationID, time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), newer))
+
+	_, err = m.ConnectPeer(context.Background(), newTestPeer(t, "user", installationID, time.Now().Add(time.Hour)), 0)
+	require.Error(t, err)
+
+	s.HealDuplicatePeers = true
+	peer := newTestPeer(t, "user", installationID, time.Now().Add(time.Hour))
+	connectPeer(t, context.Background(), m, peer, 0)
+	require.Equal(t, newer.ID, peer.ID)
+
+	peers, err := m.storage.SearchPeers(nil)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, newer.ID, peers[0].ID)
+	require.Equal(t, *peer.WireguardPublicKey, *peers[0].WireguardPublicKey)
+
+	// the duplicate's address and device entry are released
+	require.Equal(t, 1, ip4am.Stats().Used)
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	require.Len(t, wgPeers, 1)
+	require.Contains(t, wgPeers, *peer.WireguardPublicKey)
+}
+
+func TestUnsetPeerFinalTraffic(t *testing.T) {
+	m := newTestManager(t)
+	wg := m.wireguard.(*fakeWireguard)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.lock.Unlock()
+
+	setTraffic := func(peer *types.PeerInfo, rx, tx int64) {
+		wg.mu.Lock()
+		defer wg.mu.Unlock()
+		wgPeer := wg.peers[*peer.WireguardPublicKey]
+		wgPeer.ReceiveBytes = rx
+		wgPeer.TransmitBytes = tx
+		wg.peers[*peer.WireguardPublicKey] = wgPeer
+	}
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	setTraffic(peer, 1000, 500)
+	m.lock.Lock()
+	m.syncPeerStats()
+	m.lock.Unlock()
+
+	// the traffic after the last stats update
+	setTraffic(peer, 1500, 700)
+	require.NoError(t, m.UnsetPeer(context.Background(), peer.ID))
+
+	// the peer already gone from the device
+	gone := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), gone))
+	require.NoError(t, wg.UnsetPeer(gone))
+	require.NoError(t, m.UnsetPeer(context.Background(), gone.ID))
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	require.Len(t, events.events, 4)
+
+	removed := events.events[1]
+	require.EqualValues(t, 1500, removed.BytesRx)
+	require.EqualValues(t, 700, removed.BytesTx)
+	require.EqualValues(t, 500, removed.BytesDeltaRx)
+	require.EqualValues(t, 200, removed.BytesDeltaTx)
+
+	removed = events.events[3]
+	require.Zero(t, removed.BytesRx)
+	require.Zero(t, removed.BytesDeltaRx)
+}
+
+func TestWipeExpiredPeersDumpsDeviceOnce(t *testing.T) {
+	autoWipe := false
+	m := newTestManagerWithSettings(t, &settings.Config{AutoWipeExpired: &autoWipe})
+	wg := m.wireguard.(*fakeWireguard)
+
+	for i := 0; i < 5; i++ {
+		peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+		require.NoError(t, m.SetPeer(context.Background(), peer))
+		peer.Expires = &xtime.Time{Time: time.Now().Add(-time.Minute)}
+		_, err := m.storage.UpdatePeer(peer)
+		require.NoError(t, err)
+	}
+
+	// the startup stats update dumps the device on its own
+	require.Eventually(t, func() bool { return !m.LastTick().IsZero() }, 5*time.Second, 10*time.Millisecond)
+	wg.mu.Lock()
+	wg.dumps = 0
+	wg.mu.Unlock()
+	wiped, err := m.WipeExpiredPeers(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 5, wiped)
+
+	// one dump for the removals, one for the stats update
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	require.Equal(t, 2, wg.dumps)
+}
+
+func TestIdlePeerDisconnect(t *testing.T) {
+	m := newTestManager(t)
+	wg := m.wireguard.(*fakeWireguard)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.statsService.IdleTimeout = time.Hour
+	m.lock.Unlock()
+
+	active := newTestPeer(t, "user", uuid.New(), time.Now().Add(24*time.Hour))
+	connectPeer(t, context.Background(), m, active, 0)
+	silent := newTestPeer(t, "user", uuid.New(), time.Now().Add(24*time.Hour))
+	connectPeer(t, context.Background(), m, silent, 0)
+
+	wg.mu.Lock()
+	wgPeer := wg.peers[*active.WireguardPublicKey]
+	wgPeer.ReceiveBytes = 1000
+	wg.peers[*active.WireguardPublicKey] = wgPeer
+	wg.mu.Unlock()
+
+	m.lock.Lock()
+	m.syncPeerStats()
+	require.Empty(t, m.idle)
+
+	// both peers have been quiet for longer than the timeout
+	stat := m.statsService.GetRuntimePeerStat(active)
+	stat.trafficAt = stat.trafficAt.Add(-2 * time.Hour)
+	stat = m.statsService.GetRuntimePeerStat(silent)
+	stat.seen = stat.seen.Add(-2 * time.Hour)
+	m.syncPeerStats()
+	require.Len(t, m.idle, 2)
+	m.lock.Unlock()
+
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	require.Empty(t, wgPeers)
+	count, err := m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+
+	events.mu.Lock()
+	reasons := map[string]string{}
+	for _, event := range events.events {
+		if event.IdleReason != "" {
+			reasons[event.UserID+event.InstallationID] = event.IdleReason
+		}
+	}
+	events.mu.Unlock()
+	require.Equal(t, map[string]string{
+		"user" + active.InstallationId.String(): "idle",
+		"user" + silent.InstallationId.String(): "no_traffic",
+	}, reasons)
+
+	// the peer is back on the device on the next connect
+	connectPeer(t, context.Background(), m, active, 0)
+	wgPeers, err = wg.GetPeers()
+	require.NoError(t, err)
+	require.Contains(t, wgPeers, *active.WireguardPublicKey)
+	m.lock.Lock()
+	require.Len(t, m.idle, 1)
+
+	// the watchdog keeps the idle peer off the device
+	m.reprogramPeers()
+	m.lock.Unlock()
+	wgPeers, err = wg.GetPeers()
+	require.NoError(t, err)
+	require.NotContains(t, wgPeers, *silent.WireguardPublicKey)
+
+	// the idle peer expires the same as others
+	stored, err := m.GetPeer(context.Background(), silent.ID)
+	require.NoError(t, err)
+	stored.Expires = &xtime.Time{Time: time.Now().Add(-time.Minute)}
+	require.NoError(t, m.storage.UpdatePeersExpiration([]*types.PeerInfo{stored}))
+	m.lock.Lock()
+	m.syncPeerStats()
+	require.Empty(t, m.idle)
+	m.lock.Unlock()
+	_, err = m.GetPeer(context.Background(), silent.ID)
+	require.ErrorIs(t, err, xerror.EEntryNotFound("", nil))
+}
+
+func TestMaxPeersPerInterface(t *testing.T) {
+	m := newTestManagerWithSettings(t, &settings.Config{MaxPeersPerInterface: 2})
+	ip4am := m.ip4am.(*fakeIPAM)
+
+	first := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	connectPeer(t, context.Background(), m, first, 0)
+	require.NoError(t, m.SetPeer(context.Background(), newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))))
+
+	// the startup stats update dumps the device on its own
+	require.Eventually(t, func() bool { return !m.LastTick().IsZero() }, 5*time.Second, 10*time.Millisecond)
+	wg := m.wireguard.(*fakeWireguard)
+	wg.mu.Lock()
+	wg.dumps = 0
+	wg.mu.Unlock()
+	_, err := m.ConnectPeer(context.Background(), newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour)), 0)
+	require.Error(t, err)
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusInsufficientStorage, code)
+	err = m.SetPeer(context.Background(), newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour)))
+	require.Error(t, err)
+	// the device is not dumped to count the peers
+	wg.mu.Lock()
+	require.Zero(t, wg.dumps)
+	wg.mu.Unlock()
+
+	// no address is left behind by the rejected peers
+	require.Equal(t, 2, ip4am.Stats().Used)
+	count, err := m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+	onDevice, err := m.CountDevicePeers()
+	require.NoError(t, err)
+	require.Equal(t, 2, onDevice)
+
+	// updates are not limited
+	connectPeer(t, context.Background(), m, first, time.Hour)
+}
+
+func TestCountPeers(t *testing.T) {
+	m := newTestManager(t)
+
+	count, err := m.CountPeers()
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	for i := 0; i < 3; i++ {
+		connectPeer(t, context.Background(), m, newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour)), 0)
+	}
+	connectPeer(t, context.Background(), m, newTestPeer(t, "other", uuid.New(), time.Now().Add(time.Hour)), 0)
+
+	count, err = m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, count)
+
+	userID := "user"
+	count, err = m.storage.CountPeers(&types.PeerInfo{PeerIdentifiers: types.PeerIdentifiers{UserId: &userID}})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, count)
+
+	peers, err := m.storage.SearchPeers(&types.PeerInfo{PeerIdentifiers: types.PeerIdentifiers{UserId: &userID}})
+	require.NoError(t, err)
+	require.Len(t, peers, int(count))
+}
+
+type recordingEventLog struct {
+	eventlog.EventManager
+
+	mu           sync.Mutex
+	events       []*proto.PeerInfo
+	peerTypes    []eventlog.EventType
+	maintenance  []*proto.MaintenanceInfo
+	clockAnomaly []*proto.ClockAnomalyInfo
+	interfaces   []*proto.InterfaceInfo
+	pressure     []*proto.PoolPressureInfo
+	states       []eventlog.EventType
+	reloads      []*proto.SettingsReloadInfo
+}
+
+func (l *recordingEventLog) Push(eventType eventlog.EventType, data interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch v := data.(type) {
+	case *proto.PeerInfo:
+		l.events = append(l.events, v)
+		l.peerTypes = append(l.peerTypes, eventType)
+	case *proto.MaintenanceInfo:
+		l.maintenance = append(l.maintenance, v)
+	case *proto.ClockAnomalyInfo:
+		l.clockAnomaly = append(l.clockAnomaly, v)
+	case *proto.InterfaceInfo:
+		l.interfaces = append(l.interfaces, v)
+	case *proto.PoolPressureInfo:
+		l.pressure = append(l.pressure, v)
+	case *proto.ManagerStateInfo:
+		l.states = append(l.states, eventType)
+	case *proto.SettingsReloadInfo:
+		l.reloads = append(l.reloads, v)
+	}
+	return nil
+}
+
+func TestCorrelationID(t *testing.T) {
+	m := newTestManager(t)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.lock.Unlock()
+
+	ctx := WithCorrelationID(context.Background(), "req-1")
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	connectPeer(t, ctx, m, peer, 0)
+	connectPeer(t, WithCorrelationID(context.Background(), "req-2"), m, peer, 0)
+	require.NoError(t, m.UnsetPeer(context.Background(), peer.ID))
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	require.Len(t, events.events, 3)
+	require.Equal(t, "req-1", events.events[0].CorrelationID)
+	require.Equal(t, "req-2", events.events[1].CorrelationID)
+	require.Empty(t, events.events[2].CorrelationID)
+}
+
+func TestModifiedBy(t *testing.T) {
+	m := newTestManager(t)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.lock.Unlock()
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(WithModifiedBy(context.Background(), "alice"), peer))
+	stored, err := m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.Equal(t, "alice", *stored.ModifiedBy)
+
+	label := "laptop"
+	require.NoError(t, m.PatchPeer(WithModifiedBy(context.Background(), "bob"), peer.ID, types.PeerPatch{Label: &label}))
+	stored, err = m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.Equal(t, "bob", *stored.ModifiedBy)
+
+	// changes made not by the admin keep the last one
+	label = "phone"
+	require.NoError(t, m.PatchPeer(context.Background(), peer.ID, types.PeerPatch{Label: &label}))
+	stored, err = m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.Equal(t, "bob", *stored.ModifiedBy)
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	var updates []string
+	for i, typ := range events.peerTypes {
+		if typ == eventlog.PeerUpdate {
+			updates = append(updates, events.events[i].ModifiedBy)
+		}
+	}
+	require.Equal(t, []string{"bob", "bob"}, updates)
+}
+
+func TestSetPeerPointToPoint(t *testing.T) {
+	m := newTestManager(t)
+	wg := m.wireguard.(*fakeWireguard)
+
+	p2p := true
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	peer.PointToPoint = &p2p
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	require.True(t, m.ip4am.MatchesLink(*peer.Ipv4))
+
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	allowed := wgPeers[*peer.WireguardPublicKey].AllowedIPs
+	require.Len(t, allowed, 1)
+	ones, _ := allowed[0].Mask.Size()
+	require.Equal(t, 31, ones)
+
+	stats := m.ip4am.Stats()
+	require.Equal(t, 1, stats.Links)
+	require.Equal(t, 2, stats.Used)
+
+	// the flag is kept on updates not mentioning it
+	update := *peer
+	update.PointToPoint = nil
+	require.NoError(t, m.UpdatePeer(context.Background(), &update))
+	stored, err := m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.True(t, stored.IsPointToPoint())
+
+	require.NoError(t, m.UnsetPeer(context.Background(), peer.ID))
+	stats = m.ip4am.Stats()
+	require.Equal(t, 0, stats.Links)
+	require.Equal(t, 0, stats.Used)
+}
+
+func TestSetPeerAllowedIPsOverlap(t *testing.T) {
+	m := newTestManager(t)
+	ip4am := m.ip4am.(*fakeIPAM)
+
+	p2p := true
+	link := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	link.PointToPoint = &p2p
+	require.NoError(t, m.SetPeer(context.Background(), link))
+	other := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), other))
+
+	// the pool lost the upper address of the link,
+	// the /31 routed to the link peer still covers it
+	upper := xnet.Uint32ToIP(link.Ipv4.ToUint32() + 1)
+	ip4am.mu.Lock()
+	delete(ip4am.used, upper.String())
+	ip4am.mu.Unlock()
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	peer.Ipv4 = &upper
+	err := m.SetPeer(context.Background(), peer)
+	code, _ := xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusConflict, code)
+	require.True(t, ip4am.IsAvailable(upper))
+
+	// moving the existing peer into the link is rejected too
+	update := *other
+	update.Ipv4 = &upper
+	err = m.UpdatePeer(context.Background(), &update)
+	code, _ = xerror.ErrorToHttpResponse(err)
+	require.Equal(t, http.StatusConflict, code)
+	stored, err := m.GetPeer(context.Background(), other.ID)
+	require.NoError(t, err)
+	require.True(t, stored.Ipv4.Equal(*other.Ipv4))
+	require.True(t, ip4am.IsAvailable(upper))
+
+	count, err := m.CountPeers()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+}
+
+func TestUpdatePeerPolicy(t *testing.T) {
+	m := newTestManager(t)
+	ip4am := m.ip4am.(*fakeIPAM)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	addr := *peer.Ipv4
+
+	// the same address, the rules are updated
+	allowAll := ipam.AccessPolicyAllowAll
+	update := *peer
+	update.NetworkAccessPolicy = &allowAll
+	require.NoError(t, m.UpdatePeer(context.Background(), &update))
+	require.True(t, update.Ipv4.Equal(addr))
+	require.Equal(t, ipam.AccessPolicyAllowAll, ip4am.access[addr.String()])
+	require.Len(t, ip4am.used, 1)
+
+	// the policy has its own sub-pool now
+	ip4am.matches = func(addr xnet.IP, pol ipam.Policy) bool {
+		if pol.Access == ipam.AccessPolicyInternetOnly {
+			return addr.IP[3] >= 128
+		}
+		return addr.IP[3] < 128
+	}
+	internetOnly := ipam.AccessPolicyInternetOnly
+	update.NetworkAccessPolicy = &internetOnly
+	require.NoError(t, m.UpdatePeer(context.Background(), &update))
+	require.False(t, update.Ipv4.Equal(addr))
+	require.GreaterOrEqual(t, int(update.Ipv4.IP[3]), 128)
+	require.Equal(t, ipam.AccessPolicyInternetOnly, ip4am.access[update.Ipv4.String()])
+	require.Len(t, ip4am.used, 1, "the old address must be released")
+
+	stored, err := m.GetPeer(context.Background(), peer.ID)
+	require.NoError(t, err)
+	require.True(t, stored.Ipv4.Equal(*update.Ipv4))
+}
+
+func TestPeerPortRules(t *testing.T) {
+	m := newTestManager(t)
+	ports := m.ports.(*fakePortFilter)
+
+	peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	require.NoError(t, m.SetPeer(context.Background(), peer))
+	require.Equal(t, map[string]int{peer.Ipv4.String(): ipam.AccessPolicyDefault}, ports.applied)
+
+	// rules follow the policy change
+	allowAll := ipam.AccessPolicyAllowAll
+	update := *peer
+	update.NetworkAccessPolicy = &allowAll
+	require.NoError(t, m.UpdatePeer(context.Background(), &update))
+	require.Equal(t, map[string]int{peer.Ipv4.String(): ipam.AccessPolicyAllowAll}, ports.applied)
+
+	// both addresses of the link are covered
+	p2p := true
+	link := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+	link.PointToPoint = &p2p
+	require.NoError(t, m.SetPeer(context.Background(), link))
+	upper := xnet.Uint32ToIP(link.Ipv4.ToUint32() + 1)
+	require.Contains(t, ports.applied, link.Ipv4.String())
+	require.Contains(t, ports.applied, upper.String())
+
+	require.NoError(t, m.UnsetPeer(context.Background(), peer.ID))
+	require.NoError(t, m.UnsetPeer(context.Background(), link.ID))
+	require.Empty(t, ports.applied)
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"go.uber.org/zap"
+)
+
+// presenceState is the presence of the peer last reported.
+type presenceState struct {
+	online bool
+	// changedAt is when the peer went into the other state,
+	// zero if it's in the reported one
+	changedAt time.Time
+}
+
+// trackPresence pushes PeerConnected and PeerDisconnected events
+// on peers going online and offline: the peer is online while its
+// last handshake is fresh. The transition is reported once the new
+// state holds for the min duration, so the flapping peer is not
+// reported back and forth. The reported state is stored with the peer,
+// so the first sync after the restart reports only the peers changed
+// meanwhile, not every online peer again. States of peers never
+// tracked before are taken as is on the first sync.
+// Must be called with the lock held.
+func (manager *Manager) trackPresence(now time.Time, peers []*types.PeerInfo) {
+	timeout, enabled := manager.runtime.Settings.GetPeerPresenceTimeout()
+	if !enabled {
+		manager.presence = nil
+		return
+	}
+	minDuration := manager.runtime.Settings.GetPeerPresenceMinDuration()
+
+	primed := manager.presence != nil
+	presence := make(map[int64]presenceState, len(peers))
+	var changed []*types.PeerInfo
+	for _, peer := range peers {
+		online, since := peerPresence(peer, now, timeout)
+		state, known := manager.presence[peer.ID]
+		if !primed {
+			state, known = storedPresence(peer)
+		}
+		if (!known && (!primed || !online)) || online == state.online {
+			presence[peer.ID] = presenceState{online: online}
+			if stored := peer.Online; stored == nil || *stored != online {
+				changed = append(changed, withOnline(peer, online))
+			}
+			continue
+		}
+		if state.changedAt.IsZero() {
+			state.changedAt = since
+		}
+		if now.Sub(state.changedAt) < minDuration {
+			// not reported yet
+			presence[peer.ID] = state
+			continue
+		}
+		presence[peer.ID] = presenceState{online: online}
+		changed = append(changed, withOnline(peer, online))
+
+		eventType := eventlog.PeerDisconnected
+		if online {
+			eventType = eventlog.PeerConnected
+		}
+		zap.L().Debug("peer presence changed", zap.Int64("id", peer.ID), zap.Bool("online", online))
+		if err := manager.eventLog.Push(eventType, peer.IntoProto()); err != nil {
+			zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(eventType)))
+		}
+	}
+	// removed peers are forgotten
+	manager.presence = presence
+
+	if len(changed) > 0 {
+		if err := manager.storage.UpdatePeersOnline(changed); err != nil {
+			// reported again after the restart at worst
+			zap.L().Error("failed to store peers presence", zap.Error(err))
+		}
+	}
+}
+
+// storedPresence returns the state reported before the restart.
+func storedPresence(peer *types.PeerInfo) (presenceState, bool) {
+	if peer.Online == nil {
+		return presenceState{}, false
+	}
+	return presenceState{online: *peer.Online}, true
+}
+
+// withOnline returns the copy of the peer to store the reported state with.
+func withOnline(peer *types.PeerInfo, online bool) *types.PeerInfo {
+	return &types.PeerInfo{ID: peer.ID, Online: &online}
+}
+
+// peerPresence reports whether the peer is online
+// and since when it's in that state.
+func peerPresence(peer *types.PeerInfo, now time.Time, timeout time.Duration) (online bool, since time.Time) {
+	if peer.Activity == nil {
+		// never connected
+		return false, time.Time{}
+	}
+	offlineAt := peer.Activity.Time.Add(timeout)
+	if now.Before(offlineAt) {
+		return true, peer.Activity.Time
+	}
+	return false, offlineAt
+}
@@ -0,0 +1,185 @@
+package manager
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/runtime"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/storage"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/human"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"github.com/vpnhouse/common-lib-go/xtime"
+)
+
+func TestTrackPresence(t *testing.T) {
+	s := &settings.Config{PeerPresence: &settings.PeerPresenceConfig{
+		Enabled:          true,
+		HandshakeTimeout: human.MustParseInterval("3m"),
+		MinStateDuration: human.MustParseInterval("30s"),
+	}}
+	m := newTestManagerWithSettings(t, s)
+	// the initial sync is done regardless of the schedule
+	require.Eventually(t, func() bool {
+		return !m.LastTick().IsZero()
+	}, time.Second, 10*time.Millisecond)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.presence = nil
+	m.lock.Unlock()
+
+	start := time.Now()
+	newPeer := func(id int64) *types.PeerInfo {
+		peer := newTestPeer(t, "user", uuid.New(), start.Add(time.Hour))
+		peer.ID = id
+		return peer
+	}
+	handshake := func(peer *types.PeerInfo, at time.Duration) {
+		peer.Activity = &xtime.Time{Time: start.Add(at)}
+	}
+	a, b := newPeer(1), newPeer(2)
+	handshake(a, -10*time.Second)
+
+	type event struct {
+		eventType eventlog.EventType
+		id        string
+	}
+	track := func(at time.Duration, expected ...event) {
+		t.Helper()
+		m.lock.Lock()
+		m.trackPresence(start.Add(at), []*types.PeerInfo{a, b})
+		m.lock.Unlock()
+
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		var actual []event
+		for i, p := range events.events {
+			actual = append(actual, event{events.peerTypes[i], p.InstallationID})
+		}
+		events.events, events.peerTypes = nil, nil
+		assert.Equal(t, expected, actual, "at %s", at)
+	}
+	connected := func(peer *types.PeerInfo) event {
+		return event{eventlog.PeerConnected, peer.InstallationId.String()}
+	}
+	disconnected := func(peer *types.PeerInfo) event {
+		return event{eventlog.PeerDisconnected, peer.InstallationId.String()}
+	}
+
+	// the online peer is not reported on start
+	track(0)
+
+	// online for less than the min duration
+	handshake(b, 50*time.Second)
+	track(time.Minute)
+	track(2*time.Minute, connected(b))
+	track(150 * time.Second)
+
+	// the handshake of a aged out at 2m50s
+	track(3 * time.Minute)
+	track(4*time.Minute, disconnected(a))
+
+	// b flaps: offline at 3m50s, back online in 20s
+	track(4*time.Minute + 5*time.Second)
+	handshake(b, 4*time.Minute+10*time.Second)
+	track(4*time.Minute + 20*time.Second)
+	track(5 * time.Minute)
+
+	// a connects again, b's handshake aged out at 7m10s
+	handshake(a, 10*time.Minute)
+	track(11*time.Minute, connected(a), disconnected(b))
+
+	// disabled
+	m.lock.Lock()
+	s.PeerPresence.Enabled = false
+	m.lock.Unlock()
+	handshake(b, 20*time.Minute)
+	track(30 * time.Minute)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	require.Nil(t, m.presence)
+}
+
+func TestTrackPresenceRestart(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Shutdown() })
+
+	s := &settings.Config{PeerPresence: &settings.PeerPresenceConfig{
+		Enabled:          true,
+		HandshakeTimeout: human.MustParseInterval("3m"),
+		MinStateDuration: human.MustParseInterval("30s"),
+	}}
+	start := func() (*Manager, *recordingEventLog) {
+		events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+		m, err := newManager(&runtime.TunnelRuntime{Settings: s}, db, newFakeWireguard(), newFakeIPAM(), newFakePortFilter(), events, nil)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return !m.LastTick().IsZero()
+		}, time.Second, 10*time.Millisecond)
+		return m, events
+	}
+
+	now := time.Now()
+	peers := map[string]*types.PeerInfo{}
+	handshake := func(name string, ago time.Duration) {
+		peers[name].Activity = &xtime.Time{Time: now.Add(-ago)}
+		require.NoError(t, db.UpdatePeerStats(now, peers[name]))
+	}
+	for i, name := range []string{"a", "b", "c", "never"} {
+		peer := newTestPeer(t, "user", uuid.New(), now.Add(time.Hour))
+		addr := xnet.IP{IP: net.IPv4(10, 0, 0, byte(10+i)).To4()}
+		peer.Ipv4 = &addr
+		id, err := db.CreatePeer(*peer)
+		require.NoError(t, err)
+		peers[name], err = db.GetPeer(id)
+		require.NoError(t, err)
+	}
+	handshake("a", 10*time.Second)
+	handshake("b", 10*time.Minute)
+	handshake("c", 10*time.Second)
+
+	// peers never tracked are taken as is
+	m, events := start()
+	require.NoError(t, m.Shutdown())
+	assert.Empty(t, events.peerTypes)
+
+	online := func(name string) *bool {
+		peer, err := db.GetPeer(peers[name].ID)
+		require.NoError(t, err)
+		return peer.Online
+	}
+	for name, expected := range map[string]bool{"a": true, "b": false, "c": true, "never": false} {
+		require.NotNil(t, online(name), name)
+		assert.Equal(t, expected, *online(name), name)
+	}
+
+	// a went offline and b came online while the server was down,
+	// c stayed online
+	handshake("a", 5*time.Minute)
+	handshake("b", time.Minute)
+	handshake("c", 5*time.Second)
+
+	m, events = start()
+	require.NoError(t, m.Shutdown())
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	reported := map[string]eventlog.EventType{}
+	for i, p := range events.events {
+		reported[p.InstallationID] = events.peerTypes[i]
+	}
+	assert.Equal(t, map[string]eventlog.EventType{
+		peers["a"].InstallationId.String(): eventlog.PeerDisconnected,
+		peers["b"].InstallationId.String(): eventlog.PeerConnected,
+	}, reported)
+	assert.False(t, *online("a"))
+	assert.True(t, *online("b"))
+}
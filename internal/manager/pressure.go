@@ -0,0 +1,52 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/proto"
+	"go.uber.org/zap"
+)
+
+// checkPoolPressure pushes the event once the address pool utilization
+// crosses the configured threshold upwards. The threshold fires again
+// only after the utilization drops below it. Must be called with the lock held.
+func (manager *Manager) checkPoolPressure(now time.Time) {
+	pool := manager.ip4am.Stats()
+	percent := pool.Utilization() * 100
+
+	for _, threshold := range manager.runtime.Settings.GetPoolPressureThresholds() {
+		_, crossed := manager.poolPressure[threshold]
+		if percent < float64(threshold) {
+			if crossed {
+				delete(manager.poolPressure, threshold)
+				zap.L().Info("address pool utilization is back below the threshold", zap.Int("threshold", threshold))
+			}
+			continue
+		}
+		if crossed {
+			// already reported
+			continue
+		}
+		manager.poolPressure[threshold] = struct{}{}
+
+		zap.L().Warn("address pool utilization crossed the threshold",
+			zap.Int("threshold", threshold),
+			zap.Int("used", pool.Used),
+			zap.Int("total", pool.Total))
+
+		event := &proto.PoolPressureInfo{
+			Threshold:  uint32(threshold),
+			Used:       uint64(pool.Used),
+			Total:      uint64(pool.Total),
+			ServerTime: proto.TimestampFromTime(now),
+		}
+		if err := manager.eventLog.Push(eventlog.ServerPoolPressure, event); err != nil {
+			zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_ServerPoolPressure)))
+		}
+	}
+}
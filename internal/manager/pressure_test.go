@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/settings"
+)
+
+func TestPoolPressure(t *testing.T) {
+	m := newTestManagerWithSettings(t, &settings.Config{PoolPressure: []int{50, 90}})
+	ip4am := m.ip4am.(*fakeIPAM)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.lock.Unlock()
+
+	// the fake pool holds 253 addresses
+	setUsed := func(n int) {
+		ip4am.mu.Lock()
+		ip4am.used = map[string]bool{}
+		for i := 0; i < n; i++ {
+			ip4am.used[strconv.Itoa(i)] = true
+		}
+		ip4am.mu.Unlock()
+
+		m.lock.Lock()
+		m.checkPoolPressure(time.Now())
+		m.lock.Unlock()
+	}
+	thresholds := func() []uint32 {
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		v := make([]uint32, 0, len(events.pressure))
+		for _, e := range events.pressure {
+			v = append(v, e.Threshold)
+		}
+		return v
+	}
+
+	setUsed(100)
+	assert.Empty(t, thresholds())
+
+	setUsed(130)
+	require.Equal(t, []uint32{50}, thresholds())
+	events.mu.Lock()
+	assert.EqualValues(t, 130, events.pressure[0].Used)
+	assert.EqualValues(t, 253, events.pressure[0].Total)
+	events.mu.Unlock()
+
+	// fired once per crossing, not on every check
+	setUsed(140)
+	assert.Equal(t, []uint32{50}, thresholds())
+
+	// several thresholds crossed at once
+	setUsed(240)
+	assert.Equal(t, []uint32{50, 90}, thresholds())
+
+	// dropped below the upper threshold only
+	setUsed(200)
+	setUsed(240)
+	assert.Equal(t, []uint32{50, 90, 90}, thresholds())
+
+	// dropped below both, fires again
+	setUsed(10)
+	setUsed(130)
+	assert.Equal(t, []uint32{50, 90, 90, 50}, thresholds())
+}
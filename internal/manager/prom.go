@@ -7,6 +7,8 @@ package manager
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vishvananda/netlink"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/proto"
 )
 
 var allPeersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -65,14 +67,79 @@ var wgInterfaceTxErrors = prometheus.NewGauge(prometheus.GaugeOpts{
 	Help:      "transmit errors by the WG interface",
 })
 
-func init() {
-	prometheus.MustRegister(
+var wgConfigHashGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tunnel",
+	Subsystem: "wireguard",
+	Name:      "config_hash",
+	Help:      "hash of the peers configuration by source (device or storage), the value is always 1",
+}, []string{"source", "hash"})
+
+var wgConfigDriftGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "tunnel",
+	Subsystem: "wireguard",
+	Name:      "config_drift",
+	Help:      "1 if the device configuration differs from the storage, 0 otherwise",
+})
+
+var desyncedPeersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tunnel",
+	Subsystem: "wireguard",
+	Name:      "desynced_peers",
+	Help:      "peers found desynced by the last drift check: missing on the device or unknown to the storage",
+}, []string{"kind"})
+
+var reconciledPeersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "tunnel",
+	Subsystem: "wireguard",
+	Name:      "reconciled_peers",
+	Help:      "peers programmed on the device by the last reconciliation, on start or the interface recreation",
+})
+
+var lastReconcileGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "tunnel",
+	Subsystem: "wireguard",
+	Name:      "last_reconcile_timestamp_seconds",
+	Help:      "unix time of the last drift check or reconciliation of the device with the storage",
+})
+
+var throttledEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "peers",
+	Name:      "throttled_events_total",
+	Help:      "number of peer events held back by the per-peer rate limit",
+}, []string{"type"})
+
+var unattributedBytesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tunnel",
+	Subsystem: "wireguard",
+	Name:      "unattributed_bytes",
+	Help:      "link traffic of the last collection not accounted to any peer, by direction",
+}, []string{"direction"})
+
+var lockTimeoutsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "manager",
+	Name:      "lock_timeouts_total",
+	Help:      "number of requests rejected as the manager was busy for too long",
+})
+
+// RegisterMetrics registers metrics of the manager,
+// must be called once on start.
+func RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(
 		allPeersGauge, peersWithHandshakesGauge,
 		wgInterfaceRxPackets, wgInterfaceRxBytes, wgInterfaceRxErrors,
 		wgInterfaceTxPackets, wgInterfaceTxBytes, wgInterfaceTxErrors,
+		wgConfigHashGauge, wgConfigDriftGauge, unattributedBytesGauge,
+		desyncedPeersGauge, reconciledPeersGauge, lastReconcileGauge,
+		throttledEventsCounter, lockTimeoutsCounter,
 	)
 }
 
+func eventTypeLabel(eventType eventlog.EventType) string {
+	return proto.EventType(eventType).String()
+}
+
 func updatePrometheusFromLinkStats(ls *netlink.LinkStatistics) {
 	wgInterfaceRxPackets.Set(float64(ls.RxPackets))
 	wgInterfaceRxBytes.Set(float64(ls.RxBytes))
@@ -82,3 +149,26 @@ func updatePrometheusFromLinkStats(ls *netlink.LinkStatistics) {
 	wgInterfaceTxBytes.Set(float64(ls.TxBytes))
 	wgInterfaceTxErrors.Set(float64(ls.TxErrors))
 }
+
+func updatePrometheusConfigHash(deviceHash string, storageHash string) {
+	wgConfigHashGauge.Reset()
+	wgConfigHashGauge.WithLabelValues("device", deviceHash).Set(1)
+	wgConfigHashGauge.WithLabelValues("storage", storageHash).Set(1)
+
+	if deviceHash != storageHash {
+		wgConfigDriftGauge.Set(1)
+	} else {
+		wgConfigDriftGauge.Set(0)
+	}
+}
+
+func updatePrometheusDesynced(missing int, unknown int) {
+	desyncedPeersGauge.WithLabelValues("missing").Set(float64(missing))
+	desyncedPeersGauge.WithLabelValues("unknown").Set(float64(unknown))
+	lastReconcileGauge.SetToCurrentTime()
+}
+
+func updatePrometheusReconciled(programmed int) {
+	reconciledPeersGauge.Set(float64(programmed))
+	lastReconcileGauge.SetToCurrentTime()
+}
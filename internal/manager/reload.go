@@ -0,0 +1,59 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/proto"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// ReloadSettings applies the reloaded settings captured on start,
+// the ones read on use are in effect once the runtime holds them.
+// The reload is reported by the event, the restart-required
+// changes included.
+func (manager *Manager) ReloadSettings(s *settings.Config, changes settings.ConfigChanges) error {
+	if err := manager.lockWithTimeout(context.Background(), s.GetLockTimeout()); err != nil {
+		return err
+	}
+	defer manager.lock.Unlock()
+
+	var err error
+	if changes.Changed("peer_statistics") {
+		var up, down int64
+		if s.PeerStatistics != nil {
+			up = s.PeerStatistics.MaxUpstreamTrafficChange.Value()
+			down = s.PeerStatistics.MaxDownstreamTrafficChange.Value()
+		}
+		err = multierr.Append(err, manager.peerTrafficSender.SetThresholds(up, down))
+		manager.peerTrafficSender.SetInterval(s.GetSentEventInterval().Value())
+		manager.eventThrottle.setInterval(s.GetPeerEventMinInterval().Value())
+		// read by the stats sync under the lock
+		manager.statsService.ResetInterval = s.GetSentEventInterval().Value()
+		manager.statsService.IdleTimeout = s.GetPeerIdleTimeout()
+	}
+	if changes.Changed("peer_statistics") || changes.Changed("interface_watchdog") || changes.Changed("stale_peers") {
+		manager.setBackgroundIntervals(newBackgroundIntervals(s))
+	}
+	if changes.Changed("wireguard.dns") {
+		err = multierr.Append(err, manager.ports.SetDNSServers(s.GetWireguardDNS()))
+	}
+
+	event := &proto.SettingsReloadInfo{
+		Applied:    changes.Applied,
+		Pending:    changes.Pending,
+		ServerTime: proto.TimestampFromTime(time.Now()),
+	}
+	if pushErr := manager.eventLog.Push(eventlog.SettingsReloaded, event); pushErr != nil {
+		// do not return an error here because it's not related to the method itself.
+		zap.L().Error("failed to push event", zap.Error(pushErr), zap.Uint32("type", uint32(proto.EventType_SettingsReloaded)))
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/human"
+)
+
+func TestReloadSettings(t *testing.T) {
+	m := newTestManagerWithSettings(t, &settings.Config{})
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.lock.Unlock()
+
+	reloaded := &settings.Config{
+		Wireguard: wireguard.Config{DNS: []string{"10.235.0.1"}, ListenPort: 3000},
+		PeerStatistics: &settings.PeerStatisticConfig{
+			UpdateStatisticsInterval:       human.MustParseInterval("30s"),
+			TrafficChangeSendEventInterval: human.MustParseInterval("1m"),
+			MaxUpstreamTrafficChange:       human.MustParseSize("1mb"),
+			PeerEventMinInterval:           human.MustParseInterval("5s"),
+			PeerIdleTimeout:                human.MustParseInterval("1h"),
+		},
+	}
+	changes := m.runtime.Settings.Diff(reloaded)
+	require.Equal(t, []string{"wireguard.dns", "peer_statistics"}, changes.Applied)
+	require.Equal(t, []string{"wireguard.server_port"}, changes.Pending)
+
+	// the manager reads settings under the lock
+	m.lock.Lock()
+	m.runtime.Settings = reloaded
+	m.lock.Unlock()
+	require.NoError(t, m.ReloadSettings(reloaded, changes))
+
+	up, down := m.TrafficThresholds()
+	assert.Equal(t, reloaded.PeerStatistics.MaxUpstreamTrafficChange.Value(), up)
+	assert.NotZero(t, up)
+	assert.Zero(t, down)
+	m.eventThrottle.lock.Lock()
+	assert.Equal(t, 5*time.Second, m.eventThrottle.interval)
+	m.eventThrottle.lock.Unlock()
+	m.lock.Lock()
+	assert.Equal(t, time.Hour, m.statsService.IdleTimeout)
+	assert.Equal(t, time.Minute, m.statsService.ResetInterval)
+	m.lock.Unlock()
+
+	ports := m.ports.(*fakePortFilter)
+	ports.mu.Lock()
+	assert.Equal(t, []string{"10.235.0.1"}, ports.dnsServers)
+	ports.mu.Unlock()
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	require.Len(t, events.reloads, 1)
+	assert.Equal(t, changes.Applied, events.reloads[0].Applied)
+	assert.Equal(t, changes.Pending, events.reloads[0].Pending)
+}
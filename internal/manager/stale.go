@@ -0,0 +1,85 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// removeStalePeers removes peers created long ago but never connected,
+// regardless of their expiration. Peers with any traffic or the handshake,
+// either stored or seen on the device, are never touched.
+// Must be called with the lock held.
+func (manager *Manager) removeStalePeers(now time.Time) {
+	maxAge, enabled := manager.runtime.Settings.GetStalePeersMaxAge()
+	if !enabled || manager.maintenance.Load() {
+		return
+	}
+
+	peers, err := manager.peers()
+	if err != nil {
+		return
+	}
+	wgPeers, err := manager.wireguard.GetPeers()
+	if err != nil {
+		// the device state is unknown, so is the peers traffic
+		return
+	}
+
+	removed := 0
+	for _, peer := range peers {
+		if !stalePeer(peer, wgPeers, now.Add(-maxAge)) {
+			continue
+		}
+		if _, ok := manager.suspended[peer.ID]; ok || peer.Expired() {
+			// left to the expiration handling
+			continue
+		}
+
+		if err := manager.removePeer(context.Background(), peer, eventlog.PeerNeverConnected, wgPeers); err != nil {
+			zap.L().Error("failed to remove the never connected peer", zap.Int64("id", peer.ID), zap.Error(err))
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		zap.L().Info("never connected peers removed", zap.Int("count", removed), zap.Duration("max_age", maxAge))
+	}
+}
+
+// stalePeer reports whether the peer created before the given time
+// has never connected: no handshake and no traffic at all.
+func stalePeer(peer *types.PeerInfo, wgPeers map[string]wgtypes.Peer, createdBefore time.Time) bool {
+	if peer.WireguardPublicKey == nil || peer.Ipv4 == nil {
+		// not activated shared peers are not on the device yet
+		return false
+	}
+	if peer.Created == nil || !peer.Created.Time.Before(createdBefore) {
+		return false
+	}
+	if peer.Activity != nil || peer.LastConnectedAt != nil {
+		return false
+	}
+	if (peer.ConnectCount != nil && *peer.ConnectCount > 0) ||
+		(peer.Upstream != nil && *peer.Upstream > 0) ||
+		(peer.Downstream != nil && *peer.Downstream > 0) {
+		return false
+	}
+
+	// the traffic since the last stats update
+	if wgPeer, ok := wgPeers[*peer.WireguardPublicKey]; ok {
+		if !wgPeer.LastHandshakeTime.IsZero() || wgPeer.ReceiveBytes > 0 || wgPeer.TransmitBytes > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/human"
+	"github.com/vpnhouse/common-lib-go/xtime"
+)
+
+func TestRemoveStalePeers(t *testing.T) {
+	s := &settings.Config{StalePeers: &settings.StalePeersConfig{
+		Enabled: true,
+		MaxAge:  human.MustParseInterval("1h"),
+	}}
+	m := newTestManagerWithSettings(t, s)
+	wg := m.wireguard.(*fakeWireguard)
+	events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+	m.lock.Lock()
+	m.eventLog = events
+	m.lock.Unlock()
+	// the startup sync must not see the peers seeded below
+	require.Eventually(t, func() bool { return !m.LastTick().IsZero() }, 5*time.Second, 10*time.Millisecond)
+
+	created := xtime.Time{Time: time.Now().Add(-2 * time.Hour)}
+	newPeer := func(modify func(peer *types.PeerInfo)) *types.PeerInfo {
+		peer := newTestPeer(t, "user", uuid.New(), time.Now().Add(24*time.Hour))
+		peer.Created = &created
+		peer.Updated = &created
+		modify(peer)
+		require.NoError(t, m.SetPeer(context.Background(), peer))
+		return peer
+	}
+
+	stale := newPeer(func(*types.PeerInfo) {})
+	young := newPeer(func(peer *types.PeerInfo) {
+		now := xtime.Now()
+		peer.Created = &now
+		peer.Updated = &now
+	})
+	handshake := newPeer(func(peer *types.PeerInfo) {
+		peer.Activity = &created
+	})
+	traffic := newPeer(func(peer *types.PeerInfo) {
+		upstream := int64(100)
+		peer.Upstream = &upstream
+	})
+	// connected after the last stats update, seen on the device only
+	onDevice := newPeer(func(*types.PeerInfo) {})
+	wg.mu.Lock()
+	wgPeer := wg.peers[*onDevice.WireguardPublicKey]
+	wgPeer.LastHandshakeTime = time.Now()
+	wg.peers[*onDevice.WireguardPublicKey] = wgPeer
+	wg.mu.Unlock()
+
+	events.mu.Lock()
+	events.events, events.peerTypes = nil, nil
+	events.mu.Unlock()
+
+	removeStale := func() {
+		m.lock.Lock()
+		m.removeStalePeers(time.Now())
+		m.lock.Unlock()
+	}
+
+	// disabled
+	s.StalePeers.Enabled = false
+	removeStale()
+	_, err := m.GetPeer(context.Background(), stale.ID)
+	require.NoError(t, err)
+
+	s.StalePeers.Enabled = true
+	removeStale()
+	_, err = m.GetPeer(context.Background(), stale.ID)
+	require.Error(t, err)
+	wgPeers, err := wg.GetPeers()
+	require.NoError(t, err)
+	assert.NotContains(t, wgPeers, *stale.WireguardPublicKey)
+
+	for _, peer := range []*types.PeerInfo{young, handshake, traffic, onDevice} {
+		_, err := m.GetPeer(context.Background(), peer.ID)
+		assert.NoError(t, err, "peer %d", peer.ID)
+	}
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	require.Len(t, events.events, 1)
+	assert.Equal(t, eventlog.PeerNeverConnected, events.peerTypes[0])
+	assert.Equal(t, stale.InstallationId.String(), events.events[0].InstallationID)
+}
@@ -22,6 +22,10 @@ type speedValue struct {
 	Downstream int64
 }
 
+// peerReconnectGap is the minimal handshake gap
+// considered as the peer reconnection.
+const peerReconnectGap = 5 * time.Minute
+
 const (
 	peerChangeNone          peerChangeType = 0
 	peerChangeFirstActivity peerChangeType = 1
@@ -75,6 +79,12 @@ type runtimePeerStat struct {
 	startUpstream      int64 // bytes
 	startDownstream    int64 // bytes
 
+	// seen is when the peer was first seen on the device
+	seen time.Time
+	// trafficAt is when the peer's counters increased last time,
+	// zero if the peer had no traffic since it was seen
+	trafficAt time.Time
+
 	lock     sync.Mutex
 	sessions []*runtimePeerSession
 }
@@ -209,14 +219,40 @@ func (s *runtimePeerStat) Update(now time.Time, upstream int64, downstream int64
 	}
 }
 
+// idleSince returns the start of the peer's idle time: the last traffic,
+// or the time the peer was seen if there was no traffic at all.
+func (s *runtimePeerStat) idleSince() (since time.Time, hadTraffic bool) {
+	if s.trafficAt.IsZero() {
+		return s.seen, false
+	}
+	return s.trafficAt, true
+}
+
 func (s *runtimePeerStat) UpdateSpeedNoTraffic() {
 	s.UpstreamSpeed = s.upstreamSpeedAvg.Push(0)
 	s.DownstreamSpeed = s.downstreamSpeedAvg.Push(0)
 }
 
+// idlePeer is the peer without traffic for the idle timeout.
+type idlePeer struct {
+	Peer *types.PeerInfo
+	// HadTraffic is false if the peer never had traffic
+	// since it was put on the device
+	HadTraffic bool
+}
+
+// reason returns the idle reason reported in the event.
+func (p idlePeer) reason() string {
+	if p.HadTraffic {
+		return "idle"
+	}
+	return "no_traffic"
+}
+
 type updatePeerStatsResults struct {
 	UpdatedPeers           []*types.PeerInfo
 	ExpiredPeers           []*types.PeerInfo
+	IdlePeers              []idlePeer
 	FirstConnectedPeers    []*types.PeerInfo
 	TrafficUpdatedPeers    []*types.PeerInfo
 	NumPeersWithHadshakes  int
@@ -227,7 +263,10 @@ type updatePeerStatsResults struct {
 
 type runtimePeerStatsService struct {
 	ResetInterval time.Duration
-	Geo           *geoip.Instance
+	// IdleTimeout is the time without traffic after which
+	// the peer is reported idle, zero disables it
+	IdleTimeout time.Duration
+	Geo         *geoip.Instance
 
 	lock sync.Mutex
 	// {peer public key} -> peerStats
@@ -245,6 +284,18 @@ func (s *runtimePeerStatsService) GetRuntimePeerStat(peer *types.PeerInfo) *runt
 	return s.stats[*peer.WireguardPublicKey]
 }
 
+// GetSpeed returns the peer speed read under the lock,
+// zero if the peer has no stats yet.
+func (s *runtimePeerStatsService) GetSpeed(peer *types.PeerInfo) (int64, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stat, ok := s.stats[*peer.WireguardPublicKey]
+	if !ok {
+		return 0, 0
+	}
+	return stat.UpstreamSpeed, stat.DownstreamSpeed
+}
+
 func (s *runtimePeerStatsService) GetSessions(peer *types.PeerInfo) []Session {
 	stats := s.GetRuntimePeerStat(peer)
 	// Stats can gone on peer deletion that's detected on UpdatePeersStats
@@ -271,13 +322,8 @@ func (s *runtimePeerStatsService) UpdatePeersStats(now time.Time, peers []*types
 
 	for _, peer := range peers {
 		if peer.WireguardPublicKey == nil {
-			// We should never be here so it's added to be in safe
-			zap.L().Error(
-				"got a peer without the public key",
-				zap.Any("id", peer.ID),
-				zap.Any("user_id", peer.UserId),
-				zap.Any("install_id", peer.InstallationId),
-			)
+			// the shared peer waiting for the activation,
+			// the storage rejects keyless peers otherwise
 			continue
 		}
 
@@ -285,10 +331,10 @@ func (s *runtimePeerStatsService) UpdatePeersStats(now time.Time, peers []*types
 		if !ok {
 			zap.L().Error(
 				"peer is presented in the manager's storage but not configured on the interface",
-				zap.String("pub_key", *peer.WireguardPublicKey),
+				types.LogString("pub_key", peer.WireguardPublicKey),
 				zap.Any("id", peer.ID),
-				zap.Any("user_id", peer.UserId),
-				zap.Any("install_id", peer.InstallationId),
+				types.LogString("user_id", peer.UserId),
+				types.LogUUID("install_id", peer.InstallationId),
 			)
 			// Remove peer stats in case it's gone
 			delete(s.stats, *peer.WireguardPublicKey)
@@ -325,6 +371,11 @@ func (s *runtimePeerStatsService) UpdatePeersStats(now time.Time, peers []*types
 		// Peer is expired - add it to the output list for later processing
 		if peer.Expires != nil && peer.Expires.Time.Before(now) {
 			results.ExpiredPeers = append(results.ExpiredPeers, peer)
+		} else if s.IdleTimeout > 0 {
+			since, hadTraffic := s.stats[*peer.WireguardPublicKey].idleSince()
+			if now.Sub(since) >= s.IdleTimeout {
+				results.IdlePeers = append(results.IdlePeers, idlePeer{Peer: peer, HadTraffic: hadTraffic})
+			}
 		}
 	}
 
@@ -343,6 +394,31 @@ func (s *runtimePeerStatsService) UpdatePeersStats(now time.Time, peers []*types
 	return results
 }
 
+// FlushPeerStats accounts the traffic of the removed peer since the last
+// update and forgets the peer. Returns the accounted traffic.
+func (s *runtimePeerStatsService) FlushPeerStats(now time.Time, peer *types.PeerInfo, wgPeer wgtypes.Peer) (int64, int64) {
+	s.once.Do(s.init)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	upstream, downstream := *peer.Upstream, *peer.Downstream
+	s.updateRuntimePeerStatFromWireguardPeer(now, wgPeer, peer)
+	delete(s.stats, *peer.WireguardPublicKey)
+	// the counters reset by re-adding the peer to the device
+	// give no traffic rather than the negative one
+	return max(*peer.Upstream-upstream, 0), max(*peer.Downstream-downstream, 0)
+}
+
+// ForgetPeer drops the runtime stats of the peer removed from the device.
+func (s *runtimePeerStatsService) ForgetPeer(peer *types.PeerInfo) {
+	s.once.Do(s.init)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.stats, *peer.WireguardPublicKey)
+}
+
 func (s *runtimePeerStatsService) updateRuntimePeerStatFromWireguardPeer(now time.Time, wgPeer wgtypes.Peer, peer *types.PeerInfo) peerChangeSummary {
 	var changeSum peerChangeSummary
 
@@ -352,6 +428,9 @@ func (s *runtimePeerStatsService) updateRuntimePeerStatFromWireguardPeer(now tim
 
 	if !wgPeer.LastHandshakeTime.IsZero() {
 		if peer.Activity == nil || peer.Activity.Time.Unix() < wgPeer.LastHandshakeTime.Unix() {
+			if isPeerReconnect(peer, wgPeer.LastHandshakeTime) {
+				countPeerConnection(peer, wgPeer.LastHandshakeTime)
+			}
 			if peer.Activity == nil {
 				changeSum.Set(peerChangeFirstActivity)
 			}
@@ -365,7 +444,7 @@ func (s *runtimePeerStatsService) updateRuntimePeerStatFromWireguardPeer(now tim
 		var err error
 		country, err = s.Geo.GetCountry(wgPeer.Endpoint.IP)
 		if err != nil {
-			zap.L().Error("failed to detect country", zap.Stringp("peer", peer.Label))
+			zap.L().Error("failed to detect country", types.LogString("peer", peer.Label))
 		}
 		country = strings.ToLower(country)
 	}
@@ -378,6 +457,7 @@ func (s *runtimePeerStatsService) updateRuntimePeerStatFromWireguardPeer(now tim
 		}
 		// Upstream and Upstream never be nil
 		stat = newRuntimePeerStat(updated, *peer.Upstream, *peer.Downstream, country)
+		stat.seen = now
 		s.stats[*peer.WireguardPublicKey] = stat
 	}
 
@@ -396,7 +476,7 @@ func (s *runtimePeerStatsService) updateRuntimePeerStatFromWireguardPeer(now tim
 	if wgPeer.TransmitBytes-stat.Downstream > 0 || wgPeer.ReceiveBytes-stat.Upstream > 0 {
 		zap.L().Debug(
 			"update",
-			zap.Stringp("label", peer.Label),
+			types.LogString("label", peer.Label),
 			zap.Int64("wg_upstream", wgPeer.ReceiveBytes),
 			zap.Int64("stats_upstream", stat.Upstream),
 			zap.Int64("peer_upstream", *peer.Upstream),
@@ -409,6 +489,7 @@ func (s *runtimePeerStatsService) updateRuntimePeerStatFromWireguardPeer(now tim
 	}
 
 	if changeSum.Has(peerChangeTraffic) {
+		stat.trafficAt = now
 		stat.Update(now, wgPeer.ReceiveBytes, wgPeer.TransmitBytes, country, s.ResetInterval)
 	} else {
 		stat.UpdateSpeedNoTraffic()
@@ -416,3 +497,28 @@ func (s *runtimePeerStatsService) updateRuntimePeerStatFromWireguardPeer(now tim
 
 	return changeSum
 }
+
+// isPeerReconnect reports whether the new handshake starts a new peer connection:
+// it is the first handshake or the one after the gap, which was not counted yet
+// by the connect call.
+func isPeerReconnect(peer *types.PeerInfo, handshake time.Time) bool {
+	if peer.Activity == nil {
+		return peer.LastConnectedAt == nil
+	}
+	if handshake.Sub(peer.Activity.Time) <= peerReconnectGap {
+		return false
+	}
+	return peer.LastConnectedAt == nil || !peer.LastConnectedAt.Time.After(peer.Activity.Time)
+}
+
+// countPeerConnection increments the peer connections counter
+// and stamps the connection time.
+func countPeerConnection(peer *types.PeerInfo, connected time.Time) {
+	var count int64
+	if peer.ConnectCount != nil {
+		count = *peer.ConnectCount
+	}
+	count++
+	peer.ConnectCount = &count
+	peer.LastConnectedAt = &xtime.Time{Time: connected}
+}
@@ -5,6 +5,9 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/xtime"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func TestPeerSessions(t *testing.T) {
@@ -24,3 +27,83 @@ func TestPeerSessions(t *testing.T) {
 	stat.Update(ts, 3, 3, "", updateInterval)
 	require.Equal(t, 2, len(stat.sessions))
 }
+
+func TestIsPeerReconnect(t *testing.T) {
+	ts := time.Date(2023, 03, 01, 10, 0, 0, 0, time.UTC)
+	peer := &types.PeerInfo{}
+
+	// the first handshake of the peer never connected before
+	require.True(t, isPeerReconnect(peer, ts))
+	countPeerConnection(peer, ts)
+	require.Equal(t, int64(1), *peer.ConnectCount)
+	peer.Activity = &xtime.Time{Time: ts}
+
+	// regular re-handshake
+	require.False(t, isPeerReconnect(peer, ts.Add(2*time.Minute)))
+
+	// handshake after the gap
+	ts = ts.Add(time.Hour)
+	require.True(t, isPeerReconnect(peer, ts))
+	countPeerConnection(peer, ts)
+	require.Equal(t, int64(2), *peer.ConnectCount)
+	peer.Activity = &xtime.Time{Time: ts}
+
+	// connect call is followed by the handshake after the gap
+	ts = ts.Add(time.Hour)
+	countPeerConnection(peer, ts)
+	require.False(t, isPeerReconnect(peer, ts.Add(time.Second)))
+	require.Equal(t, int64(3), *peer.ConnectCount)
+}
+
+func TestIdlePeers(t *testing.T) {
+	ts := time.Date(2023, 03, 01, 10, 0, 0, 0, time.UTC)
+	s := &runtimePeerStatsService{ResetInterval: 5 * time.Minute, IdleTimeout: 10 * time.Minute}
+
+	newPeer := func() (*types.PeerInfo, wgtypes.Peer) {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		pubKey := key.PublicKey().String()
+		var up, down int64
+		return &types.PeerInfo{
+			WireguardInfo: types.WireguardInfo{WireguardPublicKey: &pubKey},
+			Upstream:      &up,
+			Downstream:    &down,
+		}, wgtypes.Peer{PublicKey: key.PublicKey()}
+	}
+	active, activeWg := newPeer()
+	silent, silentWg := newPeer()
+	peers := []*types.PeerInfo{active, silent}
+	update := func(now time.Time) []idlePeer {
+		wgPeers := map[string]wgtypes.Peer{
+			*active.WireguardPublicKey: activeWg,
+			*silent.WireguardPublicKey: silentWg,
+		}
+		return s.UpdatePeersStats(now, peers, wgPeers).IdlePeers
+	}
+
+	require.Empty(t, update(ts))
+
+	ts = ts.Add(5 * time.Minute)
+	activeWg.ReceiveBytes = 100
+	require.Empty(t, update(ts))
+
+	// the silent peer never had traffic since it was seen
+	ts = ts.Add(5 * time.Minute)
+	idle := update(ts)
+	require.Len(t, idle, 1)
+	require.Equal(t, silent, idle[0].Peer)
+	require.False(t, idle[0].HadTraffic)
+	require.Equal(t, "no_traffic", idle[0].reason())
+
+	// the active peer went idle after the traffic
+	ts = ts.Add(5 * time.Minute)
+	idle = update(ts)
+	require.Len(t, idle, 2)
+	require.Equal(t, active, idle[0].Peer)
+	require.True(t, idle[0].HadTraffic)
+	require.Equal(t, "idle", idle[0].reason())
+
+	// disabled
+	s.IdleTimeout = 0
+	require.Empty(t, update(ts.Add(time.Hour)))
+}
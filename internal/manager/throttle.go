@@ -0,0 +1,91 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+)
+
+// maxThrottledEvents is the number of tracked (peer, event type) pairs
+// above which the stale ones are evicted.
+const maxThrottledEvents = 4096
+
+type throttleKey struct {
+	peerID    int64
+	eventType eventlog.EventType
+}
+
+// eventThrottle limits the rate of events of the same type
+// emitted for a single peer, so the flapping peer can not
+// dominate the event stream.
+type eventThrottle struct {
+	// lock guards interval and last
+	lock     sync.Mutex
+	interval time.Duration
+	// last holds the time of the last emitted event
+	last map[throttleKey]time.Time
+}
+
+func newEventThrottle(interval time.Duration) *eventThrottle {
+	return &eventThrottle{
+		interval: interval,
+		last:     make(map[throttleKey]time.Time),
+	}
+}
+
+// allow reports whether the event of the given type may be emitted
+// for the peer now, the emission is recorded if so.
+func (t *eventThrottle) allow(peerID int64, eventType eventlog.EventType, now time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.interval <= 0 {
+		return true
+	}
+
+	key := throttleKey{peerID: peerID, eventType: eventType}
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.interval {
+		throttledEventsCounter.WithLabelValues(eventTypeLabel(eventType)).Inc()
+		return false
+	}
+
+	if len(t.last) >= maxThrottledEvents {
+		t.evictStale(now)
+	}
+	t.last[key] = now
+	return true
+}
+
+// evictStale drops entries which no longer throttle anything.
+func (t *eventThrottle) evictStale(now time.Time) {
+	for key, last := range t.last {
+		if now.Sub(last) >= t.interval {
+			delete(t.last, key)
+		}
+	}
+}
+
+// setInterval changes the min interval between events,
+// the ones already recorded are checked against the new value.
+func (t *eventThrottle) setInterval(interval time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.interval = interval
+}
+
+// forget drops the state of the removed peer.
+func (t *eventThrottle) forget(peerID int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key := range t.last {
+		if key.peerID == peerID {
+			delete(t.last, key)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+)
+
+func TestEventThrottle(t *testing.T) {
+	th := newEventThrottle(30 * time.Second)
+	now := time.Now()
+
+	assert.True(t, th.allow(1, eventlog.PeerTraffic, now))
+	assert.False(t, th.allow(1, eventlog.PeerTraffic, now.Add(10*time.Second)))
+	// other types and peers are not affected
+	assert.True(t, th.allow(1, eventlog.PeerFirstConnect, now.Add(10*time.Second)))
+	assert.True(t, th.allow(2, eventlog.PeerTraffic, now.Add(10*time.Second)))
+	// the window is counted from the last emitted event
+	assert.True(t, th.allow(1, eventlog.PeerTraffic, now.Add(30*time.Second)))
+	assert.False(t, th.allow(1, eventlog.PeerTraffic, now.Add(50*time.Second)))
+
+	th.forget(1)
+	assert.Len(t, th.last, 1)
+	assert.True(t, th.allow(1, eventlog.PeerTraffic, now.Add(50*time.Second)))
+}
+
+func TestEventThrottleEvictsStale(t *testing.T) {
+	th := newEventThrottle(time.Second)
+	now := time.Now()
+
+	for i := 0; i < maxThrottledEvents; i++ {
+		th.allow(int64(i), eventlog.PeerTraffic, now)
+	}
+	assert.Len(t, th.last, maxThrottledEvents)
+
+	assert.True(t, th.allow(-1, eventlog.PeerTraffic, now.Add(time.Minute)))
+	assert.Len(t, th.last, 1)
+}
+
+func TestEventThrottleDisabled(t *testing.T) {
+	th := newEventThrottle(0)
+	now := time.Now()
+	assert.True(t, th.allow(1, eventlog.PeerTraffic, now))
+	assert.True(t, th.allow(1, eventlog.PeerTraffic, now))
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/tunnel/proto"
+	"go.uber.org/zap"
+)
+
+// checkInterface confirms the wireguard interface exists. The gone
+// interface is reported once, it's recreated with all active peers
+// programmed on it again if configured.
+func (manager *Manager) checkInterface(now time.Time) {
+	_, err := manager.wireguard.GetLinkStatistic()
+	if err == nil {
+		if manager.interfaceDown.Swap(false) {
+			zap.L().Info("wireguard interface is back")
+		}
+		return
+	}
+
+	if !manager.interfaceDown.Swap(true) {
+		zap.L().Error("wireguard interface is gone, peers are unreachable", zap.Error(err))
+		event := &proto.InterfaceInfo{
+			Name:       manager.runtime.Settings.GetWireguardInterface(),
+			ServerTime: proto.TimestampFromTime(now),
+		}
+		if err := manager.eventLog.Push(eventlog.ServerInterfaceDown, event); err != nil {
+			zap.L().Error("failed to push event", zap.Error(err), zap.Uint32("type", uint32(proto.EventType_ServerInterfaceDown)))
+		}
+	}
+
+	if !manager.runtime.Settings.GetInterfaceRecreate() {
+		return
+	}
+
+	if err := manager.wireguard.Recreate(); err != nil {
+		zap.L().Error("failed to recreate wireguard interface", zap.Error(err))
+		return
+	}
+	manager.reprogramPeers()
+	manager.interfaceDown.Store(false)
+}
+
+// reprogramPeers programs all active peers on the device,
+// addresses and counters are kept as is. Idle peers stay
+// off the device until they connect again. It runs under the lock,
+// so the restore rate is not applied.
+func (manager *Manager) reprogramPeers() {
+	peers, err := manager.peers()
+	if err != nil {
+		zap.L().Error("failed to list peers to program", zap.Error(err))
+		return
+	}
+
+	program := make([]*types.PeerInfo, 0, len(peers))
+	for _, peer := range peers {
+		if _, ok := manager.suspended[peer.ID]; ok || peer.Expired() {
+			continue
+		}
+		if _, ok := manager.idle[peer.ID]; ok {
+			continue
+		}
+		program = append(program, peer)
+	}
+	manager.programPeers(program, 0)
+}
@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/eventlog"
+	"github.com/vpnhouse/tunnel/internal/settings"
+)
+
+func TestCheckInterface(t *testing.T) {
+	for _, recreate := range []bool{false, true} {
+		m := newTestManagerWithSettings(t, &settings.Config{
+			InterfaceWatchdog: &settings.InterfaceWatchdogConfig{Recreate: recreate},
+		})
+		wg := m.wireguard.(*fakeWireguard)
+		events := &recordingEventLog{EventManager: eventlog.NewDummy()}
+		m.lock.Lock()
+		m.eventLog = events
+		m.lock.Unlock()
+
+		active := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+		require.NoError(t, m.SetPeer(context.Background(), active))
+		suspended := newTestPeer(t, "user", uuid.New(), time.Now().Add(time.Hour))
+		require.NoError(t, m.SetPeer(context.Background(), suspended))
+		m.lock.Lock()
+		require.NoError(t, m.suspendPeer(suspended))
+		m.lock.Unlock()
+
+		wg.remove()
+		for i := 0; i < 2; i++ {
+			m.lock.Lock()
+			m.checkInterface(time.Now())
+			m.lock.Unlock()
+		}
+
+		// the gone interface is reported once
+		events.mu.Lock()
+		require.Len(t, events.interfaces, 1)
+		events.mu.Unlock()
+
+		wgPeers, err := wg.GetPeers()
+		require.NoError(t, err)
+		if !recreate {
+			assert.Zero(t, wg.recreated)
+			assert.Empty(t, wgPeers)
+			assert.True(t, m.interfaceDown.Load())
+			continue
+		}
+
+		assert.Equal(t, 1, wg.recreated)
+		assert.False(t, m.interfaceDown.Load())
+		require.Len(t, wgPeers, 1)
+		assert.Contains(t, wgPeers, *active.WireguardPublicKey)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/vpnhouse/tunnel/internal/extstat"
 	"github.com/vpnhouse/tunnel/internal/settings"
 	"github.com/vpnhouse/common-lib-go/control"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
@@ -20,6 +21,12 @@ type Flags struct {
 
 type ServicesInitFunc func(runtime *TunnelRuntime) error
 
+// SettingsReloader is implemented by services holding
+// the hot-reloadable settings they read on start.
+type SettingsReloader interface {
+	ReloadSettings(s *settings.Config, changes settings.ConfigChanges) error
+}
+
 type TunnelRuntime struct {
 	SetLogLevel control.ChangeLevelFunc
 	Events      *control.EventManager
@@ -37,6 +44,13 @@ type TunnelRuntime struct {
 
 	// must point to the http (NOT httpS) router instance
 	HttpRouter chi.Router
+
+	// reloadMu guards reloaders and the pending settings
+	reloadMu  sync.Mutex
+	reloaders []SettingsReloader
+	// pending are the reloaded settings with restart-required
+	// changes, they are applied to Settings on restart
+	pending *settings.Config
 }
 
 func (runtime *TunnelRuntime) ReplaceExternalStatsService(svc *extstat.Service) {
@@ -78,11 +92,61 @@ func (runtime *TunnelRuntime) ProcessEvents(event control.Event) {
 	}
 }
 
+// ValidateSettings checks the whole configuration,
+// all issues found are returned at once.
+func (runtime *TunnelRuntime) ValidateSettings() []settings.ConfigIssue {
+	return runtime.Settings.Issues()
+}
+
+// RegisterReloader adds the service to be notified of the settings reload,
+// reloaders are dropped along with services on stop.
+func (runtime *TunnelRuntime) RegisterReloader(r SettingsReloader) {
+	runtime.reloadMu.Lock()
+	defer runtime.reloadMu.Unlock()
+
+	runtime.reloaders = append(runtime.reloaders, r)
+}
+
+// ReloadSettings applies hot-reloadable changes of the given settings
+// to the running ones and notifies the running services. The rest raise
+// the restart-required flag and take effect on restart, new settings
+// are kept until then.
+func (runtime *TunnelRuntime) ReloadSettings(new *settings.Config) (settings.ConfigChanges, error) {
+	runtime.reloadMu.Lock()
+	defer runtime.reloadMu.Unlock()
+
+	changes := runtime.Settings.Apply(new)
+	if changes.RestartRequired() {
+		runtime.pending = new
+		runtime.Flags.RestartRequired = true
+	} else {
+		// the former pending changes are reverted, if any
+		runtime.pending = nil
+	}
+	if changes.Empty() {
+		return changes, nil
+	}
+	zap.L().Info("settings reloaded", zap.Strings("applied", changes.Applied), zap.Strings("pending", changes.Pending))
+
+	var err error
+	if changes.Changed("log_level") && runtime.SetLogLevel != nil {
+		err = multierr.Append(err, runtime.SetLogLevel(new.LogLevel))
+	}
+	for _, r := range runtime.reloaders {
+		err = multierr.Append(err, r.ReloadSettings(runtime.Settings, changes))
+	}
+	return changes, err
+}
+
 func (runtime *TunnelRuntime) Start() error {
 	return runtime.starter(runtime)
 }
 
 func (runtime *TunnelRuntime) Stop() error {
+	runtime.reloadMu.Lock()
+	runtime.reloaders = nil
+	runtime.reloadMu.Unlock()
+
 	return runtime.Services.Shutdown()
 }
 
@@ -96,6 +160,17 @@ func (runtime *TunnelRuntime) Restart() error {
 	// Clear restart-required flag
 	runtime.Flags.RestartRequired = false
 
+	// Services are stopped, nothing reads the settings
+	runtime.reloadMu.Lock()
+	pending := runtime.pending
+	runtime.pending = nil
+	runtime.reloadMu.Unlock()
+	if pending != nil {
+		if err := runtime.Settings.ApplyPending(pending); err != nil {
+			return err
+		}
+	}
+
 	// Start new services
 	err = runtime.Start()
 	if err != nil {
@@ -0,0 +1,87 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/settings"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/control"
+	"github.com/vpnhouse/common-lib-go/human"
+)
+
+type recordingReloader struct {
+	changes []settings.ConfigChanges
+}
+
+func (r *recordingReloader) ReloadSettings(s *settings.Config, changes settings.ConfigChanges) error {
+	r.changes = append(r.changes, changes)
+	return nil
+}
+
+func TestReloadSettings(t *testing.T) {
+	config := func() *settings.Config {
+		return &settings.Config{
+			LogLevel:  "info",
+			Wireguard: wireguard.Config{Subnet: "10.235.0.0/16", ListenPort: 3000},
+		}
+	}
+
+	var level string
+	reloader := &recordingReloader{}
+	running := config()
+	rt := &TunnelRuntime{
+		Settings:    running,
+		SetLogLevel: func(l string) error { level = l; return nil },
+		Services:    control.NewServiceMap(),
+		starter:     func(*TunnelRuntime) error { return nil },
+	}
+	rt.RegisterReloader(reloader)
+
+	// nothing changed
+	changes, err := rt.ReloadSettings(config())
+	require.NoError(t, err)
+	require.True(t, changes.Empty())
+	require.Empty(t, reloader.changes)
+
+	hot := config()
+	hot.LogLevel = "debug"
+	hot.LockTimeout = human.MustParseInterval("5s")
+	changes, err = rt.ReloadSettings(hot)
+	require.NoError(t, err)
+	// the running settings are updated in place
+	require.Same(t, running, rt.Settings)
+	require.Equal(t, "debug", rt.Settings.LogLevel)
+	require.Equal(t, 5*time.Second, rt.Settings.GetLockTimeout())
+	require.Equal(t, "debug", level)
+	require.False(t, rt.Flags.RestartRequired)
+	require.Len(t, reloader.changes, 1)
+	require.Equal(t, []string{"log_level", "lock_timeout"}, changes.Applied)
+	require.Equal(t, changes, reloader.changes[0])
+
+	restart := config()
+	restart.LogLevel = "debug"
+	restart.Wireguard.Subnet = "10.236.0.0/16"
+	restart.Wireguard.ListenPort = 3001
+	changes, err = rt.ReloadSettings(restart)
+	require.NoError(t, err)
+	require.True(t, rt.Flags.RestartRequired)
+	require.Len(t, reloader.changes, 2)
+	require.Equal(t, []string{"lock_timeout"}, changes.Applied)
+	require.Equal(t, []string{"wireguard.subnet", "wireguard.server_port"}, changes.Pending)
+	// restart-required settings are kept until the restart
+	require.Equal(t, "10.235.0.0/16", string(rt.Settings.Wireguard.Subnet))
+	require.Equal(t, 3000, rt.Settings.Wireguard.ListenPort)
+	require.Equal(t, time.Duration(0), rt.Settings.LockTimeout.Value())
+
+	require.NoError(t, rt.Restart())
+	require.Same(t, running, rt.Settings)
+	require.False(t, rt.Flags.RestartRequired)
+	require.Equal(t, "10.236.0.0/16", string(rt.Settings.Wireguard.Subnet))
+	require.Equal(t, 3001, rt.Settings.Wireguard.ListenPort)
+}
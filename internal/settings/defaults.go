@@ -5,4 +5,21 @@ const (
 	DefaultTrafficChangeSendEventInterval = "5m"
 	DefaultMaxUpstreamTrafficChange       = "50Mb"
 	DefaultMaxDownstreamTrafficChange     = "50Mb"
+	DefaultPeerEventMinInterval           = "30s"
+	DefaultAdminRequestTimeout            = "10s"
+	DefaultAdminListRequestTimeout        = "60s"
+	DefaultAdminCompressionMinSize        = "1Kb"
+	DefaultAdminSocketMode                = 0600
+	DefaultRestoreConcurrency             = 1
+	DefaultExpiryAnomalyFraction          = 0.5
+	DefaultPoolPressureWarning            = 80
+	DefaultPoolPressureCritical           = 95
+	DefaultInterfaceCheckInterval         = "10s"
+	DefaultLockTimeout                    = "30s"
+	DefaultStalePeersMaxAge               = "168h"
+	DefaultStalePeersInterval             = "1h"
+	DefaultPeerPresenceHandshakeTimeout   = "3m"
+	DefaultPeerPresenceMinStateDuration   = "30s"
+	DefaultFederationKeysMaxBodySize      = "1Mb"
+	DefaultFederationKeysMaxKeys          = 1000
 )
@@ -0,0 +1,101 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package settings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"gopkg.in/yaml.v3"
+)
+
+const redactedValue = "[redacted]"
+
+// secretSettings are never shown as is, at any nesting level.
+var secretSettings = map[string]bool{
+	"password_hash":     true,
+	"token":             true,
+	"tunnel_key":        true,
+	"persistent_tokens": true,
+	"dsn":               true,
+}
+
+// keySettings are private keys shown by their fingerprints.
+var keySettings = map[string]bool{
+	"private_key": true,
+}
+
+// Effective returns the configuration the server is running with
+// keyed like the config file: defaults of the top-level options
+// are filled in, secrets are redacted and private keys are replaced
+// by their fingerprints.
+func (s *Config) Effective() (map[string]interface{}, error) {
+	s = s.snapshot()
+	bs, err := yaml.Marshal(s)
+	if err != nil {
+		return nil, xerror.EInternalError("failed to marshal config", err)
+	}
+	effective := map[string]interface{}{}
+	if err := yaml.Unmarshal(bs, &effective); err != nil {
+		return nil, xerror.EInternalError("failed to unmarshal config", err)
+	}
+
+	for name, value := range map[string]interface{}{
+		"auto_wipe_expired":        s.GetAutoWipeExpired(),
+		"restore_concurrency":      s.GetRestoreConcurrency(),
+		"expiry_anomaly_fraction":  s.GetExpiryAnomalyFraction(),
+		"pool_pressure_thresholds": s.GetPoolPressureThresholds(),
+		"check_allowed_ips":        s.GetCheckAllowedIPs(),
+		"connect_guard":            s.GetConnectGuard(),
+		"lock_timeout":             s.GetLockTimeout().String(),
+	} {
+		effective[name] = value
+	}
+
+	redact(effective)
+	return effective, nil
+}
+
+// redact replaces secrets of the yaml tree in place.
+func redact(node interface{}) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for name, value := range v {
+			switch {
+			case isEmpty(value):
+			case secretSettings[name]:
+				v[name] = redactedValue
+			case keySettings[name]:
+				v[name] = fingerprint(value)
+			default:
+				redact(value)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			redact(value)
+		}
+	}
+}
+
+func isEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// fingerprint identifies the key without revealing it.
+func fingerprint(value interface{}) string {
+	s, _ := value.(string)
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package settings
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/common-lib-go/sentry"
+	"github.com/vpnhouse/tunnel/internal/grpc"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+)
+
+func TestConfig_Effective(t *testing.T) {
+	c := &Config{
+		LogLevel:  "info",
+		Wireguard: wireguard.Config{Subnet: "10.235.0.0/16", PrivateKey: "4BsYp8MzCvIgIwQrHIj9LW7Njrq4QoM1BR7HNC/1j1k="},
+		AdminAPI:  &AdminAPIConfig{PasswordHash: "$pbkdf2-sha256$hash", TokenLifetime: 1800},
+		GRPC:      &grpc.Config{Addr: ":8089", TunnelKey: "tunnel-secret"},
+		Sentry:    &sentry.Config{DSN: "https://key@sentry.example.com/1"},
+		IPPool:    &ipalloc.Config{Backend: ipalloc.BackendExternal, External: &ipalloc.ExternalConfig{URL: "https://ipam.example.com", Token: "ipam-secret"}},
+	}
+
+	effective, err := c.Effective()
+	require.NoError(t, err)
+
+	// the JSON response never has secrets
+	bs, err := json.Marshal(effective)
+	require.NoError(t, err)
+	for _, secret := range []string{"4BsYp8MzCvIgIwQrHIj9LW7Njrq4QoM1BR7HNC", "pbkdf2", "tunnel-secret", "key@sentry", "ipam-secret"} {
+		assert.NotContains(t, string(bs), secret)
+	}
+
+	wg := effective["wireguard"].(map[string]interface{})
+	assert.Regexp(t, "^sha256:[0-9a-f]{16}$", wg["private_key"])
+	assert.Equal(t, "10.235.0.0/16", wg["subnet"])
+	admin := effective["admin_api"].(map[string]interface{})
+	assert.Equal(t, redactedValue, admin["password_hash"])
+	assert.Equal(t, 1800, admin["token_lifetime"])
+	external := effective["ip_pool"].(map[string]interface{})["external"].(map[string]interface{})
+	assert.Equal(t, redactedValue, external["token"])
+	assert.Equal(t, "https://ipam.example.com", external["url"])
+
+	// defaults are filled in
+	assert.Equal(t, "info", effective["log_level"])
+	assert.Equal(t, true, effective["auto_wipe_expired"])
+	assert.Equal(t, DefaultRestoreConcurrency, effective["restore_concurrency"])
+	assert.Equal(t, DefaultLockTimeout, effective["lock_timeout"])
+
+	// the config itself is intact
+	assert.Equal(t, "tunnel-secret", c.GRPC.TunnelKey)
+}
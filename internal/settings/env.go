@@ -0,0 +1,132 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package settings
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the names of environment variables overriding
+// settings of the config file, e.g. VPNHOUSE_TUNNEL_LOG_LEVEL
+// for log_level and VPNHOUSE_TUNNEL_PEER_STATISTICS__PEER_IDLE_TIMEOUT
+// for peer_statistics.peer_idle_timeout.
+const envPrefix = "VPNHOUSE_TUNNEL_"
+
+// envSeparator separates the nested setting names
+// in the environment variable name.
+const envSeparator = "__"
+
+var yamlUnmarshaler = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// applyEnv overrides settings with the values of environment variables,
+// parsed the same way as values of the config file.
+// It returns the number of settings overridden.
+func (s *Config) applyEnv(environ []string) (int, error) {
+	env := map[string]string{}
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(name, envPrefix) {
+			env[strings.TrimPrefix(name, envPrefix)] = value
+		}
+	}
+	if len(env) == 0 {
+		return 0, nil
+	}
+
+	applied, err := applyEnvFields(reflect.ValueOf(s).Elem(), "", "", env)
+	if err != nil {
+		return applied, err
+	}
+	if len(env) > 0 {
+		// the applied ones are deleted, the rest name no setting
+		unknown := make([]string, 0, len(env))
+		for name := range env {
+			unknown = append(unknown, envPrefix+name)
+		}
+		sort.Strings(unknown)
+		zap.L().Warn("ignoring unknown settings in the environment", zap.Strings("names", unknown))
+	}
+	return applied, nil
+}
+
+// applyEnvFields sets fields of the struct v named in env,
+// the applied names are deleted from env.
+func applyEnvFields(v reflect.Value, envPath string, yamlPath string, env map[string]string) (int, error) {
+	applied := 0
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = strings.ToLower(field.Name)
+		}
+		envName := envPath + strings.ToUpper(name)
+		yamlName := yamlPath + name
+
+		if value, ok := env[envName]; ok {
+			if err := yaml.Unmarshal([]byte(value), v.Field(i).Addr().Interface()); err != nil {
+				return applied, xerror.EInvalidConfiguration("invalid value of "+envPrefix+envName, yamlName)
+			}
+			delete(env, envName)
+			applied++
+			continue
+		}
+
+		nested, ok := envStruct(v.Field(i), envName+envSeparator, env)
+		if !ok {
+			continue
+		}
+		n, err := applyEnvFields(nested, envName+envSeparator, yamlName+".", env)
+		applied += n
+		if err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
+
+// envStruct returns the nested settings struct of the field
+// if some environment variable is named after it,
+// the nil pointer is set to the new struct then.
+func envStruct(field reflect.Value, prefix string, env map[string]string) (reflect.Value, bool) {
+	t := field.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || reflect.PtrTo(t).Implements(yamlUnmarshaler) {
+		return reflect.Value{}, false
+	}
+
+	found := false
+	for name := range env {
+		if strings.HasPrefix(name, prefix) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return reflect.Value{}, false
+	}
+
+	if field.Kind() != reflect.Ptr {
+		return field, true
+	}
+	if field.IsNil() {
+		field.Set(reflect.New(t))
+	}
+	return field.Elem(), true
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package settings
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/xerror"
+)
+
+func TestConfig_applyEnv(t *testing.T) {
+	c := &Config{
+		LogLevel:  "info",
+		Wireguard: wireguard.Config{Subnet: "10.235.0.0/16", ListenPort: 3000},
+	}
+
+	applied, err := c.applyEnv([]string{
+		"PATH=/usr/bin",
+		"VPNHOUSE_TUNNEL_LOG_LEVEL=debug",
+		"VPNHOUSE_TUNNEL_LOCK_TIMEOUT=5s",
+		"VPNHOUSE_TUNNEL_WIREGUARD__DNS=[10.235.0.1, 10.235.0.2]",
+		"VPNHOUSE_TUNNEL_PEER_STATISTICS__PEER_IDLE_TIMEOUT=10m",
+		"VPNHOUSE_TUNNEL_NO_SUCH_SETTING=1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 4, applied)
+	require.Equal(t, "debug", c.LogLevel)
+	require.Equal(t, 5*time.Second, c.GetLockTimeout())
+	require.Equal(t, []string{"10.235.0.1", "10.235.0.2"}, c.Wireguard.DNS)
+	// the nested settings are created
+	require.Equal(t, 10*time.Minute, c.GetPeerIdleTimeout())
+	// the rest is kept
+	require.Equal(t, 3000, c.Wireguard.ListenPort)
+
+	_, err = c.applyEnv([]string{"VPNHOUSE_TUNNEL_WIREGUARD__SERVER_PORT=port"})
+	require.ErrorIs(t, err, xerror.EInvalidConfiguration("", ""))
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	commonAPI "github.com/vpnhouse/api/go/server/common"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+)
+
+const (
+	// IssueError makes the configuration unusable
+	IssueError = "error"
+	// IssueWarning is the likely mistake, the server works anyway
+	IssueWarning = "warning"
+)
+
+// wireguardRekeyInterval is how often wireguard renews the handshake
+// of the peer exchanging the traffic.
+const wireguardRekeyInterval = 2 * time.Minute
+
+// ConfigIssue is the single problem of the configuration.
+type ConfigIssue struct {
+	Field    string `json:"field"`
+	Problem  string `json:"problem"`
+	Severity string `json:"severity"`
+}
+
+type configIssues []ConfigIssue
+
+func (l *configIssues) errorf(field string, format string, args ...interface{}) {
+	*l = append(*l, ConfigIssue{Field: field, Problem: fmt.Sprintf(format, args...), Severity: IssueError})
+}
+
+func (l *configIssues) warnf(field string, format string, args ...interface{}) {
+	*l = append(*l, ConfigIssue{Field: field, Problem: fmt.Sprintf(format, args...), Severity: IssueWarning})
+}
+
+// check adds the error returned by the section validator,
+// the field named by the error takes precedence over the given one.
+func (l *configIssues) check(field string, err error) {
+	if err == nil {
+		return
+	}
+
+	var resp commonAPI.Error
+	if _, body := xerror.ErrorToHttpResponse(err); json.Unmarshal(body, &resp) == nil {
+		if resp.Field != nil && len(*resp.Field) > 0 {
+			field = *resp.Field
+		}
+		if resp.Error != nil {
+			*l = append(*l, ConfigIssue{Field: field, Problem: *resp.Error, Severity: IssueError})
+			return
+		}
+	}
+	l.errorf(field, "%s", err.Error())
+}
+
+// Issues checks the whole configuration and returns all problems found,
+// unlike the validation on load stopping at the first one.
+func (s *Config) Issues() []ConfigIssue {
+	return s.snapshot().issues()
+}
+
+func (s *Config) issues() []ConfigIssue {
+	issues := configIssues{}
+	subnet := s.wireguardIssues(&issues)
+
+	if subnet != nil {
+		hosts := peerHosts(subnet)
+		if s.IPPool != nil {
+			err := s.IPPool.Validate(subnet)
+			issues.check("ip_pool", err)
+			if err == nil {
+				for _, block := range s.IPPool.ExtraNetworks() {
+					hosts += peerHosts(block)
+				}
+			}
+		}
+
+		if s.MaxPeersPerInterface > hosts {
+			issues.warnf("max_peers_per_interface", "the limit is never reached, the pool holds %d peers at most", hosts)
+		}
+	}
+	issues.check("ip_pool.extra_subnets", s.validateExtraSubnets())
+
+	issues.check("policy_ports", s.PolicyPorts.Validate())
+	issues.check("enforce_tunnel_dns", s.EnforceTunnelDNS.Validate())
+	issues.check("enforce_tunnel_dns", s.validateTunnelDNS(s.Wireguard.DNS))
+	for name, c := range s.ClientMTU {
+		if _, ok := ipalloc.ParsePolicy(name); !ok {
+			issues.errorf("client_mtu", "unknown policy %q", name)
+			continue
+		}
+		issues.check("client_mtu."+name, c.Validate("client_mtu."+name))
+	}
+	for name, ips := range s.ClientAllowedIPs {
+		issues.check("client_allowed_ips."+name, validateClientAllowedIPs(name, ips))
+	}
+
+	if len(s.HTTP.ListenAddr) == 0 {
+		issues.errorf("http.listen_addr", "is required")
+	}
+	issues.check("http.prometheus_labels", s.HTTP.validate())
+	if s.AdminAPI != nil && s.AdminAPI.Socket != nil {
+		issues.check("admin_api.socket", s.AdminAPI.Socket.validate())
+	}
+	for _, err := range s.listenAddrErrors() {
+		// the error names the listener field
+		issues.check("", err)
+	}
+	if s.SSL != nil {
+		if len(s.SSL.ListenAddr) == 0 {
+			issues.errorf("ssl.listen_addr", "is required")
+		}
+		if s.Domain == nil || len(s.Domain.PrimaryName) == 0 {
+			issues.errorf("domain.primary_name", "SSL server is enabled, but domain name is not set")
+		}
+	}
+	if !s.InMemoryStorage && len(s.SQLitePath) == 0 {
+		issues.errorf("sqlite_path", "is required unless in_memory_storage is set")
+	}
+
+	issues.check("pool_pressure_thresholds", validatePoolPressure(s.PoolPressure))
+
+	if s.PeerStatistics != nil {
+		idle := s.PeerStatistics.PeerIdleTimeout.Value()
+		if idle > 0 && idle <= s.PeerStatistics.UpdateStatisticsInterval.Value() {
+			issues.warnf("peer_statistics.peer_idle_timeout", "must be well above update_statistics_interval, peers are disconnected on every update")
+		}
+	}
+	if timeout, ok := s.GetPeerPresenceTimeout(); ok && timeout <= wireguardRekeyInterval {
+		issues.warnf("peer_presence.handshake_timeout", "must be above %s, online peers renew the handshake that often and are reported offline in between", wireguardRekeyInterval)
+	}
+
+	return issues
+}
+
+// peerHosts returns the number of peer addresses of the subnet,
+// the server takes the first usable one.
+func peerHosts(subnet *xnet.IPNet) int {
+	ones, bits := subnet.Mask().Size()
+	return 1<<(bits-ones) - 3
+}
+
+// wireguardIssues checks the wireguard section,
+// returns the subnet if it's valid.
+func (s *Config) wireguardIssues(issues *configIssues) *xnet.IPNet {
+	c := s.Wireguard
+	if len(c.Interface) == 0 {
+		issues.errorf("wireguard.interface", "is required")
+	}
+	if c.ListenPort < 1 || c.ListenPort > 65535 {
+		issues.errorf("wireguard.server_port", "must be between 1 and 65535")
+	}
+	if c.NATedPort < 0 || c.NATedPort > 65535 {
+		issues.errorf("wireguard.nated_port", "must be between 1 and 65535, 0 or omitted announces server_port")
+	}
+	if c.FirewallMark < 0 {
+		issues.errorf("wireguard.fwmark", "must be nonnegative")
+	}
+	_, _, err := c.GetRoutingTable()
+	issues.check("wireguard.routing_table", err)
+	issues.check("wireguard.endpoints", c.ValidateEndpoints())
+	if c.Keepalive <= 0 {
+		issues.warnf("wireguard.keepalive", "is not set, clients behind NAT lose the tunnel once idle")
+	}
+
+	if len(c.DNS) == 0 {
+		issues.warnf("wireguard.dns", "is empty, clients resolve names outside of the tunnel")
+	}
+	for _, v := range c.DNS {
+		if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+			issues.errorf("wireguard.dns", "%q is not the valid IPv4 address", v)
+		}
+	}
+
+	var subnet *xnet.IPNet
+	ipa, parsed, err := xnet.ParseCIDR(string(c.Subnet))
+	switch {
+	case err != nil || !parsed.IP().Isv4():
+		issues.errorf("wireguard.subnet", "must be the valid IPv4 CIDR")
+	case !parsed.IP().Equal(*ipa):
+		issues.errorf("wireguard.subnet", "must be the network address, not the host one")
+	default:
+		if ones, _ := parsed.Mask().Size(); ones > 30 {
+			issues.errorf("wireguard.subnet", "is too small, /30 or larger is required")
+		} else {
+			subnet = parsed
+		}
+	}
+
+	if len(c.ServerIPv4) == 0 {
+		issues.warnf("wireguard.server_ipv4", "is not set, clients can't get the connection info")
+		return subnet
+	}
+	serverIP := xnet.ParseIP(c.ServerIPv4)
+	if !serverIP.Isv4() {
+		issues.errorf("wireguard.server_ipv4", "must be the valid IPv4 address")
+	} else if subnet != nil && subnet.IPNet.Contains(serverIP.IP) {
+		issues.errorf("wireguard.server_ipv4", "%s must be the public address outside the %s subnet", c.ServerIPv4, subnet.String())
+	}
+	return subnet
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package settings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/human"
+)
+
+func TestConfig_Issues(t *testing.T) {
+	c := &Config{
+		SQLitePath: "/tmp/db.sqlite3",
+		HTTP:       HttpConfig{ListenAddr: ":80"},
+		Wireguard:  wireguard.DefaultConfig(),
+	}
+	c.Wireguard.ServerIPv4 = "203.0.113.1"
+	require.Empty(t, c.Issues())
+
+	// warnings only
+	c.Wireguard.ServerIPv4 = ""
+	c.MaxPeersPerInterface = 1 << 20
+	c.PeerPresence = &PeerPresenceConfig{Enabled: true, HandshakeTimeout: human.MustParseInterval("1m")}
+	require.ElementsMatch(t, []ConfigIssue{
+		{Field: "wireguard.server_ipv4", Problem: "is not set, clients can't get the connection info", Severity: IssueWarning},
+		{Field: "max_peers_per_interface", Problem: "the limit is never reached, the pool holds 65533 peers at most", Severity: IssueWarning},
+		{Field: "peer_presence.handshake_timeout", Problem: "must be above 2m0s, online peers renew the handshake that often and are reported offline in between", Severity: IssueWarning},
+	}, c.Issues())
+
+	// every problem is reported at once
+	c = &Config{
+		Wireguard: wireguard.DefaultConfig(),
+		IPPool:    &ipalloc.Config{StartOffset: 1 << 20},
+		ClientMTU: ClientMTUPolicies{
+			"unknown":       {MTU: 1280},
+			"internet_only": {MTU: 100},
+		},
+		ClientAllowedIPs: ClientAllowedIPsPolicies{"allow_all": {"10.0.0.0/8", "bogus"}},
+		HTTP:             HttpConfig{PrometheusLabels: map[string]string{"__name": "x"}},
+		PoolPressure:     []int{80, 120},
+	}
+	c.Wireguard.ServerIPv4 = "10.235.0.10"
+	c.Wireguard.NATedPort = -1
+	c.Wireguard.RoutingTable = "main"
+	c.Wireguard.DNS = []string{"8.8.8.8", "dns.google"}
+	c.Wireguard.ListenPort = 0
+
+	fields := map[string]string{}
+	for _, issue := range c.Issues() {
+		fields[issue.Field] = issue.Severity
+	}
+	require.Equal(t, map[string]string{
+		"wireguard.server_port":        IssueError,
+		"wireguard.nated_port":         IssueError,
+		"wireguard.routing_table":      IssueError,
+		"wireguard.dns":                IssueError,
+		"wireguard.server_ipv4":        IssueError,
+		"ip_pool.start_offset":         IssueError,
+		"client_mtu":                   IssueError,
+		"client_mtu.internet_only.mtu": IssueError,
+		"client_allowed_ips.allow_all": IssueError,
+		"http.listen_addr":             IssueError,
+		"http.prometheus_labels":       IssueError,
+		"sqlite_path":                  IssueError,
+		"pool_pressure_thresholds":     IssueError,
+	}, fields)
+
+	// listener problems are reported under the field of each listener
+	c = &Config{
+		SQLitePath:    "/tmp/db.sqlite3",
+		HTTP:          HttpConfig{ListenAddr: ":80"},
+		Wireguard:     wireguard.DefaultConfig(),
+		AdminAPI:      &AdminAPIConfig{ListenAddr: "127.0.0.1:80"},
+		FederationAPI: &FederationAPIConfig{ListenAddr: "0.0.0.0:80"},
+	}
+	c.Wireguard.ServerIPv4 = "203.0.113.1"
+	fields = map[string]string{}
+	for _, issue := range c.Issues() {
+		fields[issue.Field] = issue.Severity
+	}
+	require.Equal(t, map[string]string{
+		"admin_api.listen_addr":      IssueError,
+		"federation_api.listen_addr": IssueError,
+	}, fields)
+
+	// the problems are the ones of the validation on load
+	c = &Config{PoolPressure: []int{0}}
+	var problem string
+	for _, issue := range c.Issues() {
+		if issue.Field == "pool_pressure_thresholds" {
+			problem = issue.Problem
+		}
+	}
+	require.Equal(t, "pool_pressure_thresholds: 0 must be between 1 and 100", problem)
+}
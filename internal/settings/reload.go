@@ -0,0 +1,205 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package settings
+
+import (
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// hotSettings lists settings applied to the running server on reload,
+// changes of any other one take effect after the restart.
+var hotSettings = map[string]bool{
+	"log_level":                true,
+	"wireguard.dns":            true,
+	"client_mtu":               true,
+	"client_allowed_ips":       true,
+	"client_dns_route":         true,
+	"peer_statistics":          true,
+	"auto_wipe_expired":        true,
+	"max_peers_per_interface":  true,
+	"expiry_anomaly_fraction":  true,
+	"pool_pressure_thresholds": true,
+	"heal_duplicate_peers":     true,
+	"check_allowed_ips":        true,
+	"connect_guard":            true,
+	"connect_extension":        true,
+	"lock_timeout":             true,
+	"interface_watchdog":       true,
+	"stale_peers":              true,
+	"peer_presence":            true,
+	"federation_keys":          true,
+}
+
+// nestedSettings are compared field by field,
+// so the hot ones are told from the rest.
+var nestedSettings = map[string]bool{
+	"wireguard": true,
+}
+
+// ConfigChanges lists settings which differ between
+// two configurations, by their yaml paths.
+type ConfigChanges struct {
+	// Applied are the settings applied without the restart
+	Applied []string `json:"applied"`
+	// Pending are the settings requiring the restart
+	Pending []string `json:"pending"`
+}
+
+// Empty reports whether the configurations are the same.
+func (c ConfigChanges) Empty() bool {
+	return len(c.Applied) == 0 && len(c.Pending) == 0
+}
+
+// RestartRequired reports whether some changes need the restart.
+func (c ConfigChanges) RestartRequired() bool {
+	return len(c.Pending) > 0
+}
+
+// Changed reports whether the hot-reloadable setting is changed.
+func (c ConfigChanges) Changed(name string) bool {
+	for _, v := range c.Applied {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff returns settings of the other configuration
+// which differ from the current one.
+func (s *Config) Diff(other *Config) ConfigChanges {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var changes ConfigChanges
+	diffFields(reflect.ValueOf(s).Elem(), reflect.ValueOf(other).Elem(), "", &changes, applyNone)
+	return changes
+}
+
+// applyMode tells which changed settings diffFields copies.
+type applyMode int
+
+const (
+	applyNone applyMode = iota
+	applyHot
+	applyPending
+)
+
+// Apply copies the hot-reloadable settings of the other configuration,
+// the restart-required ones are left as they are. It returns
+// all changes the same as Diff does.
+func (s *Config) Apply(other *Config) ConfigChanges {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changes ConfigChanges
+	diffFields(reflect.ValueOf(s).Elem(), reflect.ValueOf(other).Elem(), "", &changes, applyHot)
+	return changes
+}
+
+// ApplyPending copies the restart-required settings of the other
+// configuration, it must be called when no service is running.
+func (s *Config) ApplyPending(other *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changes ConfigChanges
+	diffFields(reflect.ValueOf(s).Elem(), reflect.ValueOf(other).Elem(), "", &changes, applyPending)
+	for _, name := range changes.Pending {
+		if name == "wireguard.private_key" {
+			return s.Wireguard.OnLoad()
+		}
+	}
+	return nil
+}
+
+// snapshot returns the shallow copy of the settings, safe to read
+// without the lock as the reload replaces fields, never changes them in place.
+func (s *Config) snapshot() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c := &Config{path: s.path}
+	dst, src := reflect.ValueOf(c).Elem(), reflect.ValueOf(s).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return c
+}
+
+func diffFields(a reflect.Value, b reflect.Value, prefix string, changes *ConfigChanges, mode applyMode) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			// the yaml default
+			name = strings.ToLower(field.Name)
+		}
+		name = prefix + name
+
+		if nestedSettings[name] {
+			diffFields(a.Field(i), b.Field(i), name+".", changes, mode)
+			continue
+		}
+		if reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+		if hotSettings[name] {
+			changes.Applied = append(changes.Applied, name)
+			if mode == applyHot {
+				a.Field(i).Set(b.Field(i))
+			}
+		} else {
+			changes.Pending = append(changes.Pending, name)
+			if mode == applyPending {
+				a.Field(i).Set(b.Field(i))
+			}
+		}
+	}
+}
+
+// Reload reads the config file again, the environment overrides
+// included. Without the file the safe defaults are taken,
+// keeping the identity generated for the current configuration.
+func (s *Config) Reload() (*Config, error) {
+	return s.reloadFromFS(afero.OsFs{})
+}
+
+func (s *Config) reloadFromFS(fs afero.Fs) (*Config, error) {
+	_, statErr := fs.Stat(s.path)
+	other, err := staticConfigFromFS(fs, s.ConfigDir())
+	if err != nil {
+		return nil, err
+	}
+	if !os.IsNotExist(statErr) {
+		return other, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	other.InstanceID = s.InstanceID
+	other.Wireguard.PrivateKey = s.Wireguard.PrivateKey
+	if err := other.Wireguard.OnLoad(); err != nil {
+		return nil, err
+	}
+	if s.AdminAPI != nil {
+		other.AdminAPI.PasswordHash = s.AdminAPI.PasswordHash
+	}
+	return other, nil
+}
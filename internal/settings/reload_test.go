@@ -0,0 +1,149 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package settings
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/human"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/validator"
+)
+
+func TestConfig_Diff(t *testing.T) {
+	config := func() *Config {
+		return &Config{
+			LogLevel:  "info",
+			Wireguard: wireguard.Config{Subnet: "10.235.0.0/16", ListenPort: 3000, DNS: []string{"10.235.0.1"}},
+			HTTP:      HttpConfig{ListenAddr: ":80"},
+		}
+	}
+
+	current := config()
+	require.True(t, current.Diff(config()).Empty())
+
+	hot := config()
+	hot.LogLevel = "debug"
+	hot.Wireguard.DNS = []string{"10.235.0.53"}
+	hot.LockTimeout = human.MustParseInterval("5s")
+	hot.MaxPeersPerInterface = 100
+	hot.PeerStatistics = defaultPeerStatisticConfig()
+	changes := current.Diff(hot)
+	require.Equal(t, []string{"log_level", "wireguard.dns", "peer_statistics", "max_peers_per_interface", "lock_timeout"}, changes.Applied)
+	require.Empty(t, changes.Pending)
+	require.False(t, changes.RestartRequired())
+	require.True(t, changes.Changed("lock_timeout"))
+	require.False(t, changes.Changed("http"))
+
+	restart := config()
+	restart.Wireguard.Subnet = "10.236.0.0/16"
+	restart.Wireguard.ListenPort = 3001
+	restart.HTTP.ListenAddr = ":8080"
+	restart.LockTimeout = human.MustParseInterval("5s")
+	changes = current.Diff(restart)
+	require.Equal(t, []string{"lock_timeout"}, changes.Applied)
+	require.Equal(t, []string{"wireguard.subnet", "wireguard.server_port", "http"}, changes.Pending)
+	require.True(t, changes.RestartRequired())
+}
+
+func TestConfig_Apply(t *testing.T) {
+	current := &Config{
+		LogLevel:  "info",
+		Wireguard: wireguard.Config{Subnet: "10.235.0.0/16", ListenPort: 3000, DNS: []string{"10.235.0.1"}},
+	}
+
+	other := &Config{
+		LogLevel:  "debug",
+		Wireguard: wireguard.Config{Subnet: "10.236.0.0/16", ListenPort: 3001, DNS: []string{"10.235.0.53"}},
+	}
+	changes := current.Apply(other)
+	require.Equal(t, []string{"log_level", "wireguard.dns"}, changes.Applied)
+	require.Equal(t, []string{"wireguard.subnet", "wireguard.server_port"}, changes.Pending)
+	// restart-required settings are kept
+	require.Equal(t, "debug", current.LogLevel)
+	require.Equal(t, []string{"10.235.0.53"}, current.GetWireguardDNS())
+	require.Equal(t, validator.Subnet("10.235.0.0/16"), current.Wireguard.Subnet)
+	require.Equal(t, 3000, current.Wireguard.ListenPort)
+
+	require.NoError(t, current.ApplyPending(other))
+	require.True(t, current.Diff(other).Empty())
+}
+
+func TestConfig_ApplyConcurrentReads(t *testing.T) {
+	config := func(timeout string, allowed string) *Config {
+		return &Config{
+			Wireguard:        wireguard.Config{Subnet: "10.235.0.0/16", DNS: []string{"10.235.0.1"}},
+			LockTimeout:      human.MustParseInterval(timeout),
+			ClientAllowedIPs: ClientAllowedIPsPolicies{"allow_all": {allowed}},
+			PeerPresence:     &PeerPresenceConfig{Enabled: true, HandshakeTimeout: human.MustParseInterval(timeout)},
+		}
+	}
+
+	current := config("5s", "0.0.0.0/0")
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				current.GetLockTimeout()
+				current.GetClientAllowedIPs(ipam.Policy{Access: ipam.AccessPolicyAllowAll})
+				current.GetPeerPresenceTimeout()
+				current.Issues()
+				_, _ = current.Effective()
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			current.Apply(config("10s", "10.0.0.0/8"))
+		} else {
+			current.Apply(config("5s", "0.0.0.0/0"))
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	require.Equal(t, 5*time.Second, current.GetLockTimeout())
+	timeout, ok := current.GetPeerPresenceTimeout()
+	require.True(t, ok)
+	require.Equal(t, 5*time.Second, timeout)
+	require.Equal(t, []string{"0.0.0.0/0"}, current.GetClientAllowedIPs(ipam.Policy{Access: ipam.AccessPolicyAllowAll}))
+}
+
+func TestConfig_ReloadDefaults(t *testing.T) {
+	fs := &afero.MemMapFs{}
+	require.NoError(t, fs.MkdirAll("/opt/tunnel", 0700))
+
+	current, err := staticConfigFromFS(fs, "/opt/tunnel")
+	require.NoError(t, err)
+
+	// no config file, the identity generated on start is kept
+	reloaded, err := current.reloadFromFS(fs)
+	require.NoError(t, err)
+	require.Equal(t, current.InstanceID, reloaded.InstanceID)
+	require.Equal(t, current.Wireguard.GetPrivateKey(), reloaded.Wireguard.GetPrivateKey())
+	require.Equal(t, current.AdminAPI.PasswordHash, reloaded.AdminAPI.PasswordHash)
+	require.True(t, current.Diff(reloaded).Empty())
+
+	// the environment is read again
+	t.Setenv("VPNHOUSE_TUNNEL_LOCK_TIMEOUT", "5s")
+	reloaded, err = current.reloadFromFS(fs)
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, reloaded.GetLockTimeout())
+	require.Equal(t, []string{"lock_timeout"}, current.Diff(reloaded).Applied)
+}
@@ -9,6 +9,9 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,7 +20,9 @@ import (
 	adminAPI "github.com/vpnhouse/api/go/server/tunnel_admin"
 	"github.com/vpnhouse/tunnel/internal/eventlog"
 	"github.com/vpnhouse/tunnel/internal/extstat"
+	"github.com/vpnhouse/tunnel/internal/firewall"
 	"github.com/vpnhouse/tunnel/internal/grpc"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
 	"github.com/vpnhouse/tunnel/internal/iprose"
 	"github.com/vpnhouse/tunnel/internal/proxy"
 	"github.com/vpnhouse/tunnel/internal/wireguard"
@@ -50,28 +55,54 @@ type NetworkAccessPolicy struct {
 type Config struct {
 	InstanceID string           `yaml:"instance_id"`
 	LogLevel   string           `yaml:"log_level"`
-	SQLitePath string           `yaml:"sqlite_path" valid:"path,required"`
+	SQLitePath string           `yaml:"sqlite_path" valid:"path"`
 	Rapidoc    bool             `yaml:"rapidoc"`
 	Wireguard  wireguard.Config `yaml:"wireguard"`
 	HTTP       HttpConfig       `yaml:"http"`
 
 	// optional configuration
-	Proxy              *proxy.Config               `yaml:"proxy,omitempty"`
-	ExternalStats      *extstat.Config             `yaml:"external_stats,omitempty"`
-	NetworkPolicy      *NetworkAccessPolicy        `yaml:"network,omitempty"`
-	SSL                *xhttp.SSLConfig            `yaml:"ssl,omitempty"`
-	Domain             *xhttp.DomainConfig         `yaml:"domain,omitempty"`
-	AdminAPI           *AdminAPIConfig             `yaml:"admin_api,omitempty"`
-	PublicAPI          *PublicAPIConfig            `yaml:"public_api,omitempty"`
-	GRPC               *grpc.Config                `yaml:"grpc,omitempty"`
-	Sentry             *sentry.Config              `yaml:"sentry,omitempty"`
-	EventLog           *eventlog.StorageConfig     `yaml:"event_log,omitempty"`
-	ManagementKeystore string                      `yaml:"management_keystore,omitempty" valid:"path"`
-	DNSFilter          *xdns.Config                `yaml:"dns_filter"`
-	PortRestrictions   *ipam.PortRestrictionConfig `yaml:"ports,omitempty"`
-	PeerStatistics     *PeerStatisticConfig        `yaml:"peer_statistics,omitempty"`
-	GeoDBPath          string                      `yaml:"geo_db_path,omitempty"`
-	IPRose             iprose.Config               `yaml:"iprose,omitempty"`
+	Proxy                 *proxy.Config               `yaml:"proxy,omitempty"`
+	ExternalStats         *extstat.Config             `yaml:"external_stats,omitempty"`
+	NetworkPolicy         *NetworkAccessPolicy        `yaml:"network,omitempty"`
+	IPPool                *ipalloc.Config             `yaml:"ip_pool,omitempty"`
+	SSL                   *xhttp.SSLConfig            `yaml:"ssl,omitempty"`
+	Domain                *xhttp.DomainConfig         `yaml:"domain,omitempty"`
+	AdminAPI              *AdminAPIConfig             `yaml:"admin_api,omitempty"`
+	PublicAPI             *PublicAPIConfig            `yaml:"public_api,omitempty"`
+	GRPC                  *grpc.Config                `yaml:"grpc,omitempty"`
+	Sentry                *sentry.Config              `yaml:"sentry,omitempty"`
+	EventLog              *eventlog.StorageConfig     `yaml:"event_log,omitempty"`
+	Syslog                *eventlog.SyslogConfig      `yaml:"syslog,omitempty"`
+	EventRetry            *eventlog.RetryConfig       `yaml:"event_retry,omitempty"`
+	ManagementKeystore    string                      `yaml:"management_keystore,omitempty" valid:"path"`
+	DNSFilter             *xdns.Config                `yaml:"dns_filter"`
+	PortRestrictions      *ipam.PortRestrictionConfig `yaml:"ports,omitempty"`
+	PolicyPorts           firewall.Config             `yaml:"policy_ports,omitempty"`
+	EnforceTunnelDNS      firewall.DNSEnforcement     `yaml:"enforce_tunnel_dns,omitempty"`
+	ClientMTU             ClientMTUPolicies           `yaml:"client_mtu,omitempty"`
+	ClientAllowedIPs      ClientAllowedIPsPolicies    `yaml:"client_allowed_ips,omitempty"`
+	ClientDNSRoute        *bool                       `yaml:"client_dns_route,omitempty"`
+	PeerStatistics        *PeerStatisticConfig        `yaml:"peer_statistics,omitempty"`
+	GeoDBPath             string                      `yaml:"geo_db_path,omitempty"`
+	AutoWipeExpired       *bool                       `yaml:"auto_wipe_expired,omitempty"`
+	RestoreConcurrency    int                         `yaml:"restore_concurrency,omitempty"`
+	RestoreRate           int                         `yaml:"restore_rate,omitempty"`
+	MaxPeersPerInterface  int                         `yaml:"max_peers_per_interface,omitempty"`
+	ExpiryAnomalyFraction float64                     `yaml:"expiry_anomaly_fraction,omitempty"`
+	PoolPressure          []int                       `yaml:"pool_pressure_thresholds,omitempty"`
+	HealDuplicatePeers    bool                        `yaml:"heal_duplicate_peers,omitempty"`
+	RedactLogs            bool                        `yaml:"redact_logs,omitempty"`
+	InMemoryStorage       bool                        `yaml:"in_memory_storage,omitempty"`
+	CheckAllowedIPs       *bool                       `yaml:"check_allowed_ips,omitempty"`
+	ConnectGuard          *bool                       `yaml:"connect_guard,omitempty"`
+	ConnectExtension      human.Interval              `yaml:"connect_extension,omitempty" valid:"interval"`
+	LockTimeout           human.Interval              `yaml:"lock_timeout,omitempty" valid:"interval"`
+	InterfaceWatchdog     *InterfaceWatchdogConfig    `yaml:"interface_watchdog,omitempty"`
+	StalePeers            *StalePeersConfig           `yaml:"stale_peers,omitempty"`
+	PeerPresence          *PeerPresenceConfig         `yaml:"peer_presence,omitempty"`
+	FederationKeys        *FederationKeysConfig       `yaml:"federation_keys,omitempty"`
+	FederationAPI         *FederationAPIConfig        `yaml:"federation_api,omitempty"`
+	IPRose                iprose.Config               `yaml:"iprose,omitempty"`
 
 	// path to the config file, or default path in case of safe defaults.
 	// Used to override config via the admin API.
@@ -81,7 +112,23 @@ type Config struct {
 	mu sync.RWMutex
 }
 
+// rlock read-locks the settings changed by the reload,
+// returns the function unlocking them. Nil settings are never changed.
+func (s *Config) rlock() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.mu.RLock()
+	return s.mu.RUnlock
+}
+
 func (s *Config) GetNetworkAccessPolicy() NetworkAccessPolicy {
+	defer s.rlock()()
+
+	return s.networkAccessPolicy()
+}
+
+func (s *Config) networkAccessPolicy() NetworkAccessPolicy {
 	if s.NetworkPolicy == nil || s.NetworkPolicy.Access.DefaultPolicy.Int() == ipam.AccessPolicyDefault {
 		return NetworkAccessPolicy{
 			Access: ipam.NetworkAccess{DefaultPolicy: ipam.AliasInternetOnly()},
@@ -91,6 +138,16 @@ func (s *Config) GetNetworkAccessPolicy() NetworkAccessPolicy {
 	return *s.NetworkPolicy
 }
 
+func (s *Config) GetIPPoolConfig() ipalloc.Config {
+	defer s.rlock()()
+
+	if s.IPPool == nil {
+		return ipalloc.Config{}
+	}
+
+	return *s.IPPool
+}
+
 func (s *Config) ConfigDir() string {
 	return filepath.Dir(s.path)
 }
@@ -128,6 +185,8 @@ func (s *Config) PublicURL() string {
 }
 
 func (s *Config) GetPublicAPIConfig() *PublicAPIConfig {
+	defer s.rlock()()
+
 	if s.PublicAPI != nil {
 		return s.PublicAPI
 	}
@@ -135,6 +194,8 @@ func (s *Config) GetPublicAPIConfig() *PublicAPIConfig {
 }
 
 func (s *Config) GetUpdateStatisticsInterval() human.Interval {
+	defer s.rlock()()
+
 	if s == nil || s.PeerStatistics == nil {
 		return human.MustParseInterval(DefaultUpdateStatisticsInterval)
 	}
@@ -142,12 +203,449 @@ func (s *Config) GetUpdateStatisticsInterval() human.Interval {
 }
 
 func (s *Config) GetSentEventInterval() human.Interval {
+	defer s.rlock()()
+
 	if s == nil || s.PeerStatistics == nil {
 		return human.MustParseInterval(DefaultTrafficChangeSendEventInterval)
 	}
 	return s.PeerStatistics.TrafficChangeSendEventInterval
 }
 
+func (s *Config) GetPeerEventMinInterval() human.Interval {
+	defer s.rlock()()
+
+	if s == nil || s.PeerStatistics == nil || s.PeerStatistics.PeerEventMinInterval.Value() <= 0 {
+		return human.MustParseInterval(DefaultPeerEventMinInterval)
+	}
+	return s.PeerStatistics.PeerEventMinInterval
+}
+
+// GetPeerIdleTimeout returns the time without traffic after which
+// the peer is disconnected, zero means it's disabled.
+func (s *Config) GetPeerIdleTimeout() time.Duration {
+	defer s.rlock()()
+
+	if s == nil || s.PeerStatistics == nil || s.PeerStatistics.PeerIdleTimeout.Value() <= 0 {
+		return 0
+	}
+	return s.PeerStatistics.PeerIdleTimeout.Value()
+}
+
+// GetAutoWipeExpired reports whether expired peers must be
+// deleted automatically, enabled by default.
+func (s *Config) GetAutoWipeExpired() bool {
+	defer s.rlock()()
+
+	if s == nil || s.AutoWipeExpired == nil {
+		return true
+	}
+	return *s.AutoWipeExpired
+}
+
+// GetRestoreConcurrency returns the number of peers
+// programmed on the device concurrently on startup.
+func (s *Config) GetRestoreConcurrency() int {
+	defer s.rlock()()
+
+	if s == nil || s.RestoreConcurrency <= 0 {
+		return DefaultRestoreConcurrency
+	}
+	return s.RestoreConcurrency
+}
+
+// GetRestoreRate returns the max number of peers programmed
+// on the device per second on startup, zero means no limit.
+func (s *Config) GetRestoreRate() int {
+	defer s.rlock()()
+
+	if s == nil || s.RestoreRate <= 0 {
+		return 0
+	}
+	return s.RestoreRate
+}
+
+// GetMaxPeersPerInterface returns the max number of peers
+// on the wireguard device, zero means no limit.
+func (s *Config) GetMaxPeersPerInterface() int {
+	defer s.rlock()()
+
+	if s == nil || s.MaxPeersPerInterface <= 0 {
+		return 0
+	}
+	return s.MaxPeersPerInterface
+}
+
+// GetExpiryAnomalyFraction returns the fraction of peers which
+// expiring within a single tick is treated as the clock anomaly.
+func (s *Config) GetExpiryAnomalyFraction() float64 {
+	defer s.rlock()()
+
+	if s == nil || s.ExpiryAnomalyFraction <= 0 {
+		return DefaultExpiryAnomalyFraction
+	}
+	return s.ExpiryAnomalyFraction
+}
+
+// GetPoolPressureThresholds returns the address pool utilization
+// percents firing the pool pressure event once crossed.
+func (s *Config) GetPoolPressureThresholds() []int {
+	defer s.rlock()()
+
+	if s == nil || len(s.PoolPressure) == 0 {
+		return []int{DefaultPoolPressureWarning, DefaultPoolPressureCritical}
+	}
+	return s.PoolPressure
+}
+
+// GetHealDuplicatePeers reports whether duplicate peers sharing
+// the same identifiers are removed on connect instead of failing it.
+func (s *Config) GetHealDuplicatePeers() bool {
+	defer s.rlock()()
+
+	return s != nil && s.HealDuplicatePeers
+}
+
+// GetCheckAllowedIPs reports whether the peer's AllowedIPs must be
+// checked against other peers before programming, enabled by default.
+func (s *Config) GetCheckAllowedIPs() bool {
+	defer s.rlock()()
+
+	if s == nil || s.CheckAllowedIPs == nil {
+		return true
+	}
+	return *s.CheckAllowedIPs
+}
+
+// GetConnectGuard reports whether concurrent connects of the same
+// user are serialized, enabled by default.
+func (s *Config) GetConnectGuard() bool {
+	defer s.rlock()()
+
+	if s == nil || s.ConnectGuard == nil {
+		return true
+	}
+	return *s.ConnectGuard
+}
+
+// GetConnectExtension returns how far the reconnect moves
+// the peer expiration at least, zero keeps it as is.
+func (s *Config) GetConnectExtension() time.Duration {
+	defer s.rlock()()
+
+	if s == nil || s.ConnectExtension.Value() <= 0 {
+		return 0
+	}
+	return s.ConnectExtension.Value()
+}
+
+// GetLockTimeout returns how long API requests wait for
+// the peer manager busy with another operation.
+func (s *Config) GetLockTimeout() time.Duration {
+	defer s.rlock()()
+
+	if s == nil || s.LockTimeout.Value() <= 0 {
+		return human.MustParseInterval(DefaultLockTimeout).Value()
+	}
+	return s.LockTimeout.Value()
+}
+
+// GetInterfaceCheckInterval returns how often the existence
+// of the wireguard interface is checked.
+func (s *Config) GetInterfaceCheckInterval() human.Interval {
+	defer s.rlock()()
+
+	if s == nil || s.InterfaceWatchdog == nil || s.InterfaceWatchdog.Interval.Value() <= 0 {
+		return human.MustParseInterval(DefaultInterfaceCheckInterval)
+	}
+	return s.InterfaceWatchdog.Interval
+}
+
+// GetStalePeersMaxAge returns the age of the never connected peer
+// to be removed, false if the removal is disabled.
+func (s *Config) GetStalePeersMaxAge() (time.Duration, bool) {
+	defer s.rlock()()
+
+	if s == nil || s.StalePeers == nil || !s.StalePeers.Enabled {
+		return 0, false
+	}
+	if s.StalePeers.MaxAge.Value() <= 0 {
+		return human.MustParseInterval(DefaultStalePeersMaxAge).Value(), true
+	}
+	return s.StalePeers.MaxAge.Value(), true
+}
+
+// GetStalePeersInterval returns how often stale peers are looked for.
+func (s *Config) GetStalePeersInterval() human.Interval {
+	defer s.rlock()()
+
+	if s == nil || s.StalePeers == nil || s.StalePeers.Interval.Value() <= 0 {
+		return human.MustParseInterval(DefaultStalePeersInterval)
+	}
+	return s.StalePeers.Interval
+}
+
+// GetPeerPresenceTimeout returns the age of the last handshake
+// after which the peer is offline, false if the presence events are disabled.
+func (s *Config) GetPeerPresenceTimeout() (time.Duration, bool) {
+	defer s.rlock()()
+
+	if s == nil || s.PeerPresence == nil || !s.PeerPresence.Enabled {
+		return 0, false
+	}
+	if s.PeerPresence.HandshakeTimeout.Value() <= 0 {
+		return human.MustParseInterval(DefaultPeerPresenceHandshakeTimeout).Value(), true
+	}
+	return s.PeerPresence.HandshakeTimeout.Value(), true
+}
+
+// GetPeerPresenceMinDuration returns how long the peer must stay
+// in the new presence state for the transition to be reported.
+func (s *Config) GetPeerPresenceMinDuration() time.Duration {
+	defer s.rlock()()
+
+	if s == nil || s.PeerPresence == nil || s.PeerPresence.MinStateDuration.Value() <= 0 {
+		return human.MustParseInterval(DefaultPeerPresenceMinStateDuration).Value()
+	}
+	return s.PeerPresence.MinStateDuration.Value()
+}
+
+// GetFederationKeysMaxBodySize returns the max size
+// of the authorizer keys update payload in bytes.
+func (s *Config) GetFederationKeysMaxBodySize() int64 {
+	defer s.rlock()()
+
+	if s == nil || s.FederationKeys == nil || s.FederationKeys.MaxBodySize.Value() <= 0 {
+		v := human.MustParseSize(DefaultFederationKeysMaxBodySize)
+		return v.Value()
+	}
+	return s.FederationKeys.MaxBodySize.Value()
+}
+
+// GetFederationKeysMaxKeys returns the max number
+// of keys in the single authorizer keys update.
+func (s *Config) GetFederationKeysMaxKeys() int {
+	defer s.rlock()()
+
+	if s == nil || s.FederationKeys == nil || s.FederationKeys.MaxKeys <= 0 {
+		return DefaultFederationKeysMaxKeys
+	}
+	return s.FederationKeys.MaxKeys
+}
+
+// GetInterfaceRecreate reports whether the gone wireguard
+// interface must be recreated along with its peers.
+func (s *Config) GetInterfaceRecreate() bool {
+	defer s.rlock()()
+
+	return s != nil && s.InterfaceWatchdog != nil && s.InterfaceWatchdog.Recreate
+}
+
+// GetPolicyPorts returns the per-policy port rules.
+func (s *Config) GetPolicyPorts() firewall.Config {
+	defer s.rlock()()
+
+	if s == nil {
+		return nil
+	}
+	return s.PolicyPorts
+}
+
+// GetEnforceTunnelDNS returns policies with the DNS restricted to wireguard.dns.
+func (s *Config) GetEnforceTunnelDNS() firewall.DNSEnforcement {
+	defer s.rlock()()
+
+	if s == nil {
+		return nil
+	}
+	return s.EnforceTunnelDNS
+}
+
+// validateTunnelDNS checks the DNS servers peers are restricted to
+// are served over the tunnel, i.e. belong to the wireguard subnet.
+func (s *Config) validateTunnelDNS(servers []string) error {
+	if !s.EnforceTunnelDNS.Enabled() {
+		return nil
+	}
+	if len(servers) == 0 {
+		return xerror.EInvalidConfiguration("enforce_tunnel_dns requires wireguard.dns to be set", "enforce_tunnel_dns")
+	}
+
+	_, subnet, err := xnet.ParseCIDR(string(s.Wireguard.Subnet))
+	if err != nil {
+		return xerror.EInvalidConfiguration("enforce_tunnel_dns requires the valid wireguard.subnet", "enforce_tunnel_dns")
+	}
+	for _, server := range servers {
+		if ip := net.ParseIP(server); ip == nil || !subnet.IPNet.Contains(ip) {
+			return xerror.EInvalidConfiguration(fmt.Sprintf("enforce_tunnel_dns: dns server %s is outside of the wireguard subnet", server), "wireguard.dns")
+		}
+	}
+	return nil
+}
+
+// GetClientHints returns the client config hints for the peer's policy,
+// false if hints are not enabled for the policy.
+func (s *Config) GetClientHints(pol ipam.Policy) (wireguard.ClientHints, bool) {
+	defer s.rlock()()
+
+	if s == nil || len(s.ClientMTU) == 0 {
+		return wireguard.ClientHints{}, false
+	}
+
+	access := s.clientAccess(pol)
+	for name, c := range s.ClientMTU {
+		if v, ok := ipalloc.ParsePolicy(name); ok && v == access {
+			return c.Hints(), true
+		}
+	}
+	return wireguard.ClientHints{}, false
+}
+
+// GetClientAllowedIPs returns the AllowedIPs of the client config
+// for the peer's policy, default: 0.0.0.0/0. The DNS servers outside
+// of them are routed to the tunnel too unless client_dns_route is disabled.
+func (s *Config) GetClientAllowedIPs(pol ipam.Policy) []string {
+	defer s.rlock()()
+
+	allowed := []string{wireguard.DefaultClientAllowedIPs}
+	if s == nil {
+		return allowed
+	}
+
+	access := s.clientAccess(pol)
+	for name, ips := range s.ClientAllowedIPs {
+		if v, ok := ipalloc.ParsePolicy(name); ok && v == access {
+			allowed = ips
+			break
+		}
+	}
+
+	if s.ClientDNSRoute != nil && !*s.ClientDNSRoute {
+		return append([]string(nil), allowed...)
+	}
+	return wireguard.ClientAllowedIPs(allowed, s.Wireguard.DNS)
+}
+
+// clientAccess resolves the default access policy of the peer,
+// the caller holds the lock.
+func (s *Config) clientAccess(pol ipam.Policy) int {
+	if pol.Access == ipam.AccessPolicyDefault {
+		return s.networkAccessPolicy().Access.DefaultPolicy.Int()
+	}
+	return pol.Access
+}
+
+// GetWireguardInterface returns the wireguard interface name.
+func (s *Config) GetWireguardInterface() string {
+	defer s.rlock()()
+
+	if s == nil {
+		return ""
+	}
+	return s.Wireguard.Interface
+}
+
+// ClientMTUPolicies maps the access policy name to the MTU hints
+// of the client config, policies not listed get no hints.
+type ClientMTUPolicies map[string]wireguard.ClientMTUConfig
+
+func (p ClientMTUPolicies) validate() error {
+	for name, c := range p {
+		if _, ok := ipalloc.ParsePolicy(name); !ok {
+			return xerror.EInvalidConfiguration(fmt.Sprintf("client_mtu: unknown policy %q", name), "client_mtu")
+		}
+		if err := c.Validate("client_mtu." + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClientAllowedIPsPolicies maps the access policy name to the AllowedIPs
+// of the client config, e.g. to split the tunnel for some policies.
+type ClientAllowedIPsPolicies map[string][]string
+
+func (p ClientAllowedIPsPolicies) validate() error {
+	for name, ips := range p {
+		if err := validateClientAllowedIPs(name, ips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateClientAllowedIPs checks the AllowedIPs of the single policy.
+func validateClientAllowedIPs(name string, ips []string) error {
+	if _, ok := ipalloc.ParsePolicy(name); !ok {
+		return xerror.EInvalidConfiguration(fmt.Sprintf("client_allowed_ips: unknown policy %q", name), "client_allowed_ips")
+	}
+	if len(ips) == 0 {
+		return xerror.EInvalidConfiguration("client_allowed_ips."+name+" must not be empty", "client_allowed_ips."+name)
+	}
+	for _, v := range ips {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return xerror.EInvalidConfiguration(fmt.Sprintf("client_allowed_ips.%s: invalid network %q", name, v), "client_allowed_ips."+name)
+		}
+	}
+	return nil
+}
+
+type InterfaceWatchdogConfig struct {
+	// Interval to check that the wireguard interface exists, default: 10s
+	Interval human.Interval `yaml:"interval,omitempty" valid:"interval"`
+	// Recreate the gone interface and program all peers on it again
+	Recreate bool `yaml:"recreate,omitempty"`
+}
+
+// StalePeersConfig is the removal of peers never connected
+// since they were created, independent of the expiration.
+type StalePeersConfig struct {
+	// Enabled turns the removal on, default: false
+	Enabled bool `yaml:"enabled,omitempty"`
+	// MaxAge of the never connected peer to be removed, default: 168h
+	MaxAge human.Interval `yaml:"max_age,omitempty" valid:"interval"`
+	// Interval to look for stale peers, default: 1h
+	Interval human.Interval `yaml:"interval,omitempty" valid:"interval"`
+}
+
+// PeerPresenceConfig is the events on peers going online and offline.
+type PeerPresenceConfig struct {
+	// Enabled turns the events on, default: false
+	Enabled bool `yaml:"enabled,omitempty"`
+	// HandshakeTimeout is the age of the last handshake
+	// after which the peer is offline, default: 3m
+	HandshakeTimeout human.Interval `yaml:"handshake_timeout,omitempty" valid:"interval"`
+	// MinStateDuration the peer must stay online or offline
+	// for the transition to be reported, default: 30s
+	MinStateDuration human.Interval `yaml:"min_state_duration,omitempty" valid:"interval"`
+}
+
+// FederationKeysConfig limits the authorizer keys
+// pushed by the federation sources.
+type FederationKeysConfig struct {
+	// MaxBodySize of the keys update, 413 is responded if exceeded, default: 1Mb
+	MaxBodySize human.Size `yaml:"max_body_size,omitempty" valid:"size"`
+	// MaxKeys in the single keys update, default: 1000
+	MaxKeys int `yaml:"max_keys,omitempty"`
+}
+
+// FederationAPIConfig is the listener of the federation API.
+type FederationAPIConfig struct {
+	// ListenAddr serves the federation API on its own listener
+	// instead of the main one, e.g. on the public interface only.
+	ListenAddr string `yaml:"listen_addr,omitempty" valid:"listen_addr"`
+}
+
+// GetFederationListenAddr returns the address of the federation API
+// listener, empty if the API is served on the main listener.
+func (s *Config) GetFederationListenAddr() string {
+	defer s.rlock()()
+
+	if s == nil || s.FederationAPI == nil {
+		return ""
+	}
+	return s.FederationAPI.ListenAddr
+}
+
 type HttpConfig struct {
 	// ListenAddr for HTTP server, default: ":80"
 	ListenAddr string `yaml:"listen_addr" valid:"listen_addr,required"`
@@ -155,12 +653,120 @@ type HttpConfig struct {
 	CORS bool `yaml:"cors"`
 	// Enable prometheus metrics on "/metrics" path
 	Prometheus bool `yaml:"prometheus"`
+	// PrometheusLabels are constant labels added to the metrics
+	// of the tunnel, e.g. to tell tenants apart
+	PrometheusLabels map[string]string `yaml:"prometheus_labels,omitempty"`
+}
+
+// labelNameRe matches the prometheus label name,
+// names starting with "__" are reserved
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func (c HttpConfig) validate() error {
+	for name := range c.PrometheusLabels {
+		if !labelNameRe.MatchString(name) || strings.HasPrefix(name, "__") {
+			return xerror.EInvalidConfiguration("invalid prometheus label name "+strconv.Quote(name), "http.prometheus_labels")
+		}
+	}
+	return nil
 }
 
 type AdminAPIConfig struct {
 	PasswordHash  string `yaml:"password_hash"`
 	StaticRoot    string `yaml:"static_root" valid:"path"`
 	TokenLifetime int    `yaml:"token_lifetime" valid:"natural"`
+	// RequestTimeout limits the time of handling a single admin request,
+	// the request is responded with 503 if exceeded.
+	RequestTimeout human.Interval `yaml:"request_timeout,omitempty" valid:"interval"`
+	// ListRequestTimeout is the RequestTimeout for requests
+	// listing the whole collections, like peers.
+	ListRequestTimeout human.Interval `yaml:"list_request_timeout,omitempty" valid:"interval"`
+	// Socket additionally serves the admin API on the unix domain socket
+	Socket *AdminSocketConfig `yaml:"socket,omitempty"`
+	// Compression of responses negotiated by the Accept-Encoding header
+	Compression *AdminCompressionConfig `yaml:"compression,omitempty"`
+	// ListenAddr serves the admin API and the frontend on their own
+	// listener instead of the main one, e.g. on the management interface.
+	ListenAddr string `yaml:"listen_addr,omitempty" valid:"listen_addr"`
+}
+
+type AdminCompressionConfig struct {
+	// Disabled turns the compression off
+	Disabled bool `yaml:"disabled,omitempty"`
+	// MinSize of the response body to compress,
+	// smaller responses are sent as is, default: 1Kb
+	MinSize human.Size `yaml:"min_size,omitempty" valid:"size"`
+}
+
+type AdminSocketConfig struct {
+	// Path to the socket file, stale file is replaced on start
+	Path string `yaml:"path"`
+	// Mode is the octal socket file permissions, default: "0600"
+	Mode string `yaml:"mode,omitempty"`
+	// Exclusive disables the admin API on the TCP listener,
+	// so it's reachable via the socket only.
+	Exclusive bool `yaml:"exclusive,omitempty"`
+}
+
+// FileMode returns the socket file permissions.
+func (c AdminSocketConfig) FileMode() (os.FileMode, error) {
+	if len(c.Mode) == 0 {
+		return DefaultAdminSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, xerror.EInvalidConfiguration("admin_api.socket.mode must be the octal file mode", "admin_api.socket.mode")
+	}
+	return os.FileMode(mode), nil
+}
+
+func (c AdminSocketConfig) validate() error {
+	if len(c.Path) == 0 {
+		return xerror.EInvalidConfiguration("admin_api.socket.path is required", "admin_api.socket.path")
+	}
+	_, err := c.FileMode()
+	return err
+}
+
+// AdminOnSocketOnly tells whether the admin API must not be served via TCP.
+func (c *AdminAPIConfig) AdminOnSocketOnly() bool {
+	return c != nil && c.Socket != nil && c.Socket.Exclusive
+}
+
+// GetListenAddr returns the address of the admin API listener,
+// empty if the API is served on the main listener.
+func (c *AdminAPIConfig) GetListenAddr() string {
+	if c == nil {
+		return ""
+	}
+	return c.ListenAddr
+}
+
+func (c *AdminAPIConfig) GetRequestTimeout() time.Duration {
+	if c == nil || c.RequestTimeout.IsZero() {
+		return human.MustParseInterval(DefaultAdminRequestTimeout).Value()
+	}
+	return c.RequestTimeout.Value()
+}
+
+func (c *AdminAPIConfig) GetListRequestTimeout() time.Duration {
+	if c == nil || c.ListRequestTimeout.IsZero() {
+		return human.MustParseInterval(DefaultAdminListRequestTimeout).Value()
+	}
+	return c.ListRequestTimeout.Value()
+}
+
+// GetCompressionMinSize returns the min size of the response body
+// to compress in bytes, false if the compression is disabled.
+func (c *AdminAPIConfig) GetCompressionMinSize() (int64, bool) {
+	if c != nil && c.Compression != nil && c.Compression.Disabled {
+		return 0, false
+	}
+	if c == nil || c.Compression == nil || c.Compression.MinSize.Value() <= 0 {
+		v := human.MustParseSize(DefaultAdminCompressionMinSize)
+		return v.Value(), true
+	}
+	return c.Compression.MinSize.Value(), true
 }
 
 func defaultAdminAPIConfig() *AdminAPIConfig {
@@ -203,6 +809,16 @@ type PeerStatisticConfig struct {
 	// "" or 0 means it's disabled
 	MaxUpstreamTrafficChange   human.Size `yaml:"max_upstream_traffic_change" valid:"size"`
 	MaxDownstreamTrafficChange human.Size `yaml:"max_downstream_traffic_change" valid:"size"`
+	// Min interval between events of the same type emitted for a single peer,
+	// events within the interval are coalesced (traffic) or dropped (connects).
+	// default: 30s
+	PeerEventMinInterval human.Interval `yaml:"peer_event_min_interval,omitempty" valid:"interval"`
+	// Time without traffic after which the peer is removed from the device,
+	// the peer is kept in the storage and put back on the next connect.
+	// Measured by the statistics updates, so it must be well above
+	// UpdateStatisticsInterval.
+	// "" or 0 means it's disabled
+	PeerIdleTimeout human.Interval `yaml:"peer_idle_timeout,omitempty" valid:"interval"`
 }
 
 func defaultPeerStatisticConfig() *PeerStatisticConfig {
@@ -211,6 +827,7 @@ func defaultPeerStatisticConfig() *PeerStatisticConfig {
 		TrafficChangeSendEventInterval: human.MustParseInterval(DefaultTrafficChangeSendEventInterval),
 		MaxUpstreamTrafficChange:       human.MustParseSize(DefaultMaxUpstreamTrafficChange),
 		MaxDownstreamTrafficChange:     human.MustParseSize(DefaultMaxDownstreamTrafficChange),
+		PeerEventMinInterval:           human.MustParseInterval(DefaultPeerEventMinInterval),
 	}
 }
 
@@ -222,6 +839,9 @@ func (s *PeerStatisticConfig) validate() {
 	if s.UpdateStatisticsInterval.Value() > s.TrafficChangeSendEventInterval.Value() {
 		s.TrafficChangeSendEventInterval = s.UpdateStatisticsInterval
 	}
+	if s.PeerEventMinInterval.Value() <= 0 {
+		s.PeerEventMinInterval = human.MustParseInterval(DefaultPeerEventMinInterval)
+	}
 }
 
 func LoadStatic(configDir string) (*Config, error) {
@@ -238,7 +858,17 @@ func staticConfigFromFS(fs afero.Fs, configDir string) (*Config, error) {
 	switch {
 	case os.IsNotExist(err):
 		zap.L().Warn("no static config file, using safe defaults", zap.String("path", pathToStatic))
-		return safeDefaults(configDir), nil
+		c := safeDefaults(configDir)
+		applied, err := c.applyEnv(os.Environ())
+		if err != nil {
+			return nil, err
+		}
+		if applied > 0 {
+			if err := c.validate(); err != nil {
+				return nil, err
+			}
+		}
+		return c, nil
 	case err == nil:
 		return loadStaticConfig(fs, pathToStatic)
 	default:
@@ -260,10 +890,16 @@ func loadStaticConfig(fs afero.Fs, path string) (*Config, error) {
 	if err := yaml.NewDecoder(fd).Decode(c); err != nil {
 		return nil, xerror.EInternalError("failed to unmarshal config", err)
 	}
+	if _, err := c.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
 
 	if err := validator.ValidateStruct(c); err != nil {
 		return nil, xerror.EInternalError("config validation failed", err)
 	}
+	if !c.InMemoryStorage && len(c.SQLitePath) == 0 {
+		return nil, xerror.EInternalError("sqlite_path is required unless in_memory_storage is set", nil)
+	}
 
 	if c.AdminAPI == nil {
 		c.AdminAPI = defaultAdminAPIConfig()
@@ -328,6 +964,57 @@ func (s *Config) validate() error {
 		}
 	}
 
+	if err := s.HTTP.validate(); err != nil {
+		return err
+	}
+
+	if s.Wireguard.FirewallMark < 0 {
+		return xerror.EInvalidConfiguration("wireguard.fwmark must be nonnegative", "wireguard.fwmark")
+	}
+
+	if err := s.Wireguard.Validate(); err != nil {
+		return err
+	}
+
+	if s.AdminAPI != nil && s.AdminAPI.Socket != nil {
+		if err := s.AdminAPI.Socket.validate(); err != nil {
+			return err
+		}
+	}
+	if err := s.validateListenAddrs(); err != nil {
+		return err
+	}
+
+	if s.IPPool != nil {
+		if err := s.IPPool.Validate(s.Wireguard.Subnet.Unwrap()); err != nil {
+			return err
+		}
+	}
+	if err := s.validateExtraSubnets(); err != nil {
+		return err
+	}
+
+	if err := validatePoolPressure(s.PoolPressure); err != nil {
+		return err
+	}
+
+	if err := s.PolicyPorts.Validate(); err != nil {
+		return err
+	}
+	if err := s.EnforceTunnelDNS.Validate(); err != nil {
+		return err
+	}
+	if err := s.validateTunnelDNS(s.Wireguard.DNS); err != nil {
+		return err
+	}
+
+	if err := s.ClientMTU.validate(); err != nil {
+		return err
+	}
+	if err := s.ClientAllowedIPs.validate(); err != nil {
+		return err
+	}
+
 	if s.PeerStatistics != nil {
 		s.PeerStatistics.validate()
 	}
@@ -335,6 +1022,123 @@ func (s *Config) validate() error {
 	return nil
 }
 
+// validatePoolPressure checks the pool utilization thresholds are percents.
+func validatePoolPressure(thresholds []int) error {
+	for _, v := range thresholds {
+		if v < 1 || v > 100 {
+			return xerror.EInvalidConfiguration(fmt.Sprintf("pool_pressure_thresholds: %d must be between 1 and 100", v), "pool_pressure_thresholds")
+		}
+	}
+	return nil
+}
+
+// validateListenAddrs checks the addresses of the API listeners
+// serving on their own: each must be valid and must not bind
+// the port of another listener.
+func (s *Config) validateListenAddrs() error {
+	if errs := s.listenAddrErrors(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// listenAddrErrors returns problems of all listener addresses,
+// each error names the field of the listener.
+func (s *Config) listenAddrErrors() []error {
+	type listener struct {
+		field string
+		addr  string
+	}
+	listeners := []listener{{"http.listen_addr", s.HTTP.ListenAddr}}
+	if s.SSL != nil {
+		listeners = append(listeners, listener{"ssl.listen_addr", s.SSL.ListenAddr})
+	}
+	extra := []listener{
+		{"admin_api.listen_addr", s.AdminAPI.GetListenAddr()},
+		{"federation_api.listen_addr", s.GetFederationListenAddr()},
+	}
+
+	var errs []error
+	for _, l := range extra {
+		if len(l.addr) == 0 {
+			continue
+		}
+		if _, _, err := splitListenAddr(l.addr); err != nil {
+			errs = append(errs, xerror.EInvalidConfiguration(fmt.Sprintf("%s: invalid address %q: %v", l.field, l.addr, err), l.field))
+			continue
+		}
+		conflict := false
+		for _, other := range listeners {
+			if listenAddrsOverlap(l.addr, other.addr) {
+				errs = append(errs, xerror.EInvalidConfiguration(fmt.Sprintf("%s %q conflicts with %s %q", l.field, l.addr, other.field, other.addr), l.field))
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			listeners = append(listeners, l)
+		}
+	}
+
+	if len(s.AdminAPI.GetListenAddr()) > 0 && s.AdminAPI.AdminOnSocketOnly() {
+		errs = append(errs, xerror.EInvalidConfiguration("admin_api.listen_addr can't be used with admin_api.socket.exclusive", "admin_api.listen_addr"))
+	}
+	return errs
+}
+
+// splitListenAddr returns the host and the port of the listen address,
+// the host is either empty (all interfaces) or the IP address.
+func splitListenAddr(addr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", p)
+	}
+	if len(host) > 0 && net.ParseIP(host) == nil {
+		return "", 0, fmt.Errorf("the host must be the IP address of the interface")
+	}
+	return host, port, nil
+}
+
+// listenAddrsOverlap reports whether both addresses can't be bound at once:
+// the same port on the same host or on all interfaces.
+func listenAddrsOverlap(a string, b string) bool {
+	hostA, portA, errA := splitListenAddr(a)
+	hostB, portB, errB := splitListenAddr(b)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+	return hostA == hostB || anyInterface(hostA) || anyInterface(hostB)
+}
+
+func anyInterface(host string) bool {
+	if len(host) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// validateExtraSubnets checks the extra blocks of the pool are compatible
+// with the network policy, the ipam applies it to the wireguard subnet only.
+func (s *Config) validateExtraSubnets() error {
+	if s.IPPool == nil || len(s.IPPool.ExtraSubnets) == 0 {
+		return nil
+	}
+
+	netpol := s.GetNetworkAccessPolicy()
+	if netpol.Access.DefaultPolicy.Int() != ipam.AccessPolicyAllowAll {
+		return xerror.EInvalidConfiguration("ip_pool.extra_subnets requires the allow_all default access policy", "ip_pool.extra_subnets")
+	}
+	if netpol.RateLimit != nil {
+		return xerror.EInvalidConfiguration("ip_pool.extra_subnets can't be used along with network.rate_limit", "ip_pool.extra_subnets")
+	}
+	return nil
+}
+
 // safeDefaults provides safe static config with paths started with the rootDir
 func safeDefaults(rootDir string) *Config {
 	adminAPIConfig := defaultAdminAPIConfig()
@@ -419,6 +1223,32 @@ func (s *Config) SetPublicIP(newIP xnet.IP) error {
 	return s.flush()
 }
 
+// GetWireguardDNS returns DNS servers advertised to peers.
+func (s *Config) GetWireguardDNS() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.Wireguard.DNS...)
+}
+
+// SetWireguardDNS changes DNS servers advertised to peers,
+// new peer configurations get them without the restart.
+func (s *Config) SetWireguardDNS(servers []string) error {
+	for _, server := range servers {
+		if ip := net.ParseIP(server); ip == nil || ip.To4() == nil {
+			return xerror.EInvalidField("invalid dns server "+server, "dns", nil)
+		}
+	}
+	if err := s.validateTunnelDNS(servers); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Wireguard.DNS = append([]string(nil), servers...)
+	return s.flush()
+}
+
 func (s *Config) Flush() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -5,11 +5,18 @@
 package settings
 
 import (
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/firewall"
+	"github.com/vpnhouse/tunnel/internal/ipalloc"
+	"github.com/vpnhouse/tunnel/internal/wireguard"
+	"github.com/vpnhouse/common-lib-go/ipam"
+	"github.com/vpnhouse/common-lib-go/validator"
+	"github.com/vpnhouse/common-lib-go/xerror"
 	"github.com/vpnhouse/common-lib-go/xhttp"
 )
 
@@ -28,14 +35,16 @@ func TestEmptyFile(t *testing.T) {
 
 func TestXValidation(t *testing.T) {
 	c := &Config{
-		Domain: nil,
-		SSL:    nil,
+		Domain:    nil,
+		SSL:       nil,
+		Wireguard: wireguard.DefaultConfig(),
 	}
 	require.NoError(t, c.validate())
 
 	c = &Config{
-		Domain: nil,
-		SSL:    &xhttp.SSLConfig{ListenAddr: ":1234"},
+		Domain:    nil,
+		SSL:       &xhttp.SSLConfig{ListenAddr: ":1234"},
+		Wireguard: wireguard.DefaultConfig(),
 	}
 	require.Error(t, c.validate())
 
@@ -45,7 +54,8 @@ func TestXValidation(t *testing.T) {
 			PrimaryName: "the.foo.bar",
 			IssueSSL:    true,
 		},
-		SSL: nil,
+		SSL:       nil,
+		Wireguard: wireguard.DefaultConfig(),
 	}
 	require.Error(t, c.validate())
 
@@ -55,11 +65,63 @@ func TestXValidation(t *testing.T) {
 			PrimaryName: "the.foo.bar",
 			Schema:      "https",
 		},
-		SSL: nil,
+		SSL:       nil,
+		Wireguard: wireguard.DefaultConfig(),
 	}
 	require.NoError(t, c.validate())
 }
 
+func TestWireguardValidation(t *testing.T) {
+	cases := []struct {
+		subnet    string
+		serverIP  string
+		offset    uint32
+		table     string
+		endpoints []string
+		field     string
+	}{
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4"},
+		{subnet: "10.235.0.0/16", serverIP: ""},
+		{subnet: "10.235.0.0/30", serverIP: "1.2.3.4"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", offset: 100},
+		{subnet: "foo", field: "wireguard.subnet"},
+		{subnet: "10.235.0.1/16", field: "wireguard.subnet"},
+		{subnet: "10.235.0.0/31", field: "wireguard.subnet"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3", field: "wireguard.server_ipv4"},
+		{subnet: "10.235.0.0/16", serverIP: "10.235.1.1", field: "wireguard.server_ipv4"},
+		{subnet: "10.235.0.0/24", serverIP: "1.2.3.4", offset: 300, field: "ip_pool.start_offset"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", table: "off"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", table: "1000"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", table: "0", field: "wireguard.routing_table"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", table: "main", field: "wireguard.routing_table"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", endpoints: []string{"1.2.3.4:3000", "[2001:db8::1]:3000", "vpn.example.com:51820"}},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", endpoints: []string{"1.2.3.4"}, field: "wireguard.endpoints"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", endpoints: []string{":3000"}, field: "wireguard.endpoints"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", endpoints: []string{"1.2.3.4:70000"}, field: "wireguard.endpoints"},
+		{subnet: "10.235.0.0/16", serverIP: "1.2.3.4", endpoints: []string{"1.2.3.4:3000", "1.2.3.4:3000"}, field: "wireguard.endpoints"},
+	}
+
+	for _, ca := range cases {
+		c := &Config{Wireguard: wireguard.DefaultConfig()}
+		c.Wireguard.Subnet = validator.Subnet(ca.subnet)
+		c.Wireguard.ServerIPv4 = ca.serverIP
+		c.Wireguard.RoutingTable = ca.table
+		c.Wireguard.Endpoints = ca.endpoints
+		if ca.offset > 0 {
+			c.IPPool = &ipalloc.Config{StartOffset: ca.offset}
+		}
+
+		err := c.validate()
+		if len(ca.field) == 0 {
+			require.NoError(t, err, "subnet %s, server %s", ca.subnet, ca.serverIP)
+			continue
+		}
+
+		require.ErrorIs(t, err, xerror.EInvalidConfiguration("", ""), "subnet %s, server %s", ca.subnet, ca.serverIP)
+		require.Contains(t, err.Error(), ca.field)
+	}
+}
+
 func TestConfig_SetAdminPassword(t *testing.T) {
 	cases := []struct {
 		in string
@@ -85,3 +147,169 @@ func TestConfig_SetAdminPassword(t *testing.T) {
 		}
 	}
 }
+
+func TestConfig_SetWireguardDNS(t *testing.T) {
+	c := &Config{path: filepath.Join(t.TempDir(), "config.yaml")}
+
+	require.NoError(t, c.SetWireguardDNS([]string{"1.1.1.1", "8.8.8.8"}))
+	require.Equal(t, []string{"1.1.1.1", "8.8.8.8"}, c.GetWireguardDNS())
+
+	for _, dns := range [][]string{{"1.1.1"}, {"::1"}, {"1.1.1.1", "dns.example.com"}} {
+		require.Error(t, c.SetWireguardDNS(dns), "dns %v", dns)
+	}
+	// the invalid list changes nothing
+	require.Equal(t, []string{"1.1.1.1", "8.8.8.8"}, c.GetWireguardDNS())
+}
+
+func TestConfig_validateTunnelDNS(t *testing.T) {
+	c := &Config{
+		path:      filepath.Join(t.TempDir(), "config.yaml"),
+		Wireguard: wireguard.Config{Subnet: "10.235.0.0/16"},
+	}
+	// not enforced
+	require.NoError(t, c.validateTunnelDNS(nil))
+	require.NoError(t, c.SetWireguardDNS([]string{"1.1.1.1"}))
+
+	c.EnforceTunnelDNS = firewall.DNSEnforcement{"internet_only": true}
+	require.NoError(t, c.validateTunnelDNS([]string{"10.235.0.1"}))
+	require.Error(t, c.validateTunnelDNS(nil))
+	require.Error(t, c.validateTunnelDNS([]string{"10.235.0.1", "1.1.1.1"}))
+
+	require.Error(t, c.SetWireguardDNS([]string{"8.8.8.8"}))
+	require.Equal(t, []string{"1.1.1.1"}, c.GetWireguardDNS())
+	require.NoError(t, c.SetWireguardDNS([]string{"10.235.0.1"}))
+}
+
+func TestConfig_GetClientHints(t *testing.T) {
+	c := &Config{Wireguard: wireguard.DefaultConfig()}
+	_, ok := c.GetClientHints(ipam.Policy{})
+	require.False(t, ok)
+
+	c.ClientMTU = ClientMTUPolicies{"internet_only": {MTU: 1412, ClampMSS: true}}
+	require.NoError(t, c.validate())
+
+	// the default policy is internet_only
+	hints, ok := c.GetClientHints(ipam.Policy{Access: ipam.AccessPolicyDefault})
+	require.True(t, ok)
+	require.Equal(t, 1412, hints.MTU)
+	require.NotEmpty(t, hints.PostUp)
+
+	_, ok = c.GetClientHints(ipam.Policy{Access: ipam.AccessPolicyAllowAll})
+	require.False(t, ok)
+
+	c.ClientMTU = ClientMTUPolicies{"restricted": {}}
+	require.ErrorIs(t, c.validate(), xerror.EInvalidConfiguration("", ""))
+}
+
+func TestConfig_validateFirewallMark(t *testing.T) {
+	c := &Config{Wireguard: wireguard.DefaultConfig()}
+	c.Wireguard.FirewallMark = 0x51
+	require.NoError(t, c.validate())
+
+	c.Wireguard.FirewallMark = -1
+	require.ErrorIs(t, c.validate(), xerror.EInvalidConfiguration("", ""))
+}
+
+func TestHttpConfigValidate(t *testing.T) {
+	tests := []struct {
+		labels map[string]string
+		valid  bool
+	}{
+		{labels: nil, valid: true},
+		{labels: map[string]string{"tenant": "acme", "instance_1": "a"}, valid: true},
+		{labels: map[string]string{"1tenant": "acme"}, valid: false},
+		{labels: map[string]string{"ten-ant": "acme"}, valid: false},
+		{labels: map[string]string{"__name__": "acme"}, valid: false},
+	}
+
+	for _, tt := range tests {
+		err := HttpConfig{PrometheusLabels: tt.labels}.validate()
+		if tt.valid {
+			require.NoError(t, err, "%v", tt.labels)
+		} else {
+			require.Error(t, err, "%v", tt.labels)
+		}
+	}
+}
+
+func TestConfig_GetClientAllowedIPs(t *testing.T) {
+	c := &Config{Wireguard: wireguard.DefaultConfig()}
+	c.Wireguard.DNS = []string{"10.8.0.2"}
+	require.Equal(t, []string{"0.0.0.0/0"}, c.GetClientAllowedIPs(ipam.Policy{}))
+
+	// split tunnel for the default internet_only policy, the VPN subnet is excluded
+	c.ClientAllowedIPs = ClientAllowedIPsPolicies{"internet_only": {"192.168.10.0/24"}}
+	require.NoError(t, c.validate())
+	require.Equal(t, []string{"192.168.10.0/24", "10.8.0.2/32"}, c.GetClientAllowedIPs(ipam.Policy{Access: ipam.AccessPolicyDefault}))
+	require.Equal(t, []string{"0.0.0.0/0"}, c.GetClientAllowedIPs(ipam.Policy{Access: ipam.AccessPolicyAllowAll}))
+
+	disabled := false
+	c.ClientDNSRoute = &disabled
+	require.Equal(t, []string{"192.168.10.0/24"}, c.GetClientAllowedIPs(ipam.Policy{}))
+
+	for _, ips := range [][]string{{}, {"192.168.10.0"}} {
+		c.ClientAllowedIPs = ClientAllowedIPsPolicies{"internet_only": ips}
+		require.ErrorIs(t, c.validate(), xerror.EInvalidConfiguration("", ""), "ips %v", ips)
+	}
+}
+
+func TestConfig_validateExtraSubnets(t *testing.T) {
+	c := &Config{IPPool: &ipalloc.Config{ExtraSubnets: []validator.Subnet{"10.20.5.0/24"}}}
+	// the default policy is internet_only
+	require.Error(t, c.validateExtraSubnets())
+
+	c.NetworkPolicy = &NetworkAccessPolicy{Access: ipam.NetworkAccess{DefaultPolicy: ipam.AliasAllowAll()}}
+	require.NoError(t, c.validateExtraSubnets())
+
+	c.NetworkPolicy.RateLimit = &ipam.RateLimiterConfig{TotalBandwidth: 1000}
+	require.Error(t, c.validateExtraSubnets())
+}
+
+func TestConfig_GetPoolPressureThresholds(t *testing.T) {
+	var c *Config
+	require.Equal(t, []int{DefaultPoolPressureWarning, DefaultPoolPressureCritical}, c.GetPoolPressureThresholds())
+
+	c = &Config{PoolPressure: []int{70}}
+	require.Equal(t, []int{70}, c.GetPoolPressureThresholds())
+}
+
+func TestConfig_validateListenAddrs(t *testing.T) {
+	tests := []struct {
+		admin      string
+		federation string
+		valid      bool
+	}{
+		{valid: true},
+		{admin: "127.0.0.1:8443", federation: ":8444", valid: true},
+		{admin: "127.0.0.1:80", valid: false},
+		{admin: "[::1]:8443", federation: "10.0.0.1:8443", valid: true},
+		{admin: ":8443", federation: "10.0.0.1:8443", valid: false},
+		{admin: "localhost:8443", valid: false},
+		{admin: "example.com:8443", valid: false},
+		{admin: "127.0.0.1", valid: false},
+		{federation: ":0", valid: false},
+		{federation: "0.0.0.0:443", valid: false},
+	}
+
+	for _, tt := range tests {
+		c := &Config{
+			HTTP:          HttpConfig{ListenAddr: ":80"},
+			SSL:           &xhttp.SSLConfig{ListenAddr: ":443"},
+			AdminAPI:      &AdminAPIConfig{ListenAddr: tt.admin},
+			FederationAPI: &FederationAPIConfig{ListenAddr: tt.federation},
+		}
+		err := c.validateListenAddrs()
+		if tt.valid {
+			require.NoError(t, err, "admin %q, federation %q", tt.admin, tt.federation)
+		} else {
+			require.ErrorIs(t, err, xerror.EInvalidConfiguration("", ""), "admin %q, federation %q", tt.admin, tt.federation)
+		}
+	}
+
+	// the admin API can't be both on its own listener and socket only
+	c := &Config{
+		HTTP:     HttpConfig{ListenAddr: ":80"},
+		AdminAPI: &AdminAPIConfig{ListenAddr: "127.0.0.1:8443", Socket: &AdminSocketConfig{Path: "/run/admin.sock", Exclusive: true}},
+	}
+	require.Error(t, c.validateListenAddrs())
+}
@@ -7,6 +7,8 @@ package storage
 import (
 	"embed"
 	"errors"
+	"fmt"
+	"sync/atomic"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/vpnhouse/common-lib-go/xerror"
@@ -20,6 +22,9 @@ var migrations embed.FS
 
 var ErrNotFound = errors.New("not found")
 
+// memoryDBs numbers in-memory databases to keep them apart
+var memoryDBs atomic.Int64
+
 type Storage struct {
 	db *sqlx.DB
 }
@@ -35,6 +40,26 @@ func New(path string) (*Storage, error) {
 	}, nil
 }
 
+// NewMemory returns the storage keeping its data in memory,
+// the data is lost on Shutdown or the process restart.
+// The semantics are the same as for the file database.
+func NewMemory() (*Storage, error) {
+	// connections of the pool must share the same database
+	path := fmt.Sprintf("file:memdb%d?mode=memory&cache=shared", memoryDBs.Add(1))
+	db, err := xstorage.NewSqlite3(path, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	// the database lives as long as the connection does,
+	// a single one also avoids the shared cache table locking
+	db.SetMaxOpenConns(1)
+
+	return &Storage{
+		db: db,
+	}, nil
+}
+
 func (storage *Storage) Shutdown() error {
 	err := storage.db.Close()
 	if err != nil {
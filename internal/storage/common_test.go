@@ -0,0 +1,45 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/tunnel/internal/types"
+)
+
+func TestNewMemory(t *testing.T) {
+	a, err := NewMemory()
+	require.NoError(t, err)
+	b, err := NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.Shutdown() })
+
+	keys := []types.AuthorizerKey{{ID: "key", Source: "test", Key: "data"}}
+	require.NoError(t, a.UpdateAuthorizerKeys(keys))
+	a.SetUpstreamMetric(42)
+
+	stored, err := a.ListAuthorizerKeys()
+	require.NoError(t, err)
+	assert.Equal(t, keys, stored)
+	assert.EqualValues(t, 42, a.GetUpstreamMetric())
+
+	// databases are independent
+	stored, err = b.ListAuthorizerKeys()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+	assert.Zero(t, b.GetUpstreamMetric())
+
+	// and do not survive the restart
+	require.NoError(t, a.Shutdown())
+	a, err = NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = a.Shutdown() })
+	stored, err = a.ListAuthorizerKeys()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+}
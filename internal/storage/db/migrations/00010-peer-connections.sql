@@ -0,0 +1,11 @@
+-- +migrate Up
+-- +migrate StatementBegin
+ALTER TABLE "peers" ADD column "connect_count" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "peers" ADD column "last_connected_at" INTEGER;
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+ALTER TABLE "peers" DROP column "connect_count";
+ALTER TABLE "peers" DROP column "last_connected_at";
+-- +migrate StatementEnd
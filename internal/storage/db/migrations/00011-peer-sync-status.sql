@@ -0,0 +1,11 @@
+-- +migrate Up
+-- +migrate StatementBegin
+ALTER TABLE "peers" ADD column "last_sync_error" TEXT;
+ALTER TABLE "peers" ADD column "last_synced_at" INTEGER;
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+ALTER TABLE "peers" DROP column "last_sync_error";
+ALTER TABLE "peers" DROP column "last_synced_at";
+-- +migrate StatementEnd
@@ -0,0 +1,9 @@
+-- +migrate Up
+-- +migrate StatementBegin
+ALTER TABLE "peers" ADD column "point_to_point" INTEGER;
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+ALTER TABLE "peers" DROP column "point_to_point";
+-- +migrate StatementEnd
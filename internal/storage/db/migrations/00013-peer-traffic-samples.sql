@@ -0,0 +1,17 @@
+-- +migrate Up
+-- +migrate StatementBegin
+CREATE TABLE IF NOT EXISTS peer_traffic_samples (
+    peer_id     INTEGER NOT NULL,
+    hour        INTEGER NOT NULL,
+    upstream    INTEGER NOT NULL DEFAULT 0,
+    downstream  INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (peer_id, hour)
+);
+
+CREATE INDEX IF NOT EXISTS peer_traffic_samples_hour ON peer_traffic_samples(hour);
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+DROP TABLE peer_traffic_samples;
+-- +migrate StatementEnd
@@ -0,0 +1,21 @@
+-- +migrate Up
+-- +migrate StatementBegin
+CREATE TABLE IF NOT EXISTS events (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    type            INTEGER NOT NULL,
+    timestamp       INTEGER NOT NULL,
+    user_id         VARCHAR(64) NOT NULL DEFAULT "",
+    installation_id VARCHAR(64) NOT NULL DEFAULT "",
+    session_id      VARCHAR(64) NOT NULL DEFAULT "",
+    data            BLOB
+);
+
+CREATE INDEX IF NOT EXISTS events_type_timestamp ON events(type, timestamp);
+CREATE INDEX IF NOT EXISTS events_user_id ON events(user_id);
+CREATE INDEX IF NOT EXISTS events_installation_id ON events(installation_id);
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+DROP TABLE events;
+-- +migrate StatementEnd
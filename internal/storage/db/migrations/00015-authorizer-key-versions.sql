@@ -0,0 +1,12 @@
+-- +migrate Up
+-- +migrate StatementBegin
+CREATE TABLE IF NOT EXISTS authorizer_key_versions (
+    source  char(100) PRIMARY KEY,
+    version INTEGER NOT NULL
+);
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+DROP TABLE IF EXISTS authorizer_key_versions;
+-- +migrate StatementEnd
@@ -0,0 +1,13 @@
+-- +migrate Up
+-- +migrate StatementBegin
+CREATE TABLE IF NOT EXISTS traffic_totals (
+    hour        INTEGER PRIMARY KEY,
+    upstream    INTEGER NOT NULL DEFAULT 0,
+    downstream  INTEGER NOT NULL DEFAULT 0
+);
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+DROP TABLE traffic_totals;
+-- +migrate StatementEnd
@@ -0,0 +1,30 @@
+-- +migrate Up
+-- +migrate StatementBegin
+-- keyless peers are only valid while waiting for the shared link activation,
+-- the rest can never be programmed and are moved aside for the inspection.
+CREATE TABLE IF NOT EXISTS peers_quarantine AS SELECT * FROM peers WHERE 0;
+INSERT INTO peers_quarantine SELECT * FROM peers
+    WHERE wireguard_key IS NULL AND (sharing_key IS NULL OR sharing_key = '');
+DELETE FROM peers
+    WHERE wireguard_key IS NULL AND (sharing_key IS NULL OR sharing_key = '');
+
+CREATE TRIGGER IF NOT EXISTS peers_key_required_insert BEFORE INSERT ON peers
+    WHEN NEW.wireguard_key IS NULL AND (NEW.sharing_key IS NULL OR NEW.sharing_key = '')
+BEGIN
+    SELECT RAISE(ABORT, 'peer must have public key set');
+END;
+
+CREATE TRIGGER IF NOT EXISTS peers_key_required_update BEFORE UPDATE ON peers
+    WHEN NEW.wireguard_key IS NULL AND (NEW.sharing_key IS NULL OR NEW.sharing_key = '')
+BEGIN
+    SELECT RAISE(ABORT, 'peer must have public key set');
+END;
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+DROP TRIGGER IF EXISTS peers_key_required_insert;
+DROP TRIGGER IF EXISTS peers_key_required_update;
+INSERT INTO peers SELECT * FROM peers_quarantine;
+DROP TABLE peers_quarantine;
+-- +migrate StatementEnd
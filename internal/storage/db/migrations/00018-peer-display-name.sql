@@ -0,0 +1,9 @@
+-- +migrate Up
+-- +migrate StatementBegin
+ALTER TABLE peers ADD COLUMN display_name VARCHAR(128);
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+ALTER TABLE peers DROP COLUMN display_name;
+-- +migrate StatementEnd
@@ -0,0 +1,9 @@
+-- +migrate Up
+-- +migrate StatementBegin
+ALTER TABLE peers ADD COLUMN modified_by VARCHAR(256);
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+ALTER TABLE peers DROP COLUMN modified_by;
+-- +migrate StatementEnd
@@ -0,0 +1,109 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"go.uber.org/zap"
+)
+
+// PutEvent stores the event record, the ID is assigned by the database.
+func (storage *Storage) PutEvent(record types.EventRecord) error {
+	const q = `INSERT INTO events(type, timestamp, user_id, installation_id, session_id, data) VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err := storage.db.Exec(q, record.Type, record.Timestamp.Unix(),
+		record.UserID, record.InstallationID, record.SessionID, []byte(record.Data))
+	if err != nil {
+		return xerror.EStorageError("can't put event", err, zap.Int32("type", record.Type))
+	}
+	return nil
+}
+
+// SearchEvents returns up to limit events matching the filter, newest first.
+// The cursor is the ID of the last event of the previous page, zero starts
+// from the newest event. The returned cursor points to the next page,
+// it's zero if there are no more events.
+func (storage *Storage) SearchEvents(filter types.EventFilter, cursor int64, limit int) ([]types.EventRecord, int64, error) {
+	if limit <= 0 {
+		return nil, 0, xerror.EInvalidArgument("limit must be positive", nil)
+	}
+
+	var conds []string
+	var args []interface{}
+	where := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+
+	if cursor > 0 {
+		where("id < ?", cursor)
+	}
+	if len(filter.Types) > 0 {
+		placeholders := make([]string, len(filter.Types))
+		for i, t := range filter.Types {
+			args = append(args, t)
+			placeholders[i] = "$" + strconv.Itoa(len(args))
+		}
+		conds = append(conds, "type IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if len(filter.UserID) > 0 {
+		where("user_id = ?", filter.UserID)
+	}
+	if len(filter.InstallationID) > 0 {
+		where("installation_id = ?", filter.InstallationID)
+	}
+	if len(filter.SessionID) > 0 {
+		where("session_id = ?", filter.SessionID)
+	}
+	if !filter.Since.IsZero() {
+		where("timestamp >= ?", filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		where("timestamp < ?", filter.Until.Unix())
+	}
+
+	q := `SELECT id, type, timestamp, user_id, installation_id, session_id, data FROM events`
+	if len(conds) > 0 {
+		q += ` WHERE ` + strings.Join(conds, " AND ")
+	}
+	// fetch one more record to find out whether the next page exists
+	args = append(args, limit+1)
+	q += ` ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := storage.db.Query(q, args...)
+	if err != nil {
+		return nil, 0, xerror.EStorageError("can't search events", err)
+	}
+	defer rows.Close()
+
+	records := make([]types.EventRecord, 0, limit)
+	for rows.Next() {
+		var ts int64
+		var data []byte
+		var record types.EventRecord
+		err := rows.Scan(&record.ID, &record.Type, &ts, &record.UserID, &record.InstallationID, &record.SessionID, &data)
+		if err != nil {
+			return nil, 0, xerror.EStorageError("can't scan event", err)
+		}
+		record.Timestamp = time.Unix(ts, 0)
+		record.Data = data
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, xerror.EStorageError("can't search events", err)
+	}
+
+	var next int64
+	if len(records) > limit {
+		records = records[:limit]
+		next = records[limit-1].ID
+	}
+	return records, next, nil
+}
@@ -29,18 +29,111 @@ func (storage *Storage) UpdateAuthorizerKeys(keys []types.AuthorizerKey) error {
 		return xerror.EStorageError("failed to start transaction", err)
 	}
 
+	if err := insertAuthorizerKeys(tx, keys); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateAuthorizerKeysVersion updates or inserts the given keys of the source
+// only if the version is greater than the last one stored for the source,
+// so a replayed or reordered update can't revert newer keys.
+func (storage *Storage) UpdateAuthorizerKeysVersion(source string, version int64, keys []types.AuthorizerKey) error {
+	if len(keys) == 0 {
+		return xerror.EInvalidArgument("empty key list given", nil)
+	}
+
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return xerror.EStorageError("failed to start transaction", err)
+	}
+
+	// the conditional upsert both checks and bumps the version
+	const q = `insert into authorizer_key_versions(source, version) values ($1, $2)
+				on conflict(source) do update set version=$2 where version < $2`
+
+	res, err := tx.Exec(q, source, version)
+	if err != nil {
+		_ = tx.Rollback()
+		return xerror.EStorageError("failed to update key set version", err, zap.String("source", source))
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		if err != nil {
+			return xerror.EStorageError("failed to update key set version", err, zap.String("source", source))
+		}
+		return xerror.EExists("key set version is not newer than the stored one", nil,
+			zap.String("source", source), zap.Int64("version", version))
+	}
+
+	if err := insertAuthorizerKeys(tx, keys); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AddAuthorizerKey stores the single key, the stored key with the same ID
+// is never replaced: adding it again is a no-op, adding the other key fails.
+func (storage *Storage) AddAuthorizerKey(key types.AuthorizerKey) error {
+	const q = `insert into authorizer_keys(id, source, key) values ($1, $2, $3)
+				on conflict(id) do nothing`
+
+	res, err := storage.db.Exec(q, key.ID, key.Source, key.Key)
+	if err != nil {
+		return xerror.EStorageError("failed to insert key", err,
+			zap.String("id", key.ID), zap.String("source", key.Source))
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	stored, err := storage.GetAuthorizerKeyByID(key.ID)
+	if err != nil {
+		return err
+	}
+	if stored.Key != key.Key {
+		return xerror.EExists("key with the given id already exists", nil, zap.String("id", key.ID))
+	}
+	return nil
+}
+
+// RevokeAuthorizerKey deletes the single key,
+// unlike DeleteAuthorizerKey the missing key is reported.
+func (storage *Storage) RevokeAuthorizerKey(id string) error {
+	if len(id) == 0 {
+		return xerror.EInvalidArgument("empty id given", nil)
+	}
+
+	const q = `delete from authorizer_keys where id = $1`
+	res, err := storage.db.Exec(q, id)
+	if err != nil {
+		return xerror.EStorageError("failed to delete authorizer key", err, zap.String("id", id))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return xerror.EStorageError("failed to delete authorizer key", err, zap.String("id", id))
+	}
+	if n == 0 {
+		return xerror.EEntryNotFound("no such key", nil, zap.String("id", id))
+	}
+	return nil
+}
+
+func insertAuthorizerKeys(tx *sql.Tx, keys []types.AuthorizerKey) error {
 	const q = `insert into authorizer_keys(id, source, key) values ($1, $2, $3)
 				on conflict(id) do update set source=$2,key=$3`
 
 	for _, key := range keys {
 		if _, err := tx.Exec(q, key.ID, key.Source, key.Key); err != nil {
-			_ = tx.Rollback()
 			return xerror.EStorageError("failed to insert key", err,
 				zap.String("id", key.ID), zap.String("source", key.Source))
 		}
 	}
-
-	return tx.Commit()
+	return nil
 }
 
 func (storage *Storage) GetAuthorizerKeyByID(id string) (types.AuthorizerKey, error) {
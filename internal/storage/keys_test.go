@@ -0,0 +1,61 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/tunnel/internal/types"
+)
+
+func TestAddAuthorizerKey(t *testing.T) {
+	s, err := NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	require.NoError(t, s.UpdateAuthorizerKeys([]types.AuthorizerKey{{ID: "a", Source: "controller", Key: "data-a"}}))
+
+	key := types.AuthorizerKey{ID: "b", Source: "controller", Key: "data-b"}
+	require.NoError(t, s.AddAuthorizerKey(key))
+	// adding the same key again is a no-op
+	require.NoError(t, s.AddAuthorizerKey(key))
+
+	// the stored key is never replaced
+	err = s.AddAuthorizerKey(types.AuthorizerKey{ID: "a", Source: "other", Key: "data-c"})
+	assert.ErrorIs(t, err, xerror.EExists("", nil))
+
+	stored, err := s.ListAuthorizerKeys()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []types.AuthorizerKey{
+		{ID: "a", Source: "controller", Key: "data-a"},
+		key,
+	}, stored)
+}
+
+func TestRevokeAuthorizerKey(t *testing.T) {
+	s, err := NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	keys := []types.AuthorizerKey{
+		{ID: "a", Source: "controller", Key: "data-a"},
+		{ID: "b", Source: "controller", Key: "data-b"},
+	}
+	require.NoError(t, s.UpdateAuthorizerKeys(keys))
+
+	// other keys are kept
+	require.NoError(t, s.RevokeAuthorizerKey("a"))
+	stored, err := s.ListAuthorizerKeys()
+	require.NoError(t, err)
+	assert.Equal(t, keys[1:], stored)
+
+	// the missing key is reported
+	assert.ErrorIs(t, s.RevokeAuthorizerKey("a"), xerror.EEntryNotFound("", nil))
+	assert.ErrorIs(t, s.RevokeAuthorizerKey("missing"), xerror.EEntryNotFound("", nil))
+	assert.ErrorIs(t, s.RevokeAuthorizerKey(""), xerror.EInvalidArgument("", nil))
+}
@@ -47,3 +47,18 @@ func (storage *Storage) SetUpstreamMetric(value int64) {
 func (storage *Storage) SetDownstreamMetric(value int64) {
 	storage.setMetric("downstream", value)
 }
+
+func (storage *Storage) GetEventSequence() (uint64, error) {
+	value, err := storage.getMetric("event_sequence")
+	if err != nil {
+		if errors.Is(err, xerror.EEntryNotFound("", nil)) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return uint64(value), nil
+}
+
+func (storage *Storage) SetEventSequence(seq uint64) error {
+	return storage.setMetric("event_sequence", int64(seq))
+}
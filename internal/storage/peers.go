@@ -5,30 +5,39 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
 	"github.com/vpnhouse/common-lib-go/xstorage"
 	"github.com/vpnhouse/common-lib-go/xtime"
 	"go.uber.org/zap"
 )
 
 func (storage *Storage) SearchPeers(filter *types.PeerInfo) ([]*types.PeerInfo, error) {
+	return storage.SearchPeersContext(context.Background(), filter)
+}
+
+// SearchPeersContext is the SearchPeers aborted on the context cancellation.
+func (storage *Storage) SearchPeersContext(ctx context.Context, filter *types.PeerInfo) ([]*types.PeerInfo, error) {
 	if filter == nil {
 		// tolerate nil
 		filter = &types.PeerInfo{}
 	}
 
-	zapFilter := zap.Any("filter", filter)
+	zapFilter := types.LogPeer("filter", filter)
 	query, err := xstorage.GetSelectRequest("peers", filter)
 	if err != nil {
 		return nil, xerror.EStorageError("can't get peer select query", err, zapFilter)
 	}
 
-	rows, err := storage.db.NamedQuery(query, filter)
+	rows, err := storage.db.NamedQueryContext(ctx, query, filter)
 	if err != nil {
 		return nil, xerror.EStorageError("can't lookup peers", err, zapFilter)
 	}
@@ -54,6 +63,143 @@ func (storage *Storage) SearchPeers(filter *types.PeerInfo) ([]*types.PeerInfo,
 	return peers, nil
 }
 
+// SearchPeersByDisplayName returns peers whose display name contains
+// the given substring, ASCII letters are matched case-insensitively.
+// No index serves the substring match, the table is scanned.
+func (storage *Storage) SearchPeersByDisplayName(ctx context.Context, substr string) ([]*types.PeerInfo, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(substr)
+	rows, err := storage.db.QueryxContext(ctx, `select * from peers where display_name like $1 escape '\'`, "%"+escaped+"%")
+	if err != nil {
+		return nil, xerror.EStorageError("can't lookup peers", err, types.LogString("display_name", &substr))
+	}
+	defer rows.Close()
+
+	peers := scanPeers(rows)
+	if err := rows.Err(); err != nil {
+		return nil, xerror.EStorageError("can't lookup peers", err, types.LogString("display_name", &substr))
+	}
+	return peers, nil
+}
+
+// SearchPeersInLink returns peers with the address in the point-to-point
+// link the given address belongs to, i.e. the aligned /31 of it.
+// Only such peers may have AllowedIPs overlapping the ones of the address.
+func (storage *Storage) SearchPeersInLink(ctx context.Context, ip xnet.IP) ([]*types.PeerInfo, error) {
+	// links always start at the even address
+	first := xnet.Uint32ToIP(ip.ToUint32() &^ 1)
+	second := xnet.Uint32ToIP(first.ToUint32() + 1)
+	rows, err := storage.db.QueryxContext(ctx, `select * from peers where ipv4 in ($1, $2)`, first.String(), second.String())
+	if err != nil {
+		return nil, xerror.EStorageError("can't lookup peers", err, zap.Stringer("ipv4", &ip))
+	}
+	defer rows.Close()
+
+	peers := scanPeers(rows)
+	if err := rows.Err(); err != nil {
+		return nil, xerror.EStorageError("can't lookup peers", err, zap.Stringer("ipv4", &ip))
+	}
+	return peers, nil
+}
+
+// scanPeers reads the peers from rows skipping the ones
+// which can't be scanned or fail the validation.
+func scanPeers(rows *sqlx.Rows) []*types.PeerInfo {
+	var peers []*types.PeerInfo
+	for rows.Next() {
+		var p types.PeerInfo
+		if err := rows.StructScan(&p); err != nil {
+			zap.L().Error("can't scan peer", zap.Error(err))
+			continue
+		}
+
+		// We must ensure database integrity
+		if err := p.Validate(); err != nil {
+			zap.L().Error("skipping invalid peer", zap.Error(err), zap.Int64("id", p.ID))
+			continue
+		}
+
+		peers = append(peers, &p)
+	}
+	return peers
+}
+
+// ListPeersAfter returns up to limit peers with ID greater than afterID
+// ordered by ID, so all peers may be fetched page by page.
+// The ID of the last row read is returned to continue with,
+// it equals afterID if there are no more rows.
+func (storage *Storage) ListPeersAfter(ctx context.Context, afterID int64, limit int) ([]*types.PeerInfo, int64, error) {
+	rows, err := storage.db.QueryxContext(ctx, "select * from peers where id > $1 order by id limit $2", afterID, limit)
+	if err != nil {
+		return nil, afterID, xerror.EStorageError("can't lookup peers", err, zap.Int64("after_id", afterID))
+	}
+	defer rows.Close()
+
+	lastID := afterID
+	peers := make([]*types.PeerInfo, 0, limit)
+	for rows.Next() {
+		var p types.PeerInfo
+		if err := rows.StructScan(&p); err != nil {
+			zap.L().Error("can't scan peer", zap.Error(err), zap.Int64("after_id", lastID))
+			continue
+		}
+		lastID = p.ID
+
+		// We must ensure database integrity
+		if err := p.Validate(); err != nil {
+			zap.L().Error("skipping invalid peer", zap.Error(err), zap.Int64("id", p.ID))
+			continue
+		}
+
+		peers = append(peers, &p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, afterID, xerror.EStorageError("can't lookup peers", err, zap.Int64("after_id", afterID))
+	}
+	return peers, lastID, nil
+}
+
+// CountActivatedPeers returns the number of peers having the wireguard key,
+// i.e. all the peers but the shared ones not activated yet.
+func (storage *Storage) CountActivatedPeers(ctx context.Context) (int64, error) {
+	var count int64
+	if err := storage.db.GetContext(ctx, &count, `select count(*) from peers where wireguard_key is not null`); err != nil {
+		return 0, xerror.EStorageError("can't count peers", err)
+	}
+	return count, nil
+}
+
+// CountPeers returns the number of peers matching the filter,
+// the filter is applied the same way as in SearchPeers.
+// Note that rows failing the validation are counted too.
+func (storage *Storage) CountPeers(filter *types.PeerInfo) (int64, error) {
+	if filter == nil {
+		// tolerate nil
+		filter = &types.PeerInfo{}
+	}
+
+	zapFilter := types.LogPeer("filter", filter)
+	selectQuery, err := xstorage.GetSelectRequest("peers", filter)
+	if err != nil {
+		return 0, xerror.EStorageError("can't get peer count query", err, zapFilter)
+	}
+	// count over the same select SearchPeers runs to match its filter
+	query := "SELECT COUNT(*) FROM (" + selectQuery + ")"
+
+	rows, err := storage.db.NamedQuery(query, filter)
+	if err != nil {
+		return 0, xerror.EStorageError("can't count peers", err, zapFilter)
+	}
+	defer rows.Close()
+
+	var count int64
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return 0, xerror.EStorageError("can't scan peer count", err, zapFilter)
+		}
+	}
+	return count, nil
+}
+
 func (storage *Storage) CreatePeer(peer types.PeerInfo) (int64, error) {
 	err := peer.Validate("ID")
 	if err != nil {
@@ -74,22 +220,29 @@ func (storage *Storage) CreatePeer(peer types.PeerInfo) (int64, error) {
 	if peer.Downstream == nil {
 		peer.Downstream = &zeroVal
 	}
+	if peer.ConnectCount == nil {
+		peer.ConnectCount = &zeroVal
+	}
 
 	query, err := xstorage.GetInsertRequest("peers", peer)
 	if err != nil {
-		return -1, xerror.EStorageError("can't insert peer", err, zap.Any("peer", peer))
+		return -1, xerror.EStorageError("can't insert peer", err, types.LogPeer("peer", &peer))
 	}
 
-	zap.L().Debug("Create peer", zap.Any("peer", peer), zap.String("query", query))
+	zap.L().Debug("Create peer", types.LogPeer("peer", &peer), zap.String("query", query))
 
-	res, err := storage.db.NamedExec(query, peer)
+	var res sql.Result
+	err = withRetry("create_peer", func() error {
+		res, err = storage.db.NamedExec(query, peer)
+		return err
+	})
 	if err != nil {
-		return -1, xerror.EStorageError("can't insert peer to sqlite", err, zap.Any("peer", peer), zap.String("query", query))
+		return -1, xerror.EStorageError("can't insert peer to sqlite", err, types.LogPeer("peer", &peer), zap.String("query", query))
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		return -1, xerror.EStorageError("can't get peer id after insert", err, zap.Any("peer", peer), zap.String("query", query))
+		return -1, xerror.EStorageError("can't get peer id after insert", err, types.LogPeer("peer", &peer), zap.String("query", query))
 	}
 
 	return id, nil
@@ -98,10 +251,89 @@ func (storage *Storage) CreatePeer(peer types.PeerInfo) (int64, error) {
 // Update only statistics related peer details
 func (storage *Storage) UpdatePeerStats(now time.Time, peer *types.PeerInfo) error {
 	peer.Updated = &xtime.Time{Time: now}
-	query := "UPDATE peers SET updated=:updated, activity=:activity, upstream=:upstream, downstream=:downstream WHERE id=:id"
-	_, err := storage.db.NamedExec(query, peer)
+	query := "UPDATE peers SET updated=:updated, activity=:activity, upstream=:upstream, downstream=:downstream, connect_count=:connect_count, last_connected_at=:last_connected_at WHERE id=:id"
+	err := withRetry("update_peer_stats", func() error {
+		_, err := storage.db.NamedExec(query, peer)
+		return err
+	})
+	if err != nil {
+		return xerror.EStorageError("can't update peer stats", err, types.LogPeer("peer", peer))
+	}
+	return nil
+}
+
+// Update only connection tracking peer details
+func (storage *Storage) UpdatePeerConnections(peer *types.PeerInfo) error {
+	query := "UPDATE peers SET connect_count=:connect_count, last_connected_at=:last_connected_at WHERE id=:id"
+	err := withRetry("update_peer_connections", func() error {
+		_, err := storage.db.NamedExec(query, peer)
+		return err
+	})
+	if err != nil {
+		return xerror.EStorageError("can't update peer connections", err, types.LogPeer("peer", peer))
+	}
+	return nil
+}
+
+// Update only device programming status peer details
+func (storage *Storage) UpdatePeerSyncStatus(peer *types.PeerInfo) error {
+	query := "UPDATE peers SET last_sync_error=:last_sync_error, last_synced_at=:last_synced_at WHERE id=:id"
+	err := withRetry("update_peer_sync_status", func() error {
+		_, err := storage.db.NamedExec(query, peer)
+		return err
+	})
+	if err != nil {
+		return xerror.EStorageError("can't update peer sync status", err, types.LogPeer("peer", peer))
+	}
+	return nil
+}
+
+// UpdatePeersOnline updates only the reported presence
+// of given peers in a single transaction.
+func (storage *Storage) UpdatePeersOnline(peers []*types.PeerInfo) error {
+	query := "UPDATE peers SET online=:online WHERE id=:id"
+	err := withRetry("update_peers_online", func() error {
+		txx, err := storage.db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range peers {
+			if _, err := txx.NamedExec(query, peer); err != nil {
+				_ = txx.Rollback()
+				return err
+			}
+		}
+		return txx.Commit()
+	})
 	if err != nil {
-		return xerror.EStorageError("can't update peer stats", err, zap.Any("peer", peer))
+		return xerror.EStorageError("can't update peers online state", err, zap.Int("count", len(peers)))
+	}
+	return nil
+}
+
+// UpdatePeersExpiration updates only the expiration of given peers
+// in a single transaction, nothing is changed on failure.
+func (storage *Storage) UpdatePeersExpiration(peers []*types.PeerInfo) error {
+	now := xtime.Now()
+	query := "UPDATE peers SET expires=:expires, updated=:updated WHERE id=:id"
+	err := withRetry("update_peers_expiration", func() error {
+		txx, err := storage.db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range peers {
+			peer.Updated = &now
+			if _, err := txx.NamedExec(query, peer); err != nil {
+				_ = txx.Rollback()
+				return err
+			}
+		}
+		return txx.Commit()
+	})
+	if err != nil {
+		return xerror.EStorageError("can't update peers expiration", err, zap.Int("count", len(peers)))
 	}
 	return nil
 }
@@ -116,28 +348,40 @@ func (storage *Storage) UpdatePeer(peer *types.PeerInfo) (int64, error) {
 	now := xtime.Now()
 	peer.Updated = &now
 
-	query, err := xstorage.GetUpdateRequest("peers", "id", peer, []string{"created", "activity", "upstream", "downstream"})
-	zap.L().Debug("Update peer", zap.Any("peer", peer), zap.String("query", query))
+	query, err := xstorage.GetUpdateRequest("peers", "id", peer, []string{"created", "activity", "upstream", "downstream", "connect_count", "last_connected_at", "last_sync_error", "last_synced_at", "online"})
+	zap.L().Debug("Update peer", types.LogPeer("peer", peer), zap.String("query", query))
 
 	if err != nil {
-		return -1, xerror.EStorageError("can't insert peer", err, zap.Any("peer", peer))
+		return -1, xerror.EStorageError("can't insert peer", err, types.LogPeer("peer", peer))
 	}
 
-	if _, err := storage.db.NamedExec(query, peer); err != nil {
-		return -1, xerror.EStorageError("can't update peer in sqlite", err, zap.Any("peer", peer), zap.String("query", query))
+	err = withRetry("update_peer", func() error {
+		_, err := storage.db.NamedExec(query, peer)
+		return err
+	})
+	if err != nil {
+		return -1, xerror.EStorageError("can't update peer in sqlite", err, types.LogPeer("peer", peer), zap.String("query", query))
 	}
 
 	return peer.ID, nil
 }
 
 func (storage *Storage) GetPeer(id int64) (*types.PeerInfo, error) {
-	row := storage.db.QueryRowx("select * from peers where id = $1", id)
+	return storage.GetPeerContext(context.Background(), id)
+}
+
+// GetPeerContext is the GetPeer aborted on the context cancellation.
+func (storage *Storage) GetPeerContext(ctx context.Context, id int64) (*types.PeerInfo, error) {
+	row := storage.db.QueryRowxContext(ctx, "select * from peers where id = $1", id)
 	if err := row.Err(); err != nil {
-		return nil, xerror.EStorageError("peer not found", err, zap.Int64("id", id))
+		return nil, xerror.EStorageError("failed to query peer", err, zap.Int64("id", id))
 	}
 
 	var peer types.PeerInfo
 	if err := row.StructScan(&peer); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, xerror.EEntryNotFound("peer not found", nil, zap.Int64("id", id))
+		}
 		return nil, xerror.EStorageError("failed to scan into types.PeerInfo", err, zap.Int64("id", id))
 	}
 
@@ -145,7 +389,29 @@ func (storage *Storage) GetPeer(id int64) (*types.PeerInfo, error) {
 		return nil, err
 	}
 
-	zap.L().Debug("get peer result", zap.Int64("id", id), zap.Any("peer", peer))
+	zap.L().Debug("get peer result", zap.Int64("id", id), types.LogPeer("peer", &peer))
+	return &peer, nil
+}
+
+// GetPeerByIPv4 returns the peer owning the address,
+// the upper address of the point-to-point link belongs to the link peer.
+func (storage *Storage) GetPeerByIPv4(ip xnet.IP) (*types.PeerInfo, error) {
+	// links always start at the even address
+	link := xnet.Uint32ToIP(ip.ToUint32() &^ 1)
+	const q = `select * from peers where ipv4 = $1 or (ipv4 = $2 and point_to_point = 1) limit 1`
+	row := storage.db.QueryRowx(q, ip.String(), link.String())
+
+	var peer types.PeerInfo
+	if err := row.StructScan(&peer); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, xerror.EEntryNotFound("peer not found", nil, zap.Stringer("ipv4", &ip))
+		}
+		return nil, xerror.EStorageError("failed to scan into types.PeerInfo", err, zap.Stringer("ipv4", &ip))
+	}
+
+	if err := peer.Validate(); err != nil {
+		return nil, err
+	}
 	return &peer, nil
 }
 
@@ -153,7 +419,11 @@ func (storage *Storage) DeletePeer(id int64) error {
 	zap.L().Debug("Delete peer", zap.Any("id", id))
 
 	q := `delete from peers where id = ?`
-	if _, err := storage.db.Exec(q, id); err != nil {
+	err := withRetry("delete_peer", func() error {
+		_, err := storage.db.Exec(q, id)
+		return err
+	})
+	if err != nil {
 		return xerror.EStorageError("failed to delete peer", err, zap.Int64("id", id))
 	}
 
@@ -169,7 +439,7 @@ func (s *Storage) GetPeerBySharingKey(skey string) (types.PeerInfo, error) {
 		if errors.Is(err, sql.ErrNoRows) {
 			return types.PeerInfo{}, xerror.EEntryNotFound("no peer with a given sharing key where found", nil)
 		}
-		return types.PeerInfo{}, xerror.EStorageError("failed to scan into types.PeerInfo", err, zap.String("key", skey))
+		return types.PeerInfo{}, xerror.EStorageError("failed to scan into types.PeerInfo", err, types.LogString("key", &skey))
 	}
 
 	return peer, nil
@@ -191,7 +461,7 @@ func (storage *Storage) ActivateSharedPeer(sharingKey string, pubkey string) (in
 		if errors.Is(err, sql.ErrNoRows) {
 			return -1, xerror.EEntryNotFound("no peer with a given sharing key where found", nil)
 		}
-		return -1, xerror.EStorageError("failed to scan into types.PeerInfo", err, zap.String("key", sharingKey))
+		return -1, xerror.EStorageError("failed to scan into types.PeerInfo", err, types.LogString("key", &sharingKey))
 	}
 
 	if peer.SharingKeyExpiration != nil && *peer.SharingKeyExpiration > 0 {
@@ -207,6 +477,6 @@ func (storage *Storage) ActivateSharedPeer(sharingKey string, pubkey string) (in
 	}
 
 	_ = txx.Commit()
-	zap.L().Info("shared peer activated", zap.Int64("id", peer.ID), zap.String("sharing_key", sharingKey))
+	zap.L().Info("shared peer activated", zap.Int64("id", peer.ID), types.LogString("sharing_key", &sharingKey))
 	return peer.ID, nil
 }
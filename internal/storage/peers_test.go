@@ -0,0 +1,189 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"github.com/vpnhouse/tunnel/internal/types"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerKeyRequired(t *testing.T) {
+	s, err := NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	pubKey := key.PublicKey().String()
+	ip := xnet.ParseIP("10.235.0.2")
+	id, err := s.CreatePeer(types.PeerInfo{
+		WireguardInfo: types.WireguardInfo{WireguardPublicKey: &pubKey},
+		Ipv4:          &ip,
+	})
+	require.NoError(t, err)
+
+	// the shared peer gets the key on the activation only
+	sharingKey := "sharing-key"
+	sharedIP := xnet.ParseIP("10.235.0.3")
+	_, err = s.CreatePeer(types.PeerInfo{Ipv4: &sharedIP, SharingKey: &sharingKey})
+	require.NoError(t, err)
+
+	// the storage enforces the key even if the validation is bypassed
+	_, err = s.db.Exec(`insert into peers(ipv4, created, updated) values ('10.235.0.4', 0, 0)`)
+	assert.ErrorContains(t, err, "peer must have public key set")
+	_, err = s.db.Exec(`update peers set wireguard_key = NULL where id = $1`, id)
+	assert.ErrorContains(t, err, "peer must have public key set")
+
+	peer, err := s.GetPeer(id)
+	require.NoError(t, err)
+	assert.Equal(t, pubKey, *peer.WireguardPublicKey)
+}
+
+func TestSearchPeersByDisplayName(t *testing.T) {
+	s, err := NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	for i, name := range []string{"Alice Laptop", "alice phone", "Bob", "100%_done", ""} {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		pubKey := key.PublicKey().String()
+		ip := xnet.ParseIP("10.235.0." + strconv.Itoa(i+2))
+		peer := types.PeerInfo{
+			WireguardInfo: types.WireguardInfo{WireguardPublicKey: &pubKey},
+			Ipv4:          &ip,
+		}
+		if name != "" {
+			peer.DisplayName = &name
+		}
+		_, err = s.CreatePeer(peer)
+		require.NoError(t, err)
+	}
+
+	names := func(substr string) []string {
+		peers, err := s.SearchPeersByDisplayName(context.Background(), substr)
+		require.NoError(t, err)
+		var found []string
+		for _, peer := range peers {
+			found = append(found, *peer.DisplayName)
+		}
+		return found
+	}
+
+	assert.ElementsMatch(t, []string{"Alice Laptop", "alice phone"}, names("ALICE"))
+	assert.Equal(t, []string{"Bob"}, names("ob"))
+	// wildcards are matched literally
+	assert.Equal(t, []string{"100%_done"}, names("%_"))
+	assert.Empty(t, names("carol"))
+}
+
+func TestCountPeers(t *testing.T) {
+	s, err := NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	for i, name := range []string{"alice", "alice", "bob"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		pubKey := key.PublicKey().String()
+		ip := xnet.ParseIP("10.235.0." + strconv.Itoa(i+2))
+		name := name
+		_, err = s.CreatePeer(types.PeerInfo{
+			WireguardInfo: types.WireguardInfo{WireguardPublicKey: &pubKey},
+			Ipv4:          &ip,
+			DisplayName:   &name,
+		})
+		require.NoError(t, err)
+	}
+
+	count := func(filter *types.PeerInfo) int64 {
+		n, err := s.CountPeers(filter)
+		require.NoError(t, err)
+		peers, err := s.SearchPeers(filter)
+		require.NoError(t, err)
+		assert.Len(t, peers, int(n))
+		return n
+	}
+
+	alice, carol := "alice", "carol"
+	assert.EqualValues(t, 3, count(nil))
+	assert.EqualValues(t, 2, count(&types.PeerInfo{DisplayName: &alice}))
+	assert.EqualValues(t, 0, count(&types.PeerInfo{DisplayName: &carol}))
+}
+
+func TestSearchPeersInLink(t *testing.T) {
+	s, err := NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	for _, addr := range []string{"10.235.0.3", "10.235.0.4", "10.235.0.6"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		pubKey := key.PublicKey().String()
+		ip := xnet.ParseIP(addr)
+		_, err = s.CreatePeer(types.PeerInfo{
+			WireguardInfo: types.WireguardInfo{WireguardPublicKey: &pubKey},
+			Ipv4:          &ip,
+		})
+		require.NoError(t, err)
+	}
+
+	addrs := func(addr string) []string {
+		peers, err := s.SearchPeersInLink(context.Background(), xnet.ParseIP(addr))
+		require.NoError(t, err)
+		var found []string
+		for _, peer := range peers {
+			found = append(found, peer.Ipv4.String())
+		}
+		return found
+	}
+
+	assert.Equal(t, []string{"10.235.0.3"}, addrs("10.235.0.2"))
+	assert.Equal(t, []string{"10.235.0.3"}, addrs("10.235.0.3"))
+	assert.Equal(t, []string{"10.235.0.4"}, addrs("10.235.0.5"))
+	assert.Empty(t, addrs("10.235.0.8"))
+}
+
+func TestUpdatePeersOnline(t *testing.T) {
+	s, err := NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	pubKey := key.PublicKey().String()
+	ip := xnet.ParseIP("10.235.0.2")
+	id, err := s.CreatePeer(types.PeerInfo{
+		WireguardInfo: types.WireguardInfo{WireguardPublicKey: &pubKey},
+		Ipv4:          &ip,
+	})
+	require.NoError(t, err)
+
+	peer, err := s.GetPeer(id)
+	require.NoError(t, err)
+	assert.Nil(t, peer.Online)
+
+	online := true
+	require.NoError(t, s.UpdatePeersOnline([]*types.PeerInfo{{ID: id, Online: &online}}))
+
+	// the regular update keeps the state
+	label := "label"
+	peer.Label = &label
+	_, err = s.UpdatePeer(peer)
+	require.NoError(t, err)
+
+	peer, err = s.GetPeer(id)
+	require.NoError(t, err)
+	require.NotNil(t, peer.Online)
+	assert.True(t, *peer.Online)
+	assert.Equal(t, label, *peer.Label)
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// txAttempts bounds the number of attempts of the single transaction
+	txAttempts = 4
+	// txBackoff is the delay before the first retry, doubled on each next one
+	txBackoff = 10 * time.Millisecond
+)
+
+var retriedTxCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tunnel",
+	Subsystem: "storage",
+	Name:      "retried_transactions_total",
+	Help:      "number of transactions retried after the database lock conflict",
+}, []string{"op"})
+
+// RegisterMetrics registers metrics of the storage,
+// must be called once on start.
+func RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(retriedTxCounter)
+}
+
+// withRetry runs the transaction retrying it with the jittered backoff
+// while it fails with the retryable error, the last error is returned
+// once attempts exhaust. Other errors are returned as is.
+// The transaction must be safe to run again after the failure.
+func withRetry(op string, tx func() error) error {
+	backoff := txBackoff
+	for attempt := 1; ; attempt++ {
+		err := tx()
+		if err == nil || !isRetryable(err) || attempt >= txAttempts {
+			return err
+		}
+
+		retriedTxCounter.WithLabelValues(op).Inc()
+		zap.L().Debug("retrying the transaction", zap.String("op", op), zap.Int("attempt", attempt), zap.Error(err))
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+}
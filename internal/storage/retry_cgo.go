@@ -0,0 +1,24 @@
+//go:build cgo
+// +build cgo
+
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// isRetryable reports whether the transaction failed due to
+// the conflict with the concurrent one and may succeed if retried.
+func isRetryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
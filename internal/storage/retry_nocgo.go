@@ -0,0 +1,14 @@
+//go:build !cgo
+// +build !cgo
+
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+// isRetryable never retries, the sqlite driver
+// does not work without cgo anyway.
+func isRetryable(err error) bool {
+	return false
+}
@@ -0,0 +1,63 @@
+//go:build cgo
+// +build cgo
+
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStorage fails the first transactions with the given error
+type flakyStorage struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyStorage) tx() error {
+	s.calls++
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func TestWithRetry(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+
+	// fails once then succeeds
+	before := testutil.ToFloat64(retriedTxCounter.WithLabelValues("test_once"))
+	s := &flakyStorage{failures: 1, err: busy}
+	require.NoError(t, withRetry("test_once", s.tx))
+	require.Equal(t, 2, s.calls)
+	require.Equal(t, before+1, testutil.ToFloat64(retriedTxCounter.WithLabelValues("test_once")))
+
+	// the wrapped lock conflict is retried too
+	s = &flakyStorage{failures: 1, err: fmt.Errorf("update: %w", sqlite3.Error{Code: sqlite3.ErrLocked})}
+	require.NoError(t, withRetry("test_wrapped", s.tx))
+	require.Equal(t, 2, s.calls)
+
+	// attempts are bounded
+	s = &flakyStorage{failures: txAttempts, err: busy}
+	err := withRetry("test_exhausted", s.tx)
+	require.ErrorIs(t, err, busy)
+	require.Equal(t, txAttempts, s.calls)
+
+	// other errors pass through unchanged
+	constraint := sqlite3.Error{Code: sqlite3.ErrConstraint}
+	for _, expected := range []error{constraint, errors.New("failed")} {
+		s = &flakyStorage{failures: 1, err: expected}
+		require.Equal(t, expected, withRetry("test_other", s.tx))
+		require.Equal(t, 1, s.calls)
+	}
+}
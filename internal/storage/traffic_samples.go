@@ -0,0 +1,100 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/xerror"
+	"go.uber.org/zap"
+)
+
+// PutTrafficSample stores the peer's traffic sample,
+// the sample of the same hour is replaced.
+func (storage *Storage) PutTrafficSample(peerID int64, sample types.TrafficSample) error {
+	const q = `INSERT INTO peer_traffic_samples(peer_id, hour, upstream, downstream) VALUES ($1, $2, $3, $4)
+				ON CONFLICT(peer_id, hour) DO UPDATE SET upstream=excluded.upstream, downstream=excluded.downstream`
+
+	if _, err := storage.db.Exec(q, peerID, sample.Hour.Unix(), sample.Upstream, sample.Downstream); err != nil {
+		return xerror.EStorageError("can't put traffic sample", err, zap.Int64("peer_id", peerID))
+	}
+	return nil
+}
+
+// GetTrafficSamples returns samples of all peers
+// starting from the given time, ordered by hour.
+func (storage *Storage) GetTrafficSamples(since time.Time) (map[int64][]types.TrafficSample, error) {
+	const q = `SELECT peer_id, hour, upstream, downstream FROM peer_traffic_samples WHERE hour >= $1 ORDER BY hour`
+
+	rows, err := storage.db.Query(q, since.Unix())
+	if err != nil {
+		return nil, xerror.EStorageError("can't lookup traffic samples", err)
+	}
+	defer rows.Close()
+
+	samples := make(map[int64][]types.TrafficSample)
+	for rows.Next() {
+		var peerID, hour int64
+		var sample types.TrafficSample
+		if err := rows.Scan(&peerID, &hour, &sample.Upstream, &sample.Downstream); err != nil {
+			return nil, xerror.EStorageError("can't scan traffic sample", err)
+		}
+		sample.Hour = time.Unix(hour, 0)
+		samples[peerID] = append(samples[peerID], sample)
+	}
+	return samples, rows.Err()
+}
+
+// DeleteTrafficSamples removes all samples of the peer.
+func (storage *Storage) DeleteTrafficSamples(peerID int64) error {
+	const q = `DELETE FROM peer_traffic_samples WHERE peer_id = $1`
+	if _, err := storage.db.Exec(q, peerID); err != nil {
+		return xerror.EStorageError("can't delete traffic samples", err, zap.Int64("peer_id", peerID))
+	}
+	return nil
+}
+
+// DeleteTrafficSamplesBefore removes samples older than the given time.
+func (storage *Storage) DeleteTrafficSamplesBefore(t time.Time) error {
+	const q = `DELETE FROM peer_traffic_samples WHERE hour < $1`
+	if _, err := storage.db.Exec(q, t.Unix()); err != nil {
+		return xerror.EStorageError("can't delete outdated traffic samples", err)
+	}
+	return nil
+}
+
+// AddTrafficTotal accounts the traffic of all peers to the hour,
+// totals outlive peers and their samples.
+func (storage *Storage) AddTrafficTotal(hour time.Time, upstream int64, downstream int64) error {
+	const q = `INSERT INTO traffic_totals(hour, upstream, downstream) VALUES ($1, $2, $3)
+				ON CONFLICT(hour) DO UPDATE SET upstream=upstream+excluded.upstream, downstream=downstream+excluded.downstream`
+
+	if _, err := storage.db.Exec(q, hour.Unix(), upstream, downstream); err != nil {
+		return xerror.EStorageError("can't add traffic total", err, zap.Time("hour", hour))
+	}
+	return nil
+}
+
+// SumTrafficTotals returns the traffic of hours starting within [from, to),
+// zeros if there are no totals in the range.
+func (storage *Storage) SumTrafficTotals(from time.Time, to time.Time) (int64, int64, error) {
+	const q = `SELECT COALESCE(SUM(upstream), 0), COALESCE(SUM(downstream), 0) FROM traffic_totals WHERE hour >= $1 AND hour < $2`
+
+	var upstream, downstream int64
+	if err := storage.db.QueryRow(q, from.Unix(), to.Unix()).Scan(&upstream, &downstream); err != nil {
+		return 0, 0, xerror.EStorageError("can't sum traffic totals", err)
+	}
+	return upstream, downstream, nil
+}
+
+// DeleteTrafficTotalsBefore removes totals older than the given time.
+func (storage *Storage) DeleteTrafficTotalsBefore(t time.Time) error {
+	const q = `DELETE FROM traffic_totals WHERE hour < $1`
+	if _, err := storage.db.Exec(q, t.Unix()); err != nil {
+		return xerror.EStorageError("can't delete outdated traffic totals", err)
+	}
+	return nil
+}
@@ -5,7 +5,10 @@
 package types
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
 
 	"github.com/google/uuid"
 	"github.com/vpnhouse/common-lib-go/xcrypto"
@@ -50,3 +53,24 @@ func (key *AuthorizerKey) Unwrap() (xcrypto.KeyInfo, error) {
 
 	return xcrypto.KeyInfo{Id: id, Key: pubkey}, nil
 }
+
+// AuthorizerKeysFingerprint returns the hex SHA-256 of the keys set
+// regardless of the order. The key given last wins for the repeated ID,
+// as it does on the storage update.
+func AuthorizerKeysFingerprint(keys []AuthorizerKey) string {
+	unique := make(map[string]string, len(keys))
+	for _, key := range keys {
+		unique[key.ID] = key.Key
+	}
+	ids := make([]string, 0, len(unique))
+	for id := range unique {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	h := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%s:%s\n", id, unique[id])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
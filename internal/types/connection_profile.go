@@ -0,0 +1,25 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package types
+
+// ConnectionProfile is everything the client needs to connect
+// the peer, composed at the connect time from the peer's allocation
+// and the server settings.
+type ConnectionProfile struct {
+	// Ipv4 is the tunnel address assigned to the peer
+	Ipv4            string `json:"ipv4"`
+	ServerPublicKey string `json:"server_public_key"`
+	ServerIPv4      string `json:"server_ipv4"`
+	// ServerPort is the one announced to clients, the NAT'ed one if set
+	ServerPort int `json:"server_port"`
+	// Endpoints are the ordered host:port candidates to fail over,
+	// ServerIPv4 and ServerPort stay for compatibility
+	Endpoints  []string `json:"endpoints,omitempty"`
+	DNS        []string `json:"dns"`
+	AllowedIPs []string `json:"allowed_ips"`
+	Keepalive  int      `json:"keepalive"`
+	// MTU of the client interface, zero if the hints are disabled
+	MTU int `json:"mtu,omitempty"`
+}
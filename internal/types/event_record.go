@@ -0,0 +1,33 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventRecord is the event kept in the database for the later lookup.
+type EventRecord struct {
+	ID             int64           `json:"id"`
+	Type           int32           `json:"type"`
+	Timestamp      time.Time       `json:"timestamp"`
+	UserID         string          `json:"user_id,omitempty"`
+	InstallationID string          `json:"installation_id,omitempty"`
+	SessionID      string          `json:"session_id,omitempty"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// EventFilter narrows down the event search,
+// zero fields match any event.
+type EventFilter struct {
+	Types          []int32
+	UserID         string
+	InstallationID string
+	SessionID      string
+	// Since and Until bound the event timestamp, Until is exclusive
+	Since time.Time
+	Until time.Time
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// redactedLen is the number of hash bytes kept,
+// enough to tell peers apart in logs
+const redactedLen = 8
+
+var redactLogs atomic.Bool
+
+// SetLogRedaction enables hashing of peer identifiers and keys
+// written to the operational logs, the event log is not affected.
+func SetLogRedaction(enabled bool) {
+	redactLogs.Store(enabled)
+}
+
+// LogValue returns the identifier as written to logs:
+// the truncated SHA-256 of it if the redaction is enabled.
+func LogValue(v string) string {
+	if v == "" || !redactLogs.Load() {
+		return v
+	}
+
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:redactedLen])
+}
+
+// LogString returns the zap field of the peer identifier or key.
+func LogString(key string, v *string) zap.Field {
+	if v == nil {
+		return zap.Skip()
+	}
+	return zap.String(key, LogValue(*v))
+}
+
+// LogUUID returns the zap field of the peer identifier.
+func LogUUID(key string, v *uuid.UUID) zap.Field {
+	if v == nil {
+		return zap.Skip()
+	}
+	return zap.String(key, LogValue(v.String()))
+}
+
+// LogPeer returns the zap field of the peer,
+// identifiers and keys are hashed if the redaction is enabled.
+func LogPeer(key string, peer *PeerInfo) zap.Field {
+	if peer == nil || !redactLogs.Load() {
+		return zap.Any(key, peer)
+	}
+	return zap.Object(key, redactedPeer{peer})
+}
+
+type redactedPeer struct {
+	*PeerInfo
+}
+
+func (p redactedPeer) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddInt64("id", p.ID)
+	for _, f := range []zap.Field{
+		LogString("wireguard_key", p.WireguardPublicKey),
+		LogString("user_id", p.UserId),
+		LogUUID("installation_id", p.InstallationId),
+		LogUUID("session_id", p.SessionId),
+		LogString("label", p.Label),
+		LogString("display_name", p.DisplayName),
+		LogString("sharing_key", p.SharingKey),
+	} {
+		f.AddTo(enc)
+	}
+	if p.Ipv4 != nil {
+		enc.AddString("ipv4", p.Ipv4.String())
+	}
+	if p.Expires != nil {
+		enc.AddTime("expires", p.Expires.Time)
+	}
+	if p.NetworkAccessPolicy != nil {
+		enc.AddInt("net_access_policy", *p.NetworkAccessPolicy)
+	}
+	if p.RateLimit != nil {
+		enc.AddInt("net_rate_limit", *p.RateLimit)
+	}
+	// claims may carry anything, never logged in the redacted form
+	return nil
+}
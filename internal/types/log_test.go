@@ -0,0 +1,44 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogRedaction(t *testing.T) {
+	userID := "user@example.com"
+	installationID := uuid.New()
+	peer := &PeerInfo{
+		ID:              1,
+		PeerIdentifiers: PeerIdentifiers{UserId: &userID, InstallationId: &installationID},
+	}
+
+	require.Equal(t, userID, LogValue(userID))
+	require.Equal(t, zap.Any("peer", peer), LogPeer("peer", peer))
+
+	SetLogRedaction(true)
+	defer SetLogRedaction(false)
+
+	redacted := LogValue(userID)
+	require.NotEqual(t, userID, redacted)
+	require.Len(t, redacted, 2*redactedLen)
+	// the same value is always hashed the same way
+	require.Equal(t, redacted, LogValue(userID))
+	require.Empty(t, LogValue(""))
+
+	enc := zapcore.NewMapObjectEncoder()
+	LogPeer("peer", peer).AddTo(enc)
+	fields := enc.Fields["peer"].(map[string]interface{})
+	require.Equal(t, int64(1), fields["id"])
+	require.Equal(t, redacted, fields["user_id"])
+	require.Equal(t, LogValue(installationID.String()), fields["installation_id"])
+	require.NotContains(t, fields, "session_id")
+}
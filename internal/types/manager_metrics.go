@@ -0,0 +1,36 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"time"
+)
+
+// ManagerMetrics is a snapshot of the peer manager live numbers.
+type ManagerMetrics struct {
+	// PeersTotal is a number of peers authorized to connect
+	PeersTotal int `json:"peers_total"`
+	// PeersWithHandshakes is a number of peers actually connected
+	PeersWithHandshakes int `json:"peers_with_handshakes"`
+	PeersActiveLastHour int `json:"peers_active_1h"`
+	PeersActiveLastDay  int `json:"peers_active_1d"`
+	// Upstream and Downstream are the cumulative traffic counters (bytes)
+	Upstream   int64 `json:"upstream"`
+	Downstream int64 `json:"downstream"`
+	// UnattributedUpstream and UnattributedDownstream are the link traffic
+	// of the last collection not accounted to any peer (bytes)
+	UnattributedUpstream   int64 `json:"unattributed_upstream"`
+	UnattributedDownstream int64 `json:"unattributed_downstream"`
+	// PoolUsed and PoolTotal describe the IP pool utilization
+	PoolUsed        int     `json:"pool_used"`
+	PoolTotal       int     `json:"pool_total"`
+	PoolUtilization float64 `json:"pool_utilization"`
+	// PoolLinks is a number of /31 point-to-point links,
+	// their addresses are counted in PoolUsed
+	PoolLinks int `json:"pool_links"`
+	// LastTick is the time of the last background iteration,
+	// zero if it has not run yet
+	LastTick time.Time `json:"last_tick"`
+}
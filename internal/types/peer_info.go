@@ -5,6 +5,7 @@
 package types
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
@@ -27,6 +28,9 @@ type PeerIdentifiers struct {
 	SessionId      *uuid.UUID `db:"session_id"`
 }
 
+// MaxDisplayNameLength is the max length of the peer's display name in bytes.
+const MaxDisplayNameLength = 128
+
 type PeerInfo struct {
 	WireguardInfo
 	PeerIdentifiers
@@ -39,15 +43,88 @@ type PeerInfo struct {
 	Expires *xtime.Time `db:"expires"`
 	Claims  *string     `db:"claims"`
 
+	// DisplayName is the cosmetic name shown in the admin UI,
+	// it never identifies the peer and may be shared by peers.
+	DisplayName *string `db:"display_name"`
+	// ModifiedBy is the identity of the admin who last changed the peer,
+	// nil if the peer was never changed via the admin API.
+	ModifiedBy *string `db:"modified_by"`
+
 	SharingKey           *string `db:"sharing_key"`
 	SharingKeyExpiration *int64  `db:"sharing_key_expiration"`
 
 	NetworkAccessPolicy *int `db:"net_access_policy"`
 	RateLimit           *int `db:"net_rate_limit"`
 
+	// PointToPoint peers get the RFC3021 /31 link instead of
+	// the single address, Ipv4 is the lower address of the link.
+	PointToPoint *bool `db:"point_to_point"`
+
 	Upstream   *int64      `db:"upstream"`
 	Downstream *int64      `db:"downstream"`
 	Activity   *xtime.Time `db:"activity"`
+
+	ConnectCount    *int64      `db:"connect_count"`
+	LastConnectedAt *xtime.Time `db:"last_connected_at"`
+
+	// LastSyncError is the reason the peer failed to be programmed
+	// on the wireguard device, nil if the last attempt succeeded.
+	LastSyncError *string     `db:"last_sync_error"`
+	LastSyncedAt  *xtime.Time `db:"last_synced_at"`
+
+	// Online is the presence of the peer last reported by
+	// the PeerConnected and PeerDisconnected events,
+	// nil if never tracked.
+	Online *bool `db:"online"`
+
+	// PreferredIpv4 is assigned to the new peer without Ipv4 set
+	// if it's available, otherwise the address is allocated as usual.
+	// Not stored.
+	PreferredIpv4 *xnet.IP `json:"-"`
+	// Clustered reports whether the allocated address is next to
+	// the addresses of the user's other peers, nil if the clustering
+	// was not applied. Not stored.
+	Clustered *bool `json:"-"`
+}
+
+// PeerPatch holds the peer fields to change, nil fields are kept as is.
+type PeerPatch struct {
+	WireguardPublicKey  *string
+	Label               *string
+	DisplayName         *string
+	Ipv4                *xnet.IP
+	Expires             *xtime.Time
+	Claims              *string
+	NetworkAccessPolicy *int
+	RateLimit           *int
+}
+
+// Apply sets the non-nil fields of the patch on the peer.
+func (patch PeerPatch) Apply(peer *PeerInfo) {
+	if patch.WireguardPublicKey != nil {
+		peer.WireguardPublicKey = patch.WireguardPublicKey
+	}
+	if patch.Label != nil {
+		peer.Label = patch.Label
+	}
+	if patch.DisplayName != nil {
+		peer.DisplayName = patch.DisplayName
+	}
+	if patch.Ipv4 != nil {
+		peer.Ipv4 = patch.Ipv4
+	}
+	if patch.Expires != nil {
+		peer.Expires = patch.Expires
+	}
+	if patch.Claims != nil {
+		peer.Claims = patch.Claims
+	}
+	if patch.NetworkAccessPolicy != nil {
+		peer.NetworkAccessPolicy = patch.NetworkAccessPolicy
+	}
+	if patch.RateLimit != nil {
+		peer.RateLimit = patch.RateLimit
+	}
 }
 
 func (peer *PeerInfo) GetNetworkPolicy() ipam.Policy {
@@ -66,6 +143,11 @@ func (peer *PeerInfo) GetNetworkPolicy() ipam.Policy {
 	return pol
 }
 
+// IsPointToPoint reports whether the peer is given the /31 link.
+func (peer *PeerInfo) IsPointToPoint() bool {
+	return peer.PointToPoint != nil && *peer.PointToPoint
+}
+
 func (peer *PeerInfo) IntoProto() *proto.PeerInfo {
 	p := &proto.PeerInfo{}
 	if peer == nil {
@@ -102,6 +184,9 @@ func (peer *PeerInfo) IntoProto() *proto.PeerInfo {
 	if peer.Activity != nil {
 		p.Activity = proto.TimestampFromTime(peer.Activity.Time)
 	}
+	if peer.ModifiedBy != nil {
+		p.ModifiedBy = *peer.ModifiedBy
+	}
 
 	return p
 }
@@ -146,6 +231,10 @@ func (peer *PeerInfo) Validate(omit ...string) error {
 		}
 	}
 
+	if peer.DisplayName != nil && len(*peer.DisplayName) > MaxDisplayNameLength {
+		return xerror.EInvalidField(fmt.Sprintf("display name must not exceed %d bytes", MaxDisplayNameLength), "display_name", nil)
+	}
+
 	if peer.WireguardPublicKey == nil && (peer.SharingKey == nil || len(*peer.SharingKey) == 0) {
 		return xerror.EInvalidField("peer must have public key set", "wireguard_key", nil)
 	}
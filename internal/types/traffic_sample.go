@@ -0,0 +1,17 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"time"
+)
+
+// TrafficSample is the peer traffic accumulated within an hour.
+type TrafficSample struct {
+	// Hour is the start of the sample's hour
+	Hour       time.Time `json:"hour"`
+	Upstream   int64     `json:"upstream"`
+	Downstream int64     `json:"downstream"`
+}
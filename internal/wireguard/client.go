@@ -0,0 +1,119 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vpnhouse/common-lib-go/xerror"
+)
+
+const (
+	// DefaultClientMTU is the MTU wg-quick picks for the usual 1500 bytes link
+	DefaultClientMTU = 1420
+	// minClientMTU is the minimal MTU allowed for IPv6, the client
+	// config always has the IPv6 address
+	minClientMTU = 1280
+	maxClientMTU = 1500
+
+	// ipv4 and tcp headers without options
+	mssOverhead = 20 + 20
+
+	// DefaultClientAllowedIPs routes all IPv4 traffic of the client to the tunnel
+	DefaultClientAllowedIPs = "0.0.0.0/0"
+)
+
+// ClientMTUConfig describes the MTU hints put into
+// the configuration of the client, the server is not affected.
+type ClientMTUConfig struct {
+	// MTU of the client interface, default: 1420
+	MTU int `yaml:"mtu,omitempty"`
+	// ClampMSS adds the PostUp/PostDown hooks clamping
+	// the TCP MSS of the forwarded traffic to the MTU,
+	// e.g. for routers behind PPPoE
+	ClampMSS bool `yaml:"clamp_mss,omitempty"`
+}
+
+// Validate checks the MTU is applicable to the client interface,
+// field is the configuration path used in the error.
+func (c ClientMTUConfig) Validate(field string) error {
+	if c.MTU != 0 && (c.MTU < minClientMTU || c.MTU > maxClientMTU) {
+		return xerror.EInvalidConfiguration(
+			fmt.Sprintf("%s.mtu must be between %d and %d", field, minClientMTU, maxClientMTU),
+			field+".mtu",
+		)
+	}
+	return nil
+}
+
+// ClientHints are the optional [Interface] settings of the client config.
+type ClientHints struct {
+	MTU      int
+	PostUp   string
+	PostDown string
+}
+
+// Hints returns the client interface settings derived from the effective MTU.
+func (c ClientMTUConfig) Hints() ClientHints {
+	mtu := c.MTU
+	if mtu == 0 {
+		mtu = DefaultClientMTU
+	}
+
+	hints := ClientHints{MTU: mtu}
+	if c.ClampMSS {
+		rule := fmt.Sprintf("FORWARD -o %%i -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss %d", mtu-mssOverhead)
+		hints.PostUp = "iptables -t mangle -A " + rule
+		hints.PostDown = "iptables -t mangle -D " + rule
+	}
+	return hints
+}
+
+// Lines returns hints as lines of the wg-quick [Interface] section.
+func (h ClientHints) Lines() string {
+	var b strings.Builder
+	if h.MTU > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", h.MTU)
+	}
+	if h.PostUp != "" {
+		fmt.Fprintf(&b, "PostUp = %s\n", h.PostUp)
+	}
+	if h.PostDown != "" {
+		fmt.Fprintf(&b, "PostDown = %s\n", h.PostDown)
+	}
+	return b.String()
+}
+
+// ClientAllowedIPs returns the AllowedIPs of the client config with
+// the /32 route of every IPv4 DNS server not covered by allowed,
+// so split-tunnel clients still reach the in-VPN DNS.
+func ClientAllowedIPs(allowed []string, dns []string) []string {
+	result := append([]string(nil), allowed...)
+	nets := make([]*net.IPNet, 0, len(allowed)+len(dns))
+	for _, s := range allowed {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, n)
+		}
+	}
+
+next:
+	for _, s := range dns {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			continue
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				continue next
+			}
+		}
+		host := &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+		nets = append(nets, host)
+		result = append(result, host.String())
+	}
+	return result
+}
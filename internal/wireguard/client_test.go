@@ -0,0 +1,50 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package wireguard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientMTUHints(t *testing.T) {
+	hints := ClientMTUConfig{}.Hints()
+	assert.Equal(t, ClientHints{MTU: DefaultClientMTU}, hints)
+	assert.Equal(t, "MTU = 1420\n", hints.Lines())
+
+	// PPPoE takes 8 bytes more
+	hints = ClientMTUConfig{MTU: 1412, ClampMSS: true}.Hints()
+	assert.Equal(t, 1412, hints.MTU)
+	assert.Equal(t, "iptables -t mangle -A FORWARD -o %i -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1372", hints.PostUp)
+	assert.Equal(t, "iptables -t mangle -D FORWARD -o %i -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1372", hints.PostDown)
+	assert.Equal(t, "MTU = 1412\nPostUp = "+hints.PostUp+"\nPostDown = "+hints.PostDown+"\n", hints.Lines())
+}
+
+func TestClientMTUValidate(t *testing.T) {
+	for mtu, valid := range map[int]bool{0: true, 1280: true, 1420: true, 1500: true, 1279: false, 1501: false} {
+		err := ClientMTUConfig{MTU: mtu}.Validate("client_mtu.allow_all")
+		if valid {
+			assert.NoError(t, err, "mtu %d", mtu)
+		} else {
+			assert.ErrorContains(t, err, "client_mtu.allow_all.mtu", "mtu %d", mtu)
+		}
+	}
+}
+
+func TestClientAllowedIPsDNSRoute(t *testing.T) {
+	// split tunnel: only the office network goes to the tunnel,
+	// the VPN subnet 10.8.0.0/24 with the DNS server is excluded
+	allowed := []string{"192.168.10.0/24"}
+	assert.Equal(t, []string{"192.168.10.0/24", "10.8.0.2/32"},
+		ClientAllowedIPs(allowed, []string{"10.8.0.2"}))
+	assert.Equal(t, []string{"192.168.10.0/24"}, allowed, "input must not be modified")
+
+	// covered servers and duplicates add nothing, IPv6 ones are skipped
+	assert.Equal(t, []string{"0.0.0.0/0"}, ClientAllowedIPs([]string{"0.0.0.0/0"}, []string{"10.8.0.2"}))
+	assert.Equal(t, []string{"10.8.0.0/24"}, ClientAllowedIPs([]string{"10.8.0.0/24"}, []string{"10.8.0.2", "10.8.0.2"}))
+	assert.Equal(t, []string{"192.168.10.0/24", "1.1.1.1/32"},
+		ClientAllowedIPs(allowed, []string{"1.1.1.1", "1.1.1.1", "fd00::2"}))
+}
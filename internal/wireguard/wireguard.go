@@ -6,12 +6,16 @@ package wireguard
 
 import (
 	"fmt"
+	"math"
 	"net"
+	"strconv"
 
 	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/common-lib-go/validator"
+	"github.com/vpnhouse/common-lib-go/xnet"
 	"github.com/vpnhouse/common-lib-go/xerror"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -30,6 +34,24 @@ type Config struct {
 	// so NATedPort must be set to `3333` to push the valid configuration to the client.
 	NATedPort int `yaml:"nated_port,omitempty" valid:"port"`
 
+	// Endpoints is the ordered list of host:port candidates announced
+	// to clients in addition to ServerIPv4 and the client port,
+	// e.g. when the server is reachable via several public addresses.
+	// Whether and how the client fails over between them is up to the client.
+	Endpoints []string `yaml:"endpoints,omitempty"`
+
+	// FirewallMark (fwmark) set on the packets sent by the wireguard interface,
+	// used by the policy routing to direct the tunnel traffic. 0 means no mark.
+	// Note that the mark applies to the encrypted (outer) packets only,
+	// the peer's AllowedIPs still decide which inner traffic enters the tunnel.
+	FirewallMark int `yaml:"fwmark,omitempty"`
+
+	// RoutingTable for the routes of the interface subnets, like the wg-quick's Table option:
+	// "auto" (or empty) lets the kernel install them into the main table,
+	// "off" installs no routes at all, leaving them to the external routing daemon,
+	// a number installs them into the given table.
+	RoutingTable string `yaml:"routing_table,omitempty"`
+
 	// PrivateKey of WireGuard, serialized to the string.
 	// Generated automatically on the startup.
 	PrivateKey string `yaml:"private_key"`
@@ -48,6 +70,104 @@ func (c *Config) OnLoad() error {
 	return nil
 }
 
+// Validate checks that the subnet and the server addresses
+// are consistent with each other.
+func (c Config) Validate() error {
+	ipa, subnet, err := xnet.ParseCIDR(string(c.Subnet))
+	if err != nil || !subnet.IP().Isv4() {
+		return xerror.EInvalidConfiguration("wireguard.subnet must be the valid IPv4 CIDR", "wireguard.subnet")
+	}
+	if !subnet.IP().Equal(*ipa) {
+		return xerror.EInvalidConfiguration("wireguard.subnet must be the network address, not the host one", "wireguard.subnet")
+	}
+
+	// the server interface takes the first usable address,
+	// at least one more is required for peers.
+	if ones, _ := subnet.Mask().Size(); ones > 30 {
+		return xerror.EInvalidConfiguration("wireguard.subnet is too small, /30 or larger is required", "wireguard.subnet")
+	}
+
+	if len(c.ServerIPv4) > 0 {
+		serverIP := xnet.ParseIP(c.ServerIPv4)
+		if !serverIP.Isv4() {
+			return xerror.EInvalidConfiguration("wireguard.server_ipv4 must be the valid IPv4 address", "wireguard.server_ipv4")
+		}
+		// the server_ipv4 is the public endpoint announced to clients,
+		// clients would route it into the tunnel if it was inside the subnet.
+		if subnet.IPNet.Contains(serverIP.IP) {
+			return xerror.EInvalidConfiguration(
+				fmt.Sprintf("wireguard.server_ipv4 %s must be the public address outside the %s subnet", c.ServerIPv4, subnet.String()),
+				"wireguard.server_ipv4",
+			)
+		}
+	}
+
+	if _, _, err := c.GetRoutingTable(); err != nil {
+		return err
+	}
+
+	if err := c.ValidateEndpoints(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ValidateEndpoints checks every endpoint is the host:port pair
+// with the valid port, and none is listed twice.
+func (c Config) ValidateEndpoints() error {
+	seen := make(map[string]struct{}, len(c.Endpoints))
+	for _, endpoint := range c.Endpoints {
+		host, p, err := net.SplitHostPort(endpoint)
+		if err != nil || len(host) == 0 {
+			return xerror.EInvalidConfiguration(
+				fmt.Sprintf("wireguard.endpoints: %q must be the host:port pair", endpoint),
+				"wireguard.endpoints",
+			)
+		}
+		if port, err := strconv.Atoi(p); err != nil || port < 1 || port > 65535 {
+			return xerror.EInvalidConfiguration(
+				fmt.Sprintf("wireguard.endpoints: %q has the invalid port", endpoint),
+				"wireguard.endpoints",
+			)
+		}
+		if _, ok := seen[endpoint]; ok {
+			return xerror.EInvalidConfiguration(
+				fmt.Sprintf("wireguard.endpoints: %q is listed twice", endpoint),
+				"wireguard.endpoints",
+			)
+		}
+		seen[endpoint] = struct{}{}
+	}
+	return nil
+}
+
+const (
+	RoutingTableAuto = "auto"
+	RoutingTableOff  = "off"
+)
+
+// GetRoutingTable parses the RoutingTable option, returns the table
+// to install the subnet routes into, 0 if the kernel does it on its own,
+// and whether the routes are managed outside at all.
+func (c Config) GetRoutingTable() (table int, off bool, err error) {
+	switch c.RoutingTable {
+	case "", RoutingTableAuto:
+		return 0, false, nil
+	case RoutingTableOff:
+		return 0, true, nil
+	}
+
+	v, err := strconv.ParseUint(c.RoutingTable, 10, 32)
+	if err != nil || v == 0 || v > math.MaxInt32 {
+		return 0, false, xerror.EInvalidConfiguration(
+			fmt.Sprintf("wireguard.routing_table must be \"auto\", \"off\" or the table number, got %q", c.RoutingTable),
+			"wireguard.routing_table",
+		)
+	}
+	return int(v), false, nil
+}
+
 // ClientPort  returns the port to announce to a client.
 // See Config.NATedPort for details.
 func (c Config) ClientPort() int {
@@ -59,9 +179,13 @@ func (c Config) ClientPort() int {
 
 // ServerAddr returns IPAddr/mask to use as a wireguard interface address.
 func (c Config) ServerAddr() string {
-	a := c.Subnet.Unwrap()
-	ones, _ := a.Mask().Size()
-	return fmt.Sprintf("%s/%d", a.FirstUsable().String(), ones)
+	return interfaceAddr(c.Subnet.Unwrap())
+}
+
+// interfaceAddr returns the first usable address of the subnet with its mask.
+func interfaceAddr(subnet *xnet.IPNet) string {
+	ones, _ := subnet.Mask().Size()
+	return fmt.Sprintf("%s/%d", subnet.FirstUsable().String(), ones)
 }
 
 func (c Config) GetPrivateKey() types.WGPrivateKey {
@@ -83,23 +207,34 @@ func DefaultConfig() Config {
 	}
 }
 
+// AllowedIPs returns the list of networks routed to the given peer
+// via the wireguard interface.
+// Note: it's caller responsibility to provide fully valid peer
+func AllowedIPs(info *types.PeerInfo) []net.IPNet {
+	ones := 32
+	if info.IsPointToPoint() {
+		// RFC3021 link, both addresses are routed to the peer
+		ones = 31
+	}
+	ipv4net := net.IPNet{
+		IP:   info.Ipv4.IP,
+		Mask: net.CIDRMask(ones, 32),
+	}
+	return []net.IPNet{ipv4net}
+}
+
 // getPeerConfig generates wireguard configuration for a peer.
 // Note: it's caller responsibility to provide fully valid peer
 func (wg *Wireguard) getPeerConfig(info *types.PeerInfo, remove bool) (*wgtypes.Config, error) {
 	key, err := wgtypes.ParseKey(*info.WireguardPublicKey)
 	if err != nil {
-		return nil, xerror.EInvalidArgument("can't parse client public key", err, zap.String("key", *info.WireguardPublicKey))
-	}
-
-	ipv4net := net.IPNet{
-		IP:   info.Ipv4.IP,
-		Mask: net.CIDRMask(32, 32),
+		return nil, xerror.EInvalidArgument("can't parse client public key", err, types.LogString("key", info.WireguardPublicKey))
 	}
 
 	peer := wgtypes.PeerConfig{
 		PublicKey:  key,
 		Remove:     remove,
-		AllowedIPs: []net.IPNet{ipv4net},
+		AllowedIPs: AllowedIPs(info),
 	}
 
 	config := wgtypes.Config{
@@ -108,3 +243,46 @@ func (wg *Wireguard) getPeerConfig(info *types.PeerInfo, remove bool) (*wgtypes.
 
 	return &config, nil
 }
+
+// logConfig returns the zap field of the device configuration,
+// the private key is never written and peer keys are hashed
+// if the log redaction is enabled.
+func logConfig(key string, config *wgtypes.Config) zap.Field {
+	if config == nil {
+		return zap.Skip()
+	}
+	return zap.Object(key, loggedConfig{config})
+}
+
+type loggedConfig struct {
+	*wgtypes.Config
+}
+
+func (c loggedConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	if c.ListenPort != nil {
+		enc.AddInt("listen_port", *c.ListenPort)
+	}
+	if c.FirewallMark != nil {
+		enc.AddInt("fwmark", *c.FirewallMark)
+	}
+	enc.AddBool("replace_peers", c.ReplacePeers)
+	return enc.AddArray("peers", zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+		for _, peer := range c.Peers {
+			peer := peer
+			err := enc.AppendObject(zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+				enc.AddString("public_key", types.LogValue(peer.PublicKey.String()))
+				enc.AddBool("remove", peer.Remove)
+				return enc.AddArray("allowed_ips", zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+					for _, ipnet := range peer.AllowedIPs {
+						enc.AppendString(ipnet.String())
+					}
+					return nil
+				}))
+			}))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
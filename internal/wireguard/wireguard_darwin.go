@@ -7,6 +7,7 @@ package wireguard
 import (
 	"github.com/vishvananda/netlink"
 	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/vpnhouse/common-lib-go/xnet"
 	"go.uber.org/zap"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -15,7 +16,7 @@ type Wireguard struct {
 	running bool
 }
 
-func New(config Config) (*Wireguard, error) {
+func New(config Config, extraSubnets ...*xnet.IPNet) (*Wireguard, error) {
 	return &Wireguard{running: true}, nil
 }
 
@@ -26,6 +27,11 @@ func (w *Wireguard) Shutdown() error {
 
 func (w *Wireguard) Running() bool { return w.running }
 
+func (*Wireguard) Recreate() error {
+	zap.L().Debug("wg: recreate")
+	return nil
+}
+
 func (*Wireguard) SetPeer(info *types.PeerInfo) error {
 	zap.L().Debug("wg: set peer")
 	return nil
@@ -41,6 +47,11 @@ func (*Wireguard) GetPeers() (map[string]wgtypes.Peer, error) {
 	return map[string]wgtypes.Peer{}, nil
 }
 
+func (*Wireguard) GetFirewallMark() (int, error) {
+	zap.L().Debug("wg: get firewall mark")
+	return 0, nil
+}
+
 func (*Wireguard) GetLinkStatistic() (*netlink.LinkStatistics, error) {
 	zap.L().Debug("wg: get link stats")
 	return &netlink.LinkStatistics{
@@ -5,19 +5,33 @@
 package wireguard
 
 import (
+	"net"
+
 	"github.com/vishvananda/netlink"
-	"github.com/vpnhouse/tunnel/internal/types"
 	"github.com/vpnhouse/common-lib-go/xerror"
+	"github.com/vpnhouse/common-lib-go/xnet"
+	"github.com/vpnhouse/tunnel/internal/types"
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type Wireguard struct {
-	client  *wgctrl.Client
-	config  wgtypes.Config
-	link    *wireguardLink
-	running bool
+	client *wgctrl.Client
+	config wgtypes.Config
+	link   *wireguardLink
+	// addr is the interface address, see Config.ServerAddr
+	addr string
+	// extraAddrs are the interface addresses in the extra
+	// blocks of the pool, they route the blocks to the interface
+	extraAddrs []string
+	// routingTable to install the subnet routes into,
+	// 0 leaves it to the kernel, see Config.RoutingTable
+	routingTable int
+	// routesOff means no subnet routes are installed at all
+	routesOff bool
+	running   bool
 }
 
 type wireguardLink struct {
@@ -34,7 +48,9 @@ func (wl *wireguardLink) Type() string {
 	return "wireguard"
 }
 
-func New(config Config) (*Wireguard, error) {
+// New creates the wireguard interface, extraSubnets
+// are the extra blocks of the address pool, if any.
+func New(config Config, extraSubnets ...*xnet.IPNet) (*Wireguard, error) {
 	client, err := wgctrl.New()
 	if err != nil {
 		return nil, xerror.ETunnelError("can't create wireguard controller", err)
@@ -45,12 +61,26 @@ func New(config Config) (*Wireguard, error) {
 		PrivateKey: &key,
 		ListenPort: &config.ListenPort,
 	}
+	if config.FirewallMark > 0 {
+		wgConfig.FirewallMark = &config.FirewallMark
+	}
+
+	table, off, err := config.GetRoutingTable()
+	if err != nil {
+		return nil, err
+	}
 
 	linkAttrs := wireguardLink{name: config.Interface}
 	wg := &Wireguard{
-		client: client,
-		config: wgConfig,
-		link:   &linkAttrs,
+		client:       client,
+		config:       wgConfig,
+		link:         &linkAttrs,
+		addr:         config.ServerAddr(),
+		routingTable: table,
+		routesOff:    off,
+	}
+	for _, subnet := range extraSubnets {
+		wg.extraAddrs = append(wg.extraAddrs, interfaceAddr(subnet))
 	}
 
 	if err := netlink.LinkAdd(wg.link); err != nil {
@@ -59,32 +89,88 @@ func New(config Config) (*Wireguard, error) {
 		return nil, xerror.ETunnelError("can't add link", err, zap.Any("iface", wg.link.name))
 	}
 
-	defer func() {
-		if !wg.running {
-			zap.L().Error("removing link due to unsuccessful start", zap.String("iface", wg.link.name))
-			_ = netlink.LinkDel(wg.link)
+	if err := wg.setup(); err != nil {
+		zap.L().Error("removing link due to unsuccessful start", zap.String("iface", wg.link.name))
+		_ = netlink.LinkDel(wg.link)
+		return nil, err
+	}
+
+	wg.running = true
+	return wg, nil
+}
+
+// setup configures the freshly added link and brings it up.
+func (wg *Wireguard) setup() error {
+	addrs := make([]*netlink.Addr, 0, 1+len(wg.extraAddrs))
+	for _, v := range append([]string{wg.addr}, wg.extraAddrs...) {
+		addr, err := netlink.ParseAddr(v)
+		if err != nil {
+			return xerror.EInvalidArgument("can't parse wireguard subnet", err, zap.String("addr", v))
+		}
+		if wg.routingTable > 0 || wg.routesOff {
+			// keep the kernel from adding the subnet route into the main table
+			addr.Flags = unix.IFA_F_NOPREFIXROUTE
 		}
-	}()
+		if err := netlink.AddrAdd(wg.link, addr); err != nil {
+			return xerror.ETunnelError("can't add address", err, zap.Any("addr", addr))
+		}
+		addrs = append(addrs, addr)
+	}
 
-	addr, err := netlink.ParseAddr(config.ServerAddr())
-	if err != nil {
-		return nil, xerror.EInvalidArgument("can't parse wireguard subnet", err, zap.String("subnet", string(config.Subnet)))
+	if err := wg.client.ConfigureDevice(wg.link.name, wg.config); err != nil {
+		return xerror.ETunnelError("can't configure wireguard interface", err, logConfig("config", &wg.config))
 	}
 
-	if err := netlink.AddrAdd(wg.link, addr); err != nil {
-		return nil, xerror.ETunnelError("can't add address", err, zap.Any("addr", addr))
+	if err := netlink.LinkSetUp(wg.link); err != nil {
+		return xerror.ETunnelError("can't set link up", err, zap.Any("iface", wg.link.name), zap.String("addr", wg.addr))
 	}
 
-	if err := wg.client.ConfigureDevice(config.Interface, wg.config); err != nil {
-		return nil, xerror.ETunnelError("can't configure wireguard interface", err, zap.Any("config", wg.config))
+	if wg.routingTable > 0 {
+		return wg.addRoutes(addrs)
 	}
+	return nil
+}
 
-	if err := netlink.LinkSetUp(wg.link); err != nil {
-		return nil, xerror.ETunnelError("can't set link up", err, zap.Any("iface", wg.link.name), zap.Stringer("addr", addr))
+// addRoutes installs the routes of the interface subnets
+// into the configured routing table.
+func (wg *Wireguard) addRoutes(addrs []*netlink.Addr) error {
+	link, err := netlink.LinkByName(wg.link.name)
+	if err != nil {
+		return xerror.ETunnelError("can't get link", err, zap.String("iface", wg.link.name))
 	}
 
-	wg.running = true
-	return wg, nil
+	for _, addr := range addrs {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask},
+			Src:       addr.IP,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     wg.routingTable,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return xerror.ETunnelError("can't add route", err, zap.Stringer("dst", route.Dst), zap.Int("table", wg.routingTable))
+		}
+	}
+	return nil
+}
+
+// Recreate adds the interface removed from outside (e.g. by the module
+// reload) again with the same configuration. Peers are not restored,
+// it's the caller's responsibility to program them.
+func (wg *Wireguard) Recreate() error {
+	zap.L().Info("recreating wireguard interface", zap.String("iface", wg.link.name))
+	// remove leftovers of the interface, if any
+	_ = netlink.LinkDel(wg.link)
+
+	if err := netlink.LinkAdd(wg.link); err != nil {
+		return xerror.ETunnelError("can't add link", err, zap.Any("iface", wg.link.name))
+	}
+
+	if err := wg.setup(); err != nil {
+		_ = netlink.LinkDel(wg.link)
+		return err
+	}
+	return nil
 }
 
 func (wg *Wireguard) Shutdown() error {
@@ -105,7 +191,7 @@ func (wg *Wireguard) Running() bool {
 // SetPeer sets peer on wireguard interface
 // Note: it's caller responsibility to provide fully valid peer
 func (wg *Wireguard) SetPeer(info *types.PeerInfo) error {
-	zap.L().Debug("set peer", zap.Any("peer", info))
+	zap.L().Debug("set peer", types.LogPeer("peer", info))
 
 	config, err := wg.getPeerConfig(info, false)
 	if err != nil {
@@ -114,7 +200,7 @@ func (wg *Wireguard) SetPeer(info *types.PeerInfo) error {
 
 	err = wg.client.ConfigureDevice(wg.link.name, *config)
 	if err != nil {
-		return xerror.ETunnelError("can't set peer", err, zap.Any("peer", info), zap.Any("config", config))
+		return xerror.ETunnelError("can't set peer", err, types.LogPeer("peer", info), logConfig("config", config))
 	}
 
 	return nil
@@ -123,7 +209,7 @@ func (wg *Wireguard) SetPeer(info *types.PeerInfo) error {
 // UnsetPeer removes peer from wireguard interface
 // Note: it's caller responsibility to provide fully valid peer
 func (wg *Wireguard) UnsetPeer(info *types.PeerInfo) error {
-	zap.L().Debug("unset peer", zap.Any("peer", info))
+	zap.L().Debug("unset peer", types.LogPeer("peer", info))
 
 	config, err := wg.getPeerConfig(info, true)
 	if err != nil {
@@ -132,7 +218,7 @@ func (wg *Wireguard) UnsetPeer(info *types.PeerInfo) error {
 
 	err = wg.client.ConfigureDevice(wg.link.name, *config)
 	if err != nil {
-		return xerror.ETunnelError("can't unset peer", err, zap.Any("peer", info), zap.Any("config", config))
+		return xerror.ETunnelError("can't unset peer", err, types.LogPeer("peer", info), logConfig("config", config))
 	}
 
 	return nil
@@ -154,6 +240,16 @@ func (wg *Wireguard) GetPeers() (map[string]wgtypes.Peer, error) {
 	return peers, nil
 }
 
+// GetFirewallMark returns the fwmark currently set on the underlying device.
+func (wg *Wireguard) GetFirewallMark() (int, error) {
+	dev, err := wg.client.Device(wg.link.name)
+	if err != nil {
+		return 0, xerror.ETunnelError("failed to get wireguard device", err, zap.String("iface", wg.link.name))
+	}
+
+	return dev.FirewallMark, nil
+}
+
 func (wg *Wireguard) GetLinkStatistic() (*netlink.LinkStatistics, error) {
 	link, err := netlink.LinkByName(wg.link.name)
 	if err != nil {
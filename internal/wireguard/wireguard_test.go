@@ -0,0 +1,40 @@
+// Copyright 2021 The VPN House Authors. All rights reserved.
+// Use of this source code is governed by a AGPL-style
+// license that can be found in the LICENSE file.
+
+package wireguard
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vpnhouse/tunnel/internal/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestLogConfigRedaction(t *testing.T) {
+	privKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	pubKey := privKey.PublicKey()
+	_, allowed, _ := net.ParseCIDR("10.235.0.2/32")
+	config := &wgtypes.Config{
+		PrivateKey: &privKey,
+		Peers:      []wgtypes.PeerConfig{{PublicKey: pubKey, AllowedIPs: []net.IPNet{*allowed}}},
+	}
+
+	types.SetLogRedaction(true)
+	defer types.SetLogRedaction(false)
+
+	enc := zapcore.NewMapObjectEncoder()
+	logConfig("config", config).AddTo(enc)
+	fields := enc.Fields["config"].(map[string]interface{})
+	require.NotContains(t, fields, "private_key")
+	peers := fields["peers"].([]interface{})
+	require.Len(t, peers, 1)
+	peer := peers[0].(map[string]interface{})
+	require.Equal(t, types.LogValue(pubKey.String()), peer["public_key"])
+	require.NotEqual(t, pubKey.String(), peer["public_key"])
+	require.Equal(t, []interface{}{"10.235.0.2/32"}, peer["allowed_ips"])
+}
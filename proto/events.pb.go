@@ -31,25 +31,102 @@ const (
 	// PeerTraffic is for the periodic traffic updates
 	EventType_PeerTraffic      EventType = 4
 	EventType_PeerFirstConnect EventType = 5
+	// ServerMaintenance is for the maintenance mode transitions,
+	// the data is MaintenanceInfo
+	EventType_ServerMaintenance EventType = 6
+	// ServerDNSUpdate is for changes of the DNS servers advertised to peers,
+	// the data is DNSInfo
+	EventType_ServerDNSUpdate EventType = 7
+	// ServerClockAnomaly is for the expiration skipped due to the likely
+	// server clock jump, the data is ClockAnomalyInfo
+	EventType_ServerClockAnomaly EventType = 8
+	// ServerInterfaceDown is for the wireguard interface gone from the system,
+	// the data is InterfaceInfo
+	EventType_ServerInterfaceDown EventType = 9
+	// ManagerStarting is for the peer manager started restoring peers,
+	// the data is ManagerStateInfo
+	EventType_ManagerStarting EventType = 10
+	// ManagerReady is for the peer manager ready to accept peers,
+	// the data is ManagerStateInfo
+	EventType_ManagerReady EventType = 11
+	// ManagerDraining is for the peer manager stopped accepting peers
+	// on shutdown, the data is ManagerStateInfo
+	EventType_ManagerDraining EventType = 12
+	// ManagerStopped is for the peer manager shut down,
+	// the data is ManagerStateInfo
+	EventType_ManagerStopped EventType = 13
+	// PeerIdle is for the peer removed from the device due to the lack
+	// of traffic, the peer is kept in the storage, the data is PeerInfo
+	EventType_PeerIdle EventType = 14
+	// ServerPoolPressure is for the address pool utilization crossed
+	// the configured threshold, the data is PoolPressureInfo
+	EventType_ServerPoolPressure EventType = 15
+	// PeerNeverConnected is for the peer never connected since it was
+	// created removed by the stale peers collection, sent instead of
+	// PeerRemove, the data is PeerInfo
+	EventType_PeerNeverConnected EventType = 16
+	// AuthKeysUpdated is for the authorizer keys set pushed by the federation
+	// source and stored, or the single key added or revoked by the source,
+	// the data is AuthKeysInfo
+	EventType_AuthKeysUpdated EventType = 17
+	// SettingsReloaded is for the configuration reloaded without the restart,
+	// the data is SettingsReloadInfo
+	EventType_SettingsReloaded EventType = 18
+	// PeerConnected is for the peer came online: the fresh handshake
+	// after the peer was offline or never connected, the data is PeerInfo
+	EventType_PeerConnected EventType = 19
+	// PeerDisconnected is for the peer went offline: its last handshake
+	// aged out, the data is PeerInfo
+	EventType_PeerDisconnected EventType = 20
 )
 
 // Enum value maps for EventType.
 var (
 	EventType_name = map[int32]string{
-		0: "Unspecified",
-		1: "PeerAdd",
-		2: "PeerRemove",
-		3: "PeerUpdate",
-		4: "PeerTraffic",
-		5: "PeerFirstConnect",
+		0:  "Unspecified",
+		1:  "PeerAdd",
+		2:  "PeerRemove",
+		3:  "PeerUpdate",
+		4:  "PeerTraffic",
+		5:  "PeerFirstConnect",
+		6:  "ServerMaintenance",
+		7:  "ServerDNSUpdate",
+		8:  "ServerClockAnomaly",
+		9:  "ServerInterfaceDown",
+		10: "ManagerStarting",
+		11: "ManagerReady",
+		12: "ManagerDraining",
+		13: "ManagerStopped",
+		14: "PeerIdle",
+		15: "ServerPoolPressure",
+		16: "PeerNeverConnected",
+		17: "AuthKeysUpdated",
+		18: "SettingsReloaded",
+		19: "PeerConnected",
+		20: "PeerDisconnected",
 	}
 	EventType_value = map[string]int32{
-		"Unspecified":      0,
-		"PeerAdd":          1,
-		"PeerRemove":       2,
-		"PeerUpdate":       3,
-		"PeerTraffic":      4,
-		"PeerFirstConnect": 5,
+		"Unspecified":         0,
+		"PeerAdd":             1,
+		"PeerRemove":          2,
+		"PeerUpdate":          3,
+		"PeerTraffic":         4,
+		"PeerFirstConnect":    5,
+		"ServerMaintenance":   6,
+		"ServerDNSUpdate":     7,
+		"ServerClockAnomaly":  8,
+		"ServerInterfaceDown": 9,
+		"ManagerStarting":     10,
+		"ManagerReady":        11,
+		"ManagerDraining":     12,
+		"ManagerStopped":      13,
+		"PeerIdle":            14,
+		"ServerPoolPressure":  15,
+		"PeerNeverConnected":  16,
+		"AuthKeysUpdated":     17,
+		"SettingsReloaded":    18,
+		"PeerConnected":       19,
+		"PeerDisconnected":    20,
 	}
 )
 
@@ -101,6 +178,16 @@ type PeerInfo struct {
 	Seconds        uint64     `protobuf:"varint,14,opt,name=seconds,proto3" json:"seconds,omitempty"`
 	ActivityID     string     `protobuf:"bytes,15,opt,name=activityID,proto3" json:"activityID,omitempty"`
 	Country        string     `protobuf:"bytes,16,opt,name=country,proto3" json:"country,omitempty"`
+	// correlationID links the event to the request caused it, if any
+	CorrelationID string `protobuf:"bytes,17,opt,name=correlationID,proto3" json:"correlationID,omitempty"`
+	// sequence is the monotonic event number assigned on push,
+	// consumers detect lost events by gaps in it
+	Sequence uint64 `protobuf:"varint,18,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// idleReason is set for PeerIdle: "no_traffic" if the peer never had
+	// traffic since it was put on the device, "idle" if the traffic stopped
+	IdleReason string `protobuf:"bytes,19,opt,name=idleReason,proto3" json:"idleReason,omitempty"`
+	// modifiedBy is the admin identity who last changed the peer
+	ModifiedBy string `protobuf:"bytes,20,opt,name=modifiedBy,proto3" json:"modifiedBy,omitempty"`
 }
 
 func (x *PeerInfo) Reset() {
@@ -240,6 +327,34 @@ func (x *PeerInfo) GetCountry() string {
 	return ""
 }
 
+func (x *PeerInfo) GetCorrelationID() string {
+	if x != nil {
+		return x.CorrelationID
+	}
+	return ""
+}
+
+func (x *PeerInfo) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *PeerInfo) GetIdleReason() string {
+	if x != nil {
+		return x.IdleReason
+	}
+	return ""
+}
+
+func (x *PeerInfo) GetModifiedBy() string {
+	if x != nil {
+		return x.ModifiedBy
+	}
+	return ""
+}
+
 // Position in the evenlog to start/resume the events
 type EventLogPosition struct {
 	state         protoimpl.MessageState
@@ -296,12 +411,546 @@ func (x *EventLogPosition) GetOffset() int64 {
 	return 0
 }
 
+// MaintenanceInfo describes the maintenance mode transition
+type MaintenanceInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Enabled bool `protobuf:"varint,1,opt,name=enabled,proto3" json:"enabled,omitempty"`
+	// correlationID links the event to the request caused it, if any
+	CorrelationID string `protobuf:"bytes,2,opt,name=correlationID,proto3" json:"correlationID,omitempty"`
+}
+
+func (x *MaintenanceInfo) Reset() {
+	*x = MaintenanceInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_events_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MaintenanceInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MaintenanceInfo) ProtoMessage() {}
+
+func (x *MaintenanceInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_events_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MaintenanceInfo.ProtoReflect.Descriptor instead.
+func (*MaintenanceInfo) Descriptor() ([]byte, []int) {
+	return file_events_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *MaintenanceInfo) GetEnabled() bool {
+	if x != nil {
+		return x.Enabled
+	}
+	return false
+}
+
+func (x *MaintenanceInfo) GetCorrelationID() string {
+	if x != nil {
+		return x.CorrelationID
+	}
+	return ""
+}
+
+// DNSInfo describes the change of DNS servers advertised to peers
+type DNSInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Servers []string `protobuf:"bytes,1,rep,name=servers,proto3" json:"servers,omitempty"`
+	// correlationID links the event to the request caused it, if any
+	CorrelationID string `protobuf:"bytes,2,opt,name=correlationID,proto3" json:"correlationID,omitempty"`
+}
+
+func (x *DNSInfo) Reset() {
+	*x = DNSInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_events_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DNSInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DNSInfo) ProtoMessage() {}
+
+func (x *DNSInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_events_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DNSInfo.ProtoReflect.Descriptor instead.
+func (*DNSInfo) Descriptor() ([]byte, []int) {
+	return file_events_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *DNSInfo) GetServers() []string {
+	if x != nil {
+		return x.Servers
+	}
+	return nil
+}
+
+func (x *DNSInfo) GetCorrelationID() string {
+	if x != nil {
+		return x.CorrelationID
+	}
+	return ""
+}
+
+// ClockAnomalyInfo describes the suspicious mass expiration of peers
+type ClockAnomalyInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// expiring is the number of peers expired within the tick
+	Expiring uint64 `protobuf:"varint,1,opt,name=expiring,proto3" json:"expiring,omitempty"`
+	// total is the number of peers on the node
+	Total      uint64     `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
+	ServerTime *Timestamp `protobuf:"bytes,3,opt,name=serverTime,proto3" json:"serverTime,omitempty"`
+}
+
+func (x *ClockAnomalyInfo) Reset() {
+	*x = ClockAnomalyInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_events_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ClockAnomalyInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClockAnomalyInfo) ProtoMessage() {}
+
+func (x *ClockAnomalyInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_events_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClockAnomalyInfo.ProtoReflect.Descriptor instead.
+func (*ClockAnomalyInfo) Descriptor() ([]byte, []int) {
+	return file_events_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ClockAnomalyInfo) GetExpiring() uint64 {
+	if x != nil {
+		return x.Expiring
+	}
+	return 0
+}
+
+func (x *ClockAnomalyInfo) GetTotal() uint64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *ClockAnomalyInfo) GetServerTime() *Timestamp {
+	if x != nil {
+		return x.ServerTime
+	}
+	return nil
+}
+
+// InterfaceInfo describes the wireguard interface gone from the system
+type InterfaceInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name       string     `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	ServerTime *Timestamp `protobuf:"bytes,2,opt,name=serverTime,proto3" json:"serverTime,omitempty"`
+}
+
+func (x *InterfaceInfo) Reset() {
+	*x = InterfaceInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_events_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *InterfaceInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InterfaceInfo) ProtoMessage() {}
+
+func (x *InterfaceInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_events_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InterfaceInfo.ProtoReflect.Descriptor instead.
+func (*InterfaceInfo) Descriptor() ([]byte, []int) {
+	return file_events_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *InterfaceInfo) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *InterfaceInfo) GetServerTime() *Timestamp {
+	if x != nil {
+		return x.ServerTime
+	}
+	return nil
+}
+
+// ManagerStateInfo describes the transition of the peer manager state
+type ManagerStateInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// peers is the number of peers restored on start, set for ManagerReady
+	Peers      uint64     `protobuf:"varint,1,opt,name=peers,proto3" json:"peers,omitempty"`
+	ServerTime *Timestamp `protobuf:"bytes,2,opt,name=serverTime,proto3" json:"serverTime,omitempty"`
+}
+
+func (x *ManagerStateInfo) Reset() {
+	*x = ManagerStateInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_events_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ManagerStateInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ManagerStateInfo) ProtoMessage() {}
+
+func (x *ManagerStateInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_events_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ManagerStateInfo.ProtoReflect.Descriptor instead.
+func (*ManagerStateInfo) Descriptor() ([]byte, []int) {
+	return file_events_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ManagerStateInfo) GetPeers() uint64 {
+	if x != nil {
+		return x.Peers
+	}
+	return 0
+}
+
+func (x *ManagerStateInfo) GetServerTime() *Timestamp {
+	if x != nil {
+		return x.ServerTime
+	}
+	return nil
+}
+
+// PoolPressureInfo describes the address pool utilization crossed the threshold
+type PoolPressureInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// threshold is the crossed utilization threshold, in percent
+	Threshold  uint32     `protobuf:"varint,1,opt,name=threshold,proto3" json:"threshold,omitempty"`
+	Used       uint64     `protobuf:"varint,2,opt,name=used,proto3" json:"used,omitempty"`
+	Total      uint64     `protobuf:"varint,3,opt,name=total,proto3" json:"total,omitempty"`
+	ServerTime *Timestamp `protobuf:"bytes,4,opt,name=serverTime,proto3" json:"serverTime,omitempty"`
+}
+
+func (x *PoolPressureInfo) Reset() {
+	*x = PoolPressureInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_events_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PoolPressureInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PoolPressureInfo) ProtoMessage() {}
+
+func (x *PoolPressureInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_events_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PoolPressureInfo.ProtoReflect.Descriptor instead.
+func (*PoolPressureInfo) Descriptor() ([]byte, []int) {
+	return file_events_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *PoolPressureInfo) GetThreshold() uint32 {
+	if x != nil {
+		return x.Threshold
+	}
+	return 0
+}
+
+func (x *PoolPressureInfo) GetUsed() uint64 {
+	if x != nil {
+		return x.Used
+	}
+	return 0
+}
+
+func (x *PoolPressureInfo) GetTotal() uint64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *PoolPressureInfo) GetServerTime() *Timestamp {
+	if x != nil {
+		return x.ServerTime
+	}
+	return nil
+}
+
+// AuthKeysInfo describes the authorizer keys set stored from the federation source,
+// or the single key added or revoked by the source
+type AuthKeysInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Source string `protobuf:"bytes,1,opt,name=source,proto3" json:"source,omitempty"`
+	// count is the number of keys in the set
+	Count uint64 `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	// fingerprint is the hex SHA-256 of the set, the same for the same keys
+	Fingerprint string `protobuf:"bytes,3,opt,name=fingerprint,proto3" json:"fingerprint,omitempty"`
+	// version of the set given by the source, 0 if not versioned
+	Version    int64      `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`
+	ServerTime *Timestamp `protobuf:"bytes,5,opt,name=serverTime,proto3" json:"serverTime,omitempty"`
+	// added is the ID of the single key added, the set is that key only
+	Added string `protobuf:"bytes,6,opt,name=added,proto3" json:"added,omitempty"`
+	// revoked is the ID of the single key revoked, the set is that key only
+	Revoked string `protobuf:"bytes,7,opt,name=revoked,proto3" json:"revoked,omitempty"`
+}
+
+func (x *AuthKeysInfo) Reset() {
+	*x = AuthKeysInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_events_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AuthKeysInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AuthKeysInfo) ProtoMessage() {}
+
+func (x *AuthKeysInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_events_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AuthKeysInfo.ProtoReflect.Descriptor instead.
+func (*AuthKeysInfo) Descriptor() ([]byte, []int) {
+	return file_events_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *AuthKeysInfo) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *AuthKeysInfo) GetCount() uint64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *AuthKeysInfo) GetFingerprint() string {
+	if x != nil {
+		return x.Fingerprint
+	}
+	return ""
+}
+
+func (x *AuthKeysInfo) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *AuthKeysInfo) GetServerTime() *Timestamp {
+	if x != nil {
+		return x.ServerTime
+	}
+	return nil
+}
+
+func (x *AuthKeysInfo) GetAdded() string {
+	if x != nil {
+		return x.Added
+	}
+	return ""
+}
+
+func (x *AuthKeysInfo) GetRevoked() string {
+	if x != nil {
+		return x.Revoked
+	}
+	return ""
+}
+
+// SettingsReloadInfo lists the settings changed by the reload
+type SettingsReloadInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// applied are the settings in effect right away
+	Applied []string `protobuf:"bytes,1,rep,name=applied,proto3" json:"applied,omitempty"`
+	// pending are the settings requiring the restart to take effect
+	Pending    []string   `protobuf:"bytes,2,rep,name=pending,proto3" json:"pending,omitempty"`
+	ServerTime *Timestamp `protobuf:"bytes,3,opt,name=serverTime,proto3" json:"serverTime,omitempty"`
+}
+
+func (x *SettingsReloadInfo) Reset() {
+	*x = SettingsReloadInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_events_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SettingsReloadInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SettingsReloadInfo) ProtoMessage() {}
+
+func (x *SettingsReloadInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_events_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SettingsReloadInfo.ProtoReflect.Descriptor instead.
+func (*SettingsReloadInfo) Descriptor() ([]byte, []int) {
+	return file_events_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *SettingsReloadInfo) GetApplied() []string {
+	if x != nil {
+		return x.Applied
+	}
+	return nil
+}
+
+func (x *SettingsReloadInfo) GetPending() []string {
+	if x != nil {
+		return x.Pending
+	}
+	return nil
+}
+
+func (x *SettingsReloadInfo) GetServerTime() *Timestamp {
+	if x != nil {
+		return x.ServerTime
+	}
+	return nil
+}
+
 var File_events_proto protoreflect.FileDescriptor
 
 var file_events_proto_rawDesc = []byte{
 	0x0a, 0x0c, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05,
 	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x0f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70,
-	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x80, 0x04, 0x0a, 0x08, 0x50, 0x65, 0x65, 0x72, 0x49,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x82, 0x05, 0x0a, 0x08, 0x50, 0x65, 0x65, 0x72, 0x49,
 	0x6e, 0x66, 0x6f, 0x12, 0x16, 0x0a, 0x06, 0x75, 0x73, 0x65, 0x72, 0x49, 0x44, 0x18, 0x01, 0x20,
 	0x01, 0x28, 0x09, 0x52, 0x06, 0x75, 0x73, 0x65, 0x72, 0x49, 0x44, 0x12, 0x26, 0x0a, 0x0e, 0x69,
 	0x6e, 0x73, 0x74, 0x61, 0x6c, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x18, 0x02, 0x20,
@@ -333,21 +982,108 @@ var file_events_proto_rawDesc = []byte{
 	0x1e, 0x0a, 0x0a, 0x61, 0x63, 0x74, 0x69, 0x76, 0x69, 0x74, 0x79, 0x49, 0x44, 0x18, 0x0f, 0x20,
 	0x01, 0x28, 0x09, 0x52, 0x0a, 0x61, 0x63, 0x74, 0x69, 0x76, 0x69, 0x74, 0x79, 0x49, 0x44, 0x12,
 	0x18, 0x0a, 0x07, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x18, 0x10, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x07, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x22, 0x41, 0x0a, 0x10, 0x45, 0x76, 0x65,
-	0x6e, 0x74, 0x4c, 0x6f, 0x67, 0x50, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x15, 0x0a,
-	0x06, 0x6c, 0x6f, 0x67, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6c,
-	0x6f, 0x67, 0x49, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18, 0x02,
-	0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x2a, 0x70, 0x0a, 0x09,
-	0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0f, 0x0a, 0x0b, 0x55, 0x6e, 0x73,
-	0x70, 0x65, 0x63, 0x69, 0x66, 0x69, 0x65, 0x64, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x50, 0x65,
-	0x65, 0x72, 0x41, 0x64, 0x64, 0x10, 0x01, 0x12, 0x0e, 0x0a, 0x0a, 0x50, 0x65, 0x65, 0x72, 0x52,
-	0x65, 0x6d, 0x6f, 0x76, 0x65, 0x10, 0x02, 0x12, 0x0e, 0x0a, 0x0a, 0x50, 0x65, 0x65, 0x72, 0x55,
-	0x70, 0x64, 0x61, 0x74, 0x65, 0x10, 0x03, 0x12, 0x0f, 0x0a, 0x0b, 0x50, 0x65, 0x65, 0x72, 0x54,
-	0x72, 0x61, 0x66, 0x66, 0x69, 0x63, 0x10, 0x04, 0x12, 0x14, 0x0a, 0x10, 0x50, 0x65, 0x65, 0x72,
-	0x46, 0x69, 0x72, 0x73, 0x74, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x10, 0x05, 0x42, 0x22,
-	0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x76, 0x70, 0x6e,
-	0x68, 0x6f, 0x75, 0x73, 0x65, 0x2f, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2f, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x52, 0x07, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x6f, 0x72,
+	0x72, 0x65, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x18, 0x11, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0d, 0x63, 0x6f, 0x72, 0x72, 0x65, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x12,
+	0x1a, 0x0a, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x18, 0x12, 0x20, 0x01, 0x28,
+	0x04, 0x52, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x69,
+	0x64, 0x6c, 0x65, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x13, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0a, 0x69, 0x64, 0x6c, 0x65, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x1e, 0x0a, 0x0a, 0x6d,
+	0x6f, 0x64, 0x69, 0x66, 0x69, 0x65, 0x64, 0x42, 0x79, 0x18, 0x14, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0a, 0x6d, 0x6f, 0x64, 0x69, 0x66, 0x69, 0x65, 0x64, 0x42, 0x79, 0x22, 0x41, 0x0a, 0x10, 0x45,
+	0x76, 0x65, 0x6e, 0x74, 0x4c, 0x6f, 0x67, 0x50, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x12,
+	0x15, 0x0a, 0x06, 0x6c, 0x6f, 0x67, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x6c, 0x6f, 0x67, 0x49, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x22, 0x51,
+	0x0a, 0x0f, 0x4d, 0x61, 0x69, 0x6e, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x49, 0x6e, 0x66,
+	0x6f, 0x12, 0x18, 0x0a, 0x07, 0x65, 0x6e, 0x61, 0x62, 0x6c, 0x65, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x07, 0x65, 0x6e, 0x61, 0x62, 0x6c, 0x65, 0x64, 0x12, 0x24, 0x0a, 0x0d, 0x63,
+	0x6f, 0x72, 0x72, 0x65, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0d, 0x63, 0x6f, 0x72, 0x72, 0x65, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49,
+	0x44, 0x22, 0x49, 0x0a, 0x07, 0x44, 0x4e, 0x53, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x18, 0x0a, 0x07,
+	0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x07, 0x73,
+	0x65, 0x72, 0x76, 0x65, 0x72, 0x73, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x6f, 0x72, 0x72, 0x65, 0x6c,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x63,
+	0x6f, 0x72, 0x72, 0x65, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x22, 0x76, 0x0a, 0x10,
+	0x43, 0x6c, 0x6f, 0x63, 0x6b, 0x41, 0x6e, 0x6f, 0x6d, 0x61, 0x6c, 0x79, 0x49, 0x6e, 0x66, 0x6f,
+	0x12, 0x1a, 0x0a, 0x08, 0x65, 0x78, 0x70, 0x69, 0x72, 0x69, 0x6e, 0x67, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x04, 0x52, 0x08, 0x65, 0x78, 0x70, 0x69, 0x72, 0x69, 0x6e, 0x67, 0x12, 0x14, 0x0a, 0x05,
+	0x74, 0x6f, 0x74, 0x61, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x74, 0x6f, 0x74,
+	0x61, 0x6c, 0x12, 0x30, 0x0a, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x54, 0x69, 0x6d, 0x65,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x54,
+	0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72,
+	0x54, 0x69, 0x6d, 0x65, 0x22, 0x55, 0x0a, 0x0d, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x66, 0x61, 0x63,
+	0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x30, 0x0a, 0x0a, 0x73, 0x65, 0x72,
+	0x76, 0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52,
+	0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x22, 0x5a, 0x0a, 0x10, 0x4d,
+	0x61, 0x6e, 0x61, 0x67, 0x65, 0x72, 0x53, 0x74, 0x61, 0x74, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12,
+	0x14, 0x0a, 0x05, 0x70, 0x65, 0x65, 0x72, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05,
+	0x70, 0x65, 0x65, 0x72, 0x73, 0x12, 0x30, 0x0a, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x54,
+	0x69, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x0a, 0x73, 0x65, 0x72,
+	0x76, 0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x22, 0x8c, 0x01, 0x0a, 0x10, 0x50, 0x6f, 0x6f, 0x6c,
+	0x50, 0x72, 0x65, 0x73, 0x73, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x1c, 0x0a, 0x09,
+	0x74, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x09, 0x74, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x75, 0x73,
+	0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x75, 0x73, 0x65, 0x64, 0x12, 0x14,
+	0x0a, 0x05, 0x74, 0x6f, 0x74, 0x61, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x74,
+	0x6f, 0x74, 0x61, 0x6c, 0x12, 0x30, 0x0a, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x54, 0x69,
+	0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x0a, 0x73, 0x65, 0x72, 0x76,
+	0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x22, 0xda, 0x01, 0x0a, 0x0c, 0x41, 0x75, 0x74, 0x68, 0x4b,
+	0x65, 0x79, 0x73, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x6f, 0x75, 0x72, 0x63,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x12,
+	0x14, 0x0a, 0x05, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05,
+	0x63, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x20, 0x0a, 0x0b, 0x66, 0x69, 0x6e, 0x67, 0x65, 0x72, 0x70,
+	0x72, 0x69, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x66, 0x69, 0x6e, 0x67,
+	0x65, 0x72, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x12, 0x30, 0x0a, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x18,
+	0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x54, 0x69,
+	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x54,
+	0x69, 0x6d, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x61, 0x64, 0x64, 0x65, 0x64, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x05, 0x61, 0x64, 0x64, 0x65, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x72, 0x65, 0x76,
+	0x6f, 0x6b, 0x65, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x72, 0x65, 0x76, 0x6f,
+	0x6b, 0x65, 0x64, 0x22, 0x7a, 0x0a, 0x12, 0x53, 0x65, 0x74, 0x74, 0x69, 0x6e, 0x67, 0x73, 0x52,
+	0x65, 0x6c, 0x6f, 0x61, 0x64, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x70, 0x70,
+	0x6c, 0x69, 0x65, 0x64, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x07, 0x61, 0x70, 0x70, 0x6c,
+	0x69, 0x65, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x65, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x02,
+	0x20, 0x03, 0x28, 0x09, 0x52, 0x07, 0x70, 0x65, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x30, 0x0a,
+	0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x10, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74,
+	0x61, 0x6d, 0x70, 0x52, 0x0a, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x2a,
+	0xaf, 0x03, 0x0a, 0x09, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0f, 0x0a,
+	0x0b, 0x55, 0x6e, 0x73, 0x70, 0x65, 0x63, 0x69, 0x66, 0x69, 0x65, 0x64, 0x10, 0x00, 0x12, 0x0b,
+	0x0a, 0x07, 0x50, 0x65, 0x65, 0x72, 0x41, 0x64, 0x64, 0x10, 0x01, 0x12, 0x0e, 0x0a, 0x0a, 0x50,
+	0x65, 0x65, 0x72, 0x52, 0x65, 0x6d, 0x6f, 0x76, 0x65, 0x10, 0x02, 0x12, 0x0e, 0x0a, 0x0a, 0x50,
+	0x65, 0x65, 0x72, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x10, 0x03, 0x12, 0x0f, 0x0a, 0x0b, 0x50,
+	0x65, 0x65, 0x72, 0x54, 0x72, 0x61, 0x66, 0x66, 0x69, 0x63, 0x10, 0x04, 0x12, 0x14, 0x0a, 0x10,
+	0x50, 0x65, 0x65, 0x72, 0x46, 0x69, 0x72, 0x73, 0x74, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74,
+	0x10, 0x05, 0x12, 0x15, 0x0a, 0x11, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x4d, 0x61, 0x69, 0x6e,
+	0x74, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x10, 0x06, 0x12, 0x13, 0x0a, 0x0f, 0x53, 0x65, 0x72,
+	0x76, 0x65, 0x72, 0x44, 0x4e, 0x53, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x10, 0x07, 0x12, 0x16,
+	0x0a, 0x12, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x43, 0x6c, 0x6f, 0x63, 0x6b, 0x41, 0x6e, 0x6f,
+	0x6d, 0x61, 0x6c, 0x79, 0x10, 0x08, 0x12, 0x17, 0x0a, 0x13, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72,
+	0x49, 0x6e, 0x74, 0x65, 0x72, 0x66, 0x61, 0x63, 0x65, 0x44, 0x6f, 0x77, 0x6e, 0x10, 0x09, 0x12,
+	0x13, 0x0a, 0x0f, 0x4d, 0x61, 0x6e, 0x61, 0x67, 0x65, 0x72, 0x53, 0x74, 0x61, 0x72, 0x74, 0x69,
+	0x6e, 0x67, 0x10, 0x0a, 0x12, 0x10, 0x0a, 0x0c, 0x4d, 0x61, 0x6e, 0x61, 0x67, 0x65, 0x72, 0x52,
+	0x65, 0x61, 0x64, 0x79, 0x10, 0x0b, 0x12, 0x13, 0x0a, 0x0f, 0x4d, 0x61, 0x6e, 0x61, 0x67, 0x65,
+	0x72, 0x44, 0x72, 0x61, 0x69, 0x6e, 0x69, 0x6e, 0x67, 0x10, 0x0c, 0x12, 0x12, 0x0a, 0x0e, 0x4d,
+	0x61, 0x6e, 0x61, 0x67, 0x65, 0x72, 0x53, 0x74, 0x6f, 0x70, 0x70, 0x65, 0x64, 0x10, 0x0d, 0x12,
+	0x0c, 0x0a, 0x08, 0x50, 0x65, 0x65, 0x72, 0x49, 0x64, 0x6c, 0x65, 0x10, 0x0e, 0x12, 0x16, 0x0a,
+	0x12, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x50, 0x6f, 0x6f, 0x6c, 0x50, 0x72, 0x65, 0x73, 0x73,
+	0x75, 0x72, 0x65, 0x10, 0x0f, 0x12, 0x16, 0x0a, 0x12, 0x50, 0x65, 0x65, 0x72, 0x4e, 0x65, 0x76,
+	0x65, 0x72, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x65, 0x64, 0x10, 0x10, 0x12, 0x13, 0x0a,
+	0x0f, 0x41, 0x75, 0x74, 0x68, 0x4b, 0x65, 0x79, 0x73, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64,
+	0x10, 0x11, 0x12, 0x14, 0x0a, 0x10, 0x53, 0x65, 0x74, 0x74, 0x69, 0x6e, 0x67, 0x73, 0x52, 0x65,
+	0x6c, 0x6f, 0x61, 0x64, 0x65, 0x64, 0x10, 0x12, 0x12, 0x11, 0x0a, 0x0d, 0x50, 0x65, 0x65, 0x72,
+	0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x65, 0x64, 0x10, 0x13, 0x12, 0x14, 0x0a, 0x10, 0x50,
+	0x65, 0x65, 0x72, 0x44, 0x69, 0x73, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x65, 0x64, 0x10,
+	0x14, 0x42, 0x22, 0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f,
+	0x76, 0x70, 0x6e, 0x68, 0x6f, 0x75, 0x73, 0x65, 0x2f, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2f,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -363,23 +1099,37 @@ func file_events_proto_rawDescGZIP() []byte {
 }
 
 var file_events_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_events_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_events_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
 var file_events_proto_goTypes = []interface{}{
-	(EventType)(0),           // 0: proto.EventType
-	(*PeerInfo)(nil),         // 1: proto.PeerInfo
-	(*EventLogPosition)(nil), // 2: proto.EventLogPosition
-	(*Timestamp)(nil),        // 3: proto.Timestamp
+	(EventType)(0),             // 0: proto.EventType
+	(*PeerInfo)(nil),           // 1: proto.PeerInfo
+	(*EventLogPosition)(nil),   // 2: proto.EventLogPosition
+	(*MaintenanceInfo)(nil),    // 3: proto.MaintenanceInfo
+	(*DNSInfo)(nil),            // 4: proto.DNSInfo
+	(*ClockAnomalyInfo)(nil),   // 5: proto.ClockAnomalyInfo
+	(*InterfaceInfo)(nil),      // 6: proto.InterfaceInfo
+	(*ManagerStateInfo)(nil),   // 7: proto.ManagerStateInfo
+	(*PoolPressureInfo)(nil),   // 8: proto.PoolPressureInfo
+	(*AuthKeysInfo)(nil),       // 9: proto.AuthKeysInfo
+	(*SettingsReloadInfo)(nil), // 10: proto.SettingsReloadInfo
+	(*Timestamp)(nil),          // 11: proto.Timestamp
 }
 var file_events_proto_depIdxs = []int32{
-	3, // 0: proto.PeerInfo.created:type_name -> proto.Timestamp
-	3, // 1: proto.PeerInfo.updated:type_name -> proto.Timestamp
-	3, // 2: proto.PeerInfo.expires:type_name -> proto.Timestamp
-	3, // 3: proto.PeerInfo.activity:type_name -> proto.Timestamp
-	4, // [4:4] is the sub-list for method output_type
-	4, // [4:4] is the sub-list for method input_type
-	4, // [4:4] is the sub-list for extension type_name
-	4, // [4:4] is the sub-list for extension extendee
-	0, // [0:4] is the sub-list for field type_name
+	11, // 0: proto.PeerInfo.created:type_name -> proto.Timestamp
+	11, // 1: proto.PeerInfo.updated:type_name -> proto.Timestamp
+	11, // 2: proto.PeerInfo.expires:type_name -> proto.Timestamp
+	11, // 3: proto.PeerInfo.activity:type_name -> proto.Timestamp
+	11, // 4: proto.ClockAnomalyInfo.serverTime:type_name -> proto.Timestamp
+	11, // 5: proto.InterfaceInfo.serverTime:type_name -> proto.Timestamp
+	11, // 6: proto.ManagerStateInfo.serverTime:type_name -> proto.Timestamp
+	11, // 7: proto.PoolPressureInfo.serverTime:type_name -> proto.Timestamp
+	11, // 8: proto.AuthKeysInfo.serverTime:type_name -> proto.Timestamp
+	11, // 9: proto.SettingsReloadInfo.serverTime:type_name -> proto.Timestamp
+	10, // [10:10] is the sub-list for method output_type
+	10, // [10:10] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
 }
 
 func init() { file_events_proto_init() }
@@ -413,6 +1163,102 @@ func file_events_proto_init() {
 				return nil
 			}
 		}
+		file_events_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MaintenanceInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_events_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DNSInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_events_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ClockAnomalyInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_events_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*InterfaceInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_events_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ManagerStateInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_events_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PoolPressureInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_events_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AuthKeysInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_events_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SettingsReloadInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -420,7 +1266,7 @@ func file_events_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_events_proto_rawDesc,
 			NumEnums:      1,
-			NumMessages:   2,
+			NumMessages:   10,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
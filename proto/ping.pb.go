@@ -0,0 +1,217 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        v3.21.12
+// source: ping.proto
+
+package proto
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// PingResponse is the federation ping reply,
+// mirrors the JSON tunnel_mgmt.PingResponse
+type PingResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	PeersTotal       int64 `protobuf:"varint,1,opt,name=peers_total,json=peersTotal,proto3" json:"peers_total,omitempty"`
+	PeersWithTraffic int64 `protobuf:"varint,2,opt,name=peers_with_traffic,json=peersWithTraffic,proto3" json:"peers_with_traffic,omitempty"`
+	IfRxBytes        int64 `protobuf:"varint,3,opt,name=if_rx_bytes,json=ifRxBytes,proto3" json:"if_rx_bytes,omitempty"`
+	IfRxPackets      int64 `protobuf:"varint,4,opt,name=if_rx_packets,json=ifRxPackets,proto3" json:"if_rx_packets,omitempty"`
+	IfRxErrors       int64 `protobuf:"varint,5,opt,name=if_rx_errors,json=ifRxErrors,proto3" json:"if_rx_errors,omitempty"`
+	IfTxBytes        int64 `protobuf:"varint,6,opt,name=if_tx_bytes,json=ifTxBytes,proto3" json:"if_tx_bytes,omitempty"`
+	IfTxPackets      int64 `protobuf:"varint,7,opt,name=if_tx_packets,json=ifTxPackets,proto3" json:"if_tx_packets,omitempty"`
+	IfTxErrors       int64 `protobuf:"varint,8,opt,name=if_tx_errors,json=ifTxErrors,proto3" json:"if_tx_errors,omitempty"`
+}
+
+func (x *PingResponse) Reset() {
+	*x = PingResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ping_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PingResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PingResponse) ProtoMessage() {}
+
+func (x *PingResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ping_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PingResponse.ProtoReflect.Descriptor instead.
+func (*PingResponse) Descriptor() ([]byte, []int) {
+	return file_ping_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PingResponse) GetPeersTotal() int64 {
+	if x != nil {
+		return x.PeersTotal
+	}
+	return 0
+}
+
+func (x *PingResponse) GetPeersWithTraffic() int64 {
+	if x != nil {
+		return x.PeersWithTraffic
+	}
+	return 0
+}
+
+func (x *PingResponse) GetIfRxBytes() int64 {
+	if x != nil {
+		return x.IfRxBytes
+	}
+	return 0
+}
+
+func (x *PingResponse) GetIfRxPackets() int64 {
+	if x != nil {
+		return x.IfRxPackets
+	}
+	return 0
+}
+
+func (x *PingResponse) GetIfRxErrors() int64 {
+	if x != nil {
+		return x.IfRxErrors
+	}
+	return 0
+}
+
+func (x *PingResponse) GetIfTxBytes() int64 {
+	if x != nil {
+		return x.IfTxBytes
+	}
+	return 0
+}
+
+func (x *PingResponse) GetIfTxPackets() int64 {
+	if x != nil {
+		return x.IfTxPackets
+	}
+	return 0
+}
+
+func (x *PingResponse) GetIfTxErrors() int64 {
+	if x != nil {
+		return x.IfTxErrors
+	}
+	return 0
+}
+
+var File_ping_proto protoreflect.FileDescriptor
+
+var file_ping_proto_rawDesc = []byte{
+	0x0a, 0x0a, 0x70, 0x69, 0x6e, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x22, 0xa9, 0x02, 0x0a, 0x0c, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x70, 0x65, 0x65, 0x72, 0x73, 0x5f, 0x74, 0x6f,
+	0x74, 0x61, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x70, 0x65, 0x65, 0x72, 0x73,
+	0x54, 0x6f, 0x74, 0x61, 0x6c, 0x12, 0x2c, 0x0a, 0x12, 0x70, 0x65, 0x65, 0x72, 0x73, 0x5f, 0x77,
+	0x69, 0x74, 0x68, 0x5f, 0x74, 0x72, 0x61, 0x66, 0x66, 0x69, 0x63, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x10, 0x70, 0x65, 0x65, 0x72, 0x73, 0x57, 0x69, 0x74, 0x68, 0x54, 0x72, 0x61, 0x66,
+	0x66, 0x69, 0x63, 0x12, 0x1e, 0x0a, 0x0b, 0x69, 0x66, 0x5f, 0x72, 0x78, 0x5f, 0x62, 0x79, 0x74,
+	0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x69, 0x66, 0x52, 0x78, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x12, 0x22, 0x0a, 0x0d, 0x69, 0x66, 0x5f, 0x72, 0x78, 0x5f, 0x70, 0x61, 0x63,
+	0x6b, 0x65, 0x74, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x69, 0x66, 0x52, 0x78,
+	0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x12, 0x20, 0x0a, 0x0c, 0x69, 0x66, 0x5f, 0x72, 0x78,
+	0x5f, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x69,
+	0x66, 0x52, 0x78, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x12, 0x1e, 0x0a, 0x0b, 0x69, 0x66, 0x5f,
+	0x74, 0x78, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09,
+	0x69, 0x66, 0x54, 0x78, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x22, 0x0a, 0x0d, 0x69, 0x66, 0x5f,
+	0x74, 0x78, 0x5f, 0x70, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x18, 0x07, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x0b, 0x69, 0x66, 0x54, 0x78, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x12, 0x20, 0x0a,
+	0x0c, 0x69, 0x66, 0x5f, 0x74, 0x78, 0x5f, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x18, 0x08, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x0a, 0x69, 0x66, 0x54, 0x78, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x42,
+	0x22, 0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x76, 0x70,
+	0x6e, 0x68, 0x6f, 0x75, 0x73, 0x65, 0x2f, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2f, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_ping_proto_rawDescOnce sync.Once
+	file_ping_proto_rawDescData = file_ping_proto_rawDesc
+)
+
+func file_ping_proto_rawDescGZIP() []byte {
+	file_ping_proto_rawDescOnce.Do(func() {
+		file_ping_proto_rawDescData = protoimpl.X.CompressGZIP(file_ping_proto_rawDescData)
+	})
+	return file_ping_proto_rawDescData
+}
+
+var file_ping_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_ping_proto_goTypes = []interface{}{
+	(*PingResponse)(nil), // 0: proto.PingResponse
+}
+var file_ping_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_ping_proto_init() }
+func file_ping_proto_init() {
+	if File_ping_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_ping_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PingResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_ping_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_ping_proto_goTypes,
+		DependencyIndexes: file_ping_proto_depIdxs,
+		MessageInfos:      file_ping_proto_msgTypes,
+	}.Build()
+	File_ping_proto = out.File
+	file_ping_proto_rawDesc = nil
+	file_ping_proto_goTypes = nil
+	file_ping_proto_depIdxs = nil
+}